@@ -0,0 +1,147 @@
+package wschannel
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// AdminHandler returns an http.Handler that reports the state of lst and its
+// live channels, for use by operators.
+//
+// A GET request returns a JSON object with the listener metrics and a list
+// of the live channels, giving the ID, remote address, uptime, times of the
+// last message sent and received, and message counters of each. A POST
+// request with an "id" parameter closes the channel with that ID with status
+// StatusGoingAway, or reports 404 (Not Found) if there is no live channel
+// with that ID.
+//
+// A POST request must include the AdminHeader header, or it is rejected with
+// status 403 (Forbidden). A browser does not send a custom header on a
+// cross-origin request without the consent of the server, which this handler
+// does not give, so a malicious web page cannot use an operator's browser to
+// close channels. The handler does not authenticate its callers, however: it
+// must be mounted behind authentication, or on an address that is not
+// reachable by untrusted clients.
+func (lst *Listener) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet, http.MethodHead:
+			lst.writeAdminStatus(w)
+		case http.MethodPost:
+			if req.Header.Get(AdminHeader) == "" {
+				http.Error(w, "missing "+AdminHeader+" header", http.StatusForbidden)
+				return
+			}
+			id := req.FormValue("id")
+			for _, ch := range lst.Channels() {
+				if ch.info.ID == id {
+					ch.closeWith(websocket.StatusGoingAway, "closed by administrator")
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+			}
+			http.Error(w, "channel not found", http.StatusNotFound)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// AdminHeader is the HTTP header that a POST request to an AdminHandler must
+// include, with any non-empty value, as protection against cross-site request
+// forgery.
+const AdminHeader = "Wschannel-Admin"
+
+// adminStatus is the JSON encoding of the status reported by AdminHandler.
+type adminStatus struct {
+	Metrics  Metrics        `json:"metrics"`
+	Pending  int            `json:"pending"`
+	Channels []adminChannel `json:"channels"`
+}
+
+type adminChannel struct {
+	ID         string            `json:"id"`
+	RemoteAddr string            `json:"remoteAddr"`
+	ClientIP   string            `json:"clientIP,omitempty"`
+	Path       string            `json:"path"`
+	Since      time.Time         `json:"since"`
+	Uptime     string            `json:"uptime"`
+	LastSend   *time.Time        `json:"lastSend,omitempty"`
+	LastRecv   *time.Time        `json:"lastRecv,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	ChannelStats
+}
+
+func (lst *Listener) writeAdminStatus(w http.ResponseWriter) {
+	now := lst.clock.Now()
+	st := adminStatus{
+		Metrics:  lst.Metrics(),
+		Pending:  lst.Pending(),
+		Channels: []adminChannel{},
+	}
+	for _, ch := range lst.Channels() {
+		ac := adminChannel{
+			ID:           ch.info.ID,
+			RemoteAddr:   ch.info.RemoteAddr,
+			Path:         ch.info.URL.Path,
+			Since:        ch.info.Queued,
+			Uptime:       now.Sub(ch.info.Queued).Round(time.Second).String(),
+			Labels:       ch.info.Labels,
+			ChannelStats: ch.Stats(),
+		}
+		if t := ch.LastSend(); !t.IsZero() {
+			ac.LastSend = &t
+		}
+		if t := ch.LastRecv(); !t.IsZero() {
+			ac.LastRecv = &t
+		}
+		if ch.info.ClientIP.IsValid() {
+			ac.ClientIP = ch.info.ClientIP.String()
+		}
+		st.Channels = append(st.Channels, ac)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// HealthHandler returns an http.Handler that reports the health of lst, for
+// use by load balancers and other health checkers.
+//
+// The response is a JSON object giving the status of the listener
+// ("accepting", "paused", or "closed"), the number of pending channels, and
+// the number of live channels. The HTTP status is 200 (OK) if the listener is
+// accepting connections, and otherwise 503 (Service Unavailable).
+func (lst *Listener) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var h healthStatus
+		lst.mu.Lock()
+		switch {
+		case lst.closed:
+			h.Status = "closed"
+		case lst.paused:
+			h.Status = "paused"
+		default:
+			h.Status = "accepting"
+		}
+		h.Pending, h.Active = lst.Pending(), len(lst.active)
+		lst.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if h.Status != "accepting" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(h)
+	})
+}
+
+// healthStatus is the JSON encoding of the status reported by HealthHandler.
+type healthStatus struct {
+	Status  string `json:"status"`
+	Pending int    `json:"pending"`
+	Active  int    `json:"active"`
+}
@@ -0,0 +1,46 @@
+package wschannel
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// CheckAPIKey returns a function suitable for ListenOptions.CheckAccept that
+// admits only requests presenting an API key for which valid reports true.
+//
+// The key is taken from an "Authorization: Bearer <key>" header if one is
+// present, or otherwise from the "token" query parameter of the request URL,
+// since browsers cannot set custom headers on websocket requests. Requests
+// without a valid key are rejected with status 401 (Unauthorized) and
+// ErrInvalidKey. Note that a key passed as a query parameter is visible in
+// the ConnInfo of the channel, and may be recorded in server logs.
+func CheckAPIKey(valid func(key string) bool) func(*http.Request) (int, error) {
+	return func(req *http.Request) (int, error) {
+		if key := requestKey(req); key == "" || !valid(key) {
+			return http.StatusUnauthorized, ErrInvalidKey
+		}
+		return 0, nil
+	}
+}
+
+// StaticKeys returns a function suitable for CheckAPIKey that accepts any of
+// the specified keys. Keys are compared in constant time.
+func StaticKeys(keys ...string) func(string) bool {
+	return func(key string) bool {
+		ok := 0
+		for _, k := range keys {
+			ok |= subtle.ConstantTimeCompare([]byte(k), []byte(key))
+		}
+		return ok == 1
+	}
+}
+
+// requestKey returns the API key presented by req, or "".
+func requestKey(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if scheme, key, ok := strings.Cut(auth, " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(key)
+	}
+	return req.URL.Query().Get("token")
+}
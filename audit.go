@@ -0,0 +1,60 @@
+package wschannel
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// An AuditRecord describes the lifetime of a channel created by a Listener.
+// See ListenOptions.Audit.
+type AuditRecord struct {
+	ID           string            `json:"id"`
+	RemoteAddr   string            `json:"remoteAddr"`
+	ClientIP     string            `json:"clientIP,omitempty"`
+	Path         string            `json:"path"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Connected    time.Time         `json:"connected"`
+	Disconnected time.Time         `json:"disconnected"`
+	ChannelStats
+
+	// The status code of the first close frame sent or received on the
+	// channel, or -1 if the status is not known (for example, if the
+	// connection was lost).
+	CloseStatus websocket.StatusCode `json:"closeStatus"`
+}
+
+func newAuditRecord(ch *Channel) *AuditRecord {
+	rec := &AuditRecord{
+		ID:           ch.info.ID,
+		RemoteAddr:   ch.info.RemoteAddr,
+		Path:         ch.info.URL.Path,
+		Labels:       ch.info.Labels,
+		Connected:    ch.info.Queued,
+		Disconnected: ch.clock.Now(),
+		ChannelStats: ch.Stats(),
+		CloseStatus:  -1,
+	}
+	if ch.info.ClientIP.IsValid() {
+		rec.ClientIP = ch.info.ClientIP.String()
+	}
+	if code := ch.status.Load(); code != 0 {
+		rec.CloseStatus = websocket.StatusCode(code)
+	}
+	return rec
+}
+
+// AuditLog returns a function suitable for ListenOptions.Audit that writes
+// each record to w as a line of JSON. Writes to w are serialized.
+func AuditLog(w io.Writer) func(*AuditRecord) {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(rec *AuditRecord) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(rec)
+	}
+}
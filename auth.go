@@ -0,0 +1,88 @@
+package wschannel
+
+import (
+	"context"
+	"crypto/rand"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// A Challenge configures an in-band challenge-response authentication step
+// performed by a Listener after each connection is upgraded, and before the
+// channel is made available to Accept.
+//
+// The listener sends the client a message containing a random nonce, and the
+// client must reply with a single message in response (see
+// DialOptions.Authenticator). If the client does not reply within the
+// timeout, or the response is not valid, the connection is closed with status
+// StatusPolicyViolation. Connections awaiting authentication count against
+// the MaxPending limit of the listener.
+type Challenge struct {
+	// Verify reports whether response is a valid answer to nonce for the
+	// connection described by info, by returning nil. It must be set.
+	Verify func(info *ConnInfo, nonce, response []byte) error
+
+	// The maximum time the client is allowed to respond to the challenge.
+	// If zero, the default is 10 seconds.
+	Timeout time.Duration
+}
+
+func (c *Challenge) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return 10 * time.Second
+	}
+	return c.Timeout
+}
+
+// nonceBytes is the length in bytes of a challenge nonce.
+const nonceBytes = 32
+
+// run sends a challenge to the peer of ch and verifies its response.
+func (c *Challenge) run(ch *Channel) error {
+	nonce := make([]byte, nonceBytes)
+	rand.Read(nonce)
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
+	defer cancel()
+	if err := ch.c.Write(ctx, websocket.MessageBinary, nonce); err != nil {
+		return err
+	}
+	_, rsp, err := ch.c.Read(ctx)
+	if err != nil {
+		return err
+	}
+	return c.Verify(ch.info, nonce, rsp)
+}
+
+// authenticate runs the challenge for ch, and enqueues ch if its peer answers
+// correctly. Otherwise, ch is closed with status StatusPolicyViolation.
+func (lst *Listener) authenticate(ch *Channel) {
+	err := lst.challenge.run(ch)
+
+	lst.mu.Lock()
+	defer lst.mu.Unlock()
+	lst.authing--
+	if err != nil {
+		lst.stats.authFailed.Add(1)
+		ch.closeWith(websocket.StatusPolicyViolation, "authentication failed")
+	} else if lst.closed {
+		ch.Close()
+	} else {
+		lst.push(ch)
+	}
+}
+
+// answerChallenge reads a challenge nonce from conn, and replies with the
+// response computed by auth.
+func answerChallenge(ctx context.Context, conn Conn, auth func([]byte) ([]byte, error)) error {
+	_, nonce, err := conn.Read(ctx)
+	if err != nil {
+		return err
+	}
+	rsp, err := auth(nonce)
+	if err != nil {
+		return err
+	}
+	return conn.Write(ctx, websocket.MessageBinary, rsp)
+}
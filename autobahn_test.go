@@ -0,0 +1,274 @@
+//go:build autobahn
+
+// This file is a harness for the Autobahn websocket conformance suite. It is
+// not built by default. To run it, Docker must be available:
+//
+//	go test -tags autobahn -run Autobahn -v
+//
+// Use -short to skip the slow performance and compression cases, and
+// -autobahn.reports to keep the HTML reports for inspection.
+//
+// The echo handlers in this file read and write the underlying connection
+// directly, since the suite requires each message to be echoed with its
+// original type.
+package wschannel
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var reportDir = flag.String("autobahn.reports", "", "Write Autobahn reports to this directory")
+
+const autobahnImage = "crossbario/autobahn-testsuite"
+
+// unsupportedCases match cases the websocket library does not implement.
+// Their results are reported, but do not fail the test.
+var unsupportedCases = []string{
+	// The library does not validate UTF-8 in text messages.
+	"6.*", "7.5.1",
+
+	// The library does not implement client_max_window_bits, because of
+	// limitations of compress/flate.
+	"13.3.*", "13.4.*", "13.5.*", "13.6.*",
+}
+
+// slowCases match cases skipped in -short mode.
+var slowCases = []string{"9.*", "12.*", "13.*"}
+
+func TestAutobahnServer(t *testing.T) {
+	reports := setupAutobahn(t)
+
+	lst := NewListener(&ListenOptions{
+		MaxPending:        -1,
+		EnableCompression: true,
+		Channel:           &ChannelOptions{ReadLimit: -1},
+	})
+	defer lst.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	srv := &http.Server{Handler: lst}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lst.Serve(ctx, autobahnEcho)
+
+	spec := writeSpec(t, "fuzzingclient.json", map[string]any{
+		"outdir": "/reports",
+		"servers": []map[string]any{{
+			"agent": "wschannel",
+			"url":   "ws://" + ln.Addr().String(),
+		}},
+		"cases":         []string{"*"},
+		"exclude-cases": excludedCases(),
+	})
+	if out, err := wstest(t, spec, reports, "fuzzingclient").CombinedOutput(); err != nil {
+		t.Fatalf("wstest: %v\n%s", err, out)
+	}
+	checkReports(t, filepath.Join(reports, "index.json"))
+}
+
+func TestAutobahnClient(t *testing.T) {
+	reports := setupAutobahn(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close() // the server will listen here
+	url := "ws://" + addr
+
+	spec := writeSpec(t, "fuzzingserver.json", map[string]any{
+		"url":           url,
+		"outdir":        "/reports",
+		"cases":         []string{"*"},
+		"exclude-cases": excludedCases(),
+	})
+	cmd := wstest(t, spec, reports, "fuzzingserver", "--webport=0")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Starting wstest: %v", err)
+	}
+	defer func() { cmd.Process.Kill(); cmd.Wait() }()
+
+	ctx := context.Background()
+	opts := &DialOptions{
+		EnableCompression: true,
+		Channel:           &ChannelOptions{ReadLimit: -1},
+	}
+	dial := func(endpoint string) *Channel {
+		t.Helper()
+		deadline := time.Now().Add(30 * time.Second)
+		for {
+			ch, err := DialContext(ctx, url+endpoint, opts)
+			if err == nil {
+				return ch
+			} else if time.Now().After(deadline) {
+				t.Fatalf("Dial %q: %v", endpoint, err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	ch := dial("/getCaseCount")
+	msg, err := ch.Recv()
+	ch.Close()
+	if err != nil {
+		t.Fatalf("Reading case count: %v", err)
+	}
+	n, err := strconv.Atoi(string(msg))
+	if err != nil {
+		t.Fatalf("Invalid case count %q: %v", msg, err)
+	}
+	for i := 1; i <= n; i++ {
+		ch, err := DialContext(ctx, fmt.Sprintf("%s/runCase?case=%d&agent=wschannel", url, i), opts)
+		if err != nil {
+			t.Errorf("Case %d: dial: %v", i, err)
+			continue
+		}
+		autobahnEcho(ch)
+	}
+	dial("/updateReports?agent=wschannel").Close()
+	checkReports(t, filepath.Join(reports, "index.json"))
+}
+
+// autobahnEcho echoes messages on ch, preserving their types, until the
+// connection fails. It closes ch before returning.
+func autobahnEcho(ch *Channel) {
+	defer ch.Close()
+	ctx := context.Background()
+	for {
+		typ, data, err := ch.c.Read(ctx)
+		if err != nil {
+			return
+		}
+		if err := ch.c.Write(ctx, typ, data); err != nil {
+			return
+		}
+	}
+}
+
+// setupAutobahn skips t if Docker is not available, pulls the test suite
+// image, and returns the directory where reports should be written.
+func setupAutobahn(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("Docker is not available")
+	}
+	if out, err := exec.Command("docker", "pull", autobahnImage).CombinedOutput(); err != nil {
+		t.Fatalf("Pulling %s: %v\n%s", autobahnImage, err, out)
+	}
+	dir := t.TempDir()
+	if *reportDir != "" {
+		dir = filepath.Join(*reportDir, t.Name())
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Creating report directory: %v", err)
+		}
+	}
+	return dir
+}
+
+func excludedCases() []string {
+	if testing.Short() {
+		return slowCases
+	}
+	return []string{}
+}
+
+// writeSpec writes spec as JSON to a file with the given name in a new
+// temporary directory, and returns the directory.
+func writeSpec(t *testing.T, name string, spec any) string {
+	t.Helper()
+	data, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatalf("Encoding spec: %v", err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+		t.Fatalf("Writing spec: %v", err)
+	}
+	return dir
+}
+
+// wstest returns a command to run the suite in the given mode, with the spec
+// file of that mode in specDir and output to reports. The container uses the
+// host network, so that it can reach the listener under test.
+func wstest(t *testing.T, specDir, reports, mode string, args ...string) *exec.Cmd {
+	t.Helper()
+	base := []string{
+		"run", "--rm", "--network=host",
+		"-v", specDir + ":/config",
+		"-v", reports + ":/reports",
+		autobahnImage,
+		"wstest", "--mode", mode, "--spec", "/config/" + mode + ".json",
+	}
+	return exec.Command("docker", append(base, args...)...)
+}
+
+// checkReports reads the Autobahn report index from file and reports an
+// error for each case that failed, other than those in unsupportedCases.
+func checkReports(t *testing.T, file string) {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Reading report index: %v", err)
+	}
+	var index map[string]map[string]struct {
+		Behavior      string `json:"behavior"`
+		BehaviorClose string `json:"behaviorClose"`
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		t.Fatalf("Decoding report index: %v", err)
+	}
+
+	var total, unsupported, failed int
+	for agent, cases := range index {
+		for id, res := range cases {
+			total++
+			if isOK(res.Behavior, "NON-STRICT") && isOK(res.BehaviorClose) {
+				continue
+			} else if matchAny(unsupportedCases, id) {
+				unsupported++
+				continue
+			}
+			failed++
+			t.Errorf("Agent %s case %s: behavior %s, close behavior %s", agent, id, res.Behavior, res.BehaviorClose)
+		}
+	}
+	t.Logf("Autobahn: %d cases, %d failed, %d failed but unsupported", total, failed, unsupported)
+	if failed != 0 {
+		t.Logf("See %s for details", filepath.Join(filepath.Dir(file), "index.html"))
+	}
+}
+
+// isOK reports whether behavior is an acceptable result, meaning "OK",
+// "INFORMATIONAL", or one of the extra values given.
+func isOK(behavior string, extra ...string) bool {
+	return behavior == "OK" || behavior == "INFORMATIONAL" || slices.Contains(extra, behavior)
+}
+
+// matchAny reports whether id matches any of the case patterns.
+func matchAny(patterns []string, id string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, id); ok {
+			return true
+		}
+	}
+	return false
+}
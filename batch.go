@@ -0,0 +1,85 @@
+package wschannel
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+
+	"github.com/coder/websocket"
+)
+
+// ErrBadBatch is reported by Recv when a channel using batch framing receives
+// a websocket message that is not a valid batch. The channel is closed with
+// status StatusProtocolError.
+var ErrBadBatch = errors.New("invalid batch framing")
+
+// Batched reports whether c uses batch framing, that is, whether CapBatch was
+// negotiated for c.
+func (c *Channel) Batched() bool { return c.batch }
+
+// SendBatch sends msgs to the peer of c. If c uses batch framing, the
+// messages are packed into a single websocket message; otherwise, they are
+// sent one at a time, stopping at the first error.
+func (c *Channel) SendBatch(msgs [][]byte) error {
+	if !c.batch {
+		for _, msg := range msgs {
+			if err := c.Send(msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	} else if len(msgs) == 0 {
+		return nil
+	}
+	err := c.write(context.Background(), websocket.MessageBinary, packBatch(msgs))
+	if err == nil && c.rpc != nil {
+		for _, msg := range msgs {
+			c.rpc.observe(true, msg)
+		}
+	}
+	return err
+}
+
+// packBatch encodes msgs as a batch frame.
+func packBatch(msgs [][]byte) []byte {
+	n := 0
+	for _, msg := range msgs {
+		n += binary.MaxVarintLen64 + len(msg)
+	}
+	buf := make([]byte, 0, n)
+	for _, msg := range msgs {
+		buf = binary.AppendUvarint(buf, uint64(len(msg)))
+		buf = append(buf, msg...)
+	}
+	return buf
+}
+
+// unpackBatch decodes the messages of a batch frame. The messages share
+// storage with data.
+func unpackBatch(data []byte) ([][]byte, error) {
+	var msgs [][]byte
+	for len(data) != 0 {
+		n, w := binary.Uvarint(data)
+		if w <= 0 || n > uint64(len(data)-w) {
+			return nil, ErrBadBatch
+		}
+		msgs = append(msgs, data[w:w+int(n):w+int(n)])
+		data = data[w+int(n):]
+	}
+	if len(msgs) == 0 {
+		return nil, ErrBadBatch
+	}
+	return msgs, nil
+}
+
+// recvBatch unpacks the batch frame data received by c, and returns its first
+// message. The remaining messages are returned by subsequent calls to Recv.
+func (c *Channel) recvBatch(data []byte) ([]byte, error) {
+	msgs, err := unpackBatch(data)
+	if err != nil {
+		c.closeWith(websocket.StatusProtocolError, "invalid batch")
+		return nil, err
+	}
+	c.unread = msgs[1:]
+	return msgs[0], nil
+}
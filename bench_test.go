@@ -0,0 +1,231 @@
+//go:build !js
+
+package wschannel_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/creachadair/jrpc2/channel"
+	"github.com/creachadair/wschannel"
+)
+
+var benchSizes = []int{64, 1 << 10, 16 << 10, 256 << 10, 4 << 20}
+
+// unlimited are channel options that permit messages of any size.
+var unlimited = &wschannel.ChannelOptions{ReadLimit: -1}
+
+// A benchBackend connects a client channel to a server channel using a
+// particular transport.
+type benchBackend struct {
+	name    string
+	connect func(b *testing.B) (client, server channel.Channel)
+}
+
+var benchBackends = []benchBackend{
+	{"WebSocket", func(b *testing.B) (channel.Channel, channel.Channel) {
+		return benchDial(b, false, nil)
+	}},
+	{"Deflate", func(b *testing.B) (channel.Channel, channel.Channel) {
+		return benchDial(b, true, nil)
+	}},
+	{"SSE", func(b *testing.B) (channel.Channel, channel.Channel) {
+		return benchDial(b, false, func(req *http.Request) bool {
+			req.Header.Del("Upgrade")
+			return true
+		})
+	}},
+	{"Poll", func(b *testing.B) (channel.Channel, channel.Channel) {
+		return benchDial(b, false, func(req *http.Request) bool {
+			req.Header.Del("Upgrade")
+			return req.URL.Query().Get("transport") != "sse"
+		})
+	}},
+}
+
+// benchDial starts a listener and connects a client to it. If compress is
+// true, both sides negotiate compression. If filter is set, it may modify
+// each request, and requests for which it returns false are refused.
+func benchDial(b *testing.B, compress bool, filter func(*http.Request) bool) (channel.Channel, channel.Channel) {
+	b.Helper()
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		Fallback:          filter != nil,
+		EnableCompression: compress,
+		Channel:           unlimited,
+	})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if filter != nil && !filter(req) {
+			http.Error(w, "refused", http.StatusForbidden)
+			return
+		}
+		lst.ServeHTTP(w, req)
+	}))
+	b.Cleanup(func() { lst.Close(); s.Close() })
+
+	c, err := wschannel.DialContext(context.Background(), fixURL(s.URL), &wschannel.DialOptions{
+		Fallback:          filter != nil,
+		EnableCompression: compress,
+		Channel:           unlimited,
+	})
+	if err != nil {
+		b.Fatalf("Dial: %v", err)
+	}
+	srv, err := lst.Accept(context.Background())
+	if err != nil {
+		b.Fatalf("Accept: %v", err)
+	}
+	b.Cleanup(func() { c.Close(); srv.Close() })
+	return c, srv
+}
+
+// echo sends each message received on ch back to its sender, until ch fails.
+func echo(ch channel.Channel) {
+	for {
+		msg, err := ch.Recv()
+		if err != nil || ch.Send(msg) != nil {
+			return
+		}
+	}
+}
+
+// benchPayload returns a payload of n bytes of JSON-like text, which is
+// compressible as typical traffic would be.
+func benchPayload(n int) []byte {
+	const text = `{"jsonrpc":"2.0","id":1,"method":"Bench","params":["abcdefghijklmnop"]}`
+	buf := make([]byte, n)
+	for i := 0; i < n; i += copy(buf[i:], text) {
+	}
+	return buf
+}
+
+func sizeName(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%dMiB", n>>20)
+	case n >= 1<<10:
+		return fmt.Sprintf("%dKiB", n>>10)
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// BenchmarkRoundTrip measures the latency of sending a message and
+// receiving its echo, for each backend and message size.
+func BenchmarkRoundTrip(b *testing.B) {
+	for _, be := range benchBackends {
+		b.Run(be.name, func(b *testing.B) {
+			for _, size := range benchSizes {
+				b.Run(sizeName(size), func(b *testing.B) {
+					c, s := be.connect(b)
+					go echo(s)
+					msg := benchPayload(size)
+
+					b.ReportAllocs()
+					b.SetBytes(int64(2 * size))
+					b.ResetTimer()
+					for range b.N {
+						if err := c.Send(msg); err != nil {
+							b.Fatalf("Send: %v", err)
+						}
+						if _, err := c.Recv(); err != nil {
+							b.Fatalf("Recv: %v", err)
+						}
+					}
+				})
+			}
+		})
+	}
+}
+
+// BenchmarkThroughput measures the rate at which messages can be streamed
+// in one direction, for each backend and message size.
+func BenchmarkThroughput(b *testing.B) {
+	for _, be := range benchBackends {
+		b.Run(be.name, func(b *testing.B) {
+			for _, size := range benchSizes {
+				b.Run(sizeName(size), func(b *testing.B) {
+					c, s := be.connect(b)
+					msg := benchPayload(size)
+					errc := make(chan error, 1)
+
+					b.ReportAllocs()
+					b.SetBytes(int64(size))
+					b.ResetTimer()
+					go func() {
+						for range b.N {
+							if _, err := s.Recv(); err != nil {
+								errc <- err
+								return
+							}
+						}
+						errc <- nil
+					}()
+					for range b.N {
+						if err := c.Send(msg); err != nil {
+							b.Fatalf("Send: %v", err)
+						}
+					}
+					if err := <-errc; err != nil {
+						b.Fatalf("Recv: %v", err)
+					}
+				})
+			}
+		})
+	}
+}
+
+// BenchmarkConcurrent measures round trips of 1KiB messages on many
+// channels at once, sharing a single listener.
+func BenchmarkConcurrent(b *testing.B) {
+	for _, n := range []int{1, 16, 128} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			lst := wschannel.NewListener(&wschannel.ListenOptions{MaxPending: -1})
+			s := httptest.NewServer(lst)
+			defer func() { lst.Close(); s.Close() }()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go lst.Serve(ctx, func(ch *wschannel.Channel) { echo(ch) })
+
+			clients := make([]*wschannel.Channel, n)
+			for i := range clients {
+				c, err := wschannel.Dial(fixURL(s.URL), nil)
+				if err != nil {
+					b.Fatalf("Dial: %v", err)
+				}
+				defer c.Close()
+				clients[i] = c
+			}
+			msg := benchPayload(1 << 10)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(2 * len(msg)))
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for i, c := range clients {
+				// Distribute b.N round trips among the clients.
+				ops := b.N / n
+				if i < b.N%n {
+					ops++
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for range ops {
+						if err := c.Send(msg); err != nil {
+							b.Errorf("Send: %v", err)
+							return
+						}
+						if _, err := c.Recv(); err != nil {
+							b.Errorf("Recv: %v", err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package wschannel
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+)
+
+// Broadcast sends data to every channel produced by lst that has been
+// accepted and is still open, and waits for the sends to complete or for ctx
+// to end. The sends are performed concurrently, each subject to the write
+// timeout of its channel. Pending channels do not receive the message.
+//
+// If any of the sends fail, Broadcast reports an error that wraps the errors
+// for each failed channel. Note that the websocket library closes a
+// connection whose send is interrupted by the end of ctx.
+//
+// The websocket library does not support preparing a message once for many
+// connections, so each channel frames data separately.
+func (lst *Listener) Broadcast(ctx context.Context, data []byte) error {
+	return broadcast(ctx, lst.accepted(), data)
+}
+
+// accepted returns a snapshot of the live channels of lst that have been
+// accepted.
+func (lst *Listener) accepted() []*Channel {
+	lst.mu.Lock()
+	defer lst.mu.Unlock()
+	chs := make([]*Channel, 0, len(lst.active))
+	for ch := range lst.active {
+		if ch.taken.Load() {
+			chs = append(chs, ch)
+		}
+	}
+	return chs
+}
+
+// broadcast sends data to each of chs concurrently, and returns an error that
+// wraps the errors from each send that failed.
+func broadcast(ctx context.Context, chs []*Channel, data []byte) error {
+	errs := make([]error, len(chs))
+	var wg sync.WaitGroup
+	for i, ch := range chs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = ch.send(ctx, data) // errors include the channel ID
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Join adds ch to the named group of lst, so that it receives messages sent
+// by BroadcastGroup for that group. A channel may belong to any number of
+// groups, and is removed from all of them when it closes. Join reports false
+// without effect if ch is not a live channel produced by lst.
+func (lst *Listener) Join(ch *Channel, group string) bool {
+	lst.mu.Lock()
+	defer lst.mu.Unlock()
+	if _, ok := lst.active[ch]; !ok {
+		return false
+	}
+	g := lst.groups[group]
+	if g == nil {
+		if lst.groups == nil {
+			lst.groups = make(map[string]map[*Channel]struct{})
+		}
+		g = make(map[*Channel]struct{})
+		lst.groups[group] = g
+	}
+	if _, ok := g[ch]; !ok {
+		g[ch] = struct{}{}
+		ch.groups = append(ch.groups, group)
+	}
+	return true
+}
+
+// Leave removes ch from the named group of lst. It has no effect if ch is not
+// a member of the group.
+func (lst *Listener) Leave(ch *Channel, group string) {
+	lst.mu.Lock()
+	defer lst.mu.Unlock()
+	if i := slices.Index(ch.groups, group); i >= 0 {
+		ch.groups = slices.Delete(ch.groups, i, i+1)
+		lst.leaveLocked(ch, group)
+	}
+}
+
+// leaveLocked removes ch from the membership of group, discarding the group
+// if it is empty. The caller must hold lst.mu.
+func (lst *Listener) leaveLocked(ch *Channel, group string) {
+	g := lst.groups[group]
+	delete(g, ch)
+	if len(g) == 0 {
+		delete(lst.groups, group)
+	}
+}
+
+// Group returns a snapshot of the channels that are members of the named
+// group of lst, in no particular order.
+func (lst *Listener) Group(group string) []*Channel {
+	lst.mu.Lock()
+	defer lst.mu.Unlock()
+	chs := make([]*Channel, 0, len(lst.groups[group]))
+	for ch := range lst.groups[group] {
+		chs = append(chs, ch)
+	}
+	return chs
+}
+
+// BroadcastGroup sends data to each channel that is a member of the named
+// group of lst. Otherwise, it behaves as Broadcast.
+func (lst *Listener) BroadcastGroup(ctx context.Context, group string, data []byte) error {
+	return broadcast(ctx, lst.Group(group), data)
+}
@@ -0,0 +1,137 @@
+package wschannel
+
+import (
+	"context"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// Chaos configures a channel to disconnect at random, for soak testing the
+// reconnection and resumption logic of an application under realistic
+// failure patterns. It is intended for testing only; do not enable it in
+// production. See ChannelOptions.Chaos.
+type Chaos struct {
+	// The probability, from 0 to 1, that the connection is closed instead
+	// of sending or receiving each message.
+	Probability float64
+
+	// If positive, the connection is closed after a random duration up to
+	// MaxLifetime, if it has not closed already.
+	MaxLifetime time.Duration
+
+	// The close status codes to choose from when closing the connection.
+	// If empty, the default is StatusGoingAway, StatusInternalError,
+	// StatusServiceRestart, and StatusTryAgainLater.
+	Codes []websocket.StatusCode
+
+	// If set, the source of randomness. Use a fixed seed for reproducible
+	// behavior. If nil, a randomly-seeded source is used.
+	Rand *rand.Rand
+}
+
+var defaultChaosCodes = []websocket.StatusCode{
+	websocket.StatusGoingAway,
+	websocket.StatusInternalError,
+	websocket.StatusServiceRestart,
+	websocket.StatusTryAgainLater,
+}
+
+// chaosReason is the close reason sent for a chaos disconnect.
+const chaosReason = "chaos disconnect"
+
+// A chaosConn wraps a Conn to disconnect it at random.
+type chaosConn struct {
+	Conn
+	cfg   Chaos
+	close func(websocket.StatusCode, string) bool // closes the channel
+	timer Timer                                   // if not nil, for MaxLifetime
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// wrap returns conn wrapped to disconnect at random as configured by c,
+// using close to close the channel that owns conn and clock to schedule its
+// lifetime.
+func (c *Chaos) wrap(conn Conn, close func(websocket.StatusCode, string) bool, clock Clock) *chaosConn {
+	cc := &chaosConn{Conn: conn, cfg: *c, close: close, rng: c.Rand}
+	if cc.rng == nil {
+		cc.rng = rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	}
+	if len(cc.cfg.Codes) == 0 {
+		cc.cfg.Codes = defaultChaosCodes
+	}
+	if c.MaxLifetime > 0 {
+		d := time.Duration(cc.rng.Int64N(int64(c.MaxLifetime))) + 1
+		cc.timer = clock.AfterFunc(d, func() { cc.disconnect() })
+	}
+	return cc
+}
+
+// strike reports whether a message should be replaced by a disconnect.
+func (c *chaosConn) strike() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cfg.Probability > 0 && c.rng.Float64() < c.cfg.Probability
+}
+
+// disconnect closes the connection with a randomly-chosen status, and returns
+// an error describing the closure.
+func (c *chaosConn) disconnect() error {
+	c.mu.Lock()
+	code := c.cfg.Codes[c.rng.IntN(len(c.cfg.Codes))]
+	c.mu.Unlock()
+	c.close(code, chaosReason)
+	return websocket.CloseError{Code: code, Reason: chaosReason}
+}
+
+// Read implements part of the Conn interface.
+func (c *chaosConn) Read(ctx context.Context) (websocket.MessageType, []byte, error) {
+	typ, data, err := c.Conn.Read(ctx)
+	if err == nil && c.strike() {
+		return 0, nil, c.disconnect()
+	}
+	return typ, data, err
+}
+
+// Write implements part of the Conn interface.
+func (c *chaosConn) Write(ctx context.Context, typ websocket.MessageType, data []byte) error {
+	if c.strike() {
+		c.disconnect()
+		return net.ErrClosed
+	}
+	return c.Conn.Write(ctx, typ, data)
+}
+
+// Close implements part of the Conn interface.
+func (c *chaosConn) Close(code websocket.StatusCode, reason string) error {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	return c.Conn.Close(code, reason)
+}
+
+// baseConn returns the connection underlying c, without the chaos and dump
+// wrappers.
+func (c *Channel) baseConn() Conn {
+	conn := c.c
+	if cc, ok := conn.(*chaosConn); ok {
+		conn = cc.Conn
+	}
+	if dc, ok := conn.(*dumpConn); ok {
+		conn = dc.Conn
+	}
+	return conn
+}
+
+// Ping forwards to the underlying connection, if it supports pings.
+func (c *chaosConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
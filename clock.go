@@ -0,0 +1,56 @@
+package wschannel
+
+import "time"
+
+// A Clock is a source of the current time and of timers. The timer-driven
+// behavior of channels and listeners, including keepalive pings, idle and
+// pending timeouts, rate limits, and chaos lifetimes, is scheduled using a
+// Clock, so that tests can substitute a fake clock and advance time
+// deterministically. See ChannelOptions.Clock.
+//
+// Timeouts enforced by contexts, such as ReadTimeout and WriteTimeout, the
+// deadline for a keepalive pong, and those of fallback transports, always
+// use the system clock.
+type Clock interface {
+	// Now reports the current time.
+	Now() time.Time
+
+	// NewTimer returns a timer that delivers the current time on its C
+	// channel once duration d has elapsed.
+	NewTimer(d time.Duration) Timer
+
+	// AfterFunc returns a timer that calls f once duration d has elapsed.
+	// The C channel of the timer is nil.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// A Timer is a single event scheduled by a Clock, as for a time.Timer.
+type Timer interface {
+	// C returns the channel on which the timer delivers its time.
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing, and reports whether it was
+	// stopped before it fired.
+	Stop() bool
+
+	// Reset changes the timer to expire after duration d, and reports
+	// whether the timer had been active.
+	Reset(d time.Duration) bool
+}
+
+// SystemClock is a Clock that uses the time package. It is the default.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTimer(d time.Duration) Timer { return sysTimer{time.NewTimer(d)} }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return sysTimer{time.AfterFunc(d, f)}
+}
+
+type sysTimer struct{ *time.Timer }
+
+func (t sysTimer) C() <-chan time.Time { return t.Timer.C }
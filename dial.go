@@ -0,0 +1,21 @@
+//go:build !js
+
+package wschannel
+
+import "github.com/coder/websocket"
+
+func (o *DialOptions) dialOptions() *websocket.DialOptions {
+	dopts := &websocket.DialOptions{
+		HTTPClient:   o.client(),
+		HTTPHeader:   o.header(),
+		Subprotocols: []string{Protocol},
+	}
+	if o != nil && o.EnableCompression {
+		dopts.CompressionMode = websocket.CompressionNoContextTakeover
+		dopts.CompressionThreshold = o.CompressionThreshold
+	}
+	return dopts
+}
+
+// setHeader sets a header of the handshake request for dopts.
+func setHeader(dopts *websocket.DialOptions, key, value string) { dopts.HTTPHeader.Set(key, value) }
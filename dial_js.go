@@ -0,0 +1,14 @@
+//go:build js
+
+package wschannel
+
+import "github.com/coder/websocket"
+
+// When compiled for GOOS=js, the websocket library dials using the native
+// WebSocket implementation of the browser, which does not allow the caller to
+// choose the HTTP client, headers, or compression settings.
+func (o *DialOptions) dialOptions() *websocket.DialOptions { return nil }
+
+// setHeader does nothing, since the browser does not allow the caller to set
+// the headers of the handshake request.
+func setHeader(*websocket.DialOptions, string, string) {}
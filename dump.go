@@ -0,0 +1,241 @@
+package wschannel
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/coder/websocket"
+)
+
+// A FrameDump writes a line describing each message and control frame sent or
+// received by a channel, for diagnosing interoperability problems with other
+// websocket implementations. See ChannelOptions.Dump.
+//
+// Each line gives the time, the ID of the channel, the direction ("send" or
+// "recv"), and the kind of frame. Data frames also report their size and a
+// preview of their payload: Text is shown as a quoted string, and other data
+// in hexadecimal. For example:
+//
+//	2024-05-01T12:00:00.123456Z 1f2e3d4c5b6a7988 send text 17 "{\"jsonrpc\":\"2.0\"}"
+//	2024-05-01T12:00:00.124001Z 1f2e3d4c5b6a7988 recv binary 4 0a0b0c0d
+//	2024-05-01T12:00:01.000000Z 1f2e3d4c5b6a7988 recv close 1000 "bye"
+//
+// If JSONRPC is set, data frames that contain JSON-RPC 2.0 messages are
+// instead summarized by kind, with their IDs, method names, and error codes,
+// and with parameters, results, and error messages truncated:
+//
+//	... send text 58 call id=1 method="Math.Add" params=[1,2]
+//	... recv text 36 result id=1 3
+//	... recv text 84 error id=2 code=-32601 message="no such method"
+//	... send text 52 notify method="rpc.cancel" params=[2]
+//	... send text 120 batch 2: call id=3 method="A"; call id=4 method="B"
+//
+// A FrameDump may be shared by many channels, and may be enabled or disabled
+// at any time with SetEnabled. It is enabled initially.
+type FrameDump struct {
+	// The writer to which lines are written. Writes are serialized.
+	W io.Writer
+
+	// The maximum number of payload bytes to preview for each message. If
+	// zero, the default is 64. If negative, no preview is written.
+	MaxPreview int
+
+	// If true, summarize JSON-RPC messages as described above. Messages that
+	// are not JSON-RPC are previewed as usual.
+	JSONRPC bool
+
+	off atomic.Bool // if set, dumping is disabled
+	mu  sync.Mutex  // serializes writes to W
+}
+
+// SetEnabled enables or disables dumping for all the channels that use d.
+func (d *FrameDump) SetEnabled(on bool) { d.off.Store(!on) }
+
+// Enabled reports whether dumping is enabled for d.
+func (d *FrameDump) Enabled() bool { return !d.off.Load() }
+
+func (d *FrameDump) maxPreview() int {
+	if d.MaxPreview == 0 {
+		return 64
+	}
+	return max(d.MaxPreview, 0)
+}
+
+// preview returns a bounded representation of a payload of type typ.
+func (d *FrameDump) preview(typ websocket.MessageType, data []byte) string {
+	n := d.maxPreview()
+	if d.JSONRPC {
+		if s, ok := rpcSummary(data, n); ok {
+			return " " + s
+		}
+	}
+	if n == 0 {
+		return ""
+	}
+	var more string
+	if len(data) > n {
+		data, more = data[:n], "..."
+	}
+	if typ == websocket.MessageText && utf8.Valid(data) {
+		return " " + strconv.Quote(string(data)) + more
+	}
+	return " " + hex.EncodeToString(data) + more
+}
+
+// dump writes a line for ch, if d is enabled.
+func (d *FrameDump) dump(ch *Channel, dir, format string, args ...any) {
+	if !d.Enabled() {
+		return
+	}
+	line := fmt.Sprintf("%s %s %s %s\n",
+		ch.clock.Now().UTC().Format(time.RFC3339Nano), ch.id, dir, fmt.Sprintf(format, args...))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	io.WriteString(d.W, line)
+}
+
+// kindName returns the name of a data message type for a dump.
+func kindName(typ websocket.MessageType) string {
+	if typ == websocket.MessageText {
+		return "text"
+	}
+	return "binary"
+}
+
+// A dumpConn wraps a Conn to dump its frames.
+type dumpConn struct {
+	Conn
+	d  *FrameDump
+	ch *Channel // the channel that owns the connection
+}
+
+// Read implements part of the Conn interface.
+func (c *dumpConn) Read(ctx context.Context) (websocket.MessageType, []byte, error) {
+	typ, data, err := c.Conn.Read(ctx)
+	if err == nil {
+		c.message("recv", typ, data)
+	} else if ce := (websocket.CloseError{}); errors.As(err, &ce) {
+		c.d.dump(c.ch, "recv", "close %d %q", ce.Code, ce.Reason)
+	}
+	return typ, data, err
+}
+
+// Write implements part of the Conn interface.
+func (c *dumpConn) Write(ctx context.Context, typ websocket.MessageType, data []byte) error {
+	c.message("send", typ, data)
+	return c.Conn.Write(ctx, typ, data)
+}
+
+// message dumps a data message, if dumping is enabled.
+func (c *dumpConn) message(dir string, typ websocket.MessageType, data []byte) {
+	if c.d.Enabled() {
+		c.d.dump(c.ch, dir, "%s %d%s", kindName(typ), len(data), c.d.preview(typ, data))
+	}
+}
+
+// Close implements part of the Conn interface.
+func (c *dumpConn) Close(code websocket.StatusCode, reason string) error {
+	c.d.dump(c.ch, "send", "close %d %q", code, reason)
+	return c.Conn.Close(code, reason)
+}
+
+// Ping forwards to the underlying connection, if it supports pings.
+func (c *dumpConn) Ping(ctx context.Context) error {
+	p, ok := c.Conn.(pinger)
+	if !ok {
+		return nil
+	}
+	c.d.dump(c.ch, "send", "ping")
+	return p.Ping(ctx)
+}
+
+// rpcMessage is the union of the fields of JSON-RPC 2.0 messages.
+type rpcMessage struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	Result  json.RawMessage `json:"result"`
+	Error   *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// rpcSummary describes data as a JSON-RPC message or batch, with parameters,
+// results, and messages truncated to n bytes. It reports false if data is not
+// a JSON-RPC message.
+func rpcSummary(data []byte, n int) (string, bool) {
+	data = bytes.TrimSpace(data)
+	if len(data) != 0 && data[0] == '[' {
+		var batch []json.RawMessage
+		if json.Unmarshal(data, &batch) != nil || len(batch) == 0 {
+			return "", false
+		}
+		parts := make([]string, len(batch))
+		for i, elt := range batch {
+			s, ok := rpcSummary(elt, n)
+			if !ok || strings.HasPrefix(s, "batch") {
+				return "", false
+			}
+			parts[i] = s
+		}
+		return fmt.Sprintf("batch %d: %s", len(batch), strings.Join(parts, "; ")), true
+	}
+
+	var msg rpcMessage
+	if json.Unmarshal(data, &msg) != nil || msg.Version != "2.0" {
+		return "", false
+	}
+	var sb strings.Builder
+	hasID := len(msg.ID) != 0 && string(msg.ID) != "null"
+	switch {
+	case msg.Method != "" && hasID:
+		fmt.Fprintf(&sb, "call id=%s method=%q", msg.ID, msg.Method)
+	case msg.Method != "":
+		fmt.Fprintf(&sb, "notify method=%q", msg.Method)
+	case msg.Error != nil:
+		fmt.Fprintf(&sb, "error id=%s code=%d message=%q", msg.ID, msg.Error.Code, clip(msg.Error.Message, n))
+		return sb.String(), true
+	case msg.Result != nil:
+		fmt.Fprintf(&sb, "result id=%s", msg.ID)
+		if n > 0 {
+			sb.WriteString(" " + clipJSON(msg.Result, n))
+		}
+		return sb.String(), true
+	default:
+		return "", false
+	}
+	if len(msg.Params) != 0 && n > 0 {
+		sb.WriteString(" params=" + clipJSON(msg.Params, n))
+	}
+	return sb.String(), true
+}
+
+// clip truncates s to at most n bytes, marking a truncation with "...".
+func clip(s string, n int) string {
+	if len(s) > n {
+		return s[:n] + "..."
+	}
+	return s
+}
+
+// clipJSON compacts the JSON value v and truncates it to at most n bytes.
+func clipJSON(v json.RawMessage, n int) string {
+	var buf bytes.Buffer
+	if json.Compact(&buf, v) != nil {
+		return clip(string(v), n)
+	}
+	return clip(buf.String(), n)
+}
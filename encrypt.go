@@ -0,0 +1,179 @@
+package wschannel
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/coder/websocket"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// KeyHeader is the HTTP header in which the peers of an encrypted channel
+// exchange their public keys during the websocket handshake, encoded as
+// unpadded base64url. See Encryption.
+const KeyHeader = "Wschannel-Key"
+
+var (
+	// ErrPeerKey is the reason for rejecting a request, or failing a dial,
+	// because the peer did not present a valid encryption key, or its key
+	// was refused by Encryption.VerifyPeer.
+	ErrPeerKey = errors.New("missing or invalid encryption key")
+
+	// ErrDecrypt is reported by Recv when an encrypted channel receives a
+	// message that cannot be decrypted. The channel is closed with status
+	// StatusPolicyViolation.
+	ErrDecrypt = errors.New("message decryption failed")
+)
+
+// Encryption configures end-to-end encryption of the messages of a channel,
+// for deployments in which TLS terminates at an intermediary that should not
+// see the payloads. Each message is encrypted and authenticated with NaCl box
+// (Curve25519, XSalsa20, and Poly1305) using a random nonce, and sent as a
+// binary message.
+//
+// The peers exchange public keys in KeyHeader during the handshake, so both
+// must enable encryption: a Listener rejects a request without a valid key
+// with status 403 (Forbidden), and Dial fails if the server does not send
+// one. Because an intermediary can also alter the headers, the exchange by
+// itself does not authenticate the peer; to prevent an intermediary from
+// substituting its own key, use long-term keys and check the key of the peer
+// with VerifyPeer.
+//
+// Encryption protects the contents of messages, but not their number, size,
+// or order. It is not supported when compiled for GOOS=js, or by fallback
+// sessions: enabling it together with Fallback is an error (see
+// ErrFallbackOptions).
+type Encryption struct {
+	// The private key of this peer. If nil, a new key pair is generated for
+	// each channel.
+	PrivateKey *[32]byte
+
+	// If set, this function is called with the public key of the peer during
+	// the handshake, and the channel is established only if it returns nil.
+	// For a server, req is the handshake request; for a client, req is nil.
+	VerifyPeer func(req *http.Request, peerKey *[32]byte) error
+}
+
+func (o *ChannelOptions) encryption() *Encryption {
+	if o == nil {
+		return nil
+	}
+	return o.Encryption
+}
+
+// keyPair returns the public and private keys of this peer for a channel.
+func (e *Encryption) keyPair() (pub, priv *[32]byte) {
+	if e.PrivateKey == nil {
+		pub, priv, _ = box.GenerateKey(rand.Reader)
+		return pub, priv
+	}
+	pub = new([32]byte)
+	if k, err := ecdh.X25519().NewPrivateKey(e.PrivateKey[:]); err == nil {
+		copy(pub[:], k.PublicKey().Bytes())
+	}
+	return pub, e.PrivateKey
+}
+
+// newSealer checks the peer key offered in h, and returns a sealer for a
+// channel between that peer and the private key priv.
+func (e *Encryption) newSealer(req *http.Request, h http.Header, priv *[32]byte) (*sealer, error) {
+	peer, err := decodeKey(h.Get(KeyHeader))
+	if err != nil {
+		return nil, err
+	}
+	if e.VerifyPeer != nil {
+		if err := e.VerifyPeer(req, peer); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrPeerKey, err)
+		}
+	}
+	s := new(sealer)
+	box.Precompute(&s.key, peer, priv)
+	return s, nil
+}
+
+func encodeKey(key *[32]byte) string { return base64.RawURLEncoding.EncodeToString(key[:]) }
+
+func decodeKey(s string) (*[32]byte, error) {
+	var key [32]byte
+	if base64.RawURLEncoding.DecodedLen(len(s)) != len(key) {
+		return nil, ErrPeerKey
+	} else if _, err := base64.RawURLEncoding.Decode(key[:], []byte(s)); err != nil {
+		return nil, ErrPeerKey
+	}
+	return &key, nil
+}
+
+// A sealer encrypts and decrypts messages with a shared key.
+type sealer struct {
+	key [32]byte // precomputed by box.Precompute
+}
+
+// nonceSize is the size in bytes of the nonce that prefixes each message.
+const nonceSize = 24
+
+func (s *sealer) seal(msg []byte) []byte {
+	var nonce [nonceSize]byte
+	rand.Read(nonce[:])
+	return box.SealAfterPrecomputation(nonce[:], msg, &nonce, &s.key)
+}
+
+func (s *sealer) open(data []byte) ([]byte, error) {
+	if len(data) < nonceSize {
+		return nil, ErrDecrypt
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], data)
+	msg, ok := box.OpenAfterPrecomputation(nil, data[nonceSize:], &nonce, &s.key)
+	if !ok {
+		return nil, ErrDecrypt
+	}
+	return msg, nil
+}
+
+// A sealConn wraps a Conn to encrypt and decrypt its messages.
+type sealConn struct {
+	Conn
+	s *sealer
+}
+
+// Read implements part of the Conn interface.
+func (c *sealConn) Read(ctx context.Context) (websocket.MessageType, []byte, error) {
+	typ, data, err := c.Conn.Read(ctx)
+	if err != nil {
+		return typ, data, err
+	}
+	msg, err := c.s.open(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	return typ, msg, nil
+}
+
+// Write implements part of the Conn interface.
+func (c *sealConn) Write(ctx context.Context, _ websocket.MessageType, data []byte) error {
+	return c.Conn.Write(ctx, websocket.MessageBinary, c.s.seal(data))
+}
+
+// Ping forwards to the underlying connection, if it supports pings.
+func (c *sealConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// SetReadLimit forwards to the underlying connection, if it has a limit.
+// The limit applies to encrypted messages.
+func (c *sealConn) SetReadLimit(n int64) {
+	if rl, ok := c.Conn.(readLimiter); ok {
+		rl.SetReadLimit(n)
+	}
+}
+
+// Subprotocol reports the subprotocol of the underlying connection.
+func (c *sealConn) Subprotocol() string { return subprotocol(c.Conn) }
@@ -0,0 +1,77 @@
+package wschannel
+
+import "errors"
+
+var (
+	// ErrListenerClosed is the error reported for a closed listener.
+	ErrListenerClosed = errors.New("listener is closed")
+
+	// ErrListenerPaused is the reason for rejecting a request because the
+	// listener is paused.
+	ErrListenerPaused = errors.New("listener is paused")
+
+	// ErrQueueFull is the reason for rejecting a request because the pending
+	// queue of the listener is full.
+	ErrQueueFull = errors.New("connection queue is full")
+
+	// ErrActiveLimit is the reason for rejecting a request because the
+	// listener has reached its limit on active channels.
+	ErrActiveLimit = errors.New("too many active connections")
+
+	// ErrIPLimit is the reason for rejecting a request because the client
+	// has reached the listener's limit on connections per IP address.
+	ErrIPLimit = errors.New("too many connections from this address")
+
+	// ErrAddressDenied is the reason for rejecting a request because the
+	// client address is not permitted by the listener's access policy.
+	ErrAddressDenied = errors.New("client address is not allowed")
+
+	// ErrInvalidKey is the reason for rejecting a request because it did not
+	// present a valid API key (see CheckAPIKey).
+	ErrInvalidKey = errors.New("missing or invalid API key")
+
+	// ErrUpgradeFailed is the reason reported to a client when the server
+	// responds to its websocket handshake without upgrading the connection.
+	// It is also wrapped by errors reported to ListenOptions.OnUpgradeError.
+	ErrUpgradeFailed = errors.New("websocket upgrade failed")
+
+	// ErrRateLimited is reported by Recv when a channel is closed because
+	// its peer exceeded the inbound rate limit (see ListenOptions.RateLimit).
+	ErrRateLimited = errors.New("inbound rate limit exceeded")
+
+	// ErrFallbackOptions is reported by DialContext, and by a Listener, when
+	// Fallback is enabled together with Encryption or MessageAuth, which
+	// fallback sessions do not support.
+	ErrFallbackOptions = errors.New("fallback does not support encryption or message authentication")
+)
+
+// RejectedError is the concrete type of errors reporting that a request to
+// establish a websocket connection was refused.
+//
+// On the server side, a Listener passes a *RejectedError to its ErrorWriter
+// when it rejects a request, and Err is one of the listener errors defined by
+// this package (e.g., ErrQueueFull) or the error reported by CheckAccept.
+//
+// On the client side, DialContext reports a *RejectedError if the server
+// responded to the handshake without upgrading, with Err set to
+// ErrUpgradeFailed and Reason set to the text of the response, if any.
+type RejectedError struct {
+	Code   int    // the HTTP status code of the response
+	Reason string // a human-readable description of the reason
+	Err    error  // the underlying error
+}
+
+func newRejectedError(code int, err error) *RejectedError {
+	return &RejectedError{Code: code, Reason: err.Error(), Err: err}
+}
+
+// Error satisfies the error interface.
+func (e *RejectedError) Error() string {
+	if e.Reason == "" {
+		return e.Err.Error()
+	}
+	return e.Reason
+}
+
+// Unwrap supports error wrapping.
+func (e *RejectedError) Unwrap() error { return e.Err }
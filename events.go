@@ -0,0 +1,66 @@
+package wschannel
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// EventKind identifies the kind of an Event.
+type EventKind int
+
+// The kinds of lifecycle events reported to ChannelOptions.OnEvent.
+const (
+	Dialed      EventKind = iota + 1 // the channel was connected by a dial
+	Accepted                         // the channel was returned by a Listener
+	Closed                           // the channel closed or the peer closed it; see Event.Status and Event.Err
+	PingTimeout                      // the peer did not answer a keepalive ping
+	Reconnected                      // a Redialer connected a replacement channel
+)
+
+var eventKindName = [...]string{
+	Dialed:      "Dialed",
+	Accepted:    "Accepted",
+	Closed:      "Closed",
+	PingTimeout: "PingTimeout",
+	Reconnected: "Reconnected",
+}
+
+func (k EventKind) String() string {
+	if k > 0 && int(k) < len(eventKindName) {
+		return eventKindName[k]
+	}
+	return "EventKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// An Event describes a change in the state of a channel. See
+// ChannelOptions.OnEvent.
+type Event struct {
+	Kind    EventKind
+	Channel *Channel
+	Time    time.Time
+
+	// For a Closed event, the status of the first close frame sent or
+	// received on the channel, or -1 if it is not known.
+	Status websocket.StatusCode
+
+	// For a Closed event, the error that ended the channel, or nil if the
+	// channel was closed by a call to Close.
+	Err error
+}
+
+// emit reports an event of the given kind for c, if c has an event hook.
+func (c *Channel) emit(kind EventKind) {
+	if c.onEvent != nil {
+		c.onEvent(Event{Kind: kind, Channel: c, Time: c.clock.Now(), Status: -1})
+	}
+}
+
+// emitClosed reports a Closed event for c with the given status and error,
+// if c has an event hook and has not already reported one.
+func (c *Channel) emitClosed(status websocket.StatusCode, err error) {
+	if c.onEvent != nil && c.closedEvent.CompareAndSwap(false, true) {
+		c.onEvent(Event{Kind: Closed, Channel: c, Time: c.clock.Now(), Status: status, Err: err})
+	}
+}
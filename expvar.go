@@ -0,0 +1,66 @@
+package wschannel
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"sync/atomic"
+)
+
+// pkgStats are counters for all the channels in the process.
+var pkgStats struct {
+	channelStats
+	opened, closed, errors atomic.Int64
+}
+
+// countErr records err, reported by Send or Recv, in pkgStats if it is not
+// the result of the channel closing.
+func countErr(err error) error {
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		pkgStats.errors.Add(1)
+	}
+	return err
+}
+
+// PublishExpvar publishes counters for all the channels in the process as
+// the expvar variable with the given name, so that they are reported by the
+// /debug/vars handler. The value is a JSON object with these fields:
+//
+//	channelsOpened    channels created by Dial, New, or a Listener
+//	channelsActive    channels opened and not yet closed
+//	messagesSent      messages sent, and their total payload size
+//	bytesSent
+//	messagesReceived  messages received, and their total payload size
+//	bytesReceived
+//	errors            Send and Recv failures not caused by the channel closing
+//
+// As with expvar.Publish, PublishExpvar panics if name is already in use.
+// Use the PublishExpvar method of a Listener to publish its metrics.
+func PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() any {
+		opened := pkgStats.opened.Load()
+		return map[string]int64{
+			"channelsOpened":   opened,
+			"channelsActive":   opened - pkgStats.closed.Load(),
+			"messagesSent":     pkgStats.msgSent.Load(),
+			"bytesSent":        pkgStats.bytesSent.Load(),
+			"messagesReceived": pkgStats.msgRcvd.Load(),
+			"bytesReceived":    pkgStats.bytesRcvd.Load(),
+			"errors":           pkgStats.errors.Load(),
+		}
+	}))
+}
+
+// PublishExpvar publishes the metrics of lst as the expvar variable with the
+// given name. The value is a JSON object with the fields of Metrics, and the
+// current Active and Pending counts. As with expvar.Publish, PublishExpvar
+// panics if name is already in use.
+func (lst *Listener) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() any {
+		return struct {
+			Metrics
+			Active  int
+			Pending int
+		}{lst.Metrics(), lst.Active(), lst.Pending()}
+	}))
+}
@@ -0,0 +1,742 @@
+package wschannel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// A client that cannot complete a websocket handshake may connect to a
+// listener that has ListenOptions.Fallback enabled using one of the fallback
+// transports described here. Messages are carried over ordinary HTTP
+// requests to the listener's URL, so they pass through proxies that do not
+// support websockets.
+//
+// To open a session, the client sends a GET request with the query parameter
+// transport=sse or transport=poll. The request is subject to the same
+// admission checks as a websocket handshake. If it is admitted, the response
+// body is formatted as Server-Sent Events, the first of which is a "session"
+// event whose data is the session ID. Each message sent to the client is a
+// "message" event with its content encoded as base64, and its sequence number
+// as the event ID. When the server closes the session it sends a "close"
+// event whose data are the close status code and reason, separated by a
+// space.
+//
+// With transport=sse, the response continues as a stream of events for the
+// life of the session. With transport=poll, the response ends after the
+// session event, and the client receives messages by sending GET requests
+// with the query parameters session=ID and ack=N, where N is the sequence
+// number of the last message it received. The server discards messages up to
+// N, and responds with any later ones, waiting a while for one to arrive if
+// there are none. A message is resent until the client acknowledges it.
+//
+// To send a message to the server, the client sends a POST request with the
+// query parameters session=ID and seq=N, whose body is the content of the
+// message. Messages are numbered from 1. The server replies 204 once the
+// message has been received, and ignores a message it has already received,
+// so that the client may retry a send that fails. To close the session, the
+// client sends a DELETE request with the session parameter.
+const (
+	transportParam = "transport" // selects a fallback transport
+	sessionParam   = "session"   // identifies an open fallback session
+	seqParam       = "seq"       // the sequence number of a message sent
+	ackParam       = "ack"       // the sequence number of a message received
+
+	transportSSE  = "sse"  // Server-Sent Events downstream, POST upstream
+	transportPoll = "poll" // long-polling downstream, POST upstream
+)
+
+const (
+	// sessionBuffer is the number of messages from the client that a session
+	// buffers before a send by the client blocks until the server reads.
+	sessionBuffer = 16
+
+	// sseHeartbeat is the interval at which an idle event stream sends a
+	// comment to the client, to keep proxies from timing out the response.
+	sseHeartbeat = 15 * time.Second
+
+	// pollWait is the longest time a poll waits for a message to arrive.
+	pollWait = 25 * time.Second
+
+	// pollIdle is the longest time a polling session may go without a poll
+	// from the client before it is closed.
+	pollIdle = 2 * pollWait
+
+	// pollBatch is the most messages a single poll response will carry.
+	pollBatch = 64
+
+	// fallbackOpen bounds the time a client waits for the session event when
+	// opening a session, in case a proxy buffers the response.
+	fallbackOpen = 10 * time.Second
+)
+
+// A session is the server side of a fallback connection. It implements the
+// Conn interface, so that a Channel can be built on it.
+type session struct {
+	id   string
+	in   chan []byte   // messages from the client
+	out  chan []byte   // messages to the client
+	done chan struct{} // closed when the session ends
+	once sync.Once     // guards closing done
+	drop func()        // unregisters the session from its listener
+
+	// These are set before done is closed.
+	code   websocket.StatusCode
+	reason string
+
+	// Upstream state, for all transports.
+	umu  sync.Mutex
+	rseq uint64 // the last message received from the client
+
+	// Downstream state. Only sseq is used by streaming sessions.
+	pmu     sync.Mutex
+	idle    *time.Timer // if not nil, the session is polled
+	sseq    uint64      // the last message sent to the client
+	unacked []sessionMsg
+}
+
+// A sessionMsg is a message sent to a polling client, pending acknowledgement.
+type sessionMsg struct {
+	seq  uint64
+	data []byte
+}
+
+// Read implements part of the Conn interface.
+func (s *session) Read(ctx context.Context) (websocket.MessageType, []byte, error) {
+	select {
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	case <-s.done:
+		return 0, nil, websocket.CloseError{Code: s.code, Reason: s.reason}
+	case msg := <-s.in:
+		return websocket.MessageBinary, msg, nil
+	}
+}
+
+// Write implements part of the Conn interface.
+func (s *session) Write(ctx context.Context, _ websocket.MessageType, data []byte) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.done:
+		return net.ErrClosed
+	case s.out <- data:
+		return nil
+	}
+}
+
+// Close implements part of the Conn interface. A polled session remains
+// registered until the client has been told it is closed, so that the client
+// can collect the messages sent before the close.
+func (s *session) Close(code websocket.StatusCode, reason string) error {
+	s.once.Do(func() {
+		s.code, s.reason = code, reason
+		close(s.done)
+		if s.idle == nil {
+			s.drop()
+		}
+	})
+	return nil
+}
+
+// deliver passes message seq from the client to the reader of s, blocking if
+// the reader has fallen behind. A message that was already received is
+// ignored.
+func (s *session) deliver(ctx context.Context, seq uint64, msg []byte) error {
+	s.umu.Lock()
+	defer s.umu.Unlock()
+	if seq <= s.rseq {
+		return nil // a retry of a message already received
+	} else if seq != s.rseq+1 {
+		return fmt.Errorf("message %d is out of sequence (want %d)", seq, s.rseq+1)
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.done:
+		return net.ErrClosed
+	case s.in <- msg:
+		s.rseq = seq
+		return nil
+	}
+}
+
+// stream sends the messages written to s to the client as Server-Sent Events,
+// until s ends or the client goes away.
+func (s *session) stream(w http.ResponseWriter, req *http.Request) {
+	rc := http.NewResponseController(w)
+	t := time.NewTicker(sseHeartbeat)
+	defer t.Stop()
+	for {
+		var err error
+		select {
+		case <-req.Context().Done():
+			s.Close(websocket.StatusGoingAway, "client went away")
+			return
+		case <-s.done:
+			writeCloseEvent(w, s.code, s.reason)
+			rc.Flush()
+			return
+		case <-t.C:
+			_, err = io.WriteString(w, ": ping\n\n")
+		case msg := <-s.out:
+			s.sseq++
+			err = writeMessageEvent(w, s.sseq, msg)
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			s.Close(websocket.StatusGoingAway, "stream write failed")
+			return
+		}
+	}
+}
+
+// poll responds to a poll from the client, which has received all messages
+// up to ack. Any later messages are sent in the response, waiting up to
+// pollWait for one to arrive if there are none.
+func (s *session) poll(w http.ResponseWriter, req *http.Request, ack uint64) {
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+	s.idle.Reset(pollIdle)
+	defer s.idle.Reset(pollIdle)
+
+	i := 0
+	for i < len(s.unacked) && s.unacked[i].seq <= ack {
+		i++
+	}
+	s.unacked = s.unacked[i:]
+	if len(s.unacked) == 0 {
+		t := time.NewTimer(pollWait)
+		defer t.Stop()
+		select {
+		case <-req.Context().Done():
+			return
+		case <-s.done:
+		case <-t.C:
+		case msg := <-s.out:
+			s.push(msg)
+		}
+	}
+more:
+	for len(s.unacked) < pollBatch {
+		select {
+		case msg := <-s.out:
+			s.push(msg)
+		default:
+			break more
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, m := range s.unacked {
+		writeMessageEvent(w, m.seq, m.data)
+	}
+	select {
+	case <-s.done:
+		writeCloseEvent(w, s.code, s.reason)
+		s.drop()
+	default:
+	}
+}
+
+// push adds msg to the unacknowledged messages of s. The caller must hold
+// s.pmu.
+func (s *session) push(msg []byte) {
+	s.sseq++
+	s.unacked = append(s.unacked, sessionMsg{seq: s.sseq, data: msg})
+}
+
+func writeMessageEvent(w io.Writer, seq uint64, msg []byte) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", seq, base64.StdEncoding.EncodeToString(msg))
+	return err
+}
+
+func writeCloseEvent(w io.Writer, code websocket.StatusCode, reason string) {
+	fmt.Fprintf(w, "event: close\ndata: %d %s\n\n", code, reason)
+}
+
+// openSession starts a fallback session for req using the named transport.
+// On success, the response headers and the session event have been written.
+// The caller must hold lst.mu.
+func (lst *Listener) openSession(w http.ResponseWriter, req *http.Request, transport string) (Conn, error) {
+	if transport != transportSSE && transport != transportPoll {
+		http.Error(w, "unknown transport", http.StatusBadRequest)
+		return nil, fmt.Errorf("unknown transport %q", transport)
+	} else if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("method %s not allowed", req.Method)
+	}
+	var buf [16]byte
+	rand.Read(buf[:])
+	s := &session{
+		id:   hex.EncodeToString(buf[:]),
+		in:   make(chan []byte, sessionBuffer),
+		out:  make(chan []byte),
+		done: make(chan struct{}),
+	}
+	s.drop = func() {
+		lst.mu.Lock()
+		defer lst.mu.Unlock()
+		delete(lst.sessions, s.id)
+	}
+	if transport == transportPoll {
+		s.idle = time.AfterFunc(pollIdle, func() {
+			s.Close(websocket.StatusGoingAway, "client stopped polling")
+			s.drop()
+		})
+	}
+
+	// Register the session before the client learns its ID.
+	lst.mu.Lock()
+	if lst.sessions == nil {
+		lst.sessions = make(map[string]*session)
+	}
+	lst.sessions[s.id] = s
+	lst.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "event: session\ndata: %s\n\n", s.id)
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		if s.idle != nil {
+			s.idle.Stop()
+		}
+		s.drop()
+		return nil, err
+	}
+	return s, nil
+}
+
+// serveSession handles a request for an open fallback session.
+func (lst *Listener) serveSession(w http.ResponseWriter, req *http.Request, id string) {
+	lst.mu.Lock()
+	s := lst.sessions[id]
+	lst.mu.Unlock()
+	if s == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	q := req.URL.Query()
+	switch req.Method {
+	case http.MethodGet:
+		ack, err := strconv.ParseUint(q.Get(ackParam), 10, 64)
+		if err != nil || s.idle == nil {
+			http.Error(w, "invalid poll", http.StatusBadRequest)
+			return
+		}
+		s.poll(w, req, ack)
+	case http.MethodPost:
+		seq, err := strconv.ParseUint(q.Get(seqParam), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid sequence number", http.StatusBadRequest)
+			return
+		}
+		msg, err := io.ReadAll(io.LimitReader(req.Body, lst.copts.readLimit()+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if int64(len(msg)) > lst.copts.readLimit() {
+			s.Close(websocket.StatusMessageTooBig, "message too big")
+			http.Error(w, "message too big", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err := s.deliver(req.Context(), seq, msg); errors.Is(err, net.ErrClosed) {
+			http.Error(w, "session closed", http.StatusGone)
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case http.MethodDelete:
+		s.Close(websocket.StatusNormalClosure, "")
+		s.drop()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// A fallbackClient is the client side of a fallback session. It implements
+// the Conn interface.
+type fallbackClient struct {
+	cli    *http.Client
+	url    *url.URL // the session URL, including the session ID
+	hdr    http.Header
+	line   int                // the maximum length of an event line
+	id     string             // the channel ID assigned by the server, if any
+	ctx    context.Context    // governs receiving
+	cancel context.CancelFunc // stops receiving
+
+	in   chan []byte   // messages from the server
+	done chan struct{} // closed when receiving stops
+	err  error         // set before done is closed
+
+	wmu sync.Mutex // serializes writes, to preserve their order
+	seq uint64     // the last message sent; guarded by wmu
+}
+
+// IsFallback reports whether req is a request of one of the fallback
+// transports, which a Listener with ListenOptions.Fallback enabled must serve
+// along with websocket upgrades. This is useful for routing requests to a
+// listener by the same URL as other handlers.
+func IsFallback(req *http.Request) bool {
+	q := req.URL.Query()
+	return q.Has(transportParam) || q.Has(sessionParam)
+}
+
+// checkFallback reports ErrFallbackOptions if o enables settings that
+// fallback sessions do not support.
+func (o *ChannelOptions) checkFallback() error {
+	if o.encryption() != nil || o.messageAuth() != nil {
+		return ErrFallbackOptions
+	}
+	return nil
+}
+
+// dialFallback opens a fallback session with the server at the given
+// websocket URL. It tries each transport in turn, and reports the errors from
+// all of them if none succeeds.
+func dialFallback(ctx context.Context, rawURL string, opts *DialOptions) (*fallbackClient, error) {
+	var errs []error
+	for _, t := range []string{transportSSE, transportPoll} {
+		c, err := openFallback(ctx, rawURL, t, opts)
+		if err == nil {
+			return c, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", t, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// openFallback opens a fallback session using the specified transport.
+func openFallback(ctx context.Context, rawURL, transport string, opts *DialOptions) (*fallbackClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	q := u.Query()
+	q.Set(transportParam, transport)
+	u.RawQuery = q.Encode()
+
+	cli := opts.client()
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	c := &fallbackClient{
+		cli:  cli,
+		hdr:  opts.header(),
+		line: maxEventLine(opts.channelOptions().readLimit()),
+		in:   make(chan []byte),
+		done: make(chan struct{}),
+	}
+
+	// Receiving outlives ctx, which governs only the dial. The session event
+	// must arrive promptly, in case a proxy buffers the response.
+	c.ctx, c.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, c.cancel)
+	timer := time.AfterFunc(fallbackOpen, c.cancel)
+	ev, body, events, err := c.open(u.String())
+	if !stop() {
+		err = errors.Join(err, ctx.Err())
+	} else if !timer.Stop() {
+		err = errors.Join(err, errors.New("timed out waiting for a session"))
+	}
+	if err != nil {
+		if body != nil {
+			body.Close()
+		}
+		c.cancel()
+		return nil, err
+	}
+
+	q.Del(transportParam)
+	q.Set(sessionParam, ev.data)
+	u.RawQuery = q.Encode()
+	c.url = u
+	if transport == transportSSE {
+		go c.stream(body, events)
+	} else {
+		body.Close()
+		go c.poll()
+	}
+	return c, nil
+}
+
+// open sends a request to open a session, and reads the session event from
+// the response. If the event is read, the response body is also returned for
+// the caller to close.
+func (c *fallbackClient) open(url string) (event, io.Closer, *bufio.Scanner, error) {
+	rsp, err := c.do(c.ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return event{}, nil, nil, err
+	} else if rsp.StatusCode != http.StatusOK {
+		defer rsp.Body.Close()
+		return event{}, nil, nil, rejectedFromResponse(rsp)
+	}
+	c.id = rsp.Header.Get(IDHeader)
+	events := c.scanner(rsp.Body)
+	ev, err := readEvent(events)
+	if err == nil && ev.kind != "session" {
+		err = fmt.Errorf("unexpected %q event", ev.kind)
+	}
+	return ev, rsp.Body, events, err
+}
+
+// scanner returns a scanner for the events of a response body, whose lines
+// may be long enough to hold the largest message c accepts.
+func (c *fallbackClient) scanner(body io.Reader) *bufio.Scanner {
+	sc := bufio.NewScanner(body)
+	sc.Buffer(nil, c.line)
+	return sc
+}
+
+// maxEventLine returns the length of the longest event line needed to carry
+// a message of up to limit bytes.
+func maxEventLine(limit int64) int {
+	const overhead = len("data: \r\n")
+	if limit >= math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return base64.StdEncoding.EncodedLen(int(limit)) + overhead
+}
+
+// An event is a Server-Sent Event.
+type event struct {
+	kind, id, data string
+}
+
+// readEvent reads the next event from sc, skipping comments. Events without
+// a type are reported as "message".
+func readEvent(sc *bufio.Scanner) (event, error) {
+	var ev event
+	var lines []string
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			if ev.kind == "" && lines == nil {
+				continue // no fields, e.g., only a comment
+			} else if ev.kind == "" {
+				ev.kind = "message"
+			}
+			ev.data = strings.Join(lines, "\n")
+			return ev, nil
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			ev.kind = value
+		case "id":
+			ev.id = value
+		case "data":
+			lines = append(lines, value)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return ev, err
+	}
+	return ev, io.EOF
+}
+
+// stream delivers the messages from an event stream to c.in until the stream
+// ends.
+func (c *fallbackClient) stream(body io.Closer, events *bufio.Scanner) {
+	defer close(c.done)
+	defer body.Close()
+	for {
+		ev, err := readEvent(events)
+		if err != nil {
+			c.err = net.ErrClosed
+			return
+		} else if _, ok := c.handle(ev); !ok {
+			return
+		}
+	}
+}
+
+// poll polls the server for messages and delivers them to c.in until the
+// session ends. A poll that fails is retried a few times before giving up.
+func (c *fallbackClient) poll() {
+	defer close(c.done)
+	var ack uint64
+	var failures int
+	for {
+		u := *c.url
+		q := u.Query()
+		q.Set(ackParam, strconv.FormatUint(ack, 10))
+		u.RawQuery = q.Encode()
+
+		rsp, err := c.do(c.ctx, http.MethodGet, u.String(), nil)
+		if err == nil && rsp.StatusCode != http.StatusOK {
+			rsp.Body.Close()
+			if rsp.StatusCode == http.StatusNotFound {
+				c.err = net.ErrClosed // the session is gone
+				return
+			}
+			err = errors.New(rsp.Status)
+		}
+		if err != nil {
+			failures++
+			if c.ctx.Err() != nil || failures > 3 {
+				c.err = net.ErrClosed
+				return
+			}
+			time.Sleep(time.Duration(failures) * 100 * time.Millisecond)
+			continue
+		}
+		failures = 0
+
+		events := c.scanner(rsp.Body)
+		for {
+			ev, err := readEvent(events)
+			if err != nil {
+				break // end of response; poll again
+			}
+			seq, _ := strconv.ParseUint(ev.id, 10, 64)
+			if ev.kind == "message" && seq <= ack {
+				continue // a duplicate of a message already delivered
+			}
+			ok, more := c.handle(ev)
+			if ok {
+				ack = seq
+			}
+			if !more {
+				rsp.Body.Close()
+				return
+			}
+		}
+		rsp.Body.Close()
+	}
+}
+
+// handle processes an event from the server. It reports whether a message
+// was delivered, and whether c should continue receiving.
+func (c *fallbackClient) handle(ev event) (delivered, more bool) {
+	switch ev.kind {
+	case "message":
+		msg, err := base64.StdEncoding.DecodeString(ev.data)
+		if err != nil {
+			c.err = fmt.Errorf("invalid message: %w", err)
+			return false, false
+		}
+		select {
+		case c.in <- msg:
+			return true, true
+		case <-c.ctx.Done():
+			c.err = net.ErrClosed
+			return false, false
+		}
+	case "close":
+		code, reason, _ := strings.Cut(ev.data, " ")
+		n, _ := strconv.Atoi(code)
+		c.err = websocket.CloseError{Code: websocket.StatusCode(n), Reason: reason}
+		return false, false
+	}
+	return false, true
+}
+
+// Read implements part of the Conn interface.
+func (c *fallbackClient) Read(ctx context.Context) (websocket.MessageType, []byte, error) {
+	select {
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	case <-c.done:
+		return 0, nil, c.err
+	case msg := <-c.in:
+		return websocket.MessageBinary, msg, nil
+	}
+}
+
+// Write implements part of the Conn interface. A send that fails without a
+// response is retried, since the server ignores duplicates.
+func (c *fallbackClient) Write(ctx context.Context, _ websocket.MessageType, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	select {
+	case <-c.done:
+		return net.ErrClosed
+	default:
+	}
+	c.seq++
+	u := *c.url
+	q := u.Query()
+	q.Set(seqParam, strconv.FormatUint(c.seq, 10))
+	u.RawQuery = q.Encode()
+
+	var rsp *http.Response
+	var err error
+	for range 3 {
+		rsp, err = c.do(ctx, http.MethodPost, u.String(), data)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	switch rsp.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusGone, http.StatusNotFound:
+		return net.ErrClosed
+	default:
+		return fmt.Errorf("send: %s", rsp.Status)
+	}
+}
+
+// Close implements part of the Conn interface.
+func (c *fallbackClient) Close(websocket.StatusCode, string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rsp, err := c.do(ctx, http.MethodDelete, c.url.String(), nil)
+	if err == nil {
+		rsp.Body.Close()
+	}
+	c.cancel()
+	<-c.done
+	return err
+}
+
+// do sends a request with the given method, URL, and body, and returns its
+// response. The caller must close the response body.
+func (c *fallbackClient) do(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = c.hdr.Clone()
+	if method == http.MethodGet {
+		req.Header.Set("Accept", "text/event-stream")
+	}
+	return c.cli.Do(req)
+}
@@ -0,0 +1,270 @@
+//go:build !js
+
+package wschannel_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/creachadair/jrpc2/channel"
+	"github.com/creachadair/wschannel"
+)
+
+// scriptConn is a wschannel.Conn whose reads are decoded from a fuzz input.
+// Each step of the script is a kind byte, a length byte, and up to that many
+// bytes of payload. Writes report werr.
+type scriptConn struct {
+	script []byte
+	werr   error
+}
+
+// scriptStep is a decoded step of a scriptConn.
+type scriptStep struct {
+	typ  websocket.MessageType
+	data []byte
+	err  error
+	code websocket.StatusCode // for close errors, or -1
+}
+
+func (s *scriptConn) next() (scriptStep, bool) {
+	if len(s.script) < 2 {
+		return scriptStep{}, false
+	}
+	kind, n := s.script[0], min(int(s.script[1]), len(s.script)-2)
+	data := s.script[2 : 2+n]
+	s.script = s.script[2+n:]
+
+	step := scriptStep{code: -1}
+	switch kind % 6 {
+	case 0:
+		step.typ, step.data = websocket.MessageBinary, data
+	case 1:
+		step.typ, step.data = websocket.MessageText, data
+	case 2, 3:
+		var code uint16
+		if len(data) >= 2 {
+			code, data = binary.BigEndian.Uint16(data), data[2:]
+		}
+		ce := websocket.CloseError{Code: websocket.StatusCode(code), Reason: string(data)}
+		step.err, step.code = ce, ce.Code
+		if kind%6 == 3 {
+			step.err = fmt.Errorf("failed to read frame: %w", ce)
+		}
+	case 4:
+		step.err = io.ErrUnexpectedEOF
+	case 5:
+		step.err = context.DeadlineExceeded
+	}
+	return step, true
+}
+
+func (s *scriptConn) Read(context.Context) (websocket.MessageType, []byte, error) {
+	step, ok := s.next()
+	if !ok {
+		return 0, nil, websocket.CloseError{Code: websocket.StatusNormalClosure}
+	}
+	return step.typ, step.data, step.err
+}
+
+func (s *scriptConn) Write(context.Context, websocket.MessageType, []byte) error { return s.werr }
+
+func (s *scriptConn) Close(websocket.StatusCode, string) error { return nil }
+
+// checkClassified verifies that err, reported by a channel for an underlying
+// error with the given close code (or -1), is classified correctly.
+func checkClassified(t *testing.T, op string, err, base error, code websocket.StatusCode) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("%s: got nil error, want %v", op, base)
+	}
+	if code >= 0 {
+		if !channel.IsErrClosing(err) {
+			t.Errorf("%s: error %v is not classified as closing", op, err)
+		}
+		if got := websocket.CloseStatus(err); got != code {
+			t.Errorf("%s: got close status %v, want %v", op, got, code)
+		}
+	} else if !errors.Is(err, base) {
+		t.Errorf("%s: got %v, want %v", op, err, base)
+	}
+}
+
+// FuzzConn drives Recv and Send over an injected transport that delivers
+// arbitrary messages and errors, and checks that messages are delivered
+// intact and that errors are classified correctly.
+func FuzzConn(f *testing.F) {
+	f.Add([]byte("\x00\x05hello\x01\x00"))
+	f.Add([]byte("\x02\x04\x03\xe8bye"))
+	f.Add([]byte("\x03\x01\x03"))
+	f.Add([]byte("\x00\xffshort"))
+	f.Add([]byte("\x04\x00"))
+	f.Add([]byte("\x05\x00"))
+	f.Fuzz(func(t *testing.T, script []byte) {
+		want := &scriptConn{script: script}
+		conn := &scriptConn{script: script}
+		ch := wschannel.New(conn)
+		defer ch.Close()
+
+		for {
+			step, ok := want.next()
+			if !ok {
+				step = scriptStep{err: websocket.CloseError{Code: websocket.StatusNormalClosure}, code: websocket.StatusNormalClosure}
+			}
+			got, err := ch.Recv()
+			if step.err == nil {
+				if err != nil || !bytes.Equal(got, step.data) {
+					t.Fatalf("Recv: got (%q, %v), want (%q, nil)", got, err, step.data)
+				}
+				continue
+			}
+			checkClassified(t, "Recv", err, step.err, step.code)
+
+			// Writes that fail the same way are classified the same way.
+			conn.werr = step.err
+			checkClassified(t, "Send", ch.Send([]byte("x")), step.err, step.code)
+			return
+		}
+	})
+}
+
+// rawClient opens a websocket connection to the server at url without a
+// websocket library, so that the test can send arbitrary frames.
+func rawClient(t *testing.T, url string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		strings.TrimPrefix(url, "http://"))
+	rsp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		conn.Close()
+		t.Fatalf("Reading handshake: %v", err)
+	} else if rsp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		t.Fatalf("Handshake: got %s, want 101", rsp.Status)
+	}
+	return conn
+}
+
+// frame encodes a masked client frame with the given first header byte,
+// declared payload length, and payload.
+func frame(hdr byte, length uint64, payload []byte) []byte {
+	buf := []byte{hdr}
+	switch {
+	case length < 126:
+		buf = append(buf, 0x80|byte(length))
+	case length <= 0xffff:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0x80|126), uint16(length))
+	default:
+		buf = binary.BigEndian.AppendUint64(append(buf, 0x80|127), length)
+	}
+	key := [4]byte{0x12, 0x34, 0x56, 0x78}
+	buf = append(buf, key[:]...)
+	for i, b := range payload {
+		buf = append(buf, b^key[i%4])
+	}
+	return buf
+}
+
+// validCloseCode reports whether code may be sent in a close frame.
+func validCloseCode(code uint16) bool {
+	return (code >= 1000 && code <= 1014 && (code < 1004 || code > 1006)) ||
+		(code >= 3000 && code <= 4999)
+}
+
+// FuzzFrames sends a frame with an arbitrary header, declared length, and
+// payload to a listener, followed by a normal close, and checks that the
+// channel delivers well-formed messages and close statuses, and fails
+// promptly for anything else.
+func FuzzFrames(f *testing.F) {
+	f.Add(byte(0x82), int64(-1), []byte("hello"))      // binary message
+	f.Add(byte(0x81), int64(-1), []byte("hello"))      // text message
+	f.Add(byte(0x88), int64(-1), []byte("\x0f\xa0ok")) // close with status 4000
+	f.Add(byte(0x88), int64(-1), []byte("\x03"))       // truncated close status
+	f.Add(byte(0x88), int64(-1), []byte(""))           // close without status
+	f.Add(byte(0x89), int64(-1), []byte("ping"))       // ping
+	f.Add(byte(0x02), int64(-1), []byte("frag"))       // unfinished fragment
+	f.Add(byte(0xc2), int64(-1), []byte("rsv"))        // reserved bit set
+	f.Add(byte(0x82), int64(1<<40), []byte("huge"))    // hostile length
+	f.Add(byte(0x82), int64(100), []byte("short"))     // truncated payload
+
+	const readLimit = 1024
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		Channel: &wschannel.ChannelOptions{ReadLimit: readLimit, ReadTimeout: 5 * time.Second},
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	f.Fuzz(func(t *testing.T, hdr byte, length int64, payload []byte) {
+		conn := rawClient(t, s.URL)
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ch, err := lst.AcceptChannel(ctx)
+		if err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+		defer ch.Close()
+
+		declared := uint64(length)
+		if length < 0 {
+			declared = uint64(len(payload))
+		}
+		conn.Write(frame(hdr, declared, payload))
+		conn.Write(frame(0x88, 2, []byte{0x03, 0xe8})) // status 1000
+		conn.(*net.TCPConn).CloseWrite()
+
+		var msgs [][]byte
+		for {
+			msg, err := ch.Recv()
+			if err == nil {
+				msgs = append(msgs, msg)
+				continue
+			} else if errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("Recv did not complete: %v", err)
+			}
+			if websocket.CloseStatus(err) >= 0 && !channel.IsErrClosing(err) {
+				t.Errorf("Recv: close error %v is not classified as closing", err)
+			}
+
+			wellFormed := length < 0 || declared == uint64(len(payload))
+			switch {
+			case !wellFormed:
+				// Anything but a hang or a crash is acceptable.
+			case (hdr == 0x81 || hdr == 0x82) && len(payload) <= readLimit:
+				if len(msgs) != 1 || !bytes.Equal(msgs[0], payload) {
+					t.Errorf("Recv: got messages %q, want [%q]", msgs, payload)
+				}
+				if got := websocket.CloseStatus(err); got != websocket.StatusNormalClosure {
+					t.Errorf("Recv: got status %v (%v), want %v", got, err, websocket.StatusNormalClosure)
+				}
+			case hdr == 0x88 && len(payload) >= 2 && len(payload) <= 125:
+				code := binary.BigEndian.Uint16(payload)
+				if validCloseCode(code) && websocket.CloseStatus(err) != websocket.StatusCode(code) {
+					t.Errorf("Recv: got %v, want status %d", err, code)
+				}
+			}
+			if len(msgs) != 0 && hdr&0x0f != 0x01 && hdr&0x0f != 0x02 {
+				t.Errorf("Recv: got messages %q from a non-data frame %#x", msgs, hdr)
+			}
+			return
+		}
+	})
+}
@@ -1,8 +1,15 @@
 module github.com/creachadair/wschannel
 
-go 1.23
+go 1.23.0
 
 require (
 	github.com/coder/websocket v1.8.12
 	github.com/creachadair/jrpc2 v1.3.0
+	golang.org/x/crypto v0.40.0
+)
+
+require (
+	github.com/creachadair/mds v0.21.4 // indirect
+	golang.org/x/sync v0.16.0 // indirect
+	golang.org/x/sys v0.34.0 // indirect
 )
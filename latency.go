@@ -0,0 +1,127 @@
+package wschannel
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets is the number of finite buckets in a latency histogram. The
+// upper bound of bucket i is 2^i microseconds, so the largest finite bound is
+// about 34 seconds.
+const latencyBuckets = 26
+
+// A Histogram is a snapshot of the distribution of the durations of an
+// operation. Durations are counted in buckets whose upper bounds double from
+// one microsecond to about 34 seconds.
+type Histogram struct {
+	Count int64         // the number of durations recorded
+	Sum   time.Duration // the total of the durations recorded
+
+	// Bounds are the upper bounds of the buckets, in increasing order.
+	// Counts[i] is the number of durations d with Bounds[i-1] < d ≤ Bounds[i].
+	// The final element of Counts, which has no bound, counts the durations
+	// greater than the last bound.
+	Bounds []time.Duration
+	Counts []int64
+}
+
+// Quantile returns an estimate of the q quantile of the durations in h, for
+// 0 ≤ q ≤ 1, as the upper bound of the bucket that contains it. If the
+// quantile falls above the last bound, Quantile returns the last bound. If h
+// is empty, Quantile returns 0.
+func (h Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := max(int64(math.Ceil(q*float64(h.Count))), 1)
+	var n int64
+	for i, c := range h.Counts {
+		n += c
+		if n >= rank && i < len(h.Bounds) {
+			return h.Bounds[i]
+		}
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// LatencyStats are histograms of the durations of channel operations. The
+// duration of a Recv includes the time spent waiting for the peer to send a
+// message, so it is most useful for channels whose peer sends continuously.
+// Only operations that succeed are recorded.
+type LatencyStats struct {
+	Handshake Histogram // websocket handshakes, from request to upgrade
+	Send      Histogram // calls to Send
+	Recv      Histogram // calls to Recv
+}
+
+// latencies are the live histograms underlying a LatencyStats value, indexed
+// by operation.
+type latencies [3]histogram
+
+// The operations recorded in latencies.
+const (
+	opHandshake = iota
+	opSend
+	opRecv
+)
+
+func (l *latencies) snapshot() LatencyStats {
+	return LatencyStats{
+		Handshake: l[opHandshake].snapshot(),
+		Send:      l[opSend].snapshot(),
+		Recv:      l[opRecv].snapshot(),
+	}
+}
+
+// histogram is a live latency histogram. A zero histogram is empty.
+type histogram struct {
+	counts [latencyBuckets + 1]atomic.Int64
+	sum    atomic.Int64
+}
+
+// record adds a duration d to h.
+func (h *histogram) record(d time.Duration) {
+	d = max(d, 0)
+	i := min(bits.Len64(uint64((d-1)/time.Microsecond)), latencyBuckets)
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+func (h *histogram) snapshot() Histogram {
+	out := Histogram{
+		Sum:    time.Duration(h.sum.Load()),
+		Bounds: make([]time.Duration, latencyBuckets),
+		Counts: make([]int64, latencyBuckets+1),
+	}
+	for i := range out.Counts {
+		if i < latencyBuckets {
+			out.Bounds[i] = time.Microsecond << i
+		}
+		out.Counts[i] = h.counts[i].Load()
+		out.Count += out.Counts[i]
+	}
+	return out
+}
+
+// pkgLatency are the latency histograms for all the channels in the process.
+var pkgLatency latencies
+
+// Latency returns latency histograms for all the channels in the process.
+// The handshake histogram includes both dials and upgrades by a Listener.
+// Use the Latency method of a Listener for the channels it created.
+func Latency() LatencyStats { return pkgLatency.snapshot() }
+
+// Latency returns latency histograms for the channels created by lst.
+func (lst *Listener) Latency() LatencyStats { return lst.lat.snapshot() }
+
+// observe records the duration of an operation on c that began at start, for
+// the process and for the listener of c, if any.
+func (c *Channel) observe(op int, start time.Time) {
+	d := c.clock.Now().Sub(start)
+	pkgLatency[op].record(d)
+	if c.lat != nil {
+		c.lat[op].record(d)
+	}
+}
@@ -1,84 +1,483 @@
 package wschannel
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"runtime/debug"
+	"runtime/trace"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/coder/websocket"
 	"github.com/creachadair/jrpc2/channel"
 )
 
-// ErrListenerClosed is the error reported for a closed listener.
-var ErrListenerClosed = errors.New("listener is closed")
-
 // NewListener constructs a new listener with the given options.
 // Use opts == nil for default settings (see ListenOptions).
 // A Listener implements the http.Handler interface, and the caller can use the
 // Accept method to obtain connected channels served by the handler.
+//
+// If opts enables Fallback together with encryption or message
+// authentication, the listener rejects every request with status 500
+// (Internal Server Error), and Accept and ServeListener report
+// ErrFallbackOptions.
 func NewListener(opts *ListenOptions) *Listener {
 	return &Listener{
-		hdr:   opts.header(),
-		check: opts.check(),
-		inc:   make(chan *Channel, opts.maxPending()),
+		hdr:          opts.header(),
+		check:        opts.check(),
+		errw:         opts.errorWriter(),
+		onFull:       opts.onQueueFull(),
+		onUpgradeErr: opts.onUpgradeError(),
+		upgrade:      opts.upgrader(),
+		copts:        opts.channelOptions(),
+		clock:        opts.channelOptions().clock(),
+		proxies:      opts.trustedProxies(),
+		proxyHeader:  opts.proxyHeader(),
+		allow:        opts.allowCIDRs(),
+		deny:         opts.denyCIDRs(),
+		path:         opts.path(),
+		adminPath:    opts.adminPath(),
+		healthPath:   opts.healthPath(),
+		tlsConfig:    opts.tlsConfig(),
+		notify:       opts.notifyOnShutdown(),
+		closeAll:     opts.closeActive(),
+		detach:       opts.detach(),
+		maxPending:   opts.maxPending(),
+		pendTimeout:  opts.pendingTimeout(),
+		idleTimeout:  opts.idleTimeout(),
+		onReap:       opts.onReap(),
+		ping:         opts.pingPolicy(),
+		rate:         opts.rateLimit(),
+		challenge:    opts.challenge(),
+		audit:        opts.audit(),
+		logReq:       opts.logRequest(),
+		log:          opts.logger(),
+		fallback:     opts.fallback(),
+		retry:        opts.retryAfter(),
+		fullCode:     opts.queueFullStatus(),
+		maxActive:    opts.maxActive(),
+		maxPerIP:     opts.maxConnsPerIP(),
+		perIP:        make(map[string]int),
+		shards:       opts.queueShards(),
+		ready:        newSignal(),
+		quit:         make(chan struct{}),
+		active:       make(map[*Channel]struct{}),
+		err:          opts.validate(),
 	}
 }
 
 // A Listener implements the http.Handler interface to bridge websocket
 // requests to channels. Each connection served to the listener is made
 // available to the Accept method, and its corresponding handler remains open
-// until the channel is closed.
+// until the channel is closed (see ListenOptions.Detach).
 //
 // After the listener is closed, no further connections will be admitted and
 // any unaccepted pending connections are discarded.
 type Listener struct {
-	hdr   http.Header
-	check func(*http.Request) (int, error)
+	hdr          http.Header
+	check        func(*http.Request) (int, error)
+	errw         func(http.ResponseWriter, *http.Request, int, error)
+	onFull       func(http.ResponseWriter, *http.Request) bool
+	onUpgradeErr func(*http.Request, error)
+	upgrade      func(http.ResponseWriter, *http.Request) (*websocket.Conn, error)
+	copts        *ChannelOptions
+	proxies      prefixSet
+	proxyHeader  string
+	allow        prefixSet // if not nil, only these clients are admitted
+	deny         prefixSet
+	path         string      // for standalone mode
+	adminPath    string      // for standalone mode; "" if disabled
+	healthPath   string      // for standalone mode; "" if disabled
+	tlsConfig    *tls.Config // for standalone mode
+	notify       bool
+	closeAll     bool
+	detach       bool
+	err          error // if not nil, the options are invalid
+	stats        listenerMetrics
+	lat          latencies
+	retry        string        // if not "", the Retry-After value for capacity rejections
+	fullCode     int           // HTTP status for queue-full rejections
+	pendTimeout  time.Duration // if positive, max time a channel may be pending
+	idleTimeout  time.Duration // if positive, max time an accepted channel may be idle
+	onReap       func(*Channel)
+	ping         PingPolicy
+	rate         *RateLimit
+	challenge    *Challenge
+	audit        func(*AuditRecord)
+	logReq       func(*http.Request, int, error)
+	log          *slog.Logger
+	fallback     bool
+	clock        Clock
+
+	// The pending queue. Accept uses these without holding mu.
+	shards   []*queue      // admitted but not yet accepted
+	npending atomic.Int64  // total length of shards
+	next     atomic.Uint64 // for choosing a shard to push
+	turn     atomic.Uint64 // for choosing a shard to pop
+	ready    *signal       // notified when a channel is enqueued
+	quit     chan struct{} // closed when lst closes
+
+	mu         sync.Mutex
+	authing    int                              // admitted but not yet authenticated
+	upgrading  int                              // admitted but not yet upgraded
+	maxPending int                              // if < 0, the queue is unbounded
+	active     map[*Channel]struct{}            // all channels not yet closed
+	maxActive  int                              // if > 0, max size of active
+	maxPerIP   int                              // if > 0, max active channels per client IP
+	perIP      map[string]int                   // active channels per client IP
+	idle       chan struct{}                    // if not nil, closed when active is empty
+	groups     map[string]map[*Channel]struct{} // members of each named group; see Join
+	sessions   map[string]*session              // open fallback sessions, by ID
+	srv        *http.Server                     // if not nil, the standalone server
+	paused     bool
+	closed     bool
+}
+
+// full reports whether the pending queue is at capacity, counting channels
+// awaiting authentication. The caller must hold lst.mu.
+func (lst *Listener) full() bool {
+	return lst.maxPending >= 0 && int(lst.npending.Load())+lst.authing+lst.upgrading >= lst.maxPending
+}
+
+// push adds ch to a shard of the pending queue and wakes any waiting Accept
+// calls. Shards are chosen in rotation. The caller must hold lst.mu.
+func (lst *Listener) push(ch *Channel) {
+	ch.queue = lst.shards[lst.next.Add(1)%uint64(len(lst.shards))]
+	if lst.pendTimeout > 0 {
+		// Set the timer before ch is visible to pop, which stops it.
+		ch.expire = lst.clock.AfterFunc(lst.pendTimeout, func() { lst.expire(ch) })
+	}
+	ch.queue.push(ch)
+	lst.npending.Add(1)
+	lst.ready.notify()
+}
+
+// expire removes ch from the pending queue, if it is still there, and closes
+// it with status StatusTryAgainLater.
+func (lst *Listener) expire(ch *Channel) {
+	if ch.queue.remove(ch) {
+		lst.npending.Add(-1)
+		lst.stats.expired.Add(1)
+		ch.closeWith(websocket.StatusTryAgainLater, "connection was not accepted in time")
+	}
+}
 
-	mu     sync.Mutex
-	inc    chan *Channel
-	closed bool
+// pop removes and returns a pending channel, or returns nil if the queue is
+// empty. The shards of the queue are visited in rotation, starting from a
+// different shard on each call, so that they are drained fairly.
+func (lst *Listener) pop() *Channel {
+	n := uint64(len(lst.shards))
+	start := lst.turn.Add(1)
+	for i := range n {
+		if ch := lst.shards[(start+i)%n].pop(); ch != nil {
+			lst.npending.Add(-1)
+			if ch.expire != nil {
+				ch.expire.Stop()
+			}
+			return ch
+		}
+	}
+	return nil
 }
 
 // ServeHTTP implements the http.Handler interface. It upgrades the connection
 // to a websocket, if possible, and enqueues a channel on the listener using
 // the upgraded connection. Each invocation of the handler blocks until the
-// corresponding channel closes.
+// corresponding channel closes, unless the listener is detached (see
+// ListenOptions.Detach).
 func (lst *Listener) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if id := req.URL.Query().Get(sessionParam); id != "" && lst.fallback {
+		lst.serveSession(w, req, id)
+		return
+	}
+	var sw *statusWriter
+	if lst.logReq != nil {
+		sw = &statusWriter{ResponseWriter: w}
+		w = sw
+	}
+	start := lst.clock.Now()
+	region := trace.StartRegion(req.Context(), "wschannel.Handshake")
+	ch, err := lst.handshake(w, req)
+	region.End()
+	if ch != nil {
+		ch.observe(opHandshake, start)
+	}
+	if sw != nil {
+		lst.logReq(req, sw.status(), err)
+	}
+	if lst.log != nil {
+		lst.logHandshake(req, ch, err)
+	}
+	if ch == nil {
+		return
+	}
+	ch.Do(req.Context(), func(context.Context) { lst.serveChannel(w, req, ch) })
+}
+
+// serveChannel completes the setup of a channel admitted from req, with the
+// profile labels of ch.
+func (lst *Listener) serveChannel(w http.ResponseWriter, req *http.Request, ch *Channel) {
+	if s, ok := ch.baseConn().(*session); ok {
+		// The client of a fallback session cannot answer the challenge until
+		// this request is complete, or its event stream is running.
+		if lst.challenge != nil {
+			go lst.authenticate(ch)
+		}
+		if s.idle == nil {
+			s.stream(w, req) // until the session ends
+		}
+		return
+	}
+	if lst.challenge != nil {
+		lst.authenticate(ch)
+	}
+	if !lst.detach {
+		<-ch.freed // block until the Channel has closed and been released
+	}
+}
+
+// handshake admits req and upgrades it to a websocket, returning a channel
+// for the connection. If the request is not admitted, handshake returns nil
+// and an error describing the reason, after the response has been written.
+func (lst *Listener) handshake(w http.ResponseWriter, req *http.Request) (*Channel, error) {
+	// Attach per-connection settings the check hook may update.
+	adm := &admission{remote: req.RemoteAddr, client: lst.proxies.clientIP(req, lst.proxyHeader)}
+	req = req.WithContext(context.WithValue(req.Context(), admissionKey{}, adm))
+
+	// Apply the network access policy.
+	if !lst.allowed(adm.client) {
+		lst.stats.denied.Add(1)
+		rerr := newRejectedError(http.StatusForbidden, ErrAddressDenied)
+		lst.errw(w, req, rerr.Code, rerr)
+		return nil, rerr
+	}
+
 	// Call the check hook.
 	if code, err := lst.check(req); err != nil {
+		lst.stats.rejected.Add(1)
 		if code <= 0 {
 			code = http.StatusInternalServerError
 		}
-		http.Error(w, err.Error(), code)
-		return
+		rerr := newRejectedError(code, err)
+		lst.errw(w, req, code, rerr)
+		return nil, rerr
 	}
 
-	lst.mu.Lock()
-	done := func() <-chan struct{} {
-		defer lst.mu.Unlock()
-		if lst.closed {
-			http.Error(w, "listener is closed", http.StatusInternalServerError)
-			return nil
-		} else if len(lst.inc) == cap(lst.inc) {
-			http.Error(w, "connection queue is full", http.StatusServiceUnavailable)
-			return nil
+	// Check the encryption key of the client, if one is required.
+	if enc := lst.copts.encryption(); enc != nil {
+		pub, priv := enc.keyPair()
+		s, err := enc.newSealer(req, req.Header, priv)
+		if err != nil {
+			rerr := newRejectedError(http.StatusForbidden, err)
+			lst.errw(w, req, rerr.Code, rerr)
+			return nil, rerr
 		}
+		adm.seal = s
+		w.Header().Set(KeyHeader, encodeKey(pub))
+	}
 
-		// TODO(creachadair): Add support for AcceptOptions.
-		conn, err := websocket.Accept(w, req, nil)
+	// Find the message authentication key, if one is required.
+	if ma := lst.copts.messageAuth(); ma != nil {
+		key, err := ma.key(req)
 		if err != nil {
-			return nil // Upgrade already sent an error response
+			rerr := newRejectedError(http.StatusForbidden, err)
+			lst.errw(w, req, rerr.Code, rerr)
+			return nil, rerr
 		}
+		adm.macKey = key
+	}
+
+	for {
+		ch, err := lst.admit(w, req, adm)
+		var rerr *RejectedError
+		if !errors.As(err, &rerr) {
+			return ch, err // success, or the upgrade failed
+		} else if rerr.Err == ErrQueueFull && lst.onFull != nil {
+			if lst.onFull(w, req) {
+				continue // try again to admit the connection
+			}
+			return nil, rerr // the callback handled the response
+		}
+		lst.errw(w, req, rerr.Code, rerr)
+		return nil, rerr
+	}
+}
 
-		ch := New(conn)
-		done := ch.done
-		lst.inc <- ch
-		return done
+// allowed reports whether the access policy of lst admits a client with the
+// given address. If the address is not known, it is allowed only if there is
+// no allow list.
+func (lst *Listener) allowed(client netip.Addr) bool {
+	if lst.allow != nil && !lst.allow.contains(client) {
+		return false
+	}
+	return !lst.deny.contains(client)
+}
+
+// admit attempts to upgrade req and add a channel for it to the pending
+// queue. If the request is not eligible for admission, admit reports a
+// *RejectedError describing the reason; the caller is responsible for
+// reporting it. If the upgrade fails, admit reports an error wrapping
+// ErrUpgradeFailed, and the response has already been written. If lst closes
+// during the upgrade, admit closes the connection and reports
+// ErrListenerClosed.
+func (lst *Listener) admit(w http.ResponseWriter, req *http.Request, adm *admission) (*Channel, error) {
+	// If the upgrade fails, report it after releasing the lock.
+	var uerr error
+	defer func() {
+		if uerr != nil && lst.onUpgradeErr != nil {
+			lst.onUpgradeErr(req, uerr)
+		}
 	}()
-	if done != nil {
-		<-done // block until the Channel has closed
+
+	// Reserve a slot for the channel, then release the lock while upgrading,
+	// so that the Upgrade hook cannot stall or deadlock the listener.
+	if err := lst.reserve(w, adm); err != nil {
+		return nil, err
+	}
+
+	// Add any response headers for the upgrade.
+	for _, h := range []http.Header{lst.hdr, adm.header} {
+		for key, vals := range h {
+			for _, v := range vals {
+				w.Header().Add(key, v)
+			}
+		}
+	}
+
+	id := newID()
+	w.Header().Set(IDHeader, id)
+	caps := lst.copts.acceptCapabilities(w, req)
+	conn, err := lst.open(w, req)
+
+	lst.mu.Lock()
+	defer lst.mu.Unlock()
+	lst.upgrading--
+	if err != nil {
+		lst.dropIP(adm.clientKey())
+		lst.stats.upgradeFailed.Add(1)
+		uerr = fmt.Errorf("%w: %w", ErrUpgradeFailed, err)
+		return nil, uerr // Upgrade already sent an error response
+	} else if lst.closed {
+		lst.dropIP(adm.clientKey())
+		conn.Close(websocket.StatusGoingAway, "listener is closed")
+		return nil, ErrListenerClosed
+	}
+	lst.stats.upgraded.Add(1)
+	if adm.macKey != nil {
+		conn = newMACConn(conn, adm.macKey, true)
+	}
+	if adm.seal != nil {
+		conn = &sealConn{Conn: conn, s: adm.seal}
+	}
+
+	ch := newChannel(conn, lst.copts)
+	ch.setCapabilities(caps)
+	ch.info = newConnInfo(req, adm, ch.clock.Now())
+	ch.id, ch.info.ID = id, id
+	ch.value = adm.value
+	ch.limit = lst.rate.newLimiter(ch.clock.Now())
+	ch.onDone = func() { lst.done(ch) }
+	ch.lat = &lst.lat
+	if lst.log != nil {
+		ch.log = lst.log.With(slog.String("id", ch.info.ID), slog.String("remote", req.RemoteAddr))
+	}
+	lst.active[ch] = struct{}{}
+	if lst.challenge != nil {
+		lst.authing++ // the caller must authenticate ch
+	} else {
+		lst.push(ch)
+	}
+	return ch, nil
+}
+
+// reserve checks whether lst can admit a connection for adm, and if so
+// reserves a slot for it, counted by lst.upgrading and lst.perIP. Otherwise
+// it returns a *RejectedError.
+func (lst *Listener) reserve(w http.ResponseWriter, adm *admission) error {
+	lst.mu.Lock()
+	defer lst.mu.Unlock()
+	if lst.err != nil {
+		return newRejectedError(http.StatusInternalServerError, lst.err)
+	} else if lst.closed {
+		return newRejectedError(http.StatusInternalServerError, ErrListenerClosed)
+	} else if lst.paused {
+		lst.stats.paused.Add(1)
+		lst.setRetryAfter(w)
+		return newRejectedError(http.StatusServiceUnavailable, ErrListenerPaused)
+	} else if lst.maxActive > 0 && len(lst.active)+lst.upgrading >= lst.maxActive {
+		lst.stats.activeLimited.Add(1)
+		lst.setRetryAfter(w)
+		return newRejectedError(http.StatusServiceUnavailable, ErrActiveLimit)
+	} else if lst.maxPerIP > 0 && lst.perIP[adm.clientKey()] >= lst.maxPerIP {
+		lst.stats.ipLimited.Add(1)
+		return newRejectedError(http.StatusTooManyRequests, ErrIPLimit)
+	} else if lst.full() {
+		lst.stats.queueFull.Add(1)
+		lst.setRetryAfter(w)
+		return newRejectedError(lst.fullCode, ErrQueueFull)
+	}
+	lst.upgrading++
+	lst.perIP[adm.clientKey()]++
+	return nil
+}
+
+// open upgrades req to a websocket, or starts a fallback session if the
+// client requested one and lst permits it. The caller must not hold lst.mu,
+// since the upgrade may call the Upgrade hook of the listener.
+func (lst *Listener) open(w http.ResponseWriter, req *http.Request) (Conn, error) {
+	if t := req.URL.Query().Get(transportParam); t != "" && lst.fallback {
+		return lst.openSession(w, req, t)
+	}
+	return lst.upgrade(w, req)
+}
+
+// setRetryAfter adds a Retry-After header to w, if one is configured.
+func (lst *Listener) setRetryAfter(w http.ResponseWriter) {
+	if lst.retry != "" {
+		w.Header().Set("Retry-After", lst.retry)
+	}
+}
+
+// done releases ch and reports it to the audit hook, once ch is closed.
+func (lst *Listener) done(ch *Channel) {
+	lst.release(ch)
+	if lst.audit != nil {
+		lst.audit(newAuditRecord(ch))
+	}
+}
+
+// dropIP releases a connection from the per-IP count for host. The caller
+// must hold lst.mu.
+func (lst *Listener) dropIP(host string) {
+	if lst.perIP[host] <= 1 {
+		delete(lst.perIP, host)
+	} else {
+		lst.perIP[host]--
+	}
+}
+
+// release removes ch from the active set after it has closed.
+func (lst *Listener) release(ch *Channel) {
+	lst.mu.Lock()
+	defer lst.mu.Unlock()
+	delete(lst.active, ch)
+	for _, group := range ch.groups {
+		lst.leaveLocked(ch, group)
+	}
+	ch.groups = nil
+	lst.dropIP(ch.info.clientKey())
+	if lst.idle != nil && len(lst.active) == 0 {
+		close(lst.idle)
 	}
 }
 
@@ -87,36 +486,444 @@ func (lst *Listener) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 // returned channel is closed. The concrete type of the channel returned is
 // *wschannel.Channel.
 func (lst *Listener) Accept(ctx context.Context) (channel.Channel, error) {
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case sc, ok := <-lst.inc:
-		if !ok {
-			return nil, ErrListenerClosed
+	ch, err := lst.AcceptChannel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// AcceptChannel behaves as Accept, but returns the concrete type of the
+// channel, for callers that need access to its methods.
+func (lst *Listener) AcceptChannel(ctx context.Context) (*Channel, error) {
+	ch, _, err := lst.accept(ctx, nil)
+	return ch, err
+}
+
+// AcceptInfo blocks until a channel is available or ctx ends, and returns the
+// channel along with information about the connection that created it.
+// Otherwise, it behaves like Accept.
+func (lst *Listener) AcceptInfo(ctx context.Context) (*Channel, *ConnInfo, error) {
+	return lst.accept(ctx, nil)
+}
+
+// AcceptFunc blocks until a channel for which keep reports true is available,
+// or until ctx ends. Each pending channel for which keep reports false is
+// closed and discarded without being accepted. Otherwise, AcceptFunc behaves
+// like Accept.
+func (lst *Listener) AcceptFunc(ctx context.Context, keep func(*ConnInfo) bool) (*Channel, error) {
+	ch, _, err := lst.accept(ctx, keep)
+	return ch, err
+}
+
+// accept implements AcceptInfo and AcceptFunc. If keep == nil, all pending
+// channels are accepted.
+func (lst *Listener) accept(ctx context.Context, keep func(*ConnInfo) bool) (*Channel, *ConnInfo, error) {
+	if lst.err != nil {
+		return nil, nil, lst.err
+	}
+	for {
+		ready := lst.ready.wait()
+		if ch := lst.pop(); ch != nil {
+			if keep != nil && !keep(ch.info) {
+				lst.stats.filtered.Add(1)
+				ch.closeWith(websocket.StatusPolicyViolation, "connection not accepted")
+				continue
+			}
+			lst.stats.accepted.Add(1)
+			ch.taken.Store(true)
+			ch.emit(Accepted)
+			if lst.idleTimeout > 0 {
+				lst.watchIdle(ch)
+			}
+			if lst.ping.Interval > 0 {
+				ch.goLabeled(func() { ch.keepAlive(lst.ping.Interval, lst.ping.timeout()) })
+			}
+			return ch, ch.info, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-lst.quit:
+			return nil, nil, ErrListenerClosed
+		case <-ready:
+			// try again
 		}
-		return sc, nil
 	}
 }
 
+// watchIdle arranges for ch to be closed with status StatusGoingAway if no
+// messages are sent or received on it for lst.idleTimeout.
+func (lst *Listener) watchIdle(ch *Channel) {
+	var check func()
+	check = func() {
+		select {
+		case <-ch.done:
+			return // already closed
+		default:
+		}
+		if idle := lst.clock.Now().Sub(ch.LastActive()); idle < lst.idleTimeout {
+			lst.clock.AfterFunc(lst.idleTimeout-idle, check)
+			return
+		}
+		if ch.closeWith(websocket.StatusGoingAway, "idle timeout") {
+			lst.stats.reaped.Add(1)
+			if lst.onReap != nil {
+				lst.onReap(ch)
+			}
+		}
+	}
+	lst.clock.AfterFunc(lst.idleTimeout, check)
+}
+
+// Serve accepts channels from lst until ctx ends or lst closes, and calls f
+// for each channel accepted in a separate goroutine. The channel is closed
+// when f returns. If f panics, the panic is recovered and logged with its
+// stack, to ListenOptions.Logger or else to the default logger, and the
+// channel is closed with status StatusInternalError. Serve waits for all the
+// calls to f that it started to return. Each goroutine carries the profile
+// labels of its channel (see Channel.ProfileLabels), as do the goroutines it
+// starts.
+//
+// Serve returns nil if the listener closed, or ctx.Err() if ctx ended.
+func (lst *Listener) Serve(ctx context.Context, f func(*Channel)) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		ch, _, err := lst.AcceptInfo(ctx)
+		if errors.Is(err, ErrListenerClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer ch.Close()
+			defer func() {
+				if v := recover(); v != nil {
+					handlerPanicked(ch, v)
+				}
+			}()
+			ch.Do(ctx, func(context.Context) { f(ch) })
+		}()
+	}
+}
+
+// handlerPanicked reports that the handler for ch panicked with v, and closes
+// ch with status StatusInternalError. It must be called from the deferred
+// function that recovered the panic, so that the stack is available.
+func handlerPanicked(ch *Channel, v any) {
+	log := ch.log
+	if log == nil {
+		log = slog.Default() // as net/http does for handler panics
+	}
+	log.LogAttrs(context.Background(), slog.LevelError, "channel handler panicked",
+		slog.Any("panic", v), slog.String("stack", string(debug.Stack())))
+	ch.closeWith(websocket.StatusInternalError, "internal error")
+}
+
+// SetMaxPending changes the maximum number of pending connections lst will
+// admit, with the same interpretation as ListenOptions.MaxPending. Reducing
+// the limit does not discard connections already pending, but no further
+// connections are admitted until the queue drains below the new limit.
+func (lst *Listener) SetMaxPending(n int) {
+	lst.mu.Lock()
+	defer lst.mu.Unlock()
+	lst.maxPending = (&ListenOptions{MaxPending: n}).maxPending()
+}
+
+// Pause stops lst from admitting new connections until Resume is called.
+// While the listener is paused, upgrade requests are rejected with status 503
+// (Service Unavailable) and a Retry-After header if one is configured.
+// Pausing does not affect pending or active channels.
+func (lst *Listener) Pause() {
+	lst.mu.Lock()
+	defer lst.mu.Unlock()
+	lst.paused = true
+}
+
+// Resume allows a paused listener to admit new connections again.
+// It has no effect if lst is not paused.
+func (lst *Listener) Resume() {
+	lst.mu.Lock()
+	defer lst.mu.Unlock()
+	lst.paused = false
+}
+
 // Close closes the listener, after which no further connections will be
 // admitted, and any connections admitted but not yet accepted will be closed
-// and discarded.
+// and discarded. If ListenOptions.CloseActive was set, Close also closes all
+// the channels previously returned by Accept that are still open. If lst is
+// running a standalone server (see ListenAndServe), Close also stops it.
 func (lst *Listener) Close() error {
 	lst.mu.Lock()
 	defer lst.mu.Unlock()
+	_, err := lst.closeLocked()
+	return err
+}
+
+// CloseContext closes the listener, as Close, and then waits until the close
+// handshakes for the channels it closed have completed, or until ctx ends.
+// If ctx ends first, CloseContext returns ctx.Err() without waiting further.
+// Any handshakes still in progress continue in the background, subject to the
+// timeouts imposed by the websocket library.
+func (lst *Listener) CloseContext(ctx context.Context) error {
+	lst.mu.Lock()
+	closing, err := lst.closeLocked()
+	lst.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, ch := range closing {
+		select {
+		case <-ch.closed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Shutdown closes the listener, as Close, and then waits for all the channels
+// it has produced to close, or for ctx to end. If ctx ends first, Shutdown
+// returns ctx.Err(); otherwise it returns nil. Shutdown may be called after
+// the listener has been closed.
+//
+// If ListenOptions.NotifyOnShutdown was set, Shutdown sends a websocket close
+// frame with status StatusGoingAway to each active channel, so that the peer
+// and the local reader can observe the connection ending. Otherwise, Shutdown
+// simply waits for the application to close its channels.
+func (lst *Listener) Shutdown(ctx context.Context) error {
+	lst.mu.Lock()
+	lst.closeLocked()
+	if lst.idle == nil {
+		lst.idle = make(chan struct{})
+		if len(lst.active) == 0 {
+			close(lst.idle)
+		}
+	}
+	idle := lst.idle
+	var notify []*Channel
+	if lst.notify {
+		for ch := range lst.active {
+			notify = append(notify, ch)
+		}
+	}
+	lst.mu.Unlock()
+
+	for _, ch := range notify {
+		ch.setStatus(websocket.StatusGoingAway)
+		go ch.c.Close(websocket.StatusGoingAway, "server shutting down")
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-idle:
+		return nil
+	}
+}
 
+// closeLocked implements Close, and returns the channels it closed.
+// The caller must hold lst.mu.
+func (lst *Listener) closeLocked() ([]*Channel, error) {
 	if lst.closed {
-		return ErrListenerClosed
+		return nil, ErrListenerClosed
+	}
+	var closing []*Channel
+	for ch := lst.pop(); ch != nil; ch = lst.pop() {
+		ch.Close()
+		closing = append(closing, ch)
 	}
-	close(lst.inc)
-	var cerr error
-	for ch := range lst.inc {
-		if err := ch.Close(); cerr == nil {
-			cerr = err
+	if lst.closeAll {
+		for ch := range lst.active {
+			ch.closeWith(websocket.StatusGoingAway, "listener closed")
+			closing = append(closing, ch)
 		}
 	}
+	if lst.srv != nil {
+		lst.srv.Close()
+	}
 	lst.closed = true
-	return cerr
+	close(lst.quit)
+	return closing, nil
+}
+
+// statusWriter is an http.ResponseWriter that records the status code of the
+// response written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Hijack supports the websocket upgrade.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// Unwrap supports http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// status returns the status code of the response, or 200 (OK) if none has
+// been written, as the HTTP server would report.
+func (w *statusWriter) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
+
+// admissionKey is the context key for an *admission.
+type admissionKey struct{}
+
+// An admission records per-connection settings assigned by the CheckAccept
+// hook of a Listener while a request is being admitted.
+type admission struct {
+	remote string     // the remote address of the peer
+	client netip.Addr // the IP address of the client, if known
+
+	value    any
+	header   http.Header
+	priority int
+	labels   map[string]string
+
+	seal   *sealer // if not nil, encrypts the messages of the channel
+	macKey []byte  // if not nil, authenticates the messages of the channel
+}
+
+func admissionOf(req *http.Request) *admission {
+	if adm, ok := req.Context().Value(admissionKey{}).(*admission); ok {
+		return adm
+	}
+	return new(admission) // discarded
+}
+
+// SetValue associates v with the connection for req, a request being checked
+// by the CheckAccept hook of a Listener. If the connection is admitted, v can
+// be recovered from the resulting channel by calling its Value method. If req
+// was not delivered by a Listener, SetValue has no effect.
+func SetValue(req *http.Request, v any) { admissionOf(req).value = v }
+
+// SetPriority sets the priority of the connection for req, a request being
+// checked by the CheckAccept hook of a Listener. Pending connections with
+// higher priority are accepted before those with lower priority, regardless
+// of the order in which they arrived. The default priority is 0. If req was
+// not delivered by a Listener, SetPriority has no effect.
+func SetPriority(req *http.Request, p int) { admissionOf(req).priority = p }
+
+// SetLabel attaches a label with the given key and value to the connection
+// for req, a request being checked by the CheckAccept hook of a Listener.
+// Labels identify the connection for monitoring (for example, by tenant,
+// region, or client version), and are reported in its ConnInfo. Setting a
+// label that already exists replaces its value. If req was not delivered by
+// a Listener, SetLabel has no effect.
+func SetLabel(req *http.Request, key, value string) {
+	adm := admissionOf(req)
+	if adm.labels == nil {
+		adm.labels = make(map[string]string)
+	}
+	adm.labels[key] = value
+}
+
+// ResponseHeader returns the HTTP headers to be sent in the upgrade response
+// for req, a request being checked by the CheckAccept hook of a Listener.
+// CheckAccept may modify the returned header to add values specific to this
+// connection. These are sent in addition to the ListenOptions.Header values.
+// If req was not delivered by a Listener, changes to the header are ignored.
+func ResponseHeader(req *http.Request) http.Header {
+	adm := admissionOf(req)
+	if adm.header == nil {
+		adm.header = make(http.Header)
+	}
+	return adm.header
+}
+
+// clientKey returns a string identifying the client address of adm, for use
+// in enforcing per-IP limits.
+func (adm *admission) clientKey() string { return clientKey(adm.client, adm.remote) }
+
+// clientKey returns a string identifying the client address of ci, for use
+// in enforcing per-IP limits.
+func (ci *ConnInfo) clientKey() string { return clientKey(ci.ClientIP, ci.RemoteAddr) }
+
+func clientKey(client netip.Addr, remote string) string {
+	if client.IsValid() {
+		return client.String()
+	}
+	return remoteHost(remote)
+}
+
+// remoteHost returns the host portion of a remote address, or the whole
+// address if it does not have a port.
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// ConnInfo records information about the HTTP request that established a
+// channel on the server side.
+type ConnInfo struct {
+	ID         string               // the unique ID of the channel; see Channel.ID
+	RemoteAddr string               // the remote network address of the peer
+	ClientIP   netip.Addr           // the client IP address (see TrustedProxies)
+	URL        *url.URL             // the request URL
+	Header     http.Header          // the request headers
+	TLS        *tls.ConnectionState // TLS connection state, or nil
+	Queued     time.Time            // when the connection was added to the queue or wrapped
+	Priority   int                  // the priority assigned by SetPriority
+	Labels     map[string]string    // labels assigned by SetLabel, or nil
+}
+
+func newConnInfo(req *http.Request, adm *admission, now time.Time) *ConnInfo {
+	u := *req.URL
+	return &ConnInfo{
+		RemoteAddr: req.RemoteAddr,
+		ClientIP:   adm.client,
+		URL:        &u,
+		Header:     req.Header.Clone(),
+		TLS:        req.TLS,
+		Queued:     now,
+		Priority:   adm.priority,
+		Labels:     adm.labels,
+	}
+}
+
+// A PingPolicy describes how a Listener checks that the peers of its accepted
+// channels are still alive. As with ChannelOptions.KeepAlive, pongs are only
+// processed while a Recv is in progress, so the policy is only effective for
+// channels that are read continuously.
+type PingPolicy struct {
+	// If positive, send a ping to the peer at this interval.
+	Interval time.Duration
+
+	// The maximum time to wait for the peer to respond to a ping. If the peer
+	// does not respond in time, the channel is closed with status
+	// StatusGoingAway. If zero, the default is Interval.
+	Timeout time.Duration
+}
+
+func (p PingPolicy) timeout() time.Duration {
+	if p.Timeout <= 0 {
+		return p.Interval
+	}
+	return p.Timeout
 }
 
 // ListenOptions are settings for a listener. A nil *ListenOptions is ready for
@@ -124,9 +931,99 @@ func (lst *Listener) Close() error {
 type ListenOptions struct {
 	// The maximum number of unaccepted (pending) connections that will be
 	// admitted by the listener. Connections in excess of this will be rejected.
-	// If MaxPending ≤ 0, the default limit is 1.
+	// If MaxPending == 0, the default limit is 1. If MaxPending < 0, the queue
+	// is unbounded and no connections are rejected for lack of space.
 	MaxPending int
 
+	// If greater than 1, the pending queue is divided into this many shards,
+	// each with its own lock, to reduce contention among concurrent Accept
+	// calls under a high rate of connections. Admitted connections are
+	// assigned to shards in rotation, and Accept takes from the shards in
+	// rotation. Priority and arrival order (see SetPriority) are preserved
+	// only within each shard. By default, there is a single queue.
+	QueueShards int
+
+	// If set, this function is called to upgrade each admitted request to a
+	// websocket connection, in place of the default websocket.Accept. This
+	// allows the caller to add instrumentation or to substitute a different
+	// implementation, for example in tests. If the upgrade fails, Upgrade
+	// must write an error response to w and report an error.
+	//
+	// When Upgrade is set, the AllowedOrigins, AllowAllOrigins, and
+	// compression settings are not applied; the caller is responsible for
+	// implementing them if desired.
+	Upgrade func(w http.ResponseWriter, req *http.Request) (*websocket.Conn, error)
+
+	// If set, this function is called when the websocket upgrade fails for a
+	// request that the listener would otherwise have admitted, for example
+	// because the request is not a valid handshake or its origin is not
+	// allowed. The error wraps ErrUpgradeFailed. The response to the client
+	// has already been written when OnUpgradeError is called.
+	OnUpgradeError func(req *http.Request, err error)
+
+	// If true, the listener also admits clients that cannot complete a
+	// websocket handshake, using a fallback transport over plain HTTP
+	// requests to the same URL (see DialOptions.Fallback). The fallback
+	// transports are Server-Sent Events and long polling, with messages from
+	// the client sent as POST requests. Fallback channels are subject to the
+	// same admission checks and limits as websockets, but do not support
+	// ping-based keepalive.
+	Fallback bool
+
+	// If positive, a connection that remains in the pending queue for longer
+	// than this without being accepted is removed from the queue and closed
+	// with status StatusTryAgainLater. By default, pending connections wait
+	// indefinitely.
+	PendingTimeout time.Duration
+
+	// If positive, an accepted channel on which no messages are sent or
+	// received for longer than this is closed with status StatusGoingAway.
+	// By default, accepted channels are never closed for being idle.
+	IdleTimeout time.Duration
+
+	// If set, this function is called for each channel closed by the listener
+	// because it exceeded IdleTimeout, after the channel is closed.
+	OnReap func(*Channel)
+
+	// If set, the listener pings each accepted channel according to this
+	// policy, and closes channels whose peers do not respond. This applies in
+	// addition to any KeepAlive setting in Channel.
+	PingPolicy *PingPolicy
+
+	// The HTTP status code to report when a connection is rejected because the
+	// pending queue is full. If zero, the default is 503 (Service Unavailable).
+	QueueFullStatus int
+
+	// If set, this function is called when a request cannot be admitted
+	// because the pending queue is full, instead of rejecting it. If it
+	// returns true, the listener tries again to admit the request, and calls
+	// OnQueueFull again if the queue is still full. Otherwise, the callback
+	// is responsible for writing a response to w, for example to redirect the
+	// client to another server or to report a custom error.
+	//
+	// To wait for space in the queue, OnQueueFull may block briefly and then
+	// return true. It should not return true without waiting, or the request
+	// will spin until space becomes available.
+	OnQueueFull func(w http.ResponseWriter, req *http.Request) bool
+
+	// If positive, rejections due to the pending queue being full, the active
+	// limit being reached, or the listener being paused include a Retry-After
+	// header advising the client to wait this long before retrying. The value
+	// is rounded up to a whole number of seconds.
+	RetryAfter time.Duration
+
+	// If positive, the maximum number of live channels the listener will
+	// maintain at once, including both pending and accepted channels. When
+	// this limit is reached, further connections are rejected with status 503
+	// (Service Unavailable) until some of the existing channels close.
+	MaxActive int
+
+	// If positive, the maximum number of concurrent connections the listener
+	// will admit from a single client IP address, including both pending and
+	// accepted channels. See also TrustedProxies. Connections in excess of
+	// this are rejected with status 429 (Too Many Requests).
+	MaxConnsPerIP int
+
 	// If set, this function is called on each HTTP request received by the
 	// listener, before attempting to upgrade.
 	//
@@ -135,20 +1032,171 @@ type ListenOptions struct {
 	// is used as the HTTP status code if it is greater than 0; otherwise the
 	// handler reports code 500 (server internal error).
 	//
+	// CheckAccept may call SetValue to attach a value to the connection for
+	// the request, which can be recovered from the accepted channel, may call
+	// SetPriority to move the connection ahead of others in the pending
+	// queue, may call SetLabel to label the connection for monitoring, and
+	// may use ResponseHeader to add headers to the upgrade response.
+	//
 	// If CheckAccept is not set, all requests are upgraded.
 	CheckAccept func(req *http.Request) (int, error)
 
 	// If set, include these HTTP headers when negotiating a connection upgrade.
 	Header http.Header
+
+	// Trusted reverse proxies, given as IP addresses (e.g., "10.0.0.1") or
+	// CIDR prefixes (e.g., "10.0.0.0/8"). When a request arrives from one of
+	// these addresses, the listener determines the client IP address from the
+	// ProxyHeader of the request, skipping any hops that are themselves
+	// trusted proxies. Otherwise, the client IP is the remote address of the
+	// connection, and forwarding headers are ignored. Entries that are not
+	// valid addresses or prefixes are ignored.
+	//
+	// The client IP is reported in ConnInfo and used for per-IP limits.
+	TrustedProxies []string
+
+	// The forwarding header that the trusted proxies set or append to, such
+	// as "Forwarded" (RFC 7239) or "X-Forwarded-For". Only this header is
+	// consulted, since a client may send any of the others to spoof its
+	// address. If empty, X-Forwarded-For is used.
+	ProxyHeader string
+
+	// If set, only requests from clients whose IP address matches one of
+	// these addresses or CIDR prefixes are admitted. Requests from other
+	// clients, or whose client IP cannot be determined, are rejected with
+	// status 403 (Forbidden). Entries that are not valid addresses or
+	// prefixes are ignored; if no entries are valid, all requests are
+	// rejected. The client IP is determined as described for TrustedProxies.
+	AllowCIDRs []string
+
+	// If set, requests from clients whose IP address matches one of these
+	// addresses or CIDR prefixes are rejected with status 403 (Forbidden),
+	// even if they match AllowCIDRs. Entries that are not valid addresses or
+	// prefixes are ignored.
+	DenyCIDRs []string
+
+	// If set, apply these settings to each channel created by the listener.
+	Channel *ChannelOptions
+
+	// If set, require each client to pass an authentication challenge after
+	// its connection is upgraded, before the channel is made available to
+	// Accept. See Challenge.
+	Challenge *Challenge
+
+	// If set, limit the rate at which each channel created by the listener
+	// receives messages from its peer.
+	RateLimit *RateLimit
+
+	// If set, upgrade requests whose Origin header names a host other than
+	// the host of the request itself are admitted only if the origin host
+	// matches one of these patterns. Patterns may be exact host names (e.g.,
+	// "example.com" or "example.com:8080") or wildcards in the syntax of
+	// path.Match (e.g., "*.example.com"), and are matched without regard to
+	// case. By default, only same-origin requests are admitted.
+	AllowedOrigins []string
+
+	// If true, admit upgrade requests from any origin, disabling the origin
+	// check. This allows cross-site websocket requests from any page, and
+	// should only be used if the listener has its own authentication.
+	// If AllowAllOrigins is true, AllowedOrigins is ignored.
+	AllowAllOrigins bool
+
+	// If true, negotiate per-message compression (permessage-deflate) with
+	// clients that support it. Compression state is not retained between
+	// messages, which limits the memory cost per connection.
+	EnableCompression bool
+
+	// If positive and EnableCompression is true, only compress messages that
+	// are at least this many bytes in length. If zero, the default is 512.
+	CompressionThreshold int
+
+	// If set, this function is called for each HTTP request handled by the
+	// listener, once the outcome of the handshake is known, with the HTTP
+	// status of the response. For a connection that was upgraded, the status
+	// is 101 (Switching Protocols) and err == nil. Otherwise, err describes
+	// why the request was not upgraded: A *RejectedError if the listener
+	// refused the request, or an error wrapping ErrUpgradeFailed if the
+	// upgrade failed.
+	LogRequest func(req *http.Request, status int, err error)
+
+	// If set, this function is called with an audit record for each channel
+	// created by the listener, after the channel closes. See AuditLog for a
+	// simple implementation.
+	Audit func(*AuditRecord)
+
+	// If set, log handshakes and rejections to this logger, and the closure
+	// and errors of each channel the listener creates. At debug level, the
+	// size of each message is also logged. Channel events are logged with
+	// the ID and remote address of the channel.
+	Logger *slog.Logger
+
+	// If set, this function is called to write the HTTP response when the
+	// listener rejects a request before upgrading it, with the HTTP status
+	// code and an error describing the reason for the rejection. The concrete
+	// type of the error is *RejectedError. Any headers the listener assigns
+	// (e.g., Retry-After) are already set on w.
+	//
+	// If ErrorWriter is not set, the listener writes a plain-text response
+	// containing the text of the error, as http.Error.
+	ErrorWriter func(w http.ResponseWriter, req *http.Request, code int, err error)
+
+	// The URL path served by the listener in standalone mode (see
+	// ListenAndServe). Patterns ending in "/" match all paths with that
+	// prefix, as for http.ServeMux. If empty, the default is "/".
+	Path string
+
+	// If set, the server in standalone mode also serves the AdminHandler for
+	// the listener at this URL path. The admin handler does not authenticate
+	// its callers, so it should not be exposed on a public address (see
+	// AdminHandler).
+	AdminPath string
+
+	// If set, the server in standalone mode also serves the HealthHandler for
+	// the listener at this URL path (for example, "/healthz").
+	HealthPath string
+
+	// If set, the TLS configuration for the server in standalone mode (see
+	// ListenAndServeTLS). To obtain certificates automatically, see the
+	// wsautocert package.
+	TLSConfig *tls.Config
+
+	// If true, Shutdown sends a close frame with status StatusGoingAway to
+	// each active channel before waiting for them to close.
+	NotifyOnShutdown bool
+
+	// If true, closing the listener also closes all the active channels it
+	// has produced, including those already accepted. By default, channels
+	// returned by Accept remain open until the caller closes them.
+	CloseActive bool
+
+	// If true, ServeHTTP returns as soon as the connection is upgraded and
+	// the channel is enqueued, rather than blocking until the channel closes.
+	// This avoids holding a goroutine for each open channel, but middleware
+	// that wraps the listener, such as a handler that logs or times requests,
+	// observes only the handshake. The listener still releases each channel
+	// when it closes.
+	Detach bool
 }
 
 func (o *ListenOptions) maxPending() int {
-	if o == nil || o.MaxPending <= 0 {
+	if o == nil || o.MaxPending == 0 {
 		return 1
 	}
 	return o.MaxPending
 }
 
+func (o *ListenOptions) queueShards() []*queue {
+	n := 1
+	if o != nil && o.QueueShards > 1 {
+		n = o.QueueShards
+	}
+	shards := make([]*queue, n)
+	for i := range shards {
+		shards[i] = new(queue)
+	}
+	return shards
+}
+
 func (o *ListenOptions) check() func(*http.Request) (int, error) {
 	if o == nil || o.CheckAccept == nil {
 		return func(*http.Request) (int, error) { return 0, nil }
@@ -162,3 +1210,227 @@ func (o *ListenOptions) header() http.Header {
 	}
 	return o.Header
 }
+
+func (o *ListenOptions) fallback() bool { return o != nil && o.Fallback }
+
+// validate reports an error if o combines settings that are not supported
+// together.
+func (o *ListenOptions) validate() error {
+	if o.fallback() {
+		return o.channelOptions().checkFallback()
+	}
+	return nil
+}
+
+func (o *ListenOptions) notifyOnShutdown() bool { return o != nil && o.NotifyOnShutdown }
+
+func (o *ListenOptions) closeActive() bool { return o != nil && o.CloseActive }
+
+func (o *ListenOptions) detach() bool { return o != nil && o.Detach }
+
+func (o *ListenOptions) maxConnsPerIP() int {
+	if o == nil {
+		return 0
+	}
+	return o.MaxConnsPerIP
+}
+
+func (o *ListenOptions) maxActive() int {
+	if o == nil {
+		return 0
+	}
+	return o.MaxActive
+}
+
+func (o *ListenOptions) queueFullStatus() int {
+	if o == nil || o.QueueFullStatus <= 0 {
+		return http.StatusServiceUnavailable
+	}
+	return o.QueueFullStatus
+}
+
+func (o *ListenOptions) retryAfter() string {
+	if o == nil || o.RetryAfter <= 0 {
+		return ""
+	}
+	secs := (o.RetryAfter + time.Second - 1) / time.Second
+	return strconv.Itoa(int(secs))
+}
+
+func (o *ListenOptions) errorWriter() func(http.ResponseWriter, *http.Request, int, error) {
+	if o == nil || o.ErrorWriter == nil {
+		return func(w http.ResponseWriter, _ *http.Request, code int, err error) {
+			http.Error(w, err.Error(), code)
+		}
+	}
+	return o.ErrorWriter
+}
+
+func (o *ListenOptions) upgrader() func(http.ResponseWriter, *http.Request) (*websocket.Conn, error) {
+	if o != nil && o.Upgrade != nil {
+		return o.Upgrade
+	}
+	aopts := o.acceptOptions()
+	return func(w http.ResponseWriter, req *http.Request) (*websocket.Conn, error) {
+		return websocket.Accept(w, req, aopts)
+	}
+}
+
+func (o *ListenOptions) acceptOptions() *websocket.AcceptOptions {
+	if o == nil {
+		return &websocket.AcceptOptions{Subprotocols: []string{Protocol}}
+	}
+	aopts := &websocket.AcceptOptions{
+		OriginPatterns:     o.AllowedOrigins,
+		InsecureSkipVerify: o.AllowAllOrigins,
+		Subprotocols:       []string{Protocol},
+	}
+	if o.EnableCompression {
+		aopts.CompressionMode = websocket.CompressionNoContextTakeover
+		aopts.CompressionThreshold = o.CompressionThreshold
+	}
+	return aopts
+}
+
+func (o *ListenOptions) path() string {
+	if o == nil || o.Path == "" {
+		return "/"
+	}
+	return o.Path
+}
+
+func (o *ListenOptions) adminPath() string {
+	if o == nil {
+		return ""
+	}
+	return o.AdminPath
+}
+
+func (o *ListenOptions) healthPath() string {
+	if o == nil {
+		return ""
+	}
+	return o.HealthPath
+}
+
+func (o *ListenOptions) tlsConfig() *tls.Config {
+	if o == nil || o.TLSConfig == nil {
+		return nil
+	}
+	return o.TLSConfig.Clone()
+}
+
+func (o *ListenOptions) channelOptions() *ChannelOptions {
+	if o == nil {
+		return nil
+	}
+	return o.Channel
+}
+
+func (o *ListenOptions) pendingTimeout() time.Duration {
+	if o == nil {
+		return 0
+	}
+	return o.PendingTimeout
+}
+
+func (o *ListenOptions) idleTimeout() time.Duration {
+	if o == nil {
+		return 0
+	}
+	return o.IdleTimeout
+}
+
+func (o *ListenOptions) onReap() func(*Channel) {
+	if o == nil {
+		return nil
+	}
+	return o.OnReap
+}
+
+func (o *ListenOptions) pingPolicy() PingPolicy {
+	if o == nil || o.PingPolicy == nil {
+		return PingPolicy{}
+	}
+	return *o.PingPolicy
+}
+
+func (o *ListenOptions) logRequest() func(*http.Request, int, error) {
+	if o == nil {
+		return nil
+	}
+	return o.LogRequest
+}
+
+func (o *ListenOptions) logger() *slog.Logger {
+	if o == nil {
+		return nil
+	}
+	return o.Logger
+}
+
+func (o *ListenOptions) audit() func(*AuditRecord) {
+	if o == nil {
+		return nil
+	}
+	return o.Audit
+}
+
+func (o *ListenOptions) challenge() *Challenge {
+	if o == nil {
+		return nil
+	}
+	return o.Challenge
+}
+
+func (o *ListenOptions) rateLimit() *RateLimit {
+	if o == nil {
+		return nil
+	}
+	return o.RateLimit
+}
+
+func (o *ListenOptions) onQueueFull() func(http.ResponseWriter, *http.Request) bool {
+	if o == nil {
+		return nil
+	}
+	return o.OnQueueFull
+}
+
+func (o *ListenOptions) onUpgradeError() func(*http.Request, error) {
+	if o == nil {
+		return nil
+	}
+	return o.OnUpgradeError
+}
+
+func (o *ListenOptions) allowCIDRs() prefixSet {
+	if o == nil || len(o.AllowCIDRs) == 0 {
+		return nil
+	}
+	if ps := parsePrefixes(o.AllowCIDRs); ps != nil {
+		return ps
+	}
+	return prefixSet{} // restrict, but allow nothing
+}
+
+func (o *ListenOptions) denyCIDRs() prefixSet {
+	if o == nil {
+		return nil
+	}
+	return parsePrefixes(o.DenyCIDRs)
+}
+
+func (o *ListenOptions) proxyHeader() string {
+	if o == nil || o.ProxyHeader == "" {
+		return "X-Forwarded-For"
+	}
+	return o.ProxyHeader
+}
+
+func (o *ListenOptions) trustedProxies() prefixSet {
+	if o == nil {
+		return nil
+	}
+	return parsePrefixes(o.TrustedProxies)
+}
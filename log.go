@@ -0,0 +1,56 @@
+package wschannel
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// logHandshake logs the outcome of a handshake for req, which created ch if
+// it is not nil, or otherwise failed with err.
+func (lst *Listener) logHandshake(req *http.Request, ch *Channel, err error) {
+	ctx := req.Context()
+	if ch != nil {
+		ch.log.LogAttrs(ctx, slog.LevelInfo, "websocket connected", slog.String("path", req.URL.Path))
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("remote", req.RemoteAddr),
+		slog.String("path", req.URL.Path),
+		slog.Any("error", err),
+	}
+	var rerr *RejectedError
+	if errors.As(err, &rerr) {
+		attrs = append(attrs, slog.Int("status", rerr.Code))
+		lst.log.LogAttrs(ctx, slog.LevelInfo, "websocket request rejected", attrs...)
+	} else {
+		lst.log.LogAttrs(ctx, slog.LevelWarn, "websocket upgrade failed", attrs...)
+	}
+}
+
+// logAttrs logs an event for c at the given level, if c has a logger.
+func (c *Channel) logAttrs(level slog.Level, msg string, attrs ...slog.Attr) {
+	if c.log != nil {
+		c.log.LogAttrs(context.Background(), level, msg, attrs...)
+	}
+}
+
+// logMessage logs a message of n bytes sent or received on c, at debug level.
+func (c *Channel) logMessage(dir string, n int) {
+	if c.log != nil && c.log.Enabled(context.Background(), slog.LevelDebug) {
+		c.log.LogAttrs(context.Background(), slog.LevelDebug, "websocket message",
+			slog.String("dir", dir), slog.Int("size", n))
+	}
+}
+
+// logErr logs an error reported by Send or Recv on c, unless it reports
+// that the channel closed. It returns err.
+func (c *Channel) logErr(op string, err error) error {
+	if c.log != nil && !errors.Is(err, net.ErrClosed) {
+		c.log.LogAttrs(context.Background(), slog.LevelWarn, "websocket error",
+			slog.String("op", op), slog.Any("error", err))
+	}
+	return err
+}
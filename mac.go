@@ -0,0 +1,157 @@
+package wschannel
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"sync"
+
+	"github.com/coder/websocket"
+)
+
+// ErrBadMAC is reported by Recv when a channel using message authentication
+// receives a message whose authentication code is missing or invalid. The
+// channel is closed with status StatusPolicyViolation.
+var ErrBadMAC = errors.New("message authentication failed")
+
+// MessageAuth configures authentication of the messages of a channel with
+// HMAC-SHA256, to detect messages altered, replayed, reordered, or dropped
+// between the peers, independent of the transport. Each message is sent as a
+// binary message followed by a code computed over the message, its direction,
+// and its position in the stream.
+//
+// Both peers must use the same key. A channel whose peer does not
+// authenticate its messages, or uses a different key, fails on the first
+// message it receives. Message authentication is not supported by channels
+// created with NewServerConn, or by fallback sessions: enabling it together
+// with Fallback is an error (see ErrFallbackOptions).
+type MessageAuth struct {
+	// The key shared by all channels using these settings. It is used if
+	// SessionKey is nil.
+	Key []byte
+
+	// If set, this function returns the key for a channel. For a server, req
+	// is the handshake request, and an error rejects the request with status
+	// 403 (Forbidden); for a client, req is nil, and an error fails the dial.
+	SessionKey func(req *http.Request) ([]byte, error)
+}
+
+func (o *ChannelOptions) messageAuth() *MessageAuth {
+	if o == nil {
+		return nil
+	}
+	return o.MessageAuth
+}
+
+// key returns the key for a channel established by req.
+func (m *MessageAuth) key(req *http.Request) ([]byte, error) {
+	key := m.Key
+	if m.SessionKey != nil {
+		var err error
+		key, err = m.SessionKey(req)
+		if err != nil {
+			return nil, fmt.Errorf("message authentication key: %w", err)
+		}
+	}
+	if len(key) == 0 {
+		return nil, errors.New("message authentication key is empty")
+	}
+	return key, nil
+}
+
+// A macConn wraps a Conn to authenticate its messages.
+type macConn struct {
+	Conn
+
+	wmu  sync.Mutex // serializes writes, to keep them in sequence
+	wmac hash.Hash
+	wdir byte   // the direction of outbound messages
+	wseq uint64 // the sequence number of the next outbound message
+
+	rmac hash.Hash // used only by Read
+	rseq uint64    // the sequence number of the next inbound message
+}
+
+// The directions of messages, included in their codes so that a message
+// cannot be reflected back to its sender.
+const (
+	macToServer byte = 1
+	macToClient byte = 2
+)
+
+func newMACConn(conn Conn, key []byte, server bool) *macConn {
+	dir := macToServer
+	if server {
+		dir = macToClient
+	}
+	return &macConn{
+		Conn: conn,
+		wmac: hmac.New(sha256.New, key),
+		wdir: dir,
+		rmac: hmac.New(sha256.New, key),
+	}
+}
+
+// macSum returns the code for a message in the given direction and position.
+func macSum(h hash.Hash, dir byte, seq uint64, msg []byte) []byte {
+	var hdr [9]byte
+	hdr[0] = dir
+	binary.BigEndian.PutUint64(hdr[1:], seq)
+	h.Reset()
+	h.Write(hdr[:])
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// Read implements part of the Conn interface.
+func (c *macConn) Read(ctx context.Context) (websocket.MessageType, []byte, error) {
+	typ, data, err := c.Conn.Read(ctx)
+	if err != nil {
+		return typ, data, err
+	}
+	if len(data) < sha256.Size {
+		return 0, nil, ErrBadMAC
+	}
+	msg, tag := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if !hmac.Equal(tag, macSum(c.rmac, macToServer+macToClient-c.wdir, c.rseq, msg)) {
+		return 0, nil, ErrBadMAC
+	}
+	c.rseq++
+	return typ, msg, nil
+}
+
+// Write implements part of the Conn interface.
+func (c *macConn) Write(ctx context.Context, _ websocket.MessageType, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	buf := append(data[:len(data):len(data)], macSum(c.wmac, c.wdir, c.wseq, data)...)
+	if err := c.Conn.Write(ctx, websocket.MessageBinary, buf); err != nil {
+		return err
+	}
+	c.wseq++
+	return nil
+}
+
+// Ping forwards to the underlying connection, if it supports pings.
+func (c *macConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// SetReadLimit forwards to the underlying connection, if it has a limit.
+// The limit includes the authentication code of each message.
+func (c *macConn) SetReadLimit(n int64) {
+	if rl, ok := c.Conn.(readLimiter); ok {
+		rl.SetReadLimit(n)
+	}
+}
+
+// Subprotocol reports the subprotocol of the underlying connection.
+func (c *macConn) Subprotocol() string { return subprotocol(c.Conn) }
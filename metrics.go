@@ -0,0 +1,113 @@
+package wschannel
+
+import (
+	"slices"
+	"sync/atomic"
+)
+
+// Metrics is a snapshot of cumulative counters maintained by a Listener.
+type Metrics struct {
+	Upgraded      int64 // connections successfully upgraded to websockets
+	Accepted      int64 // channels returned by Accept
+	Filtered      int64 // pending channels discarded by AcceptFunc
+	Expired       int64 // pending channels discarded by PendingTimeout
+	Reaped        int64 // accepted channels closed by IdleTimeout
+	Rejected      int64 // requests rejected by the CheckAccept hook
+	Denied        int64 // requests rejected by AllowCIDRs or DenyCIDRs
+	QueueFull     int64 // requests rejected because the queue was full
+	IPLimited     int64 // requests rejected by the per-IP connection limit
+	ActiveLimited int64 // requests rejected by the active connection limit
+	Paused        int64 // requests rejected while the listener was paused
+	UpgradeFailed int64 // requests for which the websocket upgrade failed
+	AuthFailed    int64 // connections that failed the authentication challenge
+}
+
+// listenerMetrics are the live counters underlying a Metrics value.
+type listenerMetrics struct {
+	upgraded, accepted, filtered, expired, reaped, rejected, denied, queueFull, ipLimited, activeLimited, paused, upgradeFailed, authFailed atomic.Int64
+}
+
+func (m *listenerMetrics) snapshot() Metrics {
+	return Metrics{
+		Upgraded:      m.upgraded.Load(),
+		Accepted:      m.accepted.Load(),
+		Filtered:      m.filtered.Load(),
+		Expired:       m.expired.Load(),
+		Reaped:        m.reaped.Load(),
+		Rejected:      m.rejected.Load(),
+		Denied:        m.denied.Load(),
+		QueueFull:     m.queueFull.Load(),
+		IPLimited:     m.ipLimited.Load(),
+		ActiveLimited: m.activeLimited.Load(),
+		Paused:        m.paused.Load(),
+		UpgradeFailed: m.upgradeFailed.Load(),
+		AuthFailed:    m.authFailed.Load(),
+	}
+}
+
+// Metrics returns a snapshot of the current metrics for lst.
+func (lst *Listener) Metrics() Metrics { return lst.stats.snapshot() }
+
+// Pending returns the number of channels admitted by lst that have not yet
+// been accepted.
+func (lst *Listener) Pending() int {
+	return int(lst.npending.Load())
+}
+
+// Active returns the number of live channels produced by lst that have not
+// yet closed, including those that are pending.
+func (lst *Listener) Active() int {
+	lst.mu.Lock()
+	defer lst.mu.Unlock()
+	return len(lst.active)
+}
+
+// Channels returns a snapshot of the live channels produced by lst that have
+// not yet closed, including those that are pending, in the order they were
+// admitted. Each channel's Info method reports its connection details.
+func (lst *Listener) Channels() []*Channel {
+	lst.mu.Lock()
+	chs := make([]*Channel, 0, len(lst.active))
+	for ch := range lst.active {
+		chs = append(chs, ch)
+	}
+	lst.mu.Unlock()
+	slices.SortFunc(chs, func(a, b *Channel) int {
+		return a.info.Queued.Compare(b.info.Queued)
+	})
+	return chs
+}
+
+// ChannelStats are cumulative counters for the messages exchanged on a
+// channel.
+type ChannelStats struct {
+	MessagesSent     int64 // messages successfully sent
+	MessagesReceived int64 // messages received
+	BytesSent        int64 // total payload bytes sent
+	BytesReceived    int64 // total payload bytes received
+}
+
+// channelStats are the live counters underlying a ChannelStats value.
+type channelStats struct {
+	msgSent, msgRcvd, bytesSent, bytesRcvd atomic.Int64
+}
+
+func (s *channelStats) sent(n int) {
+	s.msgSent.Add(1)
+	s.bytesSent.Add(int64(n))
+}
+
+func (s *channelStats) received(n int) {
+	s.msgRcvd.Add(1)
+	s.bytesRcvd.Add(int64(n))
+}
+
+// Stats returns a snapshot of the message counters for c.
+func (c *Channel) Stats() ChannelStats {
+	return ChannelStats{
+		MessagesSent:     c.stats.msgSent.Load(),
+		MessagesReceived: c.stats.msgRcvd.Load(),
+		BytesSent:        c.stats.bytesSent.Load(),
+		BytesReceived:    c.stats.bytesRcvd.Load(),
+	}
+}
@@ -0,0 +1,62 @@
+package wschannel
+
+import (
+	"net/http"
+	"sync"
+)
+
+// A Mux is an http.Handler that routes requests to a collection of Listeners
+// by URL path, so that a single HTTP server can serve several independent
+// accept queues with different settings. A zero Mux is ready for use, but
+// must not be copied after first use.
+type Mux struct {
+	mux http.ServeMux
+
+	mu  sync.Mutex
+	lst map[string]*Listener
+}
+
+// Listen creates a new Listener with the given options, and registers it to
+// serve requests matching pattern. Patterns have the same syntax as for
+// http.ServeMux. It panics if pattern is already registered or invalid.
+func (m *Mux) Listen(pattern string, opts *ListenOptions) *Listener {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.lst[pattern]; ok {
+		panic("wschannel: multiple listeners for pattern " + pattern)
+	}
+	lst := NewListener(opts)
+	m.mux.Handle(pattern, lst)
+	if m.lst == nil {
+		m.lst = make(map[string]*Listener)
+	}
+	m.lst[pattern] = lst
+	return lst
+}
+
+// Listener returns the listener registered for pattern, or nil if there is
+// no such listener.
+func (m *Mux) Listener(pattern string) *Listener {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lst[pattern]
+}
+
+// ServeHTTP implements the http.Handler interface by delegating req to the
+// listener whose pattern matches the request. If no pattern matches, it
+// responds with 404 (Not Found).
+func (m *Mux) ServeHTTP(w http.ResponseWriter, req *http.Request) { m.mux.ServeHTTP(w, req) }
+
+// Close closes all the listeners registered with m. It returns the first
+// error reported by any of the listeners, other than ErrListenerClosed.
+func (m *Mux) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var cerr error
+	for _, lst := range m.lst {
+		if err := lst.Close(); err != nil && err != ErrListenerClosed && cerr == nil {
+			cerr = err
+		}
+	}
+	return cerr
+}
@@ -0,0 +1,41 @@
+package wschannel
+
+import (
+	"context"
+	"maps"
+	"runtime/pprof"
+	"slices"
+)
+
+// ProfileLabels returns the pprof labels that identify c in CPU and goroutine
+// profiles:
+//
+//	wschannel.id          the ID of c (see Channel.ID)
+//	wschannel.remote      the remote address, if c was created by a Listener
+//	wschannel.label.NAME  the value of each label assigned by SetLabel
+//
+// The goroutines a Listener runs for c, including those started by Serve,
+// carry these labels. Use Do to apply them to other goroutines.
+func (c *Channel) ProfileLabels() pprof.LabelSet {
+	args := []string{"wschannel.id", c.id}
+	if c.info != nil {
+		args = append(args, "wschannel.remote", c.info.RemoteAddr)
+		for _, name := range slices.Sorted(maps.Keys(c.info.Labels)) {
+			args = append(args, "wschannel.label."+name, c.info.Labels[name])
+		}
+	}
+	return pprof.Labels(args...)
+}
+
+// Do calls f with a context derived from ctx that carries the profile labels
+// of c, and applies those labels to the calling goroutine while f runs, as
+// pprof.Do. Goroutines started by f, such as those of a jrpc2 server serving
+// c, inherit the labels.
+func (c *Channel) Do(ctx context.Context, f func(context.Context)) {
+	pprof.Do(ctx, c.ProfileLabels(), f)
+}
+
+// goLabeled runs f in a new goroutine with the profile labels of c.
+func (c *Channel) goLabeled(f func()) {
+	go c.Do(context.Background(), func(context.Context) { f() })
+}
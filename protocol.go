@@ -0,0 +1,114 @@
+package wschannel
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Protocol is the websocket subprotocol offered by Dial and selected by a
+// Listener. Within it, the peers negotiate optional capabilities: the client
+// lists the capabilities it supports in the CapabilitiesHeader of its
+// handshake request, and the server responds with those it also supports.
+// A channel whose peer does not select Protocol has no capabilities.
+const Protocol = "jrpc2.v1"
+
+// CapabilitiesHeader is the HTTP header used to negotiate capabilities
+// during the websocket handshake. Its value is a comma-separated list of
+// capability names.
+const CapabilitiesHeader = "Wschannel-Capabilities"
+
+// The capabilities defined by this package. Names beginning with "x-" are
+// reserved for extensions defined by applications (see
+// ChannelOptions.Capabilities).
+const (
+	// Batch framing, in which each websocket message carries one or more
+	// channel messages, each prefixed by its length in bytes as a uvarint.
+	// See ChannelOptions.Batch and Channel.SendBatch.
+	CapBatch = "batch"
+)
+
+// capabilities returns the sorted capabilities offered or accepted for
+// channels with these options.
+func (o *ChannelOptions) capabilities() []string {
+	if o == nil {
+		return nil
+	}
+	caps := slices.Clone(o.Capabilities)
+	if o.Batch {
+		caps = append(caps, CapBatch)
+	}
+	slices.Sort(caps)
+	return slices.Compact(caps)
+}
+
+// negotiate returns the capabilities listed in h that are also in supported.
+func negotiate(h http.Header, supported []string) []string {
+	var caps []string
+	for _, c := range headerTokens(h, CapabilitiesHeader) {
+		if slices.Contains(supported, c) && !slices.Contains(caps, c) {
+			caps = append(caps, c)
+		}
+	}
+	slices.Sort(caps)
+	return caps
+}
+
+// acceptCapabilities negotiates the capabilities for a server channel with
+// these options from req, and reports them in the response headers of w.
+// It returns nil if req does not offer Protocol.
+func (o *ChannelOptions) acceptCapabilities(w http.ResponseWriter, req *http.Request) []string {
+	if !slices.Contains(headerTokens(req.Header, "Sec-WebSocket-Protocol"), Protocol) {
+		return nil
+	}
+	caps := negotiate(req.Header, o.capabilities())
+	if len(caps) != 0 {
+		w.Header().Set(CapabilitiesHeader, strings.Join(caps, ", "))
+	}
+	return caps
+}
+
+// headerTokens returns the comma-separated values of the header key in h.
+func headerTokens(h http.Header, key string) []string {
+	var out []string
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				out = append(out, t)
+			}
+		}
+	}
+	return out
+}
+
+// subprotocol returns the websocket subprotocol selected for conn, if any.
+func subprotocol(conn Conn) string {
+	if sp, ok := conn.(interface{ Subprotocol() string }); ok {
+		return sp.Subprotocol()
+	}
+	return ""
+}
+
+// setCapabilities records caps as the negotiated capabilities of c, if c
+// uses Protocol.
+func (c *Channel) setCapabilities(caps []string) {
+	if c.proto == Protocol {
+		c.caps = caps
+		c.batch = slices.Contains(caps, CapBatch)
+	}
+}
+
+// Protocol returns the websocket subprotocol selected for c, or "" if none
+// was selected.
+func (c *Channel) Protocol() string { return c.proto }
+
+// Capabilities returns the set of capabilities negotiated for c. It is empty
+// unless c uses Protocol. The capabilities of a channel created by
+// NewServerConn are always empty.
+func (c *Channel) Capabilities() map[string]bool {
+	m := make(map[string]bool, len(c.caps))
+	for _, name := range c.caps {
+		m[name] = true
+	}
+	return m
+}
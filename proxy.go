@@ -0,0 +1,102 @@
+package wschannel
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// prefixSet is a set of IP address prefixes, such as trusted proxy addresses.
+type prefixSet []netip.Prefix
+
+// parsePrefixes parses a list of IP addresses and CIDR prefixes. Entries that
+// cannot be parsed are ignored.
+func parsePrefixes(ss []string) prefixSet {
+	var ps prefixSet
+	for _, s := range ss {
+		if p, err := netip.ParsePrefix(s); err == nil {
+			ps = append(ps, p.Masked())
+		} else if a, err := netip.ParseAddr(s); err == nil {
+			ps = append(ps, netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()))
+		}
+	}
+	return ps
+}
+
+// contains reports whether addr is in one of the prefixes of ps.
+func (ps prefixSet) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range ps {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client that originated req. If the
+// immediate peer is a trusted proxy, the forwarding header key of the request
+// is consulted, from the nearest hop outward, and the first address that is
+// not a trusted proxy is returned. If no valid address can be found, clientIP
+// returns the zero Addr.
+func (ps prefixSet) clientIP(req *http.Request, key string) netip.Addr {
+	addr := parseHostAddr(req.RemoteAddr)
+	if !addr.IsValid() || !ps.contains(addr) {
+		return addr
+	}
+	hops := forwardedFor(req.Header, key)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHostAddr(hops[i])
+		if !hop.IsValid() {
+			break // malformed or obfuscated; stop at the last good address
+		}
+		addr = hop
+		if !ps.contains(hop) {
+			break
+		}
+	}
+	return addr
+}
+
+// forwardedFor returns the list of client addresses recorded by proxies in
+// the header key of h, in order from the original client to the nearest
+// proxy. A Forwarded header is parsed as defined by RFC 7239; any other
+// header is treated as a comma-separated list of addresses, as for
+// X-Forwarded-For.
+func forwardedFor(h http.Header, key string) []string {
+	var hops []string
+	if !strings.EqualFold(key, "Forwarded") {
+		for _, line := range h.Values(key) {
+			for _, hop := range strings.Split(line, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+		return hops
+	}
+	for _, line := range h.Values(key) {
+		for _, elt := range strings.Split(line, ",") {
+			for _, pair := range strings.Split(elt, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, strings.Trim(val, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseHostAddr parses an IP address with an optional port, and IPv6
+// addresses with optional brackets. It returns the zero Addr if s is not a
+// valid address.
+func parseHostAddr(s string) netip.Addr {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	a, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return a.Unmap()
+}
@@ -0,0 +1,75 @@
+package wschannel
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// A queue is one shard of the pending queue of a Listener. Each shard has its
+// own lock, so that concurrent Accept calls contend only when they take from
+// the same shard.
+type queue struct {
+	mu    sync.Mutex
+	items []*Channel // ordered by descending priority, then by arrival
+}
+
+// push adds ch to q.
+func (q *queue) push(ch *Channel) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := len(q.items)
+	for i > 0 && q.items[i-1].info.Priority < ch.info.Priority {
+		i--
+	}
+	q.items = slices.Insert(q.items, i, ch)
+}
+
+// pop removes and returns the first channel in q, or returns nil if q is
+// empty.
+func (q *queue) pop() *Channel {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return nil
+	}
+	ch := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	return ch
+}
+
+// remove removes ch from q, and reports whether it was present.
+func (q *queue) remove(ch *Channel) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := slices.Index(q.items, ch)
+	if i >= 0 {
+		q.items = slices.Delete(q.items, i, i+1)
+	}
+	return i >= 0
+}
+
+// A signal wakes goroutines waiting for the state of a queue to change,
+// without requiring a lock.
+type signal struct {
+	p atomic.Pointer[chan struct{}]
+}
+
+func newSignal() *signal {
+	s := new(signal)
+	ch := make(chan struct{})
+	s.p.Store(&ch)
+	return s
+}
+
+// wait returns a channel that is closed at the next call to notify. To avoid
+// missing a notification, the caller must call wait before checking the
+// condition it is waiting for.
+func (s *signal) wait() <-chan struct{} { return *s.p.Load() }
+
+// notify wakes all the goroutines currently waiting on s.
+func (s *signal) notify() {
+	next := make(chan struct{})
+	close(*s.p.Swap(&next))
+}
@@ -0,0 +1,96 @@
+package wschannel
+
+import (
+	"sync"
+	"time"
+)
+
+// A RateLimit bounds the rate at which a channel accepts inbound messages,
+// using a token bucket for the number of messages and for their total size.
+// A zero rate imposes no limit on the corresponding dimension. Each message of
+// a batch (see CapBatch) counts separately.
+type RateLimit struct {
+	// If positive, the sustained number of messages per second.
+	Messages float64
+
+	// The maximum number of messages that may arrive in a burst above the
+	// sustained rate. If zero, the default is Messages (one second's worth),
+	// but at least 1.
+	MessageBurst int
+
+	// If positive, the sustained number of payload bytes per second.
+	Bytes float64
+
+	// The maximum number of bytes that may arrive in a burst above the
+	// sustained rate. If zero, the default is Bytes (one second's worth), but
+	// at least 1. A message larger than the burst always exceeds the limit.
+	ByteBurst int
+
+	// If true, Recv delays returning a message that exceeds the limit until
+	// the sender is back within it, applying backpressure to the peer.
+	// Otherwise, a message that exceeds the limit causes the channel to be
+	// closed with status StatusPolicyViolation, and Recv reports
+	// ErrRateLimited.
+	Delay bool
+}
+
+// newLimiter returns a limiter for r, or nil if r does not impose a limit.
+func (r *RateLimit) newLimiter(now time.Time) *limiter {
+	if r == nil || (r.Messages <= 0 && r.Bytes <= 0) {
+		return nil
+	}
+	return &limiter{
+		msgs:  newBucket(r.Messages, r.MessageBurst, now),
+		bytes: newBucket(r.Bytes, r.ByteBurst, now),
+		delay: r.Delay,
+	}
+}
+
+// A limiter enforces a RateLimit for a single channel.
+type limiter struct {
+	mu    sync.Mutex
+	msgs  bucket
+	bytes bucket
+	delay bool
+}
+
+// reserve accounts for the arrival of a message of n bytes at time now, and
+// returns how long the receiver must wait before the message is within the
+// limit, or 0 if it is within the limit already.
+func (lim *limiter) reserve(now time.Time, n int) time.Duration {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	return max(lim.msgs.take(now, 1), lim.bytes.take(now, float64(n)))
+}
+
+// A bucket is a token bucket replenished at a fixed rate.
+type bucket struct {
+	rate   float64 // tokens per second; if ≤ 0, the bucket is unlimited
+	burst  float64 // maximum tokens
+	tokens float64 // current tokens; negative if overdrawn
+	last   time.Time
+}
+
+func newBucket(rate float64, burst int, now time.Time) bucket {
+	b := bucket{rate: rate, burst: float64(burst), last: now}
+	if b.burst <= 0 {
+		b.burst = max(rate, 1) // admit at least one message before limiting
+	}
+	b.tokens = b.burst
+	return b
+}
+
+// take removes n tokens from b, and returns how long until b will no longer
+// be overdrawn, or 0 if it was not overdrawn.
+func (b *bucket) take(now time.Time, n float64) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
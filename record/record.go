@@ -0,0 +1,200 @@
+// Package record implements a channel wrapper that records the messages it
+// sends and receives, for debugging and for building regression fixtures,
+// and a channel that replays a recording to reproduce a captured session.
+//
+// # Format
+//
+// A recording is a sequence of records, one per message. The Writer sink
+// encodes each record as a JSON object on a line by itself:
+//
+//	{"time":"2024-05-01T12:00:00.123456789Z","dir":"send","data":"eyJqc29ucnBjIjoiMi4wIn0="}
+//
+// The fields are:
+//
+//   - time: when the message was sent or received, in RFC 3339 format
+//   - dir: "send" for a message sent by the recorded channel, or "recv" for a
+//     message it received
+//   - data: the message payload, base64-encoded
+//
+// Records are written in the order they were observed. Use Read to decode a
+// recording in this format.
+package record
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/creachadair/jrpc2/channel"
+	"github.com/creachadair/wschannel"
+)
+
+// A Direction indicates whether a message was sent or received.
+type Direction string
+
+// The directions of a recorded message.
+const (
+	Send Direction = "send" // sent by the recorded channel
+	Recv Direction = "recv" // received by the recorded channel
+)
+
+// A Record describes a single message.
+type Record struct {
+	Time time.Time `json:"time"`
+	Dir  Direction `json:"dir"`
+	Data []byte    `json:"data"`
+}
+
+// A Sink receives the records of a Channel. Its Write method must be safe
+// for concurrent use, and must not retain the record data after it returns.
+type Sink interface {
+	Write(Record) error
+}
+
+// Options are settings for a Channel. A nil *Options is ready for use and
+// provides default values as described.
+type Options struct {
+	// If set, the clock used to timestamp records. If nil,
+	// wschannel.SystemClock is used.
+	Clock wschannel.Clock
+
+	// If set, this function is called for each error reported by the sink.
+	// Sink errors do not interrupt the traffic on the channel. The first one
+	// is also reported by the Err method of the channel.
+	OnError func(error)
+}
+
+func (o *Options) clock() wschannel.Clock {
+	if o == nil || o.Clock == nil {
+		return wschannel.SystemClock
+	}
+	return o.Clock
+}
+
+func (o *Options) onError() func(error) {
+	if o == nil {
+		return nil
+	}
+	return o.OnError
+}
+
+// A Channel wraps a channel.Channel to record the messages it sends and
+// receives to a Sink.
+type Channel struct {
+	ch      channel.Channel
+	sink    Sink
+	clock   wschannel.Clock
+	onError func(error)
+
+	mu  sync.Mutex
+	err error // the first error reported by sink
+}
+
+// New returns a channel that wraps ch and records its messages to sink.
+// The Channel takes ownership of ch.
+func New(ch channel.Channel, sink Sink, opts *Options) *Channel {
+	return &Channel{ch: ch, sink: sink, clock: opts.clock(), onError: opts.onError()}
+}
+
+// Send implements the corresponding method of the Channel interface.
+// The message is recorded before it is sent, so that a reply to it cannot be
+// recorded first.
+func (c *Channel) Send(data []byte) error {
+	c.record(Send, data)
+	return c.ch.Send(data)
+}
+
+// Recv implements the corresponding method of the Channel interface.
+func (c *Channel) Recv() ([]byte, error) {
+	data, err := c.ch.Recv()
+	if err == nil {
+		c.record(Recv, data)
+	}
+	return data, err
+}
+
+// Close implements the corresponding method of the Channel interface.
+func (c *Channel) Close() error { return c.ch.Close() }
+
+// Err returns the first error reported by the sink, or nil.
+func (c *Channel) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Channel) record(dir Direction, data []byte) {
+	err := c.sink.Write(Record{Time: c.clock.Now(), Dir: dir, Data: data})
+	if err == nil {
+		return
+	}
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	if c.onError != nil {
+		c.onError(err)
+	}
+}
+
+// A Writer is a Sink that writes records to an io.Writer in the format
+// described in the package documentation, such as a file.
+type Writer struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewWriter constructs a Writer that writes records to w. The caller is
+// responsible for closing w, if necessary, after the recorded channel is
+// closed.
+func NewWriter(w io.Writer) *Writer { return &Writer{enc: json.NewEncoder(w)} }
+
+// Write implements the Sink interface.
+func (w *Writer) Write(r Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.enc.Encode(r)
+}
+
+// A Buffer is a Sink that retains records in memory. A zero Buffer is ready
+// for use.
+type Buffer struct {
+	mu      sync.Mutex
+	records []Record
+}
+
+// Write implements the Sink interface.
+func (b *Buffer) Write(r Record) error {
+	r.Data = append([]byte(nil), r.Data...)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.records = append(b.records, r)
+	return nil
+}
+
+// Records returns a copy of the records in b, in the order they were written.
+func (b *Buffer) Records() []Record {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Record(nil), b.records...)
+}
+
+// Read decodes a recording in the format written by a Writer from r.
+func Read(r io.Reader) ([]Record, error) {
+	var out []Record
+	dec := json.NewDecoder(r)
+	for {
+		var rec Record
+		if err := dec.Decode(&rec); err == io.EOF {
+			return out, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("record %d: %w", len(out)+1, err)
+		} else if rec.Dir != Send && rec.Dir != Recv {
+			return nil, fmt.Errorf("record %d: invalid direction %q", len(out)+1, rec.Dir)
+		}
+		out = append(out, rec)
+	}
+}
@@ -0,0 +1,218 @@
+package record_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/jrpc2/channel"
+	"github.com/creachadair/jrpc2/handler"
+	"github.com/creachadair/wschannel/record"
+	"github.com/creachadair/wschannel/wschanneltest"
+)
+
+var (
+	_ channel.Channel = (*record.Channel)(nil)
+	_ channel.Channel = (*record.Replay)(nil)
+)
+
+func TestChannel(t *testing.T) {
+	clk := wschanneltest.NewFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	start := clk.Now()
+	cli, srv := wschanneltest.Pipe()
+	defer srv.Close()
+
+	var buf record.Buffer
+	var out bytes.Buffer
+	c := record.New(cli, multiSink{&buf, record.NewWriter(&out)}, &record.Options{Clock: clk})
+	defer c.Close()
+
+	if err := c.Send([]byte("request")); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+	if _, err := srv.Recv(); err != nil {
+		t.Fatalf("Server Recv: unexpected error: %v", err)
+	}
+	clk.Advance(time.Second)
+	if err := srv.Send([]byte("reply")); err != nil {
+		t.Fatalf("Server Send: unexpected error: %v", err)
+	}
+	if got, err := c.Recv(); err != nil || string(got) != "reply" {
+		t.Fatalf("Recv: got (%q, %v), want (reply, nil)", got, err)
+	}
+
+	want := []record.Record{
+		{Time: start, Dir: record.Send, Data: []byte("request")},
+		{Time: start.Add(time.Second), Dir: record.Recv, Data: []byte("reply")},
+	}
+	if got := buf.Records(); !equalRecords(got, want) {
+		t.Errorf("Buffer records: got %+v, want %+v", got, want)
+	}
+
+	// The file format round-trips through Read.
+	const wantText = `{"time":"2024-05-01T12:00:00Z","dir":"send","data":"cmVxdWVzdA=="}
+{"time":"2024-05-01T12:00:01Z","dir":"recv","data":"cmVwbHk="}
+`
+	if got := out.String(); got != wantText {
+		t.Errorf("Writer output:\ngot:\n%s\nwant:\n%s", got, wantText)
+	}
+	got, err := record.Read(strings.NewReader(out.String()))
+	if err != nil {
+		t.Fatalf("Read: unexpected error: %v", err)
+	}
+	if !equalRecords(got, want) {
+		t.Errorf("Read records: got %+v, want %+v", got, want)
+	}
+	if _, err := record.Read(strings.NewReader(`{"dir":"sideways"}`)); err == nil {
+		t.Error("Read with invalid direction: got nil error, want failure")
+	}
+
+	// Sink errors are reported, but do not interrupt traffic.
+	bad := errors.New("sink failed")
+	var reported []error
+	f := record.New(srv, failSink{bad}, &record.Options{
+		OnError: func(err error) { reported = append(reported, err) },
+	})
+	if err := f.Send([]byte("more")); err != nil {
+		t.Errorf("Send with failing sink: unexpected error: %v", err)
+	}
+	if err := f.Err(); err != bad {
+		t.Errorf("Err: got %v, want %v", err, bad)
+	}
+	if len(reported) != 1 || reported[0] != bad {
+		t.Errorf("OnError: got %v, want [%v]", reported, bad)
+	}
+}
+
+func equalRecords(a, b []record.Record) bool {
+	return slices.EqualFunc(a, b, func(x, y record.Record) bool {
+		return x.Time.Equal(y.Time) && x.Dir == y.Dir && bytes.Equal(x.Data, y.Data)
+	})
+}
+
+type multiSink []record.Sink
+
+func (m multiSink) Write(r record.Record) error {
+	for _, s := range m {
+		if err := s.Write(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type failSink struct{ err error }
+
+func (f failSink) Write(record.Record) error { return f.err }
+
+func TestReplay(t *testing.T) {
+	// Record a session between a jrpc2 client and server.
+	c, s := wschanneltest.Pipe()
+	srv := jrpc2.NewServer(handler.Map{
+		"Add": handler.New(func(_ context.Context, vs []int) int {
+			sum := 0
+			for _, v := range vs {
+				sum += v
+			}
+			return sum
+		}),
+	}, nil).Start(s)
+	var buf record.Buffer
+	cli := jrpc2.NewClient(record.New(c, &buf, nil), nil)
+	call := func(cli *jrpc2.Client, vs ...int) (int, error) {
+		var got int
+		err := cli.CallResult(context.Background(), "Add", vs, &got)
+		return got, err
+	}
+	for _, vs := range [][]int{{1, 2}, {3, 4, 5}} {
+		if _, err := call(cli, vs...); err != nil {
+			t.Fatalf("Call %v: unexpected error: %v", vs, err)
+		}
+	}
+	cli.Close()
+	srv.Stop()
+	recs := buf.Records()
+
+	t.Run("Match", func(t *testing.T) {
+		r := record.NewReplay(recs, nil)
+		cli := jrpc2.NewClient(r, nil)
+		defer cli.Close()
+		for _, tc := range []struct {
+			vs   []int
+			want int
+		}{{[]int{1, 2}, 3}, {[]int{3, 4, 5}, 12}} {
+			if got, err := call(cli, tc.vs...); err != nil || got != tc.want {
+				t.Errorf("Call %v: got (%d, %v), want (%d, nil)", tc.vs, got, err, tc.want)
+			}
+		}
+		if err := r.Verify(); err != nil {
+			t.Errorf("Verify: unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		r := record.NewReplay(recs, nil)
+		defer r.Close()
+		var merr *record.MismatchError
+		if err := r.Send([]byte(`{"wrong"}`)); !errors.As(err, &merr) || merr.Index != 0 {
+			t.Errorf("Send: got %v, want mismatch at record 0", err)
+		}
+		if err := r.Verify(); !errors.As(err, &merr) {
+			t.Errorf("Verify: got %v, want mismatch", err)
+		}
+	})
+
+	t.Run("Incomplete", func(t *testing.T) {
+		r := record.NewReplay(recs, nil)
+		defer r.Close()
+		if err := r.Verify(); err == nil {
+			t.Error("Verify: got nil error, want failure")
+		}
+	})
+
+	t.Run("Timing", func(t *testing.T) {
+		clk := wschanneltest.NewFakeClock(time.Now())
+		start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		r := record.NewReplay([]record.Record{
+			{Time: start, Dir: record.Send, Data: []byte("ping")},
+			{Time: start.Add(10 * time.Second), Dir: record.Recv, Data: []byte("pong")},
+		}, &record.ReplayOptions{Speed: 2, Clock: clk})
+		defer r.Close()
+
+		if err := r.Send([]byte("ping")); err != nil {
+			t.Fatalf("Send: unexpected error: %v", err)
+		}
+		got := make(chan string, 1)
+		go func() {
+			msg, _ := r.Recv()
+			got <- string(msg)
+		}()
+		// Wait for Recv to schedule its delivery, then advance past it.
+		for clk.Timers() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clk.Advance(4 * time.Second)
+		select {
+		case msg := <-got:
+			t.Fatalf("Recv: got %q before the scheduled time", msg)
+		default:
+		}
+		clk.Advance(time.Second)
+		if msg := <-got; msg != "pong" {
+			t.Errorf("Recv: got %q, want pong", msg)
+		}
+		if err := r.Verify(); err != nil {
+			t.Errorf("Verify: unexpected error: %v", err)
+		}
+		r.Close()
+		if msg, err := r.Recv(); err != net.ErrClosed {
+			t.Errorf("Recv after Close: got (%q, %v), want %v", msg, err, net.ErrClosed)
+		}
+	})
+}
@@ -0,0 +1,233 @@
+package record
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/creachadair/wschannel"
+)
+
+// ReplayOptions are settings for a Replay. A nil *ReplayOptions is ready for
+// use and provides default values as described.
+type ReplayOptions struct {
+	// If positive, reproduce the intervals between records, scaled by this
+	// factor: 1 replays in real time, 2 twice as fast, and so on. If zero,
+	// inbound messages are delivered as soon as their turn comes.
+	Speed float64
+
+	// If set, the clock used to schedule inbound messages when Speed is
+	// positive. If nil, wschannel.SystemClock is used.
+	Clock wschannel.Clock
+
+	// If set, this function reports whether a sent message got matches the
+	// recorded message want. If nil, messages must be byte-for-byte equal.
+	Equal func(want, got []byte) bool
+}
+
+func (o *ReplayOptions) speed() float64 {
+	if o == nil {
+		return 0
+	}
+	return o.Speed
+}
+
+func (o *ReplayOptions) clock() wschannel.Clock {
+	if o == nil || o.Clock == nil {
+		return wschannel.SystemClock
+	}
+	return o.Clock
+}
+
+func (o *ReplayOptions) equal() func(want, got []byte) bool {
+	if o == nil || o.Equal == nil {
+		return bytes.Equal
+	}
+	return o.Equal
+}
+
+// A MismatchError reports a message sent to a Replay that does not match the
+// recording.
+type MismatchError struct {
+	Index int    // the index of the expected record, or -1 if none remained
+	Want  []byte // the recorded message, or nil if none remained
+	Got   []byte // the message sent
+}
+
+func (e *MismatchError) Error() string {
+	if e.Index < 0 {
+		return fmt.Sprintf("unexpected message %q: no messages remain to be sent", e.Got)
+	}
+	return fmt.Sprintf("record %d: sent %q, want %q", e.Index, e.Got, e.Want)
+}
+
+// A Replay implements the jrpc2 Channel interface by replaying a recording in
+// place of the channel that was recorded. Recv delivers the recorded inbound
+// messages, and Send checks the outbound messages against the recording.
+//
+// Each inbound message is delivered only after all the outbound messages that
+// precede it in the recording have been sent, so the replay is deterministic
+// for a peer that sends in the recorded order. Once the last inbound message
+// has been delivered, Recv blocks until the Replay is closed, as for an idle
+// connection. Use Verify to check that the whole recording was replayed.
+type Replay struct {
+	recs  []Record
+	speed float64
+	clock wschannel.Clock
+	equal func(want, got []byte) bool
+
+	mu     sync.Mutex
+	at     []time.Time   // when each record was replayed; zero if not yet
+	sends  []int         // indexes of outbound records, in order
+	nsent  int           // number of sends that have occurred
+	recvs  []int         // indexes of inbound records, in order
+	nrecv  int           // number of inbound messages delivered
+	err    error         // the first mismatch, if any
+	wake   chan struct{} // closed and replaced when nsent changes
+	done   chan struct{} // closed by Close
+	closed bool
+}
+
+// NewReplay constructs a Replay for the given recording, as returned by Read
+// or by the Records method of a Buffer.
+func NewReplay(recs []Record, opts *ReplayOptions) *Replay {
+	r := &Replay{
+		recs:  recs,
+		speed: opts.speed(),
+		clock: opts.clock(),
+		equal: opts.equal(),
+		at:    make([]time.Time, len(recs)),
+		wake:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	for i, rec := range recs {
+		if rec.Dir == Send {
+			r.sends = append(r.sends, i)
+		} else {
+			r.recvs = append(r.recvs, i)
+		}
+	}
+	return r
+}
+
+// Send implements the corresponding method of the Channel interface. If data
+// does not match the next outbound message of the recording, Send reports a
+// *MismatchError, and the recorded message is consumed.
+func (r *Replay) Send(data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return net.ErrClosed
+	} else if r.nsent == len(r.sends) {
+		return r.fail(&MismatchError{Index: -1, Got: data})
+	}
+	i := r.sends[r.nsent]
+	r.nsent++
+	r.at[i] = r.clock.Now()
+	close(r.wake)
+	r.wake = make(chan struct{})
+	if want := r.recs[i].Data; !r.equal(want, data) {
+		return r.fail(&MismatchError{Index: i, Want: want, Got: data})
+	}
+	return nil
+}
+
+// fail records err as a mismatch and returns it. The caller must hold r.mu.
+func (r *Replay) fail(err *MismatchError) error {
+	if r.err == nil {
+		r.err = err
+	}
+	return err
+}
+
+// Recv implements the corresponding method of the Channel interface.
+func (r *Replay) Recv() ([]byte, error) {
+	for {
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			return nil, net.ErrClosed
+		}
+		next := len(r.recs) // the position of the next inbound message
+		if r.nrecv < len(r.recvs) {
+			next = r.recvs[r.nrecv]
+		}
+		if next == len(r.recs) || (r.nsent < len(r.sends) && r.sends[r.nsent] < next) {
+			// Wait for the peer to send the messages that precede next, or
+			// for r to close if no inbound messages remain.
+			wake := r.wake
+			r.mu.Unlock()
+			select {
+			case <-wake:
+				continue
+			case <-r.done:
+				return nil, net.ErrClosed
+			}
+		}
+		r.mu.Unlock()
+		if err := r.delay(next); err != nil {
+			return nil, err
+		}
+
+		r.mu.Lock()
+		r.nrecv++
+		r.at[next] = r.clock.Now()
+		r.mu.Unlock()
+		return r.recs[next].Data, nil
+	}
+}
+
+// delay waits until inbound record i is due, when replaying with timing.
+func (r *Replay) delay(i int) error {
+	if r.speed <= 0 || i == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	prev := r.at[i-1]
+	r.mu.Unlock()
+	gap := time.Duration(float64(r.recs[i].Time.Sub(r.recs[i-1].Time)) / r.speed)
+	wait := prev.Add(gap).Sub(r.clock.Now())
+	if wait <= 0 {
+		return nil
+	}
+	t := r.clock.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return nil
+	case <-r.done:
+		return net.ErrClosed
+	}
+}
+
+// Close implements the corresponding method of the Channel interface.
+func (r *Replay) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.closed {
+		r.closed = true
+		close(r.done)
+	}
+	return nil
+}
+
+// Verify reports an error if a message sent to r did not match the
+// recording, or if any messages of the recording have not been replayed.
+func (r *Replay) Verify() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	var errs []error
+	if n := len(r.sends) - r.nsent; n > 0 {
+		errs = append(errs, fmt.Errorf("%d recorded messages were not sent", n))
+	}
+	if n := len(r.recvs) - r.nrecv; n > 0 {
+		errs = append(errs, fmt.Errorf("%d recorded messages were not received", n))
+	}
+	return errors.Join(errs...)
+}
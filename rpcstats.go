@@ -0,0 +1,178 @@
+package wschannel
+
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"sync"
+)
+
+// RPCStats counts the JSON-RPC 2.0 messages sent and received by channels,
+// by method name, by inspecting their payloads. This allows a program to
+// monitor the methods in use without access to the options of the jrpc2
+// client or server. See ChannelOptions.RPCStats.
+//
+// Requests are counted under their method name. Responses are counted under
+// the method of the request with the same ID, if the channel saw it, or
+// otherwise under the empty string. Messages that are not JSON-RPC are not
+// counted. At most MaxMethods distinct method names are counted; messages for
+// further methods are counted under OtherMethods, so that a peer cannot grow
+// the stats without bound by sending arbitrary method names. A zero RPCStats
+// is ready for use, and may be shared by many channels.
+type RPCStats struct {
+	mu      sync.Mutex
+	methods map[string]*MethodStats
+}
+
+const (
+	// MaxMethods is the maximum number of distinct method names counted by
+	// an RPCStats, including the empty string.
+	MaxMethods = 256
+
+	// OtherMethods is the key under which RPCStats counts messages for
+	// methods beyond the first MaxMethods.
+	OtherMethods = "(other)"
+)
+
+// MethodStats are the counters reported by RPCStats for a method. The counts
+// include messages in both directions.
+type MethodStats struct {
+	Calls         int64 // requests with an ID
+	Notifications int64 // requests without an ID
+	Results       int64 // successful responses
+	Errors        int64 // error responses
+	RequestBytes  int64 // total encoded size of requests
+	ResponseBytes int64 // total encoded size of responses
+
+	Codes map[int]int64 // error responses by error code
+}
+
+// Methods returns a snapshot of the counters of s, by method name.
+func (s *RPCStats) Methods() map[string]MethodStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]MethodStats, len(s.methods))
+	for name, m := range s.methods {
+		cp := *m
+		cp.Codes = maps.Clone(m.Codes)
+		out[name] = cp
+	}
+	return out
+}
+
+// update applies f to the counters for method.
+func (s *RPCStats) update(method string, f func(*MethodStats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.methods[method]
+	if !ok {
+		if s.methods == nil {
+			s.methods = make(map[string]*MethodStats)
+		}
+		if len(s.methods) >= MaxMethods {
+			method = OtherMethods
+		}
+		if m, ok = s.methods[method]; !ok {
+			m = new(MethodStats)
+			s.methods[method] = m
+		}
+	}
+	f(m)
+}
+
+// maxPendingCalls is the maximum number of unanswered calls an rpcTracker
+// remembers in each direction. Responses to calls beyond this limit are
+// counted under the empty method name.
+const maxPendingCalls = 1024
+
+// An rpcTracker records the JSON-RPC messages of one channel in an RPCStats.
+type rpcTracker struct {
+	stats *RPCStats
+
+	mu      sync.Mutex
+	pending [2]map[string]string // [sent] call ID → method
+}
+
+func newRPCTracker(s *RPCStats) *rpcTracker {
+	return &rpcTracker{
+		stats:   s,
+		pending: [2]map[string]string{make(map[string]string), make(map[string]string)},
+	}
+}
+
+// observe records the JSON-RPC messages in data, a payload sent or received
+// by the channel.
+func (t *rpcTracker) observe(sent bool, data []byte) {
+	data = bytes.TrimSpace(data)
+	elts := []json.RawMessage{data}
+	if len(data) != 0 && data[0] == '[' && json.Unmarshal(data, &elts) != nil {
+		return
+	}
+	for _, elt := range elts {
+		var msg rpcMessage
+		if json.Unmarshal(elt, &msg) == nil && msg.Version == "2.0" {
+			t.record(sent, &msg, int64(len(elt)))
+		}
+	}
+}
+
+// record counts a single message of n bytes.
+func (t *rpcTracker) record(sent bool, msg *rpcMessage, n int64) {
+	id := string(msg.ID)
+	hasID := id != "" && id != "null"
+	switch {
+	case msg.Method != "":
+		if hasID {
+			t.callStarted(sent, id, msg.Method)
+		}
+		t.stats.update(msg.Method, func(m *MethodStats) {
+			if hasID {
+				m.Calls++
+			} else {
+				m.Notifications++
+			}
+			m.RequestBytes += n
+		})
+	case msg.Error != nil || msg.Result != nil:
+		// A response answers a call that traveled in the opposite direction.
+		t.stats.update(t.callDone(!sent, id), func(m *MethodStats) {
+			if msg.Error != nil {
+				m.Errors++
+				if m.Codes == nil {
+					m.Codes = make(map[int]int64)
+				}
+				m.Codes[msg.Error.Code]++
+			} else {
+				m.Results++
+			}
+			m.ResponseBytes += n
+		})
+	}
+}
+
+func dirIndex(sent bool) int {
+	if sent {
+		return 1
+	}
+	return 0
+}
+
+// callStarted remembers the method of a call with the given ID.
+func (t *rpcTracker) callStarted(sent bool, id, method string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p := t.pending[dirIndex(sent)]; len(p) < maxPendingCalls {
+		p[id] = method
+	}
+}
+
+// callDone returns and forgets the method of the call with the given ID, or
+// returns "" if it is not known.
+func (t *rpcTracker) callDone(sent bool, id string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.pending[dirIndex(sent)]
+	method := p[id]
+	delete(p, id)
+	return method
+}
@@ -0,0 +1,112 @@
+package wschannel
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/coder/websocket"
+)
+
+// ListenAndServe listens for TCP connections on addr and serves websocket
+// requests to lst, as ServeListener.
+func (lst *Listener) ListenAndServe(addr string) error {
+	nl, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return lst.ServeListener(nl)
+}
+
+// ListenAndServeTLS listens for TCP connections on addr and serves websocket
+// requests to lst over TLS, as ServeListenerTLS.
+func (lst *Listener) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	nl, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return lst.ServeListenerTLS(nl, certFile, keyFile)
+}
+
+// ServeListener runs an HTTP server for lst on connections received from nl,
+// until lst is closed. The server routes requests for ListenOptions.Path to
+// lst, and requests for ListenOptions.AdminPath and ListenOptions.HealthPath
+// (if set) to the admin and health handlers for lst. It responds to other
+// requests with 404 (Not Found). This allows a program to serve websocket
+// channels without setting up its own server.
+//
+// ServeListener closes nl before returning. It returns ErrListenerClosed
+// after lst has been closed; otherwise it reports the error that caused the
+// server to stop.
+func (lst *Listener) ServeListener(nl net.Listener) error {
+	return lst.serve(nl, func(srv *http.Server) error { return srv.Serve(nl) })
+}
+
+// ServeListenerTLS behaves as ServeListener, but serves requests over TLS.
+// The server uses ListenOptions.TLSConfig, if set. The certFile and keyFile
+// name files containing a certificate and matching private key for the
+// server. They may be empty if the TLS configuration provides certificates.
+func (lst *Listener) ServeListenerTLS(nl net.Listener, certFile, keyFile string) error {
+	return lst.serve(nl, func(srv *http.Server) error {
+		return srv.ServeTLS(nl, certFile, keyFile)
+	})
+}
+
+func (lst *Listener) serve(nl net.Listener, run func(*http.Server) error) error {
+	srv, err := lst.server()
+	if err != nil {
+		nl.Close()
+		return err
+	}
+	if err := run(srv); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return ErrListenerClosed
+}
+
+// server returns the HTTP server for standalone mode, creating it if needed.
+// It reports ErrListenerClosed if lst is closed.
+func (lst *Listener) server() (*http.Server, error) {
+	lst.mu.Lock()
+	defer lst.mu.Unlock()
+	if lst.err != nil {
+		return nil, lst.err
+	} else if lst.closed {
+		return nil, ErrListenerClosed
+	}
+	if lst.srv == nil {
+		mux := http.NewServeMux()
+		mux.Handle(lst.path, lst)
+		if lst.adminPath != "" {
+			mux.Handle(lst.adminPath, lst.AdminHandler())
+		}
+		if lst.healthPath != "" {
+			mux.Handle(lst.healthPath, lst.HealthHandler())
+		}
+		lst.srv = &http.Server{Handler: mux, TLSConfig: lst.tlsConfig}
+	}
+	return lst.srv, nil
+}
+
+// RegisterOnShutdown registers a hook with srv so that when srv.Shutdown is
+// called, lst is closed and each of its live channels is closed with status
+// StatusGoingAway. Use this when lst is served as a handler by srv, so that
+// the handlers blocked on its channels finish and the server can shut down
+// gracefully, without waiting for the application to close every channel.
+func (lst *Listener) RegisterOnShutdown(srv *http.Server) {
+	srv.RegisterOnShutdown(lst.drain)
+}
+
+// drain closes lst and all its live channels.
+func (lst *Listener) drain() {
+	lst.mu.Lock()
+	lst.closeLocked()
+	live := make([]*Channel, 0, len(lst.active))
+	for ch := range lst.active {
+		live = append(live, ch)
+	}
+	lst.mu.Unlock()
+	for _, ch := range live {
+		ch.closeWith(websocket.StatusGoingAway, "server shutting down")
+	}
+}
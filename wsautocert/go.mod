@@ -0,0 +1,18 @@
+module github.com/creachadair/wschannel/wsautocert
+
+go 1.25.0
+
+replace github.com/creachadair/wschannel => ../
+
+require (
+	github.com/creachadair/wschannel v0.0.0
+	golang.org/x/crypto v0.40.0
+)
+
+require (
+	github.com/coder/websocket v1.8.12 // indirect
+	github.com/creachadair/jrpc2 v1.3.0 // indirect
+	golang.org/x/net v0.41.0 // indirect
+	golang.org/x/sys v0.34.0 // indirect
+	golang.org/x/text v0.27.0 // indirect
+)
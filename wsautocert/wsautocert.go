@@ -0,0 +1,61 @@
+// Package wsautocert obtains TLS certificates for a wschannel.Listener
+// automatically from Let's Encrypt using the ACME protocol.
+//
+// It is a separate module so that the wschannel module does not depend on the
+// ACME client.
+package wsautocert
+
+import (
+	"crypto/tls"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Options are settings for obtaining certificates. By using them, the caller
+// agrees to the terms of service of the certificate authority.
+//
+// Certificates are obtained using the TLS-ALPN-01 challenge, so the server
+// must be reachable on port 443 for each of the Domains.
+type Options struct {
+	// The host names for which certificates may be obtained. Requests for
+	// other names are refused. This field must be non-empty.
+	Domains []string
+
+	// If set, certificates are cached in this directory, which is created if
+	// necessary. Otherwise, certificates are kept only in memory, and must be
+	// obtained again each time the program starts.
+	CacheDir string
+
+	// If set, a contact email address to register with the certificate
+	// authority, to receive notices about problems with certificates.
+	Email string
+}
+
+// TLSConfig returns a copy of base, or a new configuration if base is nil,
+// that obtains and renews certificates as described by opts, replacing any
+// certificates in base. Use it as the TLSConfig of a wschannel.ListenOptions
+// for standalone TLS mode (see wschannel.Listener.ListenAndServeTLS), in
+// which case the certificate and key files may be empty.
+func TLSConfig(base *tls.Config, opts *Options) *tls.Config {
+	cfg := base.Clone()
+	if cfg == nil {
+		cfg = new(tls.Config)
+	}
+	cfg.GetCertificate = opts.manager().GetCertificate
+	cfg.NextProtos = append(cfg.NextProtos, acme.ALPNProto)
+	return cfg
+}
+
+// manager returns a certificate manager for the settings of o.
+func (o *Options) manager() *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(o.Domains...),
+		Email:      o.Email,
+	}
+	if o.CacheDir != "" {
+		m.Cache = autocert.DirCache(o.CacheDir)
+	}
+	return m
+}
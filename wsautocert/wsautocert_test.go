@@ -0,0 +1,94 @@
+//go:build !js
+
+package wsautocert_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/creachadair/wschannel"
+	"github.com/creachadair/wschannel/wsautocert"
+)
+
+func TestAutoCert(t *testing.T) {
+	// Populate the certificate cache so that no ACME requests are needed.
+	const domain = "example.com"
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: domain},
+		DNSNames:              []string{domain},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, domain), buf.Bytes(), 0600); err != nil {
+		t.Fatalf("Write cache: %v", err)
+	}
+
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		TLSConfig: wsautocert.TLSConfig(nil, &wsautocert.Options{
+			Domains:  []string{domain},
+			CacheDir: dir,
+		}),
+	})
+	defer lst.Close()
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go lst.ServeListenerTLS(nl, "", "")
+
+	cert, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	c, err := wschannel.Dial("wss://"+nl.Addr().String(), &wschannel.DialOptions{
+		HTTPClient: &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: domain, RootCAs: roots},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+
+	_, info, err := lst.AcceptInfo(context.Background())
+	if err != nil {
+		t.Fatalf("AcceptInfo: unexpected error: %v", err)
+	}
+	if info.TLS == nil || info.TLS.ServerName != domain {
+		t.Errorf("Connection TLS state: got %+v, want server name %q", info.TLS, domain)
+	}
+}
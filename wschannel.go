@@ -2,16 +2,48 @@
 //
 // For jrpc2, see https://godoc.org/github.com/creachadair/jrpc2.
 // For websockets see https://datatracker.ietf.org/doc/html/rfc6455.
-// This package uses the nhooyr.io/websocket library.
+// This package uses the github.com/coder/websocket library, the maintained
+// successor to nhooyr.io/websocket.
 package wschannel
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"runtime/trace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/coder/websocket"
+	"github.com/creachadair/jrpc2/channel"
+)
+
+// Conn is the interface to a websocket connection used by a Channel. A
+// *websocket.Conn satisfies this interface; other implementations, such as
+// scripted or in-memory transports for testing, may be wrapped with New.
+//
+// If the concrete type also has a Ping(context.Context) error method, it is
+// used for keepalive pings. If it has a SetReadLimit(int64) method, it is used
+// to apply ChannelOptions.ReadLimit.
+type Conn interface {
+	Read(ctx context.Context) (websocket.MessageType, []byte, error)
+	Write(ctx context.Context, typ websocket.MessageType, data []byte) error
+	Close(code websocket.StatusCode, reason string) error
+}
+
+// pinger and readLimiter are optional interfaces that a Conn may implement.
+type (
+	pinger      interface{ Ping(context.Context) error }
+	readLimiter interface{ SetReadLimit(int64) }
 )
 
 // Channel implements the jrpc2 Channel interface over a websocket.
@@ -21,66 +53,688 @@ import (
 //
 // On the server side, you can either use NewListener to create a listener that
 // plugs in to the http.Handler interface automatically, or handle the upgrade
-// negotation explicitly and call New to construct a Channel.
+// negotation explicitly and call New or NewServerConn to construct a Channel.
 type Channel struct {
-	c    *websocket.Conn
-	done chan struct{} // if not nil, closed by Close
+	c      Conn
+	mtype  websocket.MessageType
+	rto    time.Duration // if positive, timeout for Recv
+	wto    time.Duration // if positive, timeout for Send
+	done   chan struct{} // closed by Close
+	once   sync.Once     // guards closing done
+	closed chan struct{} // closed when the close handshake is complete
+	freed  chan struct{} // closed once onDone, if any, has returned
+	info   *ConnInfo     // for channels served by a Listener; otherwise nil
+	value  any           // from SetValue during admission
+	expire Timer         // if not nil, expires the channel while it is pending
+	queue  *queue        // the pending queue shard that holds c, if any
+	last   atomic.Int64  // time of the last Send or Recv, in Unix nanoseconds
+	stats  channelStats
+	groups []string     // groups of the Listener that c belongs to; see Join
+	limit  *limiter     // if not nil, the inbound rate limit
+	taken  atomic.Bool  // set when c is accepted from a Listener
+	status atomic.Int32 // the first close status sent or received, or 0
+	onDone func()       // if not nil, called once after c is closed
+	clock  Clock
+	log    *slog.Logger // if not nil, receives events for c
+	id     string       // see ID
+	lat    *latencies   // if not nil, latencies of the listener of c
+
+	lastSend atomic.Int64 // time of the last Send, in Unix nanoseconds, or 0
+	lastRecv atomic.Int64 // time of the last Recv, in Unix nanoseconds, or 0
+
+	proto  string   // the negotiated websocket subprotocol, if any
+	caps   []string // the negotiated capabilities, in order
+	batch  bool     // if set, messages use batch framing; see CapBatch
+	unread [][]byte // messages of the last batch not yet returned by Recv
+
+	rpc *rpcTracker // if not nil, records JSON-RPC statistics
+
+	onEvent     func(Event) // if not nil, receives lifecycle events
+	closedEvent atomic.Bool // set when a Closed event has been reported
+	finished    atomic.Bool // set when c has been counted as closed in pkgStats
+}
+
+// IDHeader is the HTTP header a Listener uses to send the ID of a channel to
+// the peer in its handshake response. A channel dialed to a server that sends
+// this header uses the same ID, so that both ends of a connection can be
+// correlated in logs.
+const IDHeader = "Wschannel-Id"
+
+// newID returns a new random channel ID.
+func newID() string {
+	var buf [8]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
 }
 
 // Send implements the corresponding method of the Channel interface.
-// The data are transmitted as a single binary websocket message.
-func (c *Channel) Send(data []byte) error {
-	return filterErr(c.c.Write(context.Background(), websocket.MessageBinary, data))
+// The data are transmitted as a single binary websocket message, unless the
+// channel was created with ChannelOptions.Text set. If c uses batch framing,
+// the data are sent as a binary batch of one message.
+func (c *Channel) Send(data []byte) error { return c.send(context.Background(), data) }
+
+// send implements Send, subject to ctx and the write timeout for c.
+func (c *Channel) send(ctx context.Context, data []byte) error {
+	var err error
+	if c.batch {
+		err = c.write(ctx, websocket.MessageBinary, packBatch([][]byte{data}))
+	} else {
+		err = c.write(ctx, c.mtype, data)
+	}
+	if err == nil && c.rpc != nil {
+		c.rpc.observe(true, data)
+	}
+	return err
+}
+
+// write sends a websocket message of type typ on c.
+func (c *Channel) write(ctx context.Context, typ websocket.MessageType, data []byte) error {
+	defer c.region(ctx, "wschannel.Send", len(data)).End()
+	ctx, cancel := withTimeout(ctx, c.wto)
+	defer cancel()
+	start := c.clock.Now()
+	if err := c.c.Write(ctx, typ, data); err != nil {
+		return c.failed("send", filterErr(err))
+	}
+	c.observe(opSend, start)
+	c.touch(&c.lastSend)
+	c.stats.sent(len(data))
+	pkgStats.sent(len(data))
+	c.logMessage("send", len(data))
+	return nil
 }
 
 // Recv implements the corresponding method of the Channel interface.
 // The message type is not checked; either a binary or text message is
-// accepted.
+// accepted. If c uses batch framing, each message of a batch is returned by a
+// separate call to Recv.
 func (c *Channel) Recv() ([]byte, error) {
-	_, bits, err := c.c.Read(context.Background())
+	msg, err := c.recv()
+	if err == nil && c.rpc != nil {
+		c.rpc.observe(false, msg)
+	}
+	return msg, err
+}
+
+// recv implements Recv.
+func (c *Channel) recv() ([]byte, error) {
+	if len(c.unread) != 0 {
+		msg := c.unread[0]
+		c.unread = c.unread[1:]
+		return c.limited(msg)
+	}
+	ctx, cancel := withTimeout(context.Background(), c.rto)
+	defer cancel()
+	defer c.region(ctx, "wschannel.Recv", -1).End()
+	start := c.clock.Now()
+	_, bits, err := c.c.Read(ctx)
 	if err != nil {
-		return nil, filterErr(err)
+		code := websocket.CloseStatus(err)
+		if code >= 0 {
+			c.setStatus(code)
+			c.logAttrs(slog.LevelInfo, "websocket closed by peer", slog.Int("status", int(code)))
+		}
+		if errors.Is(err, ErrDecrypt) {
+			c.closeWith(websocket.StatusPolicyViolation, "decryption failed")
+		} else if errors.Is(err, ErrBadMAC) {
+			c.closeWith(websocket.StatusPolicyViolation, "message authentication failed")
+		}
+		err = filterErr(err)
+		if errors.Is(err, net.ErrClosed) {
+			c.emitClosed(code, err)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+			c.finish() // the peer closed c, or the connection failed
+		}
+		return nil, c.failed("recv", err)
+	}
+	c.observe(opRecv, start)
+	c.touch(&c.lastRecv)
+	c.stats.received(len(bits))
+	pkgStats.received(len(bits))
+	c.logMessage("recv", len(bits))
+	if c.batch {
+		msg, err := c.recvBatch(bits)
+		if err != nil {
+			return nil, c.failed("recv", err)
+		}
+		bits = msg
+	}
+	return c.limited(bits)
+}
+
+// limited enforces the inbound rate limit of c, if any, for msg, and returns
+// msg if it is within the limit. Each message of a batch is charged
+// separately.
+func (c *Channel) limited(msg []byte) ([]byte, error) {
+	if c.limit != nil {
+		if err := c.throttle(len(msg)); err != nil {
+			return nil, c.failed("recv", err)
+		}
 	}
-	return bits, nil
+	return msg, nil
+}
+
+// region starts an execution trace region for an operation on c, and logs the
+// ID of c and the message size n, if n ≥ 0, when tracing is enabled.
+func (c *Channel) region(ctx context.Context, name string, n int) *trace.Region {
+	if trace.IsEnabled() {
+		trace.Log(ctx, "wschannel.id", c.id)
+		if n >= 0 {
+			trace.Logf(ctx, "wschannel.size", "%d", n)
+		}
+	}
+	return trace.StartRegion(ctx, name)
+}
+
+// failed counts and logs err, reported by the named operation on c, and
+// returns it annotated with the ID of c.
+func (c *Channel) failed(op string, err error) error {
+	c.logErr(op, countErr(err))
+	return fmt.Errorf("channel %s: %w", c.id, err)
+}
+
+// throttle enforces the inbound rate limit of c for a message of n bytes.
+func (c *Channel) throttle(n int) error {
+	wait := c.limit.reserve(c.clock.Now(), n)
+	if wait == 0 {
+		return nil
+	} else if !c.limit.delay {
+		c.closeWith(websocket.StatusPolicyViolation, "rate limit exceeded")
+		return ErrRateLimited
+	}
+	t := c.clock.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return nil
+	case <-c.done:
+		return net.ErrClosed
+	}
+}
+
+// touch records the current time as the last activity on c, and in at.
+func (c *Channel) touch(at *atomic.Int64) {
+	now := c.clock.Now().UnixNano()
+	c.last.Store(now)
+	at.Store(now)
+}
+
+// LastActive returns the time of the most recent message sent or received on
+// c, or the time c was created if no messages have been exchanged.
+func (c *Channel) LastActive() time.Time { return time.Unix(0, c.last.Load()) }
+
+// LastSend returns the time of the most recent successful Send on c, or the
+// zero time if no messages have been sent.
+func (c *Channel) LastSend() time.Time { return unixTime(c.lastSend.Load()) }
+
+// LastRecv returns the time of the most recent successful Recv on c, or the
+// zero time if no messages have been received.
+func (c *Channel) LastRecv() time.Time { return unixTime(c.lastRecv.Load()) }
+
+// unixTime returns the time for ns nanoseconds since the Unix epoch, or the
+// zero time if ns == 0.
+func unixTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// withTimeout returns a context derived from ctx with the specified timeout,
+// or ctx itself if d ≤ 0.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d)
 }
 
 // Close shuts down the websocket. The first Close triggers a websocket close
 // handshake, but does not block for its completion.
 func (c *Channel) Close() error {
-	if c.done != nil {
+	c.closeWith(websocket.StatusNormalClosure, "bye")
+	return nil
+}
+
+// closeWith closes c, if it is not already closed, and triggers a websocket
+// close handshake with the specified status code and reason. It reports
+// whether this call closed c.
+func (c *Channel) closeWith(code websocket.StatusCode, reason string) (ok bool) {
+	c.once.Do(func() {
+		ok = true
+		c.finish()
+		c.setStatus(code)
+		c.logAttrs(slog.LevelInfo, "websocket closed",
+			slog.Int("status", int(code)), slog.String("reason", reason))
 		close(c.done)
-		go c.c.Close(websocket.StatusNormalClosure, "bye")
-		c.done = nil
+		c.closed = make(chan struct{})
+		go func() {
+			defer close(c.closed)
+			if c.onDone != nil {
+				c.onDone()
+			}
+			close(c.freed)
+			c.c.Close(code, reason)
+			c.emitClosed(code, nil)
+		}()
+	})
+	return ok
+}
+
+// finish counts c as closed in pkgStats, if it was not already counted. It is
+// called both when c is closed locally and when a Recv finds that the peer has
+// closed c or the connection has failed.
+func (c *Channel) finish() {
+	if c.finished.CompareAndSwap(false, true) {
+		pkgStats.closed.Add(1)
 	}
-	return nil
 }
 
+// setStatus records code as the close status of c, if none was recorded.
+func (c *Channel) setStatus(code websocket.StatusCode) { c.status.CompareAndSwap(0, int32(code)) }
+
 // Done returns a channel that is closed when c is closed.
 func (c *Channel) Done() <-chan struct{} { return c.done }
 
+// Info returns information about the HTTP request that established c, if it
+// was created by a Listener or NewServerConn. Otherwise it returns nil.
+func (c *Channel) Info() *ConnInfo { return c.info }
+
+// ID returns the unique ID of c. For a channel created by a Listener, this is
+// the same as the ID of its Info. A channel dialed to a Listener shares the ID
+// of the server's channel (see IDHeader); otherwise c has a random ID.
+func (c *Channel) ID() string { return c.id }
+
+// Value returns the value associated with c by SetValue when its connection
+// was admitted by a Listener, or nil if no value was set.
+func (c *Channel) Value() any { return c.value }
+
+// filterErr marks an error reporting that the peer closed the connection as
+// net.ErrClosed, so that jrpc2 treats it as the end of the channel. The close
+// status remains available via websocket.CloseStatus.
 func filterErr(err error) error {
-	if errors.Is(err, (*websocket.CloseError)(nil)) {
-		return net.ErrClosed
+	if websocket.CloseStatus(err) >= 0 && !errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("%w: %w", net.ErrClosed, err)
 	}
 	return err
 }
 
 // New wraps the given websocket connection to implement the Channel interface.
-func New(conn *websocket.Conn) *Channel {
-	return &Channel{c: conn, done: make(chan struct{})}
+// The channel has default settings (see ChannelOptions).
+func New(conn Conn) *Channel { return newChannel(conn, nil) }
+
+// NewServerConn wraps a websocket connection that was upgraded from req by
+// the caller, to implement the Channel interface with the given options. The
+// resulting channel reports information about req from its Info method. Use
+// this when a framework performs the websocket upgrade itself, rather than a
+// Listener.
+func NewServerConn(conn Conn, req *http.Request, opts *ChannelOptions) *Channel {
+	ch := newChannel(conn, opts)
+	ch.info = newConnInfo(req, &admission{
+		remote: req.RemoteAddr,
+		client: parseHostAddr(req.RemoteAddr),
+	}, ch.clock.Now())
+	ch.info.ID = ch.id
+	return ch
+}
+
+func newChannel(conn Conn, opts *ChannelOptions) *Channel {
+	ch := &Channel{
+		c:     conn,
+		mtype: opts.messageType(),
+		done:  make(chan struct{}),
+		freed: make(chan struct{}),
+		clock: opts.clock(),
+		id:    newID(),
+		proto: subprotocol(conn),
+	}
+	if opts != nil {
+		ch.onEvent = opts.OnEvent
+	}
+	pkgStats.opened.Add(1)
+	ch.last.Store(ch.clock.Now().UnixNano())
+	if opts != nil {
+		ch.rto, ch.wto = opts.ReadTimeout, opts.WriteTimeout
+		if rl, ok := conn.(readLimiter); ok && opts.ReadLimit != 0 {
+			rl.SetReadLimit(opts.ReadLimit)
+		}
+		if opts.RPCStats != nil {
+			ch.rpc = newRPCTracker(opts.RPCStats)
+		}
+		if opts.Dump != nil {
+			ch.c = &dumpConn{Conn: ch.c, d: opts.Dump, ch: ch}
+		}
+		if opts.Chaos != nil {
+			ch.c = opts.Chaos.wrap(ch.c, ch.closeWith, ch.clock)
+		}
+		if opts.KeepAlive > 0 {
+			go ch.keepAlive(opts.KeepAlive, opts.KeepAlive)
+		}
+	}
+	return ch
+}
+
+// keepAlive sends a ping to the peer at the specified interval until c is
+// closed. If the peer does not respond to a ping within timeout, the
+// connection is closed with status StatusGoingAway. If the connection does
+// not support pings, keepAlive does nothing.
+func (c *Channel) keepAlive(interval, timeout time.Duration) {
+	p, ok := c.c.(pinger)
+	if !ok {
+		return
+	}
+	t := c.clock.NewTimer(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C():
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := p.Ping(ctx)
+		cancel()
+		if err != nil {
+			select {
+			case <-c.done:
+			default:
+				c.emit(PingTimeout)
+				c.closeWith(websocket.StatusGoingAway, "keepalive timeout")
+			}
+			return
+		}
+		t.Reset(interval)
+	}
+}
+
+// ChannelOptions are settings for a channel. A nil *ChannelOptions is ready
+// for use and provides default values as described.
+type ChannelOptions struct {
+	// If nonzero, the maximum size in bytes of a message the channel will
+	// receive. A message larger than this causes the connection to close.
+	// If ReadLimit < 0, there is no limit. If ReadLimit == 0, the default
+	// limit of the websocket library is used (32KiB).
+	ReadLimit int64
+
+	// If positive, the maximum time Recv will wait for a message to arrive.
+	// If the timeout expires, the connection is closed.
+	ReadTimeout time.Duration
+
+	// If positive, the maximum time Send will wait for a message to be sent.
+	// If the timeout expires, the connection is closed.
+	WriteTimeout time.Duration
+
+	// If positive, send a ping to the peer at this interval, and close the
+	// connection if the peer does not respond before the next ping is due.
+	// Pongs are only processed while a Recv is in progress, so this should
+	// only be enabled for channels that are read continuously (as they are
+	// by a jrpc2 client or server).
+	KeepAlive time.Duration
+
+	// If true, Send transmits text messages rather than binary messages.
+	Text bool
+
+	// If true, offer (for a client) or accept (for a server) batch framing,
+	// which allows SendBatch to send several messages in one websocket
+	// message. Batch framing is used only if both peers enable it, and its
+	// messages are always binary. A batch counts as one message in the
+	// channel statistics. See CapBatch.
+	Batch bool
+
+	// Additional capabilities to offer (for a client) or accept (for a
+	// server), for protocol extensions defined by the application. Their
+	// names should begin with "x-". See Protocol and Channel.Capabilities.
+	Capabilities []string
+
+	// If set, the channel disconnects at random as described. This is for
+	// soak testing only, and must not be enabled in production.
+	Chaos *Chaos
+
+	// If set, write a description of each frame sent or received by the
+	// channel as described. This is for debugging; the dump can be enabled
+	// and disabled while the channel is in use.
+	Dump *FrameDump
+
+	// If set, encrypt the messages of the channel end to end, as described.
+	// For a channel created by a Listener, this is required of every client.
+	Encryption *Encryption
+
+	// If set, authenticate the messages of the channel with a shared key, as
+	// described. For a channel created by a Listener, this is required of
+	// every client.
+	MessageAuth *MessageAuth
+
+	// If set, count the JSON-RPC messages sent and received by the channel
+	// by method, as described.
+	RPCStats *RPCStats
+
+	// If set, this function is called for each lifecycle event of the
+	// channel (see EventKind), on the goroutine where the event occurs. It
+	// must not block. To observe the channels of a Listener, set it in
+	// ListenOptions.Channel.
+	OnEvent func(Event)
+
+	// If set, the clock used to schedule the timers of the channel, and of
+	// a Listener whose channels use these options. If nil, SystemClock is
+	// used. This is intended for testing; see Clock.
+	Clock Clock
+}
+
+func (o *ChannelOptions) clock() Clock {
+	if o == nil || o.Clock == nil {
+		return SystemClock
+	}
+	return o.Clock
+}
+
+// readLimit returns the effective read limit for messages that are not read
+// by the websocket library, such as those of fallback sessions.
+func (o *ChannelOptions) readLimit() int64 {
+	if o == nil || o.ReadLimit == 0 {
+		return 32768
+	} else if o.ReadLimit < 0 {
+		return math.MaxInt64 - 1
+	}
+	return o.ReadLimit
+}
+
+func (o *ChannelOptions) messageType() websocket.MessageType {
+	if o != nil && o.Text {
+		return websocket.MessageText
+	}
+	return websocket.MessageBinary
 }
 
 // DialContext dials the specified websocket URL ("ws://....") with the given
-// options and negotiates a client channel with the server.
+// options and negotiates a client channel with the server. If the server
+// responds without upgrading the connection, the error has concrete type
+// *RejectedError.
 func DialContext(ctx context.Context, url string, opts *DialOptions) (*Channel, error) {
-	conn, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{
-		HTTPClient: opts.client(),
-		HTTPHeader: opts.header(),
-	})
+	ctx, task := trace.NewTask(ctx, "wschannel.Dial")
+	defer task.End()
+	start := opts.channelOptions().clock().Now()
+	ch, err := dial(ctx, url, opts)
+	if log := opts.logger(); log != nil {
+		log = log.With(slog.String("url", url))
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelWarn, "websocket dial failed", slog.Any("error", err))
+			return nil, err
+		}
+		ch.log = log.With(slog.String("id", ch.id))
+		ch.log.LogAttrs(ctx, slog.LevelInfo, "websocket connected")
+	}
 	if err != nil {
 		return nil, err
 	}
-	return New(conn), nil
+	ch.observe(opHandshake, start)
+	ch.emit(Dialed)
+	return ch, nil
+}
+
+// dial implements DialContext.
+func dial(ctx context.Context, url string, opts *DialOptions) (*Channel, error) {
+	if d := opts.timeout(); d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	if opts.fallback() {
+		if err := opts.channelOptions().checkFallback(); err != nil {
+			return nil, err
+		}
+	}
+	var conn Conn
+	var id string // the channel ID assigned by the server, if any
+	dopts := opts.dialOptions()
+	enc := opts.channelOptions().encryption()
+	var priv *[32]byte
+	if enc != nil && dopts != nil {
+		var pub *[32]byte
+		pub, priv = enc.keyPair()
+		setHeader(dopts, KeyHeader, encodeKey(pub))
+	}
+	var macKey []byte
+	if ma := opts.channelOptions().messageAuth(); ma != nil {
+		var err error
+		if macKey, err = ma.key(nil); err != nil {
+			return nil, err
+		}
+	}
+	ws, rsp, err := websocket.Dial(ctx, url, dopts)
+	if err != nil {
+		if rsp != nil && rsp.StatusCode != http.StatusSwitchingProtocols {
+			err = rejectedFromResponse(rsp)
+		}
+		if !opts.fallback() || ctx.Err() != nil {
+			return nil, err
+		}
+		fc, ferr := dialFallback(ctx, url, opts)
+		if ferr != nil {
+			return nil, errors.Join(err, fmt.Errorf("fallback: %w", ferr))
+		}
+		conn, id = fc, fc.id
+	} else {
+		conn = ws
+		if rsp != nil {
+			id = rsp.Header.Get(IDHeader)
+		}
+	}
+	if macKey != nil {
+		conn = newMACConn(conn, macKey, false)
+	}
+	if enc != nil {
+		var h http.Header
+		if rsp != nil && priv != nil {
+			h = rsp.Header
+		}
+		s, err := enc.newSealer(nil, h, priv)
+		if err != nil {
+			// The server is not reading yet, so do not wait for a close
+			// handshake if the connection can be closed without one.
+			if cn, ok := conn.(interface{ CloseNow() error }); ok {
+				cn.CloseNow()
+			} else {
+				conn.Close(websocket.StatusPolicyViolation, "invalid encryption key")
+			}
+			return nil, err
+		}
+		conn = &sealConn{Conn: conn, s: s}
+	}
+	if auth := opts.authenticator(); auth != nil {
+		if err := answerChallenge(ctx, conn, auth); err != nil {
+			conn.Close(websocket.StatusPolicyViolation, "authentication failed")
+			return nil, fmt.Errorf("authentication: %w", err)
+		}
+	}
+	ch := newChannel(conn, opts.channelOptions())
+	if id != "" {
+		ch.id = id
+	}
+	if rsp != nil {
+		ch.setCapabilities(negotiate(rsp.Header, opts.channelOptions().capabilities()))
+	}
+	return ch, nil
+}
+
+// rejectedFromResponse constructs a *RejectedError for a failed handshake.
+func rejectedFromResponse(rsp *http.Response) *RejectedError {
+	// The websocket library allows reading only a prefix of the body.
+	body, _ := io.ReadAll(io.LimitReader(rsp.Body, 1024))
+	reason := strings.TrimSpace(string(body))
+	if reason == "" {
+		reason = rsp.Status
+	}
+	return &RejectedError{Code: rsp.StatusCode, Reason: reason, Err: ErrUpgradeFailed}
+}
+
+// DialAny attempts to dial each of the specified websocket URLs in order with
+// the given options, and returns a channel for the first one that succeeds.
+// If opts.Timeout is set, it bounds each attempt separately.  If all the
+// attempts fail, DialAny reports an error that wraps the errors from each.
+//
+// If opts.Parallel is true, the URLs are dialed concurrently rather than in
+// order, and DialAny returns the first connection to succeed. Any other
+// connections that succeed are closed.
+func DialAny(ctx context.Context, urls []string, opts *DialOptions) (*Channel, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("no URLs to dial")
+	} else if opts.parallel() {
+		return dialRace(ctx, urls, opts)
+	}
+	var errs []error
+	for _, url := range urls {
+		ch, err := DialContext(ctx, url, opts)
+		if err == nil {
+			return ch, nil
+		}
+		errs = append(errs, fmt.Errorf("dial %q: %w", url, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// dialRace dials all the urls concurrently and returns the first channel to
+// succeed. The remaining attempts are cancelled, and any other channels that
+// connect despite that are closed.
+func dialRace(ctx context.Context, urls []string, opts *DialOptions) (*Channel, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		ch  *Channel
+		err error
+	}
+	results := make(chan result, len(urls))
+	for _, url := range urls {
+		go func() {
+			ch, err := DialContext(ctx, url, opts)
+			if err != nil {
+				err = fmt.Errorf("dial %q: %w", url, err)
+			}
+			results <- result{ch, err}
+		}()
+	}
+
+	var win *Channel
+	var errs []error
+	for range urls {
+		r := <-results
+		if r.err != nil {
+			errs = append(errs, r.err)
+		} else if win == nil {
+			win = r.ch
+			cancel() // stop the remaining attempts
+		} else {
+			r.ch.Close() // lost the race
+		}
+	}
+	if win != nil {
+		return win, nil
+	}
+	return nil, errors.Join(errs...)
 }
 
 // Dial is a shorthand for DialContext with a background context.
@@ -88,26 +742,168 @@ func Dial(url string, opts *DialOptions) (*Channel, error) {
 	return DialContext(context.Background(), url, opts)
 }
 
+// Redialer returns a function that dials url with the given options each time
+// it is called. This is suitable for use as a factory to rebuild the channel
+// for a jrpc2 client after a failure.  All the channels created by the
+// factory share the same HTTP client. Each channel after the first reports a
+// Reconnected event, after its Dialed event (see ChannelOptions.OnEvent).
+func Redialer(url string, opts *DialOptions) func() (channel.Channel, error) {
+	var shared DialOptions
+	if opts != nil {
+		shared = *opts
+		shared.HTTPClient = opts.client()
+		shared.MaxHeaderBytes = 0 // already applied to the client, if possible
+	}
+	var dialed atomic.Bool // set after the first successful dial
+	return func() (channel.Channel, error) {
+		ch, err := Dial(url, &shared)
+		if err != nil {
+			return nil, err
+		}
+		if dialed.Swap(true) {
+			ch.emit(Reconnected)
+		}
+		return ch, nil
+	}
+}
+
+// DefaultUserAgent is the User-Agent string sent by a client that does not
+// specify one in its DialOptions.
+const DefaultUserAgent = "github.com/creachadair/wschannel"
+
 // DialOptions are settings for a client channel. A nil *DialOptions is
 // ready for use and provides default values as described.
+//
+// When compiled for GOOS=js, the browser's native WebSocket is used to dial,
+// and the HTTPClient, Header, UserAgent, compression, and MaxHeaderBytes
+// settings have no effect.
 type DialOptions struct {
 	// If non-nil, use this HTTP client instead of the default.
 	HTTPClient *http.Client
 
 	// If set, send these HTTP headers during the websocket handshake.
 	Header http.Header
+
+	// If set, use this value as the User-Agent for the websocket handshake.
+	// Otherwise, any User-Agent in Header is used; if Header does not
+	// include one, DefaultUserAgent is sent.
+	UserAgent string
+
+	// If set, apply these settings to the channel after it connects.
+	Channel *ChannelOptions
+
+	// If true, negotiate per-message compression (permessage-deflate) with
+	// servers that support it, as for ListenOptions.EnableCompression.
+	EnableCompression bool
+
+	// If positive and EnableCompression is true, only compress messages that
+	// are at least this many bytes in length. If zero, the default is 512.
+	CompressionThreshold int
+
+	// If positive, bound the time allowed for each dial attempt to this
+	// duration. By default, a dial is bounded only by its context.
+	Timeout time.Duration
+
+	// If positive, limit the size of the response headers the client will
+	// accept from the server during the websocket handshake. This is enforced
+	// only if the HTTP client uses an *http.Transport (the default).
+	MaxHeaderBytes int64
+
+	// If true, DialAny dials all its URLs concurrently instead of in order.
+	Parallel bool
+
+	// If set, this function is called to answer the authentication challenge
+	// of a server that requires one (see ListenOptions.Challenge). It is
+	// passed the nonce sent by the server, and returns the response to send.
+	// If Authenticator is set and the server does not send a challenge, the
+	// dial blocks until its context ends.
+	Authenticator func(nonce []byte) ([]byte, error)
+
+	// If true and the websocket handshake fails, try to connect using a
+	// fallback transport over plain HTTP requests, for networks that block
+	// websocket upgrades. Server-Sent Events are tried first, then long
+	// polling. This requires a server that enables ListenOptions.Fallback.
+	// A fallback channel does not support ping-based keepalive.
+	Fallback bool
+
+	// If set, log the handshake, closure, and errors of the channel to this
+	// logger, and at debug level the size of each message.
+	Logger *slog.Logger
 }
 
 func (o *DialOptions) header() http.Header {
+	h := make(http.Header)
+	if o != nil {
+		h = o.Header.Clone()
+		if h == nil {
+			h = make(http.Header)
+		}
+		if o.UserAgent != "" {
+			h.Set("User-Agent", o.UserAgent)
+		}
+	}
+	if h.Get("User-Agent") == "" {
+		h.Set("User-Agent", DefaultUserAgent)
+	}
+	if caps := o.channelOptions().capabilities(); len(caps) != 0 {
+		h.Set(CapabilitiesHeader, strings.Join(caps, ", "))
+	}
+	return h
+}
+
+func (o *DialOptions) client() *http.Client {
 	if o == nil {
 		return nil
+	} else if o.MaxHeaderBytes <= 0 {
+		return o.HTTPClient
+	}
+	cli := http.DefaultClient
+	if o.HTTPClient != nil {
+		cli = o.HTTPClient
 	}
-	return o.Header
+	var tr *http.Transport
+	switch t := cli.Transport.(type) {
+	case nil:
+		tr = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		tr = t.Clone()
+	default:
+		return cli // we cannot enforce the limit on this transport
+	}
+	tr.MaxResponseHeaderBytes = o.MaxHeaderBytes
+	cp := *cli
+	cp.Transport = tr
+	return &cp
 }
 
-func (o *DialOptions) client() *http.Client {
+func (o *DialOptions) timeout() time.Duration {
+	if o == nil {
+		return 0
+	}
+	return o.Timeout
+}
+
+func (o *DialOptions) authenticator() func([]byte) ([]byte, error) {
+	if o == nil {
+		return nil
+	}
+	return o.Authenticator
+}
+
+func (o *DialOptions) parallel() bool { return o != nil && o.Parallel }
+
+func (o *DialOptions) fallback() bool { return o != nil && o.Fallback }
+
+func (o *DialOptions) logger() *slog.Logger {
+	if o == nil {
+		return nil
+	}
+	return o.Logger
+}
+
+func (o *DialOptions) channelOptions() *ChannelOptions {
 	if o == nil {
 		return nil
 	}
-	return o.HTTPClient
+	return o.Channel
 }
@@ -0,0 +1,34 @@
+//go:build js
+
+package wschannel_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/creachadair/wschannel"
+)
+
+// TestDialBrowser exercises Dial using the native WebSocket of the browser.
+// It requires an echo server, whose URL is given by WSCHANNEL_ECHO_URL.
+func TestDialBrowser(t *testing.T) {
+	url := os.Getenv("WSCHANNEL_ECHO_URL")
+	if url == "" {
+		t.Skip("WSCHANNEL_ECHO_URL is not set")
+	}
+	ch, err := wschannel.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial %q: unexpected error: %v", url, err)
+	}
+	defer ch.Close()
+
+	const message = "hello from the browser"
+	if err := ch.Send([]byte(message)); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+	if got, err := ch.Recv(); err != nil {
+		t.Errorf("Recv: unexpected error: %v", err)
+	} else if string(got) != message {
+		t.Errorf("Recv: got %q, want %q", got, message)
+	}
+}
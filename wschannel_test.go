@@ -1,16 +1,39 @@
+//go:build !js
+
 package wschannel_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"runtime/pprof"
+	"runtime/trace"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/coder/websocket"
 	"github.com/creachadair/jrpc2/channel"
 	"github.com/creachadair/wschannel"
+	"golang.org/x/crypto/nacl/box"
 )
 
 var _ channel.Channel = (*wschannel.Channel)(nil)
@@ -84,13 +107,135 @@ func TestClientServer(t *testing.T) {
 	}
 }
 
+// memConn is an in-memory implementation of wschannel.Conn.
+type memConn struct {
+	in     <-chan []byte
+	out    chan<- []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+func memPipe() (*memConn, *memConn) {
+	ab, ba := make(chan []byte, 1), make(chan []byte, 1)
+	return &memConn{in: ba, out: ab, closed: make(chan struct{})},
+		&memConn{in: ab, out: ba, closed: make(chan struct{})}
+}
+
+func (m *memConn) Read(ctx context.Context) (websocket.MessageType, []byte, error) {
+	select {
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	case <-m.closed:
+		return 0, nil, net.ErrClosed
+	case msg := <-m.in:
+		return websocket.MessageBinary, msg, nil
+	}
+}
+
+func (m *memConn) Write(ctx context.Context, _ websocket.MessageType, data []byte) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-m.closed:
+		return net.ErrClosed
+	case m.out <- data:
+		return nil
+	}
+}
+
+func (m *memConn) Close(websocket.StatusCode, string) error {
+	m.once.Do(func() { close(m.closed) })
+	return nil
+}
+
+func TestConn(t *testing.T) {
+	a, b := memPipe()
+	ca, cb := wschannel.New(a), wschannel.New(b)
+
+	if err := ca.Send([]byte("ping")); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+	if got, err := cb.Recv(); err != nil || string(got) != "ping" {
+		t.Errorf("Recv: got (%q, %v), want (ping, nil)", got, err)
+	}
+	if err := cb.Send([]byte("pong")); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+	if got, err := ca.Recv(); err != nil || string(got) != "pong" {
+		t.Errorf("Recv: got (%q, %v), want (pong, nil)", got, err)
+	}
+
+	if err := ca.Close(); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+	if _, err := ca.Recv(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Recv after close: got %v, want %v", err, net.ErrClosed)
+	}
+	cb.Close()
+}
+
+func TestHandlerReturns(t *testing.T) {
+	for _, detach := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Detach=%v", detach), func(t *testing.T) {
+			lst := wschannel.NewListener(&wschannel.ListenOptions{Detach: detach})
+			defer lst.Close()
+			served := make(chan struct{})
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				defer close(served)
+				lst.ServeHTTP(w, req)
+			}))
+			defer s.Close()
+
+			c, err := wschannel.Dial(fixURL(s.URL), nil)
+			if err != nil {
+				t.Fatalf("Dial: unexpected error: %v", err)
+			}
+			defer c.Close()
+			ch, err := lst.AcceptChannel(context.Background())
+			if err != nil {
+				t.Fatalf("Accept: unexpected error: %v", err)
+			}
+
+			// A detached handler should return while the channel is still
+			// open; otherwise, the handler should block.
+			select {
+			case <-served:
+				if !detach {
+					t.Fatal("Handler returned while the channel was open")
+				}
+			case <-time.After(100 * time.Millisecond):
+				if detach {
+					t.Fatal("Timed out waiting for the handler to return")
+				}
+			}
+			if err := c.Send([]byte("hello")); err != nil {
+				t.Fatalf("Send: unexpected error: %v", err)
+			}
+			if got, err := ch.Recv(); err != nil || string(got) != "hello" {
+				t.Errorf("Recv: got (%q, %v), want (hello, nil)", got, err)
+			}
+			if n := lst.Active(); n != 1 {
+				t.Errorf("Active: got %d, want 1", n)
+			}
+			ch.Close()
+			<-served
+
+			// Closing the channel should release it from the listener.
+			for lst.Active() != 0 {
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
+
 func TestListenerErrors(t *testing.T) {
 	t.Run("CheckReject", func(t *testing.T) {
-		s := httptest.NewServer(wschannel.NewListener(&wschannel.ListenOptions{
+		lst := wschannel.NewListener(&wschannel.ListenOptions{
 			CheckAccept: func(*http.Request) (int, error) {
 				return http.StatusTeapot, errors.New("failed")
 			},
-		}))
+		})
+		s := httptest.NewServer(lst)
 		defer s.Close()
 
 		rsp, err := http.Get(s.URL)
@@ -99,6 +244,40 @@ func TestListenerErrors(t *testing.T) {
 		} else if rsp.StatusCode != http.StatusTeapot {
 			t.Errorf("Response status: got %v, want %v", rsp.StatusCode, http.StatusTeapot)
 		}
+
+		if got, want := lst.Metrics(), (wschannel.Metrics{Rejected: 1}); got != want {
+			t.Errorf("Metrics: got %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("UpgradeFailed", func(t *testing.T) {
+		uerr := make(chan error, 1)
+		lst := wschannel.NewListener(&wschannel.ListenOptions{
+			OnUpgradeError: func(_ *http.Request, err error) { uerr <- err },
+		})
+		s := httptest.NewServer(lst)
+		defer s.Close()
+
+		// A plain HTTP request is not a valid websocket handshake.
+		rsp, err := http.Get(s.URL)
+		if err != nil {
+			t.Errorf("Get failed: %v", err)
+		} else if rsp.StatusCode < 400 {
+			t.Errorf("Response status: got %v, want error", rsp.StatusCode)
+		}
+
+		select {
+		case err := <-uerr:
+			if !errors.Is(err, wschannel.ErrUpgradeFailed) {
+				t.Errorf("OnUpgradeError: got %v, want %v", err, wschannel.ErrUpgradeFailed)
+			}
+		case <-time.After(time.Second):
+			t.Error("Timed out waiting for OnUpgradeError")
+		}
+
+		if got, want := lst.Metrics(), (wschannel.Metrics{UpgradeFailed: 1}); got != want {
+			t.Errorf("Metrics: got %+v, want %+v", got, want)
+		}
 	})
 
 	t.Run("QueueFull", func(t *testing.T) {
@@ -123,5 +302,3566 @@ func TestListenerErrors(t *testing.T) {
 			t.Errorf("Client 2 dial: got %+v, want error", c2)
 			c2.Close()
 		}
+
+		if got, want := lst.Metrics(), (wschannel.Metrics{Upgraded: 1, QueueFull: 1}); got != want {
+			t.Errorf("Metrics: got %+v, want %+v", got, want)
+		}
+
+		// Widening the queue admits more connections.
+		lst.SetMaxPending(2)
+		c3, err := wschannel.Dial(fixURL(s.URL), nil)
+		if err != nil {
+			t.Fatalf("Client 3 failed: %v", err)
+		}
+		defer c3.Close()
+
+		// Shrinking it again does not discard those already pending.
+		lst.SetMaxPending(1)
+		if got := lst.Pending(); got != 2 {
+			t.Errorf("Pending: got %d, want 2", got)
+		}
+		if c4, err := wschannel.Dial(fixURL(s.URL), nil); err == nil {
+			t.Errorf("Client 4 dial: got %+v, want error", c4)
+			c4.Close()
+		}
+	})
+
+	t.Run("RetryAfter", func(t *testing.T) {
+		lst := wschannel.NewListener(&wschannel.ListenOptions{
+			QueueFullStatus: http.StatusTooManyRequests,
+			RetryAfter:      1500 * time.Millisecond,
+		})
+		defer lst.Close()
+
+		s := httptest.NewServer(lst)
+		defer s.Close()
+
+		c1, err := wschannel.Dial(fixURL(s.URL), nil)
+		if err != nil {
+			t.Fatalf("Client 1 failed: %v", err)
+		}
+		defer c1.Close()
+
+		c2, rsp, err := websocket.Dial(context.Background(), fixURL(s.URL), nil)
+		if err == nil {
+			c2.CloseNow()
+			t.Fatal("Client 2 dial: got nil error, want failure")
+		}
+		if got, want := rsp.StatusCode, http.StatusTooManyRequests; got != want {
+			t.Errorf("Status: got %v, want %v", got, want)
+		}
+		if got, want := rsp.Header.Get("Retry-After"), "2"; got != want {
+			t.Errorf("Retry-After: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("PerIPLimit", func(t *testing.T) {
+		lst := wschannel.NewListener(&wschannel.ListenOptions{
+			MaxPending:    -1,
+			MaxConnsPerIP: 2,
+		})
+		defer lst.Close()
+
+		s := httptest.NewServer(lst)
+		defer s.Close()
+
+		for i := range 2 {
+			c, err := wschannel.Dial(fixURL(s.URL), nil)
+			if err != nil {
+				t.Fatalf("Client %d failed: %v", i+1, err)
+			}
+			defer c.Close()
+		}
+		if c, err := wschannel.Dial(fixURL(s.URL), nil); err == nil {
+			t.Errorf("Client 3 dial: got %+v, want error", c)
+			c.Close()
+		} else {
+			t.Logf("Client 3 dial: got expected error: %v", err)
+		}
+
+		// Closing a channel frees a slot for the address.
+		ch, err := lst.Accept(context.Background())
+		if err != nil {
+			t.Fatalf("Accept failed: %v", err)
+		}
+		ch.Close()
+		for i := 0; ; i++ {
+			c, err := wschannel.Dial(fixURL(s.URL), nil)
+			if err == nil {
+				c.Close()
+				break
+			} else if i > 20 {
+				t.Fatalf("Client 4 dial failed: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := lst.Metrics().IPLimited; got < 1 {
+			t.Errorf("Metrics IPLimited: got %d, want ≥ 1", got)
+		}
+	})
+
+	t.Run("ActiveLimit", func(t *testing.T) {
+		lst := wschannel.NewListener(&wschannel.ListenOptions{
+			MaxPending: -1,
+			MaxActive:  1,
+		})
+		defer lst.Close()
+
+		s := httptest.NewServer(lst)
+		defer s.Close()
+
+		c1, err := wschannel.Dial(fixURL(s.URL), nil)
+		if err != nil {
+			t.Fatalf("Client 1 failed: %v", err)
+		}
+		defer c1.Close()
+		ch, err := lst.Accept(context.Background())
+		if err != nil {
+			t.Fatalf("Accept failed: %v", err)
+		}
+
+		// The accepted channel still counts against the limit.
+		if c2, err := wschannel.Dial(fixURL(s.URL), nil); err == nil {
+			t.Errorf("Client 2 dial: got %+v, want error", c2)
+			c2.Close()
+		} else {
+			t.Logf("Client 2 dial: got expected error: %v", err)
+		}
+
+		// Closing the channel admits a new connection.
+		ch.Close()
+		for i := 0; ; i++ {
+			c3, err := wschannel.Dial(fixURL(s.URL), nil)
+			if err == nil {
+				c3.Close()
+				break
+			} else if i > 20 {
+				t.Fatalf("Client 3 dial failed: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	t.Run("Unbounded", func(t *testing.T) {
+		lst := wschannel.NewListener(&wschannel.ListenOptions{MaxPending: -1})
+		defer lst.Close()
+
+		s := httptest.NewServer(lst)
+		defer s.Close()
+
+		const numClients = 10
+		for i := range numClients {
+			c, err := wschannel.Dial(fixURL(s.URL), nil)
+			if err != nil {
+				t.Fatalf("Client %d failed: %v", i+1, err)
+			}
+			defer c.Close()
+		}
+		if got := lst.Pending(); got != numClients {
+			t.Errorf("Pending: got %d, want %d", got, numClients)
+		}
+		var accepted []channel.Channel
+		for i := range numClients {
+			ch, err := lst.Accept(context.Background())
+			if err != nil {
+				t.Fatalf("Accept %d failed: %v", i+1, err)
+			}
+			accepted = append(accepted, ch)
+		}
+		if got := lst.Pending(); got != 0 {
+			t.Errorf("Pending: got %d, want 0", got)
+		}
+		if got := lst.Active(); got != numClients {
+			t.Errorf("Active: got %d, want %d", got, numClients)
+		}
+		for _, ch := range accepted {
+			ch.Close()
+		}
+	})
+}
+
+func TestDialAny(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{MaxPending: 4})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	// A server that is not listening for websocket connections.
+	bad := httptest.NewServer(http.NotFoundHandler())
+	defer bad.Close()
+
+	t.Run("Failover", func(t *testing.T) {
+		ch, err := wschannel.DialAny(context.Background(), []string{
+			fixURL(bad.URL), fixURL(s.URL),
+		}, &wschannel.DialOptions{Timeout: time.Second})
+		if err != nil {
+			t.Fatalf("DialAny: unexpected error: %v", err)
+		}
+		ch.Close()
+	})
+
+	t.Run("Parallel", func(t *testing.T) {
+		ch, err := wschannel.DialAny(context.Background(), []string{
+			fixURL(bad.URL), fixURL(s.URL), fixURL(bad.URL),
+		}, &wschannel.DialOptions{Parallel: true})
+		if err != nil {
+			t.Fatalf("DialAny: unexpected error: %v", err)
+		}
+		ch.Close()
+	})
+
+	t.Run("AllFail", func(t *testing.T) {
+		ch, err := wschannel.DialAny(context.Background(), []string{
+			fixURL(bad.URL), fixURL(bad.URL),
+		}, nil)
+		if err == nil {
+			ch.Close()
+			t.Fatal("DialAny: got nil error, want failure")
+		}
+		t.Logf("DialAny: got expected error: %v", err)
+	})
+}
+
+func TestUserAgent(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *wschannel.DialOptions
+		want string
+	}{
+		{"Default", nil, wschannel.DefaultUserAgent},
+		{"Option", &wschannel.DialOptions{UserAgent: "test/1.0"}, "test/1.0"},
+		{"Header", &wschannel.DialOptions{
+			Header: http.Header{"User-Agent": {"header/2.0"}},
+		}, "header/2.0"},
+		{"Override", &wschannel.DialOptions{
+			Header:    http.Header{"User-Agent": {"header/2.0"}},
+			UserAgent: "test/1.0",
+		}, "test/1.0"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got string
+			lst := wschannel.NewListener(&wschannel.ListenOptions{
+				CheckAccept: func(req *http.Request) (int, error) {
+					got = req.UserAgent()
+					return 0, nil
+				},
+			})
+			defer lst.Close()
+			s := httptest.NewServer(lst)
+			defer s.Close()
+
+			ch, err := wschannel.Dial(fixURL(s.URL), tc.opts)
+			if err != nil {
+				t.Fatalf("Dial: unexpected error: %v", err)
+			}
+			ch.Close()
+			if got != tc.want {
+				t.Errorf("User-Agent: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Padding", strings.Repeat("x", 4096))
+		conn, err := websocket.Accept(w, req, nil)
+		if err == nil {
+			conn.CloseNow()
+		}
+	}))
+	defer s.Close()
+
+	ch, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{MaxHeaderBytes: 1024})
+	if err == nil {
+		ch.Close()
+		t.Fatal("Dial: got nil error, want header size failure")
+	}
+	t.Logf("Dial: got expected error: %v", err)
+
+	ch, err = wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{MaxHeaderBytes: 16384})
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	ch.Close()
+}
+
+func TestRedialer(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{MaxPending: 2})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	redial := wschannel.Redialer(fixURL(s.URL), nil)
+	for i := range 2 {
+		ch, err := redial()
+		if err != nil {
+			t.Fatalf("Redial %d: unexpected error: %v", i+1, err)
+		}
+		ch.Close()
+	}
+}
+
+func TestAcceptInfo(t *testing.T) {
+	lst := wschannel.NewListener(nil)
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	start := time.Now()
+	c, err := wschannel.Dial(fixURL(s.URL)+"/path?q=1", &wschannel.DialOptions{
+		Header: http.Header{"X-Test": {"ok"}},
+	})
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+
+	ch, info, err := lst.AcceptInfo(context.Background())
+	if err != nil {
+		t.Fatalf("AcceptInfo: unexpected error: %v", err)
+	}
+	defer ch.Close()
+
+	if info.RemoteAddr == "" {
+		t.Error("RemoteAddr is empty")
+	}
+	if got, want := info.URL.Path, "/path"; got != want {
+		t.Errorf("URL path: got %q, want %q", got, want)
+	}
+	if got, want := info.URL.Query().Get("q"), "1"; got != want {
+		t.Errorf("URL query: got %q, want %q", got, want)
+	}
+	if got, want := info.Header.Get("X-Test"), "ok"; got != want {
+		t.Errorf("Header X-Test: got %q, want %q", got, want)
+	}
+	if info.TLS != nil {
+		t.Errorf("TLS: got %+v, want nil", info.TLS)
+	}
+	if info.Queued.Before(start) {
+		t.Errorf("Queued: got %v, want after %v", info.Queued, start)
+	}
+}
+
+func TestSetValue(t *testing.T) {
+	type identity struct{ user string }
+
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		CheckAccept: func(req *http.Request) (int, error) {
+			user := req.Header.Get("X-User")
+			if user == "" {
+				return http.StatusUnauthorized, errors.New("no user")
+			}
+			wschannel.SetValue(req, identity{user})
+			return 0, nil
+		},
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{
+		Header: http.Header{"X-User": {"alice"}},
+	})
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+	if v := c.Value(); v != nil {
+		t.Errorf("Client value: got %v, want nil", v)
+	}
+
+	ch, _, err := lst.AcceptInfo(context.Background())
+	if err != nil {
+		t.Fatalf("AcceptInfo: unexpected error: %v", err)
+	}
+	defer ch.Close()
+
+	if got, want := ch.Value(), (identity{"alice"}); got != want {
+		t.Errorf("Value: got %v, want %v", got, want)
+	}
+}
+
+func TestResponseHeader(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		Header: http.Header{"X-Static": {"all"}},
+		CheckAccept: func(req *http.Request) (int, error) {
+			wschannel.ResponseHeader(req).Set("X-Session", req.Header.Get("X-Want"))
+			return 0, nil
+		},
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	conn, rsp, err := websocket.Dial(context.Background(), fixURL(s.URL), &websocket.DialOptions{
+		HTTPHeader: http.Header{"X-Want": {"s123"}},
+	})
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer conn.CloseNow()
+
+	if got, want := rsp.Header.Get("X-Static"), "all"; got != want {
+		t.Errorf("X-Static: got %q, want %q", got, want)
+	}
+	if got, want := rsp.Header.Get("X-Session"), "s123"; got != want {
+		t.Errorf("X-Session: got %q, want %q", got, want)
+	}
+}
+
+func TestServe(t *testing.T) {
+	var log logRecorder
+	lst := wschannel.NewListener(&wschannel.ListenOptions{MaxPending: -1, Logger: log.logger()})
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- lst.Serve(context.Background(), func(ch *wschannel.Channel) {
+			msg, err := ch.Recv()
+			if err != nil {
+				return
+			}
+			if string(msg) == "panic" {
+				panic("test panic")
+			}
+			ch.Send(msg) // echo
+		})
+	}()
+
+	for _, msg := range []string{"hello", "panic", "world"} {
+		c, err := wschannel.Dial(fixURL(s.URL), nil)
+		if err != nil {
+			t.Fatalf("Dial: unexpected error: %v", err)
+		}
+		if err := c.Send([]byte(msg)); err != nil {
+			t.Fatalf("Send %q: unexpected error: %v", msg, err)
+		}
+		got, err := c.Recv()
+		if msg == "panic" {
+			if code := websocket.CloseStatus(err); code != websocket.StatusInternalError {
+				t.Errorf("Recv: got (%q, %v), want status %v", got, err, websocket.StatusInternalError)
+			}
+			if !log.find("channel handler panicked", map[string]string{"panic": "test panic"}) {
+				t.Error("Handler panic was not logged")
+			}
+		} else if err != nil {
+			t.Errorf("Recv: unexpected error: %v", err)
+		} else if string(got) != msg {
+			t.Errorf("Recv: got %q, want %q", got, msg)
+		}
+		c.Close()
+	}
+
+	if err := lst.Close(); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve: unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for Serve to return")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	setup := func(t *testing.T, opts *wschannel.ListenOptions) (*wschannel.Listener, *wschannel.Channel) {
+		t.Helper()
+		lst := wschannel.NewListener(opts)
+		s := httptest.NewServer(lst)
+		t.Cleanup(s.Close)
+
+		c, err := wschannel.Dial(fixURL(s.URL), nil)
+		if err != nil {
+			t.Fatalf("Dial: unexpected error: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+
+		ch, _, err := lst.AcceptInfo(context.Background())
+		if err != nil {
+			t.Fatalf("AcceptInfo: unexpected error: %v", err)
+		}
+		t.Cleanup(func() { ch.Close() })
+
+		// Simulate a server that closes its channel when reads fail.
+		go func() {
+			defer ch.Close()
+			for {
+				if _, err := ch.Recv(); err != nil {
+					return
+				}
+			}
+		}()
+		return lst, c
+	}
+
+	t.Run("Notify", func(t *testing.T) {
+		lst, c := setup(t, &wschannel.ListenOptions{NotifyOnShutdown: true})
+
+		// The client must be reading to complete the close handshake.
+		recv := make(chan error, 1)
+		go func() { _, err := c.Recv(); recv <- err }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := lst.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: unexpected error: %v", err)
+		}
+		if err := <-recv; err == nil {
+			t.Error("Client Recv: got nil error, want error")
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		lst, _ := setup(t, nil)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := lst.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Shutdown: got %v, want %v", err, context.DeadlineExceeded)
+		}
 	})
 }
+
+func TestCloseActive(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{CloseActive: true})
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	c, err := wschannel.Dial(fixURL(s.URL), nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+
+	ch, err := lst.AcceptChannel(context.Background())
+	if err != nil {
+		t.Fatalf("AcceptChannel: unexpected error: %v", err)
+	}
+	if err := lst.Close(); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+
+	select {
+	case <-ch.Done():
+		t.Log("Accepted channel closed (OK)")
+	case <-time.After(time.Second):
+		t.Error("Timed out waiting for accepted channel to close")
+	}
+	if msg, err := c.Recv(); err == nil {
+		t.Errorf("Client Recv: got %q, want error", msg)
+	}
+}
+
+func TestErrorWriter(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		CheckAccept: func(*http.Request) (int, error) {
+			return http.StatusForbidden, errors.New("go away")
+		},
+		ErrorWriter: func(w http.ResponseWriter, _ *http.Request, code int, err error) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(code)
+			fmt.Fprintf(w, `{"code":%d,"error":%q}`, code, err.Error())
+		},
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	rsp, err := http.Get(s.URL)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	body, _ := io.ReadAll(rsp.Body)
+	rsp.Body.Close()
+
+	if got, want := rsp.StatusCode, http.StatusForbidden; got != want {
+		t.Errorf("Status: got %v, want %v", got, want)
+	}
+	if got, want := rsp.Header.Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("Content-Type: got %q, want %q", got, want)
+	}
+	if got, want := string(body), `{"code":403,"error":"go away"}`; got != want {
+		t.Errorf("Body: got %q, want %q", got, want)
+	}
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   *wschannel.ListenOptions
+		origin string
+		ok     bool
+	}{
+		{"NoOrigin", nil, "", true},
+		{"CrossDefault", nil, "http://example.com", false},
+		{"Exact", &wschannel.ListenOptions{
+			AllowedOrigins: []string{"example.com"},
+		}, "http://example.com", true},
+		{"ExactMismatch", &wschannel.ListenOptions{
+			AllowedOrigins: []string{"example.com"},
+		}, "http://evil.com", false},
+		{"Wildcard", &wschannel.ListenOptions{
+			AllowedOrigins: []string{"*.example.com"},
+		}, "https://app.example.com", true},
+		{"WildcardMismatch", &wschannel.ListenOptions{
+			AllowedOrigins: []string{"*.example.com"},
+		}, "https://example.com.evil.com", false},
+		{"AllowAll", &wschannel.ListenOptions{
+			AllowAllOrigins: true,
+		}, "http://anywhere.org", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			lst := wschannel.NewListener(tc.opts)
+			defer lst.Close()
+			s := httptest.NewServer(lst)
+			defer s.Close()
+
+			var hdr http.Header
+			if tc.origin != "" {
+				hdr = http.Header{"Origin": {tc.origin}}
+			}
+			c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{Header: hdr})
+			if err == nil {
+				c.Close()
+			}
+			if ok := err == nil; ok != tc.ok {
+				t.Errorf("Dial with origin %q: got err=%v, want ok=%v", tc.origin, err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestServeListener(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{Path: "/rpc"})
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- lst.ServeListener(nl) }()
+
+	base := "ws://" + nl.Addr().String()
+	if c, err := wschannel.Dial(base+"/other", nil); err == nil {
+		t.Error("Dial /other: got nil error, want failure")
+		c.Close()
+	}
+	c, err := wschannel.Dial(base+"/rpc", nil)
+	if err != nil {
+		t.Fatalf("Dial /rpc: unexpected error: %v", err)
+	}
+	defer c.Close()
+
+	if err := lst.Close(); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+	select {
+	case err := <-served:
+		if !errors.Is(err, wschannel.ErrListenerClosed) {
+			t.Errorf("ServeListener: got %v, want %v", err, wschannel.ErrListenerClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for ServeListener to return")
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		MaxPending: -1,
+		Path:       "/rpc",
+		AdminPath:  "/debug/wschannel",
+	})
+	defer lst.Close()
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go lst.ServeListener(nl)
+
+	base := nl.Addr().String()
+	for i := range 2 {
+		c, err := wschannel.Dial("ws://"+base+"/rpc", nil)
+		if err != nil {
+			t.Fatalf("Dial %d: unexpected error: %v", i+1, err)
+		}
+		defer c.Close()
+		if err := c.Send([]byte("hello")); err != nil {
+			t.Fatalf("Send %d: unexpected error: %v", i+1, err)
+		}
+	}
+	ch, err := lst.AcceptChannel(context.Background())
+	if err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+	defer ch.Close()
+	if _, err := ch.Recv(); err != nil {
+		t.Fatalf("Recv: unexpected error: %v", err)
+	}
+
+	admin := "http://" + base + "/debug/wschannel"
+	rsp, err := http.Get(admin)
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	var status struct {
+		Pending  int
+		Channels []struct {
+			ID            string
+			Path          string
+			BytesReceived int64
+			LastRecv      *time.Time
+		}
+	}
+	err = json.NewDecoder(rsp.Body).Decode(&status)
+	rsp.Body.Close()
+	if err != nil {
+		t.Fatalf("Decode status: %v", err)
+	}
+	if status.Pending != 1 || len(status.Channels) != 2 {
+		t.Fatalf("Status: got %+v, want 1 pending and 2 channels", status)
+	}
+	if got := status.Channels[0]; got.ID != ch.Info().ID || got.Path != "/rpc" || got.BytesReceived != 5 {
+		t.Errorf("Channel 0: got %+v, want ID %q, path /rpc, 5 bytes received", got, ch.Info().ID)
+	}
+	if got := status.Channels[0].LastRecv; got == nil || !got.Equal(ch.LastRecv()) {
+		t.Errorf("Channel 0 last recv: got %v, want %v", got, ch.LastRecv())
+	}
+
+	post := func(id string, header bool) int {
+		t.Helper()
+		req, err := http.NewRequest("POST", admin, strings.NewReader(url.Values{"id": {id}}.Encode()))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if header {
+			req.Header.Set(wschannel.AdminHeader, "1")
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Post: unexpected error: %v", err)
+		}
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+
+	// A request without the admin header is refused, as a form submitted by a
+	// browser from another site would be.
+	if got := post(ch.Info().ID, false); got != http.StatusForbidden {
+		t.Errorf("Post without header: got %v, want %v", got, http.StatusForbidden)
+	}
+	select {
+	case <-ch.Done():
+		t.Fatal("Channel closed by a request without the admin header")
+	default:
+	}
+
+	// Close the accepted channel by its ID.
+	if got := post(ch.Info().ID, true); got != http.StatusNoContent {
+		t.Errorf("Post status: got %v, want %v", got, http.StatusNoContent)
+	}
+	select {
+	case <-ch.Done():
+		// OK
+	case <-time.After(time.Second):
+		t.Error("Timed out waiting for the channel to close")
+	}
+
+	if got := post("nonesuch", true); got != http.StatusNotFound {
+		t.Errorf("Post status: got %v, want %v", got, http.StatusNotFound)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		Path:       "/rpc",
+		HealthPath: "/healthz",
+	})
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go lst.ServeListener(nl)
+	defer lst.Close()
+
+	c, err := wschannel.Dial("ws://"+nl.Addr().String()+"/rpc", nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+
+	// Use the handler directly, so that it remains reachable after the
+	// listener closes.
+	h := lst.HealthHandler()
+	check := func(wantCode int, want string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+		if rec.Code != wantCode {
+			t.Errorf("Status code: got %v, want %v", rec.Code, wantCode)
+		}
+		if got := strings.TrimSpace(rec.Body.String()); got != want {
+			t.Errorf("Health: got %s, want %s", got, want)
+		}
+	}
+
+	rsp, err := http.Get("http://" + nl.Addr().String() + "/healthz")
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Errorf("Get status: got %v, want %v", rsp.StatusCode, http.StatusOK)
+	}
+	check(http.StatusOK, `{"status":"accepting","pending":1,"active":1}`)
+
+	lst.Pause()
+	check(http.StatusServiceUnavailable, `{"status":"paused","pending":1,"active":1}`)
+	lst.Resume()
+
+	lst.Close()
+	check(http.StatusServiceUnavailable, `{"status":"closed","pending":0,"active":1}`)
+}
+
+func TestRegisterOnShutdown(t *testing.T) {
+	lst := wschannel.NewListener(nil)
+	s := httptest.NewServer(lst)
+	defer s.Close()
+	lst.RegisterOnShutdown(s.Config)
+
+	conn, _, err := websocket.Dial(context.Background(), fixURL(s.URL), nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer conn.CloseNow()
+	ch, err := lst.AcceptChannel(context.Background())
+	if err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Config.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown: unexpected error: %v", err)
+	}
+	select {
+	case <-ch.Done():
+		// OK
+	case <-ctx.Done():
+		t.Fatal("Timed out waiting for the channel to close")
+	}
+	_, _, err = conn.Read(context.Background())
+	if got, want := websocket.CloseStatus(err), websocket.StatusGoingAway; got != want {
+		t.Errorf("Read: got status %v (%v), want %v", got, err, want)
+	}
+	if _, err := lst.Accept(ctx); !errors.Is(err, wschannel.ErrListenerClosed) {
+		t.Errorf("Accept: got %v, want %v", err, wschannel.ErrListenerClosed)
+	}
+}
+
+func TestServeListenerTLS(t *testing.T) {
+	// Borrow a certificate and a client that trusts it from httptest.
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	lst := wschannel.NewListener(&wschannel.ListenOptions{TLSConfig: ts.TLS})
+	defer lst.Close()
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go lst.ServeListenerTLS(nl, "", "")
+
+	c, err := wschannel.Dial("wss://"+nl.Addr().String(), &wschannel.DialOptions{
+		HTTPClient: ts.Client(),
+	})
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+
+	_, info, err := lst.AcceptInfo(context.Background())
+	if err != nil {
+		t.Fatalf("AcceptInfo: unexpected error: %v", err)
+	}
+	if info.TLS == nil {
+		t.Error("Connection info has no TLS state")
+	}
+}
+
+func TestMux(t *testing.T) {
+	var mux wschannel.Mux
+	v1 := mux.Listen("/rpc/v1", nil)
+	admin := mux.Listen("/admin", &wschannel.ListenOptions{MaxPending: 2})
+	defer mux.Close()
+
+	if got := mux.Listener("/rpc/v1"); got != v1 {
+		t.Errorf("Listener /rpc/v1: got %p, want %p", got, v1)
+	}
+	if got := mux.Listener("/nonesuch"); got != nil {
+		t.Errorf("Listener /nonesuch: got %p, want nil", got)
+	}
+
+	s := httptest.NewServer(&mux)
+	defer s.Close()
+
+	for _, tc := range []struct {
+		path string
+		lst  *wschannel.Listener
+	}{{"/rpc/v1", v1}, {"/admin", admin}} {
+		c, err := wschannel.Dial(fixURL(s.URL)+tc.path, nil)
+		if err != nil {
+			t.Fatalf("Dial %q: unexpected error: %v", tc.path, err)
+		}
+		defer c.Close()
+
+		_, info, err := tc.lst.AcceptInfo(context.Background())
+		if err != nil {
+			t.Fatalf("AcceptInfo %q: unexpected error: %v", tc.path, err)
+		}
+		if info.URL.Path != tc.path {
+			t.Errorf("Accepted path: got %q, want %q", info.URL.Path, tc.path)
+		}
+	}
+
+	if c, err := wschannel.Dial(fixURL(s.URL)+"/other", nil); err == nil {
+		t.Error("Dial /other: got nil error, want failure")
+		c.Close()
+	}
+
+	if err := mux.Close(); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+	if _, err := v1.Accept(context.Background()); !errors.Is(err, wschannel.ErrListenerClosed) {
+		t.Errorf("Accept after Close: got %v, want %v", err, wschannel.ErrListenerClosed)
+	}
+}
+
+func TestAcceptFunc(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{MaxPending: -1})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	var clients []*wschannel.Channel
+	for _, tenant := range []string{"draining", "draining", "active"} {
+		c, err := wschannel.Dial(fixURL(s.URL)+"?tenant="+tenant, nil)
+		if err != nil {
+			t.Fatalf("Dial %q: unexpected error: %v", tenant, err)
+		}
+		defer c.Close()
+		clients = append(clients, c)
+	}
+
+	ch, err := lst.AcceptFunc(context.Background(), func(ci *wschannel.ConnInfo) bool {
+		return ci.URL.Query().Get("tenant") != "draining"
+	})
+	if err != nil {
+		t.Fatalf("AcceptFunc: unexpected error: %v", err)
+	}
+	defer ch.Close()
+
+	// The discarded clients should see their connections close.
+	for i, c := range clients[:2] {
+		if msg, err := c.Recv(); err == nil {
+			t.Errorf("Client %d Recv: got %q, want error", i+1, msg)
+		}
+	}
+	if m := lst.Metrics(); m.Accepted != 1 || m.Filtered != 2 {
+		t.Errorf("Metrics: got %+v, want 1 accepted and 2 filtered", m)
+	}
+}
+
+func TestChannelOptions(t *testing.T) {
+	// accept dials lst and returns the client and server ends of a channel.
+	accept := func(t *testing.T, opts *wschannel.ChannelOptions) (client *websocket.Conn, server *wschannel.Channel) {
+		t.Helper()
+		lst := wschannel.NewListener(&wschannel.ListenOptions{Channel: opts})
+		t.Cleanup(func() { lst.Close() })
+		s := httptest.NewServer(lst)
+		t.Cleanup(s.Close)
+
+		conn, _, err := websocket.Dial(context.Background(), fixURL(s.URL), nil)
+		if err != nil {
+			t.Fatalf("Dial: unexpected error: %v", err)
+		}
+		t.Cleanup(func() { conn.CloseNow() })
+		ch, _, err := lst.AcceptInfo(context.Background())
+		if err != nil {
+			t.Fatalf("AcceptInfo: unexpected error: %v", err)
+		}
+		t.Cleanup(func() { ch.Close() })
+		return conn, ch
+	}
+
+	t.Run("Text", func(t *testing.T) {
+		conn, ch := accept(t, &wschannel.ChannelOptions{Text: true})
+		if err := ch.Send([]byte("hello")); err != nil {
+			t.Fatalf("Send: unexpected error: %v", err)
+		}
+		typ, msg, err := conn.Read(context.Background())
+		if err != nil {
+			t.Fatalf("Read: unexpected error: %v", err)
+		}
+		if typ != websocket.MessageText || string(msg) != "hello" {
+			t.Errorf("Read: got %v %q, want %v %q", typ, msg, websocket.MessageText, "hello")
+		}
+	})
+
+	t.Run("ReadLimit", func(t *testing.T) {
+		conn, ch := accept(t, &wschannel.ChannelOptions{ReadLimit: 16})
+		ctx := context.Background()
+		if err := conn.Write(ctx, websocket.MessageBinary, []byte("short")); err != nil {
+			t.Fatalf("Write: unexpected error: %v", err)
+		}
+		if msg, err := ch.Recv(); err != nil || string(msg) != "short" {
+			t.Errorf("Recv: got %q, %v; want %q, nil", msg, err, "short")
+		}
+		go conn.Write(ctx, websocket.MessageBinary, []byte(strings.Repeat("x", 64)))
+		if msg, err := ch.Recv(); err == nil {
+			t.Errorf("Recv: got %q, want error", msg)
+		}
+	})
+
+	t.Run("ReadTimeout", func(t *testing.T) {
+		_, ch := accept(t, &wschannel.ChannelOptions{ReadTimeout: 50 * time.Millisecond})
+		if msg, err := ch.Recv(); err == nil {
+			t.Errorf("Recv: got %q, want error", msg)
+		}
+	})
+}
+
+func TestCompression(t *testing.T) {
+	for _, enable := range []bool{false, true} {
+		t.Run(fmt.Sprint(enable), func(t *testing.T) {
+			lst := wschannel.NewListener(&wschannel.ListenOptions{EnableCompression: enable})
+			defer lst.Close()
+			s := httptest.NewServer(lst)
+			defer s.Close()
+
+			conn, rsp, err := websocket.Dial(context.Background(), fixURL(s.URL), &websocket.DialOptions{
+				CompressionMode: websocket.CompressionNoContextTakeover,
+			})
+			if err != nil {
+				t.Fatalf("Dial: unexpected error: %v", err)
+			}
+			defer conn.CloseNow()
+
+			ext := rsp.Header.Get("Sec-WebSocket-Extensions")
+			if got := strings.Contains(ext, "permessage-deflate"); got != enable {
+				t.Errorf("Extensions: got %q, want deflate %v", ext, enable)
+			}
+		})
+	}
+
+	t.Run("Channel", func(t *testing.T) {
+		lst := wschannel.NewListener(&wschannel.ListenOptions{EnableCompression: true})
+		defer lst.Close()
+		s := httptest.NewServer(lst)
+		defer s.Close()
+
+		c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{
+			EnableCompression:    true,
+			CompressionThreshold: 1,
+		})
+		if err != nil {
+			t.Fatalf("Dial: unexpected error: %v", err)
+		}
+		defer c.Close()
+		ch, err := lst.Accept(context.Background())
+		if err != nil {
+			t.Fatalf("Accept: unexpected error: %v", err)
+		}
+		defer ch.Close()
+
+		msg := strings.Repeat("compressible ", 100)
+		if err := c.Send([]byte(msg)); err != nil {
+			t.Fatalf("Send: unexpected error: %v", err)
+		}
+		if got, err := ch.Recv(); err != nil || string(got) != msg {
+			t.Errorf("Recv: got %q, %v; want %q, nil", got, err, msg)
+		}
+	})
+}
+
+func TestCloseContext(t *testing.T) {
+	setup := func(t *testing.T) (*wschannel.Listener, *wschannel.Channel) {
+		t.Helper()
+		lst := wschannel.NewListener(nil)
+		s := httptest.NewServer(lst)
+		t.Cleanup(s.Close)
+
+		c, err := wschannel.Dial(fixURL(s.URL), nil)
+		if err != nil {
+			t.Fatalf("Dial: unexpected error: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return lst, c
+	}
+
+	t.Run("Complete", func(t *testing.T) {
+		lst, c := setup(t)
+		go c.Recv() // the client must read to complete the handshake
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := lst.CloseContext(ctx); err != nil {
+			t.Errorf("CloseContext: unexpected error: %v", err)
+		}
+		if err := lst.CloseContext(ctx); !errors.Is(err, wschannel.ErrListenerClosed) {
+			t.Errorf("CloseContext again: got %v, want %v", err, wschannel.ErrListenerClosed)
+		}
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		lst, _ := setup(t) // the client does not read
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		if err := lst.CloseContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("CloseContext: got %v, want %v", err, context.DeadlineExceeded)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("CloseContext took %v, want prompt return", d)
+		}
+	})
+}
+
+func TestPauseResume(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		MaxPending: -1,
+		RetryAfter: 30 * time.Second,
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	c1, err := wschannel.Dial(fixURL(s.URL), nil)
+	if err != nil {
+		t.Fatalf("Dial 1: unexpected error: %v", err)
+	}
+	defer c1.Close()
+
+	lst.Pause()
+	c2, rsp, err := websocket.Dial(context.Background(), fixURL(s.URL), nil)
+	if err == nil {
+		c2.CloseNow()
+		t.Fatal("Dial while paused: got nil error, want failure")
+	}
+	if got, want := rsp.StatusCode, http.StatusServiceUnavailable; got != want {
+		t.Errorf("Status: got %v, want %v", got, want)
+	}
+	if got, want := rsp.Header.Get("Retry-After"), "30"; got != want {
+		t.Errorf("Retry-After: got %q, want %q", got, want)
+	}
+	if got := lst.Pending(); got != 1 {
+		t.Errorf("Pending while paused: got %d, want 1", got)
+	}
+
+	lst.Resume()
+	c3, err := wschannel.Dial(fixURL(s.URL), nil)
+	if err != nil {
+		t.Fatalf("Dial after resume: unexpected error: %v", err)
+	}
+	c3.Close()
+	if got := lst.Metrics().Paused; got != 1 {
+		t.Errorf("Metrics Paused: got %d, want 1", got)
+	}
+}
+
+func TestPendingTimeout(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		PendingTimeout: 50 * time.Millisecond,
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	conn, _, err := websocket.Dial(context.Background(), fixURL(s.URL), nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer conn.CloseNow()
+
+	// Nobody calls Accept, so the connection should expire.
+	_, _, err = conn.Read(context.Background())
+	if got, want := websocket.CloseStatus(err), websocket.StatusTryAgainLater; got != want {
+		t.Errorf("Read: got status %v (%v), want %v", got, err, want)
+	}
+	if got := lst.Pending(); got != 0 {
+		t.Errorf("Pending: got %d, want 0", got)
+	}
+	if got := lst.Metrics().Expired; got != 1 {
+		t.Errorf("Metrics Expired: got %d, want 1", got)
+	}
+}
+
+func TestPendingTimeoutRace(t *testing.T) {
+	// Accept channels while others are being admitted, so that the pending
+	// timers are set and stopped concurrently. Run with -race. The clock
+	// delays starting each timer, to widen the window for a race.
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		MaxPending:     -1,
+		PendingTimeout: time.Minute,
+		Channel:        &wschannel.ChannelOptions{Clock: slowTimerClock{wschannel.SystemClock}},
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	const numConns = 64
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range numConns / 4 {
+				ch, err := lst.AcceptChannel(context.Background())
+				if err != nil {
+					t.Errorf("Accept: unexpected error: %v", err)
+					return
+				}
+				ch.Close()
+			}
+		}()
+	}
+	for range numConns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := wschannel.Dial(fixURL(s.URL), nil)
+			if err != nil {
+				t.Errorf("Dial: unexpected error: %v", err)
+				return
+			}
+			c.Close()
+		}()
+	}
+	wg.Wait()
+	if got := lst.Metrics().Expired; got != 0 {
+		t.Errorf("Metrics Expired: got %d, want 0", got)
+	}
+}
+
+// slowTimerClock is a Clock that pauses before starting each AfterFunc timer.
+type slowTimerClock struct{ wschannel.Clock }
+
+func (c slowTimerClock) AfterFunc(d time.Duration, f func()) wschannel.Timer {
+	time.Sleep(time.Millisecond)
+	return c.Clock.AfterFunc(d, f)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	reaped := make(chan *wschannel.Channel, 1)
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		IdleTimeout: 100 * time.Millisecond,
+		OnReap:      func(ch *wschannel.Channel) { reaped <- ch },
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	conn, _, err := websocket.Dial(context.Background(), fixURL(s.URL), nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer conn.CloseNow()
+
+	ch, err := lst.AcceptChannel(context.Background())
+	if err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+	defer ch.Close()
+
+	// Activity on the channel should defer reaping.
+	for range 3 {
+		time.Sleep(60 * time.Millisecond)
+		if err := ch.Send([]byte("ping")); err != nil {
+			t.Fatalf("Send: unexpected error: %v", err)
+		}
+		if _, _, err := conn.Read(context.Background()); err != nil {
+			t.Fatalf("Read: unexpected error: %v", err)
+		}
+	}
+	select {
+	case <-reaped:
+		t.Fatal("Channel was reaped while active")
+	default:
+	}
+
+	// Once the channel goes idle, it should be closed.
+	_, _, err = conn.Read(context.Background())
+	if got, want := websocket.CloseStatus(err), websocket.StatusGoingAway; got != want {
+		t.Errorf("Read: got status %v (%v), want %v", got, err, want)
+	}
+	if got := <-reaped; got != ch {
+		t.Errorf("OnReap: got channel %p, want %p", got, ch)
+	}
+	if got := lst.Metrics().Reaped; got != 1 {
+		t.Errorf("Metrics Reaped: got %d, want 1", got)
+	}
+}
+
+func TestPingPolicy(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		MaxPending: 2,
+		PingPolicy: &wschannel.PingPolicy{
+			Interval: 50 * time.Millisecond,
+			Timeout:  50 * time.Millisecond,
+		},
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	// accept returns a server channel that is being read continuously, so
+	// that pongs are delivered.
+	accept := func() *wschannel.Channel {
+		t.Helper()
+		ch, err := lst.AcceptChannel(context.Background())
+		if err != nil {
+			t.Fatalf("Accept: unexpected error: %v", err)
+		}
+		go func() {
+			for {
+				if _, err := ch.Recv(); err != nil {
+					return
+				}
+			}
+		}()
+		return ch
+	}
+
+	t.Run("Alive", func(t *testing.T) {
+		conn, _, err := websocket.Dial(context.Background(), fixURL(s.URL), nil)
+		if err != nil {
+			t.Fatalf("Dial: unexpected error: %v", err)
+		}
+		defer conn.CloseNow()
+		ctx := conn.CloseRead(context.Background()) // respond to pings
+
+		ch := accept()
+		defer ch.Close()
+		select {
+		case <-ch.Done():
+			t.Error("Channel closed while the peer was responsive")
+		case <-ctx.Done():
+			t.Error("Client connection closed unexpectedly")
+		case <-time.After(300 * time.Millisecond):
+			// OK
+		}
+	})
+
+	t.Run("Dead", func(t *testing.T) {
+		conn, _, err := websocket.Dial(context.Background(), fixURL(s.URL), nil)
+		if err != nil {
+			t.Fatalf("Dial: unexpected error: %v", err)
+		}
+		defer conn.CloseNow()
+
+		// The client does not read, so it never responds to pings.
+		ch := accept()
+		select {
+		case <-ch.Done():
+			// OK
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for the channel to close")
+		}
+		_, _, err = conn.Read(context.Background())
+		if got, want := websocket.CloseStatus(err), websocket.StatusGoingAway; got != want {
+			t.Errorf("Read: got status %v (%v), want %v", got, err, want)
+		}
+	})
+}
+
+func TestOnQueueFull(t *testing.T) {
+	t.Run("Respond", func(t *testing.T) {
+		lst := wschannel.NewListener(&wschannel.ListenOptions{
+			OnQueueFull: func(w http.ResponseWriter, req *http.Request) bool {
+				http.Redirect(w, req, "/elsewhere", http.StatusTemporaryRedirect)
+				return false
+			},
+		})
+		defer lst.Close()
+		s := httptest.NewServer(lst)
+		defer s.Close()
+
+		c1, err := wschannel.Dial(fixURL(s.URL), nil)
+		if err != nil {
+			t.Fatalf("Dial 1: unexpected error: %v", err)
+		}
+		defer c1.Close()
+
+		cli := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+		c2, rsp, err := websocket.Dial(context.Background(), fixURL(s.URL), &websocket.DialOptions{
+			HTTPClient: cli,
+		})
+		if err == nil {
+			c2.CloseNow()
+			t.Fatal("Dial 2: got nil error, want failure")
+		}
+		if got, want := rsp.StatusCode, http.StatusTemporaryRedirect; got != want {
+			t.Errorf("Status: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Wait", func(t *testing.T) {
+		lst := wschannel.NewListener(&wschannel.ListenOptions{
+			OnQueueFull: func(http.ResponseWriter, *http.Request) bool {
+				time.Sleep(10 * time.Millisecond)
+				return true
+			},
+		})
+		defer lst.Close()
+		s := httptest.NewServer(lst)
+		defer s.Close()
+
+		c1, err := wschannel.Dial(fixURL(s.URL), nil)
+		if err != nil {
+			t.Fatalf("Dial 1: unexpected error: %v", err)
+		}
+		defer c1.Close()
+
+		// Make space in the queue after a short delay.
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			if ch, err := lst.Accept(context.Background()); err == nil {
+				ch.Close()
+			}
+		}()
+
+		c2, err := wschannel.Dial(fixURL(s.URL), nil)
+		if err != nil {
+			t.Fatalf("Dial 2: unexpected error: %v", err)
+		}
+		c2.Close()
+		if got := lst.Metrics().QueueFull; got == 0 {
+			t.Error("Metrics QueueFull: got 0, want > 0")
+		}
+	})
+}
+
+func TestRejectedError(t *testing.T) {
+	var mu sync.Mutex
+	var got []error
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		CheckAccept: func(req *http.Request) (int, error) {
+			if req.URL.Query().Get("ok") == "" {
+				return http.StatusForbidden, errors.New("not ok")
+			}
+			return 0, nil
+		},
+		ErrorWriter: func(w http.ResponseWriter, _ *http.Request, code int, err error) {
+			mu.Lock()
+			got = append(got, err)
+			mu.Unlock()
+			http.Error(w, err.Error(), code)
+		},
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	c1, err := wschannel.Dial(fixURL(s.URL)+"?ok=1", nil)
+	if err != nil {
+		t.Fatalf("Dial 1: unexpected error: %v", err)
+	}
+	defer c1.Close()
+
+	tests := []struct {
+		query string
+		code  int
+		want  string
+		cause error
+	}{
+		{"", http.StatusForbidden, "not ok", nil},
+		{"?ok=1", http.StatusServiceUnavailable, "connection queue is full", wschannel.ErrQueueFull},
+	}
+	for _, tc := range tests {
+		_, err := wschannel.Dial(fixURL(s.URL)+tc.query, nil)
+		var rerr *wschannel.RejectedError
+		if !errors.As(err, &rerr) {
+			t.Errorf("Dial %q: got %v, want *RejectedError", tc.query, err)
+			continue
+		}
+		if rerr.Code != tc.code || rerr.Reason != tc.want {
+			t.Errorf("Dial %q: got (%d, %q), want (%d, %q)", tc.query, rerr.Code, rerr.Reason, tc.code, tc.want)
+		}
+		if !errors.Is(err, wschannel.ErrUpgradeFailed) {
+			t.Errorf("Dial %q: got %v, want %v", tc.query, err, wschannel.ErrUpgradeFailed)
+		}
+	}
+
+	// Check the errors reported to the server's error writer.
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != len(tests) {
+		t.Fatalf("Got %d server errors, want %d", len(got), len(tests))
+	}
+	for i, tc := range tests {
+		var rerr *wschannel.RejectedError
+		if !errors.As(got[i], &rerr) || rerr.Code != tc.code {
+			t.Errorf("Server error %d: got %v, want *RejectedError with code %d", i+1, got[i], tc.code)
+		}
+		if tc.cause != nil && !errors.Is(got[i], tc.cause) {
+			t.Errorf("Server error %d: got %v, want %v", i+1, got[i], tc.cause)
+		}
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		key     string
+		header  http.Header
+		want    string
+	}{
+		{"Direct", nil, "", nil, "127.0.0.1"},
+		{"Untrusted", nil, "", http.Header{"X-Forwarded-For": {"203.0.113.5"}}, "127.0.0.1"},
+		{"XFF", []string{"127.0.0.1"}, "",
+			http.Header{"X-Forwarded-For": {"203.0.113.5"}}, "203.0.113.5"},
+		{"XFFChain", []string{"127.0.0.1", "10.0.0.0/8"}, "",
+			http.Header{"X-Forwarded-For": {"198.51.100.1, 203.0.113.5", "10.1.2.3"}}, "203.0.113.5"},
+		{"XFFUntrustedHop", []string{"127.0.0.1"}, "",
+			http.Header{"X-Forwarded-For": {"203.0.113.5, 10.1.2.3"}}, "10.1.2.3"},
+		{"Forwarded", []string{"127.0.0.0/8"}, "Forwarded",
+			http.Header{"Forwarded": {`for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"`}},
+			"2001:db8:cafe::17"},
+		{"ForwardedSpoofed", []string{"127.0.0.1", "10.0.0.0/8"}, "", http.Header{
+			"Forwarded":       {"for=192.0.2.60"},
+			"X-Forwarded-For": {"203.0.113.5, 10.1.2.3"},
+		}, "203.0.113.5"},
+		{"XFFSpoofed", []string{"127.0.0.1"}, "Forwarded", http.Header{
+			"Forwarded":       {"for=192.0.2.60"},
+			"X-Forwarded-For": {"203.0.113.5"},
+		}, "192.0.2.60"},
+		{"CustomHeader", []string{"127.0.0.1"}, "X-Real-IP", http.Header{
+			"X-Real-Ip":       {"198.51.100.7"},
+			"X-Forwarded-For": {"203.0.113.5"},
+		}, "198.51.100.7"},
+		{"Malformed", []string{"127.0.0.1"}, "",
+			http.Header{"X-Forwarded-For": {"bogus"}}, "127.0.0.1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			lst := wschannel.NewListener(&wschannel.ListenOptions{
+				TrustedProxies: tc.trusted,
+				ProxyHeader:    tc.key,
+			})
+			defer lst.Close()
+			s := httptest.NewServer(lst)
+			defer s.Close()
+
+			c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{Header: tc.header})
+			if err != nil {
+				t.Fatalf("Dial: unexpected error: %v", err)
+			}
+			defer c.Close()
+			_, info, err := lst.AcceptInfo(context.Background())
+			if err != nil {
+				t.Fatalf("AcceptInfo: unexpected error: %v", err)
+			}
+			if got := info.ClientIP.String(); got != tc.want {
+				t.Errorf("ClientIP: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewServerConn(t *testing.T) {
+	chs := make(chan *wschannel.Channel, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := websocket.Accept(w, req, nil)
+		if err != nil {
+			return
+		}
+		ch := wschannel.NewServerConn(conn, req, &wschannel.ChannelOptions{Text: true})
+		chs <- ch
+		<-ch.Done()
+	}))
+	defer s.Close()
+
+	c, err := wschannel.Dial(fixURL(s.URL)+"/framework", nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+
+	ch := <-chs
+	defer ch.Close()
+	if info := ch.Info(); info == nil {
+		t.Error("Info: got nil, want connection info")
+	} else if info.URL.Path != "/framework" || !info.ClientIP.IsLoopback() {
+		t.Errorf("Info: got path %q, client %v; want /framework, loopback", info.URL.Path, info.ClientIP)
+	}
+	if info := c.Info(); info != nil {
+		t.Errorf("Client Info: got %+v, want nil", info)
+	}
+
+	if err := ch.Send([]byte("hi")); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+	if got, err := c.Recv(); err != nil || string(got) != "hi" {
+		t.Errorf("Recv: got %q, %v; want %q, nil", got, err, "hi")
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	var calls atomic.Int32
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		MaxPending: 2,
+		Upgrade: func(w http.ResponseWriter, req *http.Request) (*websocket.Conn, error) {
+			calls.Add(1)
+			if req.Header.Get("X-Deny") != "" {
+				http.Error(w, "denied by upgrader", http.StatusForbidden)
+				return nil, errors.New("denied")
+			}
+			return websocket.Accept(w, req, nil)
+		},
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	c, err := wschannel.Dial(fixURL(s.URL), nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+
+	_, err = wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{
+		Header: http.Header{"X-Deny": {"1"}},
+	})
+	var rerr *wschannel.RejectedError
+	if !errors.As(err, &rerr) || rerr.Code != http.StatusForbidden {
+		t.Errorf("Dial denied: got %v, want *RejectedError with code %d", err, http.StatusForbidden)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("Upgrade calls: got %d, want 2", got)
+	}
+	if m := lst.Metrics(); m.Upgraded != 1 || m.UpgradeFailed != 1 {
+		t.Errorf("Metrics: got %+v, want 1 upgraded, 1 failed", m)
+	}
+}
+
+func TestUpgradeUnlocked(t *testing.T) {
+	// The Upgrade hook runs without the listener's lock, so a slow upgrade
+	// does not stall other admissions, and the hook may call the listener.
+	var lst *wschannel.Listener
+	block := make(chan struct{})
+	lst = wschannel.NewListener(&wschannel.ListenOptions{
+		MaxPending: -1,
+		Upgrade: func(w http.ResponseWriter, req *http.Request) (*websocket.Conn, error) {
+			lst.Active()
+			if req.Header.Get("X-Block") != "" {
+				<-block
+			}
+			return websocket.Accept(w, req, nil)
+		},
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	slow := make(chan error, 1)
+	go func() {
+		c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{
+			Header: http.Header{"X-Block": {"1"}},
+		})
+		if err == nil {
+			c.Close()
+		}
+		slow <- err
+	}()
+
+	c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+	if got := lst.Active(); got != 1 {
+		t.Errorf("Active: got %d, want 1", got)
+	}
+
+	close(block)
+	if err := <-slow; err != nil {
+		t.Errorf("Dial blocked: unexpected error: %v", err)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{MaxPending: -1})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	if got := lst.Channels(); len(got) != 0 {
+		t.Errorf("Channels: got %d, want 0", len(got))
+	}
+	for i := range 3 {
+		c, err := wschannel.Dial(fixURL(s.URL)+fmt.Sprintf("/c%d", i), nil)
+		if err != nil {
+			t.Fatalf("Dial %d: unexpected error: %v", i, err)
+		}
+		defer c.Close()
+	}
+
+	chs := lst.Channels()
+	if len(chs) != 3 {
+		t.Fatalf("Channels: got %d, want 3", len(chs))
+	}
+	for i, ch := range chs {
+		if got, want := ch.Info().URL.Path, fmt.Sprintf("/c%d", i); got != want {
+			t.Errorf("Channel %d path: got %q, want %q", i, got, want)
+		}
+	}
+
+	// Closing a channel removes it from the snapshot.
+	chs[1].Close()
+	for i := 0; ; i++ {
+		if got := lst.Channels(); len(got) == 2 {
+			break
+		} else if i > 20 {
+			t.Fatalf("Channels after close: got %d, want 2", len(got))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	const message = "attention all planets"
+	lst := wschannel.NewListener(&wschannel.ListenOptions{MaxPending: -1})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	var clients []*wschannel.Channel
+	for i := range 3 {
+		c, err := wschannel.Dial(fixURL(s.URL), nil)
+		if err != nil {
+			t.Fatalf("Dial %d: unexpected error: %v", i+1, err)
+		}
+		defer c.Close()
+		clients = append(clients, c)
+	}
+
+	// Accept only the first two; the third remains pending.
+	for i := range 2 {
+		ch, err := lst.AcceptChannel(context.Background())
+		if err != nil {
+			t.Fatalf("Accept %d: unexpected error: %v", i+1, err)
+		}
+		defer ch.Close()
+	}
+
+	if err := lst.Broadcast(context.Background(), []byte(message)); err != nil {
+		t.Fatalf("Broadcast: unexpected error: %v", err)
+	}
+	for i, c := range clients[:2] {
+		got, err := c.Recv()
+		if err != nil {
+			t.Errorf("Client %d Recv: unexpected error: %v", i+1, err)
+		} else if string(got) != message {
+			t.Errorf("Client %d Recv: got %q, want %q", i+1, got, message)
+		}
+	}
+
+	// The pending client should not have received the message.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	ch, err := lst.AcceptChannel(ctx)
+	if err != nil {
+		t.Fatalf("Accept 3: unexpected error: %v", err)
+	}
+	defer ch.Close()
+	if err := ch.Send([]byte("direct")); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+	if got, err := clients[2].Recv(); err != nil || string(got) != "direct" {
+		t.Errorf("Client 3 Recv: got %q, %v; want direct", got, err)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{MaxPending: -1})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	var clients, servers []*wschannel.Channel
+	for i := range 3 {
+		c, err := wschannel.Dial(fixURL(s.URL), nil)
+		if err != nil {
+			t.Fatalf("Dial %d: unexpected error: %v", i+1, err)
+		}
+		defer c.Close()
+		clients = append(clients, c)
+
+		ch, err := lst.AcceptChannel(context.Background())
+		if err != nil {
+			t.Fatalf("Accept %d: unexpected error: %v", i+1, err)
+		}
+		defer ch.Close()
+		servers = append(servers, ch)
+	}
+
+	// Clients 1 and 3 join "odd"; client 2 joins "even".
+	for i, ch := range servers {
+		group := "odd"
+		if i%2 == 1 {
+			group = "even"
+		}
+		if !lst.Join(ch, group) {
+			t.Errorf("Join %d %q: got false, want true", i+1, group)
+		}
+	}
+	if lst.Join(wschannel.New(nil), "odd") {
+		t.Error("Join of a foreign channel: got true, want false")
+	}
+	if got := len(lst.Group("odd")); got != 2 {
+		t.Errorf("Group odd: got %d members, want 2", got)
+	}
+
+	if err := lst.BroadcastGroup(context.Background(), "odd", []byte("odd")); err != nil {
+		t.Fatalf("BroadcastGroup: unexpected error: %v", err)
+	}
+	if err := lst.BroadcastGroup(context.Background(), "even", []byte("even")); err != nil {
+		t.Fatalf("BroadcastGroup: unexpected error: %v", err)
+	}
+	for i, want := range []string{"odd", "even", "odd"} {
+		if got, err := clients[i].Recv(); err != nil || string(got) != want {
+			t.Errorf("Client %d Recv: got %q, %v; want %q", i+1, got, err, want)
+		}
+	}
+
+	// Leaving and closing both remove members.
+	lst.Leave(servers[0], "odd")
+	servers[2].Close()
+	for i := 0; ; i++ {
+		if got := len(lst.Group("odd")); got == 0 {
+			break
+		} else if i > 20 {
+			t.Fatalf("Group odd: got %d members, want 0", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSetPriority(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		MaxPending: -1,
+		CheckAccept: func(req *http.Request) (int, error) {
+			p, _ := strconv.Atoi(req.URL.Query().Get("p"))
+			wschannel.SetPriority(req, p)
+			return 0, nil
+		},
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	for _, name := range []string{"0", "5", "1", "5"} {
+		c, err := wschannel.Dial(fixURL(s.URL)+"/?p="+name, nil)
+		if err != nil {
+			t.Fatalf("Dial p=%s: unexpected error: %v", name, err)
+		}
+		defer c.Close()
+	}
+
+	var got []int
+	var queued []time.Time
+	for range 4 {
+		ch, info, err := lst.AcceptInfo(context.Background())
+		if err != nil {
+			t.Fatalf("Accept: unexpected error: %v", err)
+		}
+		defer ch.Close()
+		got = append(got, info.Priority)
+		queued = append(queued, info.Queued)
+	}
+	if want := []int{5, 5, 1, 0}; !slices.Equal(got, want) {
+		t.Errorf("Accept order: got %v, want %v", got, want)
+	}
+	if !queued[0].Before(queued[1]) {
+		t.Error("Equal-priority channels were not accepted in arrival order")
+	}
+}
+
+func TestSetLabel(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		CheckAccept: func(req *http.Request) (int, error) {
+			wschannel.SetLabel(req, "tenant", req.Header.Get("X-Tenant"))
+			wschannel.SetLabel(req, "region", "moon")
+			return 0, nil
+		},
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{
+		Header: http.Header{"X-Tenant": {"acme"}},
+	})
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+
+	ch, info, err := lst.AcceptInfo(context.Background())
+	if err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+	defer ch.Close()
+	want := map[string]string{"tenant": "acme", "region": "moon"}
+	if !maps.Equal(info.Labels, want) {
+		t.Errorf("Labels: got %v, want %v", info.Labels, want)
+	}
+
+	// Labels are reported by the admin handler.
+	rec := httptest.NewRecorder()
+	lst.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if body := rec.Body.String(); !strings.Contains(body, `"labels":{"region":"moon","tenant":"acme"}`) {
+		t.Errorf("Admin status is missing labels: %s", body)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	// setup returns a client and an accepted server channel for a listener
+	// with the given rate limit.
+	setup := func(t *testing.T, rl *wschannel.RateLimit) (*websocket.Conn, *wschannel.Channel) {
+		t.Helper()
+		lst := wschannel.NewListener(&wschannel.ListenOptions{RateLimit: rl})
+		t.Cleanup(func() { lst.Close() })
+		s := httptest.NewServer(lst)
+		t.Cleanup(s.Close)
+
+		conn, _, err := websocket.Dial(context.Background(), fixURL(s.URL), nil)
+		if err != nil {
+			t.Fatalf("Dial: unexpected error: %v", err)
+		}
+		t.Cleanup(func() { conn.CloseNow() })
+		ch, err := lst.AcceptChannel(context.Background())
+		if err != nil {
+			t.Fatalf("Accept: unexpected error: %v", err)
+		}
+		t.Cleanup(func() { ch.Close() })
+		return conn, ch
+	}
+	send := func(t *testing.T, conn *websocket.Conn, n int) {
+		t.Helper()
+		for i := range n {
+			if err := conn.Write(context.Background(), websocket.MessageText, []byte("x")); err != nil {
+				t.Fatalf("Write %d: unexpected error: %v", i+1, err)
+			}
+		}
+	}
+
+	t.Run("Close", func(t *testing.T) {
+		conn, ch := setup(t, &wschannel.RateLimit{Messages: 1, MessageBurst: 2})
+		send(t, conn, 3)
+		for i := range 2 {
+			if _, err := ch.Recv(); err != nil {
+				t.Fatalf("Recv %d: unexpected error: %v", i+1, err)
+			}
+		}
+		if _, err := ch.Recv(); !errors.Is(err, wschannel.ErrRateLimited) {
+			t.Errorf("Recv 3: got %v, want %v", err, wschannel.ErrRateLimited)
+		}
+		_, _, err := conn.Read(context.Background())
+		if got, want := websocket.CloseStatus(err), websocket.StatusPolicyViolation; got != want {
+			t.Errorf("Read: got status %v (%v), want %v", got, err, want)
+		}
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		// Each message of a batch is charged against the limit.
+		batch := &wschannel.ChannelOptions{Batch: true}
+		lst := wschannel.NewListener(&wschannel.ListenOptions{
+			RateLimit: &wschannel.RateLimit{Messages: 1, MessageBurst: 2},
+			Channel:   batch,
+		})
+		t.Cleanup(func() { lst.Close() })
+		s := httptest.NewServer(lst)
+		t.Cleanup(s.Close)
+
+		c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{Channel: batch})
+		if err != nil {
+			t.Fatalf("Dial: unexpected error: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		ch, err := lst.AcceptChannel(context.Background())
+		if err != nil {
+			t.Fatalf("Accept: unexpected error: %v", err)
+		}
+		t.Cleanup(func() { ch.Close() })
+		if !ch.Batched() {
+			t.Fatal("Batched: got false, want true")
+		}
+
+		if err := c.SendBatch([][]byte{[]byte("a"), []byte("b"), []byte("c")}); err != nil {
+			t.Fatalf("SendBatch: unexpected error: %v", err)
+		}
+		for i := range 2 {
+			if _, err := ch.Recv(); err != nil {
+				t.Fatalf("Recv %d: unexpected error: %v", i+1, err)
+			}
+		}
+		if _, err := ch.Recv(); !errors.Is(err, wschannel.ErrRateLimited) {
+			t.Errorf("Recv 3: got %v, want %v", err, wschannel.ErrRateLimited)
+		}
+	})
+
+	t.Run("SlowRate", func(t *testing.T) {
+		// With a rate below 1/s, the default burst still admits one message.
+		conn, ch := setup(t, &wschannel.RateLimit{Messages: 0.5})
+		send(t, conn, 2)
+		if _, err := ch.Recv(); err != nil {
+			t.Fatalf("Recv 1: unexpected error: %v", err)
+		}
+		if _, err := ch.Recv(); !errors.Is(err, wschannel.ErrRateLimited) {
+			t.Errorf("Recv 2: got %v, want %v", err, wschannel.ErrRateLimited)
+		}
+	})
+
+	t.Run("Delay", func(t *testing.T) {
+		conn, ch := setup(t, &wschannel.RateLimit{Messages: 20, MessageBurst: 1, Delay: true})
+		send(t, conn, 4)
+		start := time.Now()
+		for i := range 4 {
+			if _, err := ch.Recv(); err != nil {
+				t.Fatalf("Recv %d: unexpected error: %v", i+1, err)
+			}
+		}
+		// The first message is within the burst; the others arrive at 20/s.
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Errorf("Recv took %v, want at least 100ms", elapsed)
+		}
+	})
+}
+
+func TestAccessPolicy(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		MaxPending:     -1,
+		TrustedProxies: []string{"127.0.0.1", "::1"},
+		AllowCIDRs:     []string{"10.0.0.0/8", "2001:db8::/32"},
+		DenyCIDRs:      []string{"10.1.0.0/16"},
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	tests := []struct {
+		client string
+		ok     bool
+	}{
+		{"10.2.3.4", true},
+		{"2001:db8::1", true},
+		{"10.1.2.3", false},    // denied
+		{"192.168.1.1", false}, // not allowed
+		{"unknown", false},     // not allowed
+	}
+	for _, tc := range tests {
+		c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{
+			Header: http.Header{"X-Forwarded-For": {tc.client}},
+		})
+		if tc.ok {
+			if err != nil {
+				t.Errorf("Dial from %s: unexpected error: %v", tc.client, err)
+			} else {
+				c.Close()
+			}
+			continue
+		}
+		var rerr *wschannel.RejectedError
+		if err == nil {
+			c.Close()
+			t.Errorf("Dial from %s: got nil error, want rejection", tc.client)
+		} else if !errors.As(err, &rerr) || rerr.Code != http.StatusForbidden {
+			t.Errorf("Dial from %s: got %v, want status %d", tc.client, err, http.StatusForbidden)
+		}
+	}
+	if got := lst.Metrics().Denied; got != 3 {
+		t.Errorf("Metrics Denied: got %d, want 3", got)
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	sign := func(key string) func([]byte) ([]byte, error) {
+		return func(nonce []byte) ([]byte, error) {
+			h := hmac.New(sha256.New, []byte(key))
+			h.Write(nonce)
+			return h.Sum(nil), nil
+		}
+	}
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		MaxPending: 2,
+		Challenge: &wschannel.Challenge{
+			Verify: func(_ *wschannel.ConnInfo, nonce, rsp []byte) error {
+				want, _ := sign("sesame")(nonce)
+				if !hmac.Equal(rsp, want) {
+					return errors.New("invalid response")
+				}
+				return nil
+			},
+			Timeout: time.Second,
+		},
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	t.Run("Valid", func(t *testing.T) {
+		c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{Authenticator: sign("sesame")})
+		if err != nil {
+			t.Fatalf("Dial: unexpected error: %v", err)
+		}
+		defer c.Close()
+
+		ch, err := lst.AcceptChannel(context.Background())
+		if err != nil {
+			t.Fatalf("Accept: unexpected error: %v", err)
+		}
+		defer ch.Close()
+		if err := c.Send([]byte("hello")); err != nil {
+			t.Fatalf("Send: unexpected error: %v", err)
+		}
+		if got, err := ch.Recv(); err != nil || string(got) != "hello" {
+			t.Errorf("Recv: got %q, %v; want hello", got, err)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{Authenticator: sign("wrong")})
+		if err != nil {
+			t.Fatalf("Dial: unexpected error: %v", err)
+		}
+		defer c.Close()
+		if _, err := c.Recv(); err == nil {
+			t.Error("Recv: got nil error, want failure")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if ch, err := lst.AcceptChannel(ctx); err == nil {
+			ch.Close()
+			t.Error("Accept: got a channel that failed authentication")
+		}
+		if got := lst.Metrics().AuthFailed; got != 1 {
+			t.Errorf("Metrics AuthFailed: got %d, want 1", got)
+		}
+	})
+}
+
+func TestCheckAPIKey(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		MaxPending:  -1,
+		CheckAccept: wschannel.CheckAPIKey(wschannel.StaticKeys("k1", "k2")),
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	tests := []struct {
+		query  string
+		header string
+		ok     bool
+	}{
+		{"", "", false},
+		{"?token=k1", "", true},
+		{"?token=k3", "", false},
+		{"", "Bearer k2", true},
+		{"", "bearer k1", true},
+		{"", "Bearer k3", false},
+		{"", "Basic k1", false},
+	}
+	for _, tc := range tests {
+		opts := &wschannel.DialOptions{Header: make(http.Header)}
+		if tc.header != "" {
+			opts.Header.Set("Authorization", tc.header)
+		}
+		c, err := wschannel.Dial(fixURL(s.URL)+"/"+tc.query, opts)
+		if err == nil {
+			c.Close()
+		}
+		if tc.ok && err != nil {
+			t.Errorf("Dial %q %q: unexpected error: %v", tc.query, tc.header, err)
+		} else if !tc.ok {
+			var rerr *wschannel.RejectedError
+			if !errors.As(err, &rerr) || rerr.Code != http.StatusUnauthorized {
+				t.Errorf("Dial %q %q: got %v, want status %d", tc.query, tc.header, err, http.StatusUnauthorized)
+			}
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	recs := make(chan *wschannel.AuditRecord, 1)
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		CheckAccept: func(req *http.Request) (int, error) {
+			wschannel.SetLabel(req, "tenant", "acme")
+			return 0, nil
+		},
+		Audit: func(rec *wschannel.AuditRecord) { recs <- rec },
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	c, err := wschannel.Dial(fixURL(s.URL)+"/audit", nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+	ch, err := lst.AcceptChannel(context.Background())
+	if err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+	if err := c.Send([]byte("hello")); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+	if _, err := ch.Recv(); err != nil {
+		t.Fatalf("Recv: unexpected error: %v", err)
+	}
+	ch.Close()
+
+	var rec *wschannel.AuditRecord
+	select {
+	case rec = <-recs:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for an audit record")
+	}
+	if rec.ID != ch.Info().ID || rec.Path != "/audit" || rec.Labels["tenant"] != "acme" {
+		t.Errorf("Audit record: got %+v, want ID %q, path /audit, tenant acme", rec, ch.Info().ID)
+	}
+	if rec.MessagesReceived != 1 || rec.BytesReceived != 5 {
+		t.Errorf("Audit stats: got %+v, want 1 message, 5 bytes received", rec.ChannelStats)
+	}
+	if rec.CloseStatus != websocket.StatusNormalClosure {
+		t.Errorf("Audit close status: got %v, want %v", rec.CloseStatus, websocket.StatusNormalClosure)
+	}
+	if !rec.Disconnected.After(rec.Connected) {
+		t.Errorf("Audit times: connected %v, disconnected %v", rec.Connected, rec.Disconnected)
+	}
+
+	var buf bytes.Buffer
+	wschannel.AuditLog(&buf)(rec)
+	if got := buf.String(); !strings.Contains(got, `"closeStatus":1000`) || !strings.HasSuffix(got, "}\n") {
+		t.Errorf("AuditLog: got %q, want a JSON line with the close status", got)
+	}
+}
+
+func TestLogRequest(t *testing.T) {
+	type entry struct {
+		status int
+		err    error
+	}
+	logged := make(chan entry, 3)
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		LogRequest: func(_ *http.Request, status int, err error) {
+			logged <- entry{status, err}
+		},
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	// Accepted.
+	c, err := wschannel.Dial(fixURL(s.URL), nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+	if e := <-logged; e.status != http.StatusSwitchingProtocols || e.err != nil {
+		t.Errorf("Log accepted: got %d, %v; want %d, nil", e.status, e.err, http.StatusSwitchingProtocols)
+	}
+
+	// Rejected, because the queue is full.
+	if c, err := wschannel.Dial(fixURL(s.URL), nil); err == nil {
+		c.Close()
+		t.Error("Dial: got nil error, want rejection")
+	}
+	if e := <-logged; e.status != http.StatusServiceUnavailable || !errors.Is(e.err, wschannel.ErrQueueFull) {
+		t.Errorf("Log rejected: got %d, %v; want %d, %v", e.status, e.err, http.StatusServiceUnavailable, wschannel.ErrQueueFull)
+	}
+
+	// Failed upgrade. Make room in the queue first.
+	lst.SetMaxPending(2)
+	rsp, err := http.Get(s.URL)
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	rsp.Body.Close()
+	if e := <-logged; e.status != rsp.StatusCode || !errors.Is(e.err, wschannel.ErrUpgradeFailed) {
+		t.Errorf("Log failed upgrade: got %d, %v; want %d, %v", e.status, e.err, rsp.StatusCode, wschannel.ErrUpgradeFailed)
+	}
+}
+
+func TestQueueShards(t *testing.T) {
+	const numConns = 20
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		MaxPending:  -1,
+		QueueShards: 4,
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	for i := range numConns {
+		c, err := wschannel.Dial(fixURL(s.URL)+fmt.Sprintf("/c%d", i), nil)
+		if err != nil {
+			t.Fatalf("Dial %d: unexpected error: %v", i, err)
+		}
+		defer c.Close()
+	}
+	if got := lst.Pending(); got != numConns {
+		t.Errorf("Pending: got %d, want %d", got, numConns)
+	}
+
+	// Accept concurrently, and check that every channel is accepted once.
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range numConns / 4 {
+				ch, err := lst.AcceptChannel(context.Background())
+				if err != nil {
+					t.Errorf("Accept: unexpected error: %v", err)
+					return
+				}
+				defer ch.Close()
+				mu.Lock()
+				seen[ch.Info().URL.Path] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(seen) != numConns {
+		t.Errorf("Accepted %d distinct channels, want %d", len(seen), numConns)
+	}
+	if got := lst.Pending(); got != 0 {
+		t.Errorf("Pending: got %d, want 0", got)
+	}
+
+	// Closing the listener wakes a blocked Accept.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		lst.Close()
+	}()
+	if _, err := lst.Accept(context.Background()); !errors.Is(err, wschannel.ErrListenerClosed) {
+		t.Errorf("Accept: got %v, want %v", err, wschannel.ErrListenerClosed)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{Fallback: true})
+	defer lst.Close()
+
+	// Simulate a proxy that does not forward websocket upgrades.
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.Header.Del("Upgrade")
+		lst.ServeHTTP(w, req)
+	}))
+	defer s.Close()
+
+	if c, err := wschannel.Dial(fixURL(s.URL), nil); err == nil {
+		c.Close()
+		t.Fatal("Dial without fallback: got nil error, want failure")
+	}
+	c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{Fallback: true})
+	if err != nil {
+		t.Fatalf("Dial with fallback: unexpected error: %v", err)
+	}
+	defer c.Close()
+	ch, err := lst.AcceptChannel(context.Background())
+	if err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+
+	for _, msg := range []string{"hello", `{"multi":` + "\n" + `"line"}`, ""} {
+		if err := c.Send([]byte(msg)); err != nil {
+			t.Fatalf("Send: unexpected error: %v", err)
+		}
+		if got, err := ch.Recv(); err != nil || string(got) != msg {
+			t.Errorf("Server Recv: got (%q, %v), want (%q, nil)", got, err, msg)
+		}
+		if err := ch.Send([]byte("re: " + msg)); err != nil {
+			t.Fatalf("Send: unexpected error: %v", err)
+		}
+		if got, err := c.Recv(); err != nil || string(got) != "re: "+msg {
+			t.Errorf("Client Recv: got (%q, %v), want (%q, nil)", got, err, "re: "+msg)
+		}
+	}
+
+	// Closing the server side ends the session for the client.
+	ch.Close()
+	if got, err := c.Recv(); err == nil {
+		t.Errorf("Recv after close: got %q, want error", got)
+	} else if code := websocket.CloseStatus(err); code != websocket.StatusNormalClosure {
+		t.Errorf("Recv after close: got %v, want status %v", err, websocket.StatusNormalClosure)
+	}
+}
+
+func TestFallbackPoll(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{Fallback: true})
+	defer lst.Close()
+
+	// Simulate a proxy that blocks websocket upgrades and event streams.
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("transport") == "sse" {
+			http.Error(w, "streaming not allowed", http.StatusForbidden)
+			return
+		}
+		req.Header.Del("Upgrade")
+		lst.ServeHTTP(w, req)
+	}))
+	defer s.Close()
+
+	c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{Fallback: true})
+	if err != nil {
+		t.Fatalf("Dial with fallback: unexpected error: %v", err)
+	}
+	defer c.Close()
+	ch, err := lst.AcceptChannel(context.Background())
+	if err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+
+	for _, msg := range []string{"one", "two", "three"} {
+		if err := c.Send([]byte(msg)); err != nil {
+			t.Fatalf("Send: unexpected error: %v", err)
+		}
+	}
+	for _, want := range []string{"one", "two", "three"} {
+		if got, err := ch.Recv(); err != nil || string(got) != want {
+			t.Errorf("Server Recv: got (%q, %v), want (%q, nil)", got, err, want)
+		}
+	}
+
+	// Messages sent before the server closes are delivered before the close.
+	for _, msg := range []string{"four", "five"} {
+		if err := ch.Send([]byte(msg)); err != nil {
+			t.Fatalf("Send: unexpected error: %v", err)
+		}
+	}
+	ch.Close()
+	for _, want := range []string{"four", "five"} {
+		if got, err := c.Recv(); err != nil || string(got) != want {
+			t.Errorf("Client Recv: got (%q, %v), want (%q, nil)", got, err, want)
+		}
+	}
+	if got, err := c.Recv(); err == nil {
+		t.Errorf("Recv after close: got %q, want error", got)
+	} else if code := websocket.CloseStatus(err); code != websocket.StatusNormalClosure {
+		t.Errorf("Recv after close: got %v, want status %v", err, websocket.StatusNormalClosure)
+	}
+}
+
+func TestChaos(t *testing.T) {
+	lst := wschannel.NewListener(nil)
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{
+		Channel: &wschannel.ChannelOptions{
+			Chaos: &wschannel.Chaos{
+				Probability: 1,
+				Codes:       []websocket.StatusCode{websocket.StatusTryAgainLater},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+	ch, err := lst.AcceptChannel(context.Background())
+	if err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+	defer ch.Close()
+
+	// With probability 1, the first message triggers a disconnect.
+	if err := c.Send([]byte("hello")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Send: got %v, want %v", err, net.ErrClosed)
+	}
+	if _, err := ch.Recv(); websocket.CloseStatus(err) != websocket.StatusTryAgainLater {
+		t.Errorf("Recv: got %v, want status %v", err, websocket.StatusTryAgainLater)
+	}
+}
+
+func TestPublishExpvar(t *testing.T) {
+	if expvar.Get("wschannel_test") == nil {
+		wschannel.PublishExpvar("wschannel_test")
+	}
+	lst := wschannel.NewListener(nil)
+	defer lst.Close()
+	lname := fmt.Sprintf("wschannel_test_listener_%p", lst)
+	lst.PublishExpvar(lname)
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	read := func(name string, v any) {
+		t.Helper()
+		if err := json.Unmarshal([]byte(expvar.Get(name).String()), v); err != nil {
+			t.Fatalf("Decoding %q: %v", name, err)
+		}
+	}
+	var before, after map[string]int64
+	read("wschannel_test", &before)
+
+	c, err := wschannel.Dial(fixURL(s.URL), nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+	ch, err := lst.AcceptChannel(context.Background())
+	if err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+	defer ch.Close()
+	if err := c.Send([]byte("hello")); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+	if _, err := ch.Recv(); err != nil {
+		t.Fatalf("Recv: unexpected error: %v", err)
+	}
+
+	read("wschannel_test", &after)
+	for key, want := range map[string]int64{
+		"channelsOpened":   2,
+		"channelsActive":   2,
+		"messagesSent":     1,
+		"bytesSent":        5,
+		"messagesReceived": 1,
+		"bytesReceived":    5,
+		"errors":           0,
+	} {
+		if got := after[key] - before[key]; got != want {
+			t.Errorf("%s: got change %d, want %d", key, got, want)
+		}
+	}
+
+	var lm struct {
+		wschannel.Metrics
+		Active, Pending int
+	}
+	read(lname, &lm)
+	if lm.Upgraded != 1 || lm.Accepted != 1 || lm.Active != 1 || lm.Pending != 0 {
+		t.Errorf("Listener metrics: got %+v, want 1 upgraded, accepted, and active", lm)
+	}
+
+	// When the peer closes the channel, it is no longer counted as active,
+	// although it was not closed locally.
+	c.Close()
+	if _, err := ch.Recv(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Recv: got %v, want %v", err, net.ErrClosed)
+	}
+	read("wschannel_test", &after)
+	if got := after["channelsActive"] - before["channelsActive"]; got != 0 {
+		t.Errorf("channelsActive after peer close: got change %d, want 0", got)
+	}
+}
+
+// logRecorder records the messages and attributes of the events logged to
+// the loggers it creates.
+type logRecorder struct {
+	mu     sync.Mutex
+	events []map[string]string
+}
+
+// logger returns a logger that records its events, at all levels, in r.
+func (r *logRecorder) logger() *slog.Logger { return slog.New(logHandler{rec: r}) }
+
+// logHandler is a slog.Handler that records events in a logRecorder.
+type logHandler struct {
+	rec   *logRecorder
+	attrs []slog.Attr
+}
+
+func (logHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h logHandler) Handle(_ context.Context, rec slog.Record) error {
+	evt := map[string]string{"msg": rec.Message, "level": rec.Level.String()}
+	for _, a := range h.attrs {
+		evt[a.Key] = a.Value.String()
+	}
+	rec.Attrs(func(a slog.Attr) bool {
+		evt[a.Key] = a.Value.String()
+		return true
+	})
+	h.rec.mu.Lock()
+	defer h.rec.mu.Unlock()
+	h.rec.events = append(h.rec.events, evt)
+	return nil
+}
+
+func (h logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return logHandler{rec: h.rec, attrs: append(slices.Clip(h.attrs), attrs...)}
+}
+
+func (h logHandler) WithGroup(string) slog.Handler { return h }
+
+// find reports whether r has an event with the given message whose
+// attributes include want.
+func (r *logRecorder) find(msg string, want map[string]string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, evt := range r.events {
+		if evt["msg"] != msg {
+			continue
+		}
+		match := true
+		for k, v := range want {
+			match = match && evt[k] == v
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogger(t *testing.T) {
+	var srvLog, cliLog logRecorder
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		Logger:        srvLog.logger(),
+		MaxConnsPerIP: 1,
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+	url := fixURL(s.URL)
+
+	c, err := wschannel.Dial(url, &wschannel.DialOptions{Logger: cliLog.logger()})
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	ch, err := lst.AcceptChannel(context.Background())
+	if err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+	if err := c.Send([]byte("hello")); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+	if _, err := ch.Recv(); err != nil {
+		t.Fatalf("Recv: unexpected error: %v", err)
+	}
+
+	// A second connection from the same client is rejected.
+	if _, err := wschannel.Dial(url, &wschannel.DialOptions{Logger: cliLog.logger()}); err == nil {
+		t.Fatal("Dial: got nil error, want rejection")
+	}
+
+	c.Close()
+	if _, err := ch.Recv(); err == nil {
+		t.Fatal("Recv: got nil error after close")
+	}
+	ch.Close()
+
+	id := ch.Info().ID
+	for _, tc := range []struct {
+		log  *logRecorder
+		msg  string
+		want map[string]string
+	}{
+		{&cliLog, "websocket connected", map[string]string{"url": url}},
+		{&cliLog, "websocket message", map[string]string{"dir": "send", "size": "5", "level": "DEBUG"}},
+		{&cliLog, "websocket dial failed", map[string]string{"url": url, "level": "WARN"}},
+		{&cliLog, "websocket closed", map[string]string{"url": url, "status": "1000"}},
+		{&srvLog, "websocket connected", map[string]string{"id": id, "path": "/"}},
+		{&srvLog, "websocket message", map[string]string{"id": id, "dir": "recv", "size": "5"}},
+		{&srvLog, "websocket request rejected", map[string]string{"status": "429"}},
+		{&srvLog, "websocket closed by peer", map[string]string{"id": id, "status": "1000"}},
+	} {
+		if !tc.log.find(tc.msg, tc.want) {
+			t.Errorf("Missing event %q with %v", tc.msg, tc.want)
+		}
+	}
+}
+
+func TestChannelID(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{Fallback: true})
+	defer lst.Close()
+
+	// Simulate a proxy that does not forward websocket upgrades, on request.
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Block-Upgrade") != "" {
+			req.Header.Del("Upgrade")
+		}
+		lst.ServeHTTP(w, req)
+	}))
+	defer s.Close()
+
+	// Dialed channels share the ID of the server's channel.
+	ids := make(map[string]bool)
+	for _, opts := range []*wschannel.DialOptions{
+		nil,
+		{Fallback: true, Header: http.Header{"X-Block-Upgrade": {"1"}}},
+	} {
+		c, err := wschannel.Dial(fixURL(s.URL), opts)
+		if err != nil {
+			t.Fatalf("Dial: unexpected error: %v", err)
+		}
+		defer c.Close()
+		ch, err := lst.AcceptChannel(context.Background())
+		if err != nil {
+			t.Fatalf("Accept: unexpected error: %v", err)
+		}
+		defer ch.Close()
+
+		id := ch.ID()
+		if id == "" || id != ch.Info().ID || c.ID() != id {
+			t.Errorf("IDs: client %q, server %q, info %q; want equal and non-empty", c.ID(), id, ch.Info().ID)
+		}
+		if ids[id] {
+			t.Errorf("ID %q is not unique", id)
+		}
+		ids[id] = true
+	}
+
+	// A channel not created by a dial or a listener has its own ID.
+	a, b := memPipe()
+	ca, cb := wschannel.New(a), wschannel.New(b)
+	if ca.ID() == "" || ca.ID() == cb.ID() {
+		t.Errorf("IDs: got %q and %q, want distinct and non-empty", ca.ID(), cb.ID())
+	}
+
+	// Errors from the channel include its ID.
+	c, err := wschannel.Dial(fixURL(s.URL), nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	ch, err := lst.AcceptChannel(context.Background())
+	if err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+	defer ch.Close()
+	c.Close()
+	if _, err := ch.Recv(); err == nil || !strings.Contains(err.Error(), ch.ID()) {
+		t.Errorf("Recv after close: got %v, want error mentioning %q", err, ch.ID())
+	}
+}
+
+func TestLatency(t *testing.T) {
+	before := wschannel.Latency()
+	lst := wschannel.NewListener(nil)
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	c, err := wschannel.Dial(fixURL(s.URL), nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+	ch, err := lst.AcceptChannel(context.Background())
+	if err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+	defer ch.Close()
+	for range 3 {
+		if err := c.Send([]byte("hello")); err != nil {
+			t.Fatalf("Send: unexpected error: %v", err)
+		}
+		if _, err := ch.Recv(); err != nil {
+			t.Fatalf("Recv: unexpected error: %v", err)
+		}
+	}
+
+	lat := lst.Latency()
+	if lat.Handshake.Count != 1 || lat.Send.Count != 0 || lat.Recv.Count != 3 {
+		t.Errorf("Listener latency counts: got handshake %d, send %d, recv %d; want 1, 0, 3",
+			lat.Handshake.Count, lat.Send.Count, lat.Recv.Count)
+	}
+	if lat.Recv.Sum <= 0 || lat.Recv.Quantile(0.5) <= 0 {
+		t.Errorf("Listener recv latency: got sum %v, median %v; want positive", lat.Recv.Sum, lat.Recv.Quantile(0.5))
+	}
+	after := wschannel.Latency()
+	if got := after.Handshake.Count - before.Handshake.Count; got != 2 {
+		t.Errorf("Process handshakes: got %d, want 2 (dial and upgrade)", got)
+	}
+	if got := after.Send.Count - before.Send.Count; got != 3 {
+		t.Errorf("Process sends: got %d, want 3", got)
+	}
+
+	h := wschannel.Histogram{
+		Count:  4,
+		Bounds: []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond},
+		Counts: []int64{1, 2, 0, 1},
+	}
+	for _, tc := range []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0, time.Millisecond},
+		{0.25, time.Millisecond},
+		{0.5, 2 * time.Millisecond},
+		{0.75, 2 * time.Millisecond},
+		{1, 4 * time.Millisecond},
+	} {
+		if got := h.Quantile(tc.q); got != tc.want {
+			t.Errorf("Quantile(%v): got %v, want %v", tc.q, got, tc.want)
+		}
+	}
+}
+
+func TestFrameDump(t *testing.T) {
+	var buf bytes.Buffer
+	dump := &wschannel.FrameDump{W: &buf, MaxPreview: 8}
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		Channel: &wschannel.ChannelOptions{Dump: dump},
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{
+		Channel: &wschannel.ChannelOptions{Text: true},
+	})
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+	ch, err := lst.AcceptChannel(context.Background())
+	if err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+	defer ch.Close()
+
+	exchange := func(from, to *wschannel.Channel, msg string) {
+		t.Helper()
+		if err := from.Send([]byte(msg)); err != nil {
+			t.Fatalf("Send: unexpected error: %v", err)
+		}
+		if _, err := to.Recv(); err != nil {
+			t.Fatalf("Recv: unexpected error: %v", err)
+		}
+	}
+	exchange(c, ch, `{"jsonrpc":"2.0"}`)
+	exchange(ch, c, "\x01\x02\x03")
+	dump.SetEnabled(false)
+	exchange(c, ch, "not dumped")
+	dump.SetEnabled(true)
+	exchange(c, ch, "ok")
+
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		// Remove the timestamp, which varies.
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			t.Fatalf("Invalid dump line: %q", line)
+		} else if _, err := time.Parse(time.RFC3339Nano, fields[0]); err != nil {
+			t.Errorf("Invalid timestamp: %v", err)
+		}
+		got = append(got, fields[1]+" "+fields[2])
+	}
+	id := ch.ID()
+	want := []string{
+		id + ` recv text 17 "{\"jsonrp"...`,
+		id + ` send binary 3 010203`,
+		id + ` recv text 2 "ok"`,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Dump: got %q, want %q", got, want)
+	}
+}
+
+func TestProfileLabels(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		CheckAccept: func(req *http.Request) (int, error) {
+			wschannel.SetLabel(req, "tenant", "acme")
+			return 0, nil
+		},
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan *wschannel.Channel)
+	release := make(chan struct{})
+	go lst.Serve(ctx, func(ch *wschannel.Channel) {
+		served <- ch
+		<-release
+	})
+
+	c, err := wschannel.Dial(fixURL(s.URL), nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+	ch := <-served
+	defer close(release)
+
+	id := ch.ID()
+	want := map[string]string{
+		"wschannel.id":           id,
+		"wschannel.remote":       ch.Info().RemoteAddr,
+		"wschannel.label.tenant": "acme",
+	}
+	ch.Do(context.Background(), func(ctx context.Context) {
+		for key, val := range want {
+			if got, ok := pprof.Label(ctx, key); !ok || got != val {
+				t.Errorf("Label %q: got %q, want %q", key, got, val)
+			}
+		}
+	})
+
+	// The goroutine running the Serve callback carries the labels.
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	if !strings.Contains(buf.String(), `"wschannel.id":"`+id+`"`) {
+		t.Errorf("Goroutine profile does not mention channel %q:\n%s", id, buf.String())
+	}
+}
+
+func TestTraceRegions(t *testing.T) {
+	lst := wschannel.NewListener(nil)
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	var buf bytes.Buffer
+	if err := trace.Start(&buf); err != nil {
+		t.Skipf("Cannot start tracing: %v", err)
+	}
+	c, err := wschannel.Dial(fixURL(s.URL), nil)
+	if err != nil {
+		trace.Stop()
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+	ch, err := lst.AcceptChannel(context.Background())
+	if err != nil {
+		trace.Stop()
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+	defer ch.Close()
+	if err := c.Send([]byte("hello")); err != nil {
+		t.Errorf("Send: unexpected error: %v", err)
+	}
+	if _, err := ch.Recv(); err != nil {
+		t.Errorf("Recv: unexpected error: %v", err)
+	}
+	trace.Stop()
+
+	// The trace format is not public, but it records the names of tasks and
+	// regions as strings.
+	for _, name := range []string{"wschannel.Dial", "wschannel.Handshake", "wschannel.Send", "wschannel.Recv"} {
+		if !bytes.Contains(buf.Bytes(), []byte(name)) {
+			t.Errorf("Trace does not mention %q", name)
+		}
+	}
+}
+
+// eventRecorder records the lifecycle events reported to its hook.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []wschannel.Event
+}
+
+func (r *eventRecorder) hook(e wschannel.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+// find returns the first event of the given kind for ch, waiting briefly for
+// it to be reported.
+func (r *eventRecorder) find(kind wschannel.EventKind, ch *wschannel.Channel) (wschannel.Event, bool) {
+	for range 100 {
+		r.mu.Lock()
+		for _, e := range r.events {
+			if e.Kind == kind && e.Channel == ch {
+				r.mu.Unlock()
+				return e, true
+			}
+		}
+		r.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	return wschannel.Event{}, false
+}
+
+// failPinger is a memConn whose pings fail.
+type failPinger struct{ *memConn }
+
+func (failPinger) Ping(context.Context) error { return errors.New("no pong") }
+
+func TestEvents(t *testing.T) {
+	var rec eventRecorder
+	copts := &wschannel.ChannelOptions{OnEvent: rec.hook}
+	lst := wschannel.NewListener(&wschannel.ListenOptions{Channel: copts})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	redial := wschannel.Redialer(fixURL(s.URL), &wschannel.DialOptions{Channel: copts})
+	var clients, servers []*wschannel.Channel
+	for range 2 {
+		c, err := redial()
+		if err != nil {
+			t.Fatalf("Dial: unexpected error: %v", err)
+		}
+		defer c.Close()
+		clients = append(clients, c.(*wschannel.Channel))
+		ch, err := lst.AcceptChannel(context.Background())
+		if err != nil {
+			t.Fatalf("Accept: unexpected error: %v", err)
+		}
+		defer ch.Close()
+		servers = append(servers, ch)
+	}
+	ch := servers[0]
+
+	for _, tc := range []struct {
+		kind wschannel.EventKind
+		ch   *wschannel.Channel
+	}{
+		{wschannel.Dialed, clients[0]},
+		{wschannel.Dialed, clients[1]},
+		{wschannel.Reconnected, clients[1]},
+		{wschannel.Accepted, ch},
+	} {
+		if _, ok := rec.find(tc.kind, tc.ch); !ok {
+			t.Errorf("Missing %v event for channel %s", tc.kind, tc.ch.ID())
+		}
+	}
+	if _, ok := rec.find(wschannel.Reconnected, clients[0]); ok {
+		t.Error("Unexpected Reconnected event for the first channel")
+	}
+
+	// Closing the first client reports Closed on both ends.
+	clients[0].Close()
+	if _, err := ch.Recv(); err == nil {
+		t.Fatal("Recv: got nil error after close")
+	}
+	if e, ok := rec.find(wschannel.Closed, clients[0]); !ok {
+		t.Error("Missing Closed event for the client")
+	} else if e.Status != websocket.StatusNormalClosure || e.Err != nil {
+		t.Errorf("Client Closed: got status %v, error %v; want %v, nil", e.Status, e.Err, websocket.StatusNormalClosure)
+	}
+	if e, ok := rec.find(wschannel.Closed, ch); !ok {
+		t.Error("Missing Closed event for the server")
+	} else if e.Status != websocket.StatusNormalClosure || !errors.Is(e.Err, net.ErrClosed) {
+		t.Errorf("Server Closed: got status %v, error %v; want %v, closed", e.Status, e.Err, websocket.StatusNormalClosure)
+	}
+
+	// A failed keepalive ping reports PingTimeout.
+	a, _ := memPipe()
+	pc := wschannel.NewServerConn(failPinger{a}, httptest.NewRequest("GET", "/", nil), &wschannel.ChannelOptions{
+		KeepAlive: time.Millisecond,
+		OnEvent:   rec.hook,
+	})
+	defer pc.Close()
+	if _, ok := rec.find(wschannel.PingTimeout, pc); !ok {
+		t.Error("Missing PingTimeout event")
+	}
+	if e, ok := rec.find(wschannel.Closed, pc); !ok || e.Status != websocket.StatusGoingAway {
+		t.Errorf("Closed after ping timeout: got %+v, want status %v", e, websocket.StatusGoingAway)
+	}
+}
+
+func TestFrameDumpJSONRPC(t *testing.T) {
+	var buf bytes.Buffer
+	dump := &wschannel.FrameDump{W: &buf, MaxPreview: 8, JSONRPC: true}
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		Channel: &wschannel.ChannelOptions{Dump: dump},
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{
+		Channel: &wschannel.ChannelOptions{Text: true},
+	})
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+	ch, err := lst.AcceptChannel(context.Background())
+	if err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+	defer ch.Close()
+
+	msgs := []string{
+		`{"jsonrpc":"2.0","id":1,"method":"Math.Add","params":[1, 2]}`,
+		`{"jsonrpc":"2.0","method":"rpc.cancel","params":[1]}`,
+		`{"jsonrpc":"2.0","id":"a","result":{"value":"long result"}}`,
+		`{"jsonrpc":"2.0","id":2,"error":{"code":-32601,"message":"no such method"}}`,
+		`[{"jsonrpc":"2.0","id":3,"method":"A"},{"jsonrpc":"2.0","id":4,"method":"B"}]`,
+		`{"id":5,"method":"NotRPC"}`,
+	}
+	for _, msg := range msgs {
+		if err := c.Send([]byte(msg)); err != nil {
+			t.Fatalf("Send: unexpected error: %v", err)
+		}
+		if _, err := ch.Recv(); err != nil {
+			t.Fatalf("Recv: unexpected error: %v", err)
+		}
+	}
+
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		// Keep only the kind and summary, after the timestamp, ID, and direction.
+		fields := strings.SplitN(line, " ", 4)
+		if len(fields) != 4 {
+			t.Fatalf("Invalid dump line: %q", line)
+		}
+		got = append(got, fields[3])
+	}
+	want := []string{
+		`text 60 call id=1 method="Math.Add" params=[1,2]`,
+		`text 52 notify method="rpc.cancel" params=[1]`,
+		`text 59 result id="a" {"value"...`,
+		`text 75 error id=2 code=-32601 message="no such ..."`,
+		`text 77 batch 2: call id=3 method="A"; call id=4 method="B"`,
+		`text 26 "{\"id\":5,"...`,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Dump:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestLastSendRecv(t *testing.T) {
+	a, b := memPipe()
+	ca, cb := wschannel.New(a), wschannel.New(b)
+	defer ca.Close()
+	defer cb.Close()
+
+	if !ca.LastSend().IsZero() || !ca.LastRecv().IsZero() {
+		t.Errorf("Before exchange: got send %v, recv %v, want zero", ca.LastSend(), ca.LastRecv())
+	}
+	created := ca.LastActive()
+
+	if err := ca.Send([]byte("ping")); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+	if _, err := cb.Recv(); err != nil {
+		t.Fatalf("Recv: unexpected error: %v", err)
+	}
+	if ca.LastSend().Before(created) || !ca.LastRecv().IsZero() {
+		t.Errorf("Sender: got send %v, recv %v, want send after %v and zero recv", ca.LastSend(), ca.LastRecv(), created)
+	}
+	if !cb.LastSend().IsZero() || cb.LastRecv().IsZero() {
+		t.Errorf("Receiver: got send %v, recv %v, want zero send and nonzero recv", cb.LastSend(), cb.LastRecv())
+	}
+	if got := ca.LastActive(); !got.Equal(ca.LastSend()) {
+		t.Errorf("LastActive: got %v, want %v", got, ca.LastSend())
+	}
+}
+
+func TestBatchFraming(t *testing.T) {
+	batch := &wschannel.ChannelOptions{Batch: true}
+	lst := wschannel.NewListener(&wschannel.ListenOptions{Channel: batch})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	connect := func(opts *wschannel.ChannelOptions) (c, ch *wschannel.Channel) {
+		t.Helper()
+		c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{Channel: opts})
+		if err != nil {
+			t.Fatalf("Dial: unexpected error: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		ch, err = lst.AcceptChannel(context.Background())
+		if err != nil {
+			t.Fatalf("Accept: unexpected error: %v", err)
+		}
+		t.Cleanup(func() { ch.Close() })
+		return c, ch
+	}
+	msgs := [][]byte{[]byte(`{"id":1}`), nil, []byte(`{"id":2}`)}
+	checkRecv := func(ch *wschannel.Channel) {
+		t.Helper()
+		for _, want := range msgs {
+			got, err := ch.Recv()
+			if err != nil {
+				t.Fatalf("Recv: unexpected error: %v", err)
+			} else if string(got) != string(want) {
+				t.Errorf("Recv: got %q, want %q", got, want)
+			}
+		}
+	}
+
+	t.Run("Negotiated", func(t *testing.T) {
+		c, ch := connect(batch)
+		if !c.Batched() || !ch.Batched() {
+			t.Fatalf("Batched: got client %v, server %v; want true, true", c.Batched(), ch.Batched())
+		}
+		if err := c.SendBatch(msgs); err != nil {
+			t.Fatalf("SendBatch: unexpected error: %v", err)
+		}
+		checkRecv(ch)
+		if got := ch.Stats().MessagesReceived; got != 1 {
+			t.Errorf("Messages received: got %d, want 1", got)
+		}
+
+		// A single Send is delivered as a batch of one.
+		if err := ch.Send([]byte("reply")); err != nil {
+			t.Fatalf("Send: unexpected error: %v", err)
+		}
+		if got, err := c.Recv(); err != nil || string(got) != "reply" {
+			t.Errorf("Recv: got (%q, %v), want (reply, nil)", got, err)
+		}
+	})
+
+	t.Run("NotOffered", func(t *testing.T) {
+		c, ch := connect(nil)
+		if c.Batched() || ch.Batched() {
+			t.Fatalf("Batched: got client %v, server %v; want false, false", c.Batched(), ch.Batched())
+		}
+		if err := c.SendBatch(msgs); err != nil {
+			t.Fatalf("SendBatch: unexpected error: %v", err)
+		}
+		checkRecv(ch)
+		if got := ch.Stats().MessagesReceived; got != 3 {
+			t.Errorf("Messages received: got %d, want 3", got)
+		}
+	})
+}
+
+func TestRPCStats(t *testing.T) {
+	lst := wschannel.NewListener(nil)
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	var stats wschannel.RPCStats
+	c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{
+		Channel: &wschannel.ChannelOptions{RPCStats: &stats},
+	})
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+	ch, err := lst.AcceptChannel(context.Background())
+	if err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+	defer ch.Close()
+
+	exchange := func(from, to *wschannel.Channel, msg string) {
+		t.Helper()
+		if err := from.Send([]byte(msg)); err != nil {
+			t.Fatalf("Send: unexpected error: %v", err)
+		}
+		if _, err := to.Recv(); err != nil {
+			t.Fatalf("Recv: unexpected error: %v", err)
+		}
+	}
+	const (
+		add  = `{"jsonrpc":"2.0","id":1,"method":"Add","params":[1,2]}`
+		sub  = `{"jsonrpc":"2.0","id":2,"method":"Sub","params":[1,2]}`
+		note = `{"jsonrpc":"2.0","method":"Log"}`
+		res1 = `{"jsonrpc":"2.0","id":1,"result":3}`
+		err2 = `{"jsonrpc":"2.0","id":2,"error":{"code":-32601,"message":"no"}}`
+		res9 = `{"jsonrpc":"2.0","id":9,"result":0}`
+	)
+	exchange(c, ch, "["+add+","+sub+"]")
+	exchange(c, ch, note)
+	exchange(ch, c, res1)
+	exchange(ch, c, err2)
+	exchange(ch, c, res9)
+	exchange(c, ch, "not JSON-RPC")
+
+	got := stats.Methods()
+	want := map[string]wschannel.MethodStats{
+		"Add": {Calls: 1, Results: 1, RequestBytes: int64(len(add)), ResponseBytes: int64(len(res1))},
+		"Sub": {Calls: 1, Errors: 1, RequestBytes: int64(len(sub)), ResponseBytes: int64(len(err2)),
+			Codes: map[int]int64{-32601: 1}},
+		"Log": {Notifications: 1, RequestBytes: int64(len(note))},
+		"":    {Results: 1, ResponseBytes: int64(len(res9))},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Methods:\n got %+v\nwant %+v", got, want)
+	}
+
+	// Methods beyond the limit are counted together.
+	var notes []string
+	for i := range wschannel.MaxMethods {
+		notes = append(notes, fmt.Sprintf(`{"jsonrpc":"2.0","method":"M%d"}`, i))
+	}
+	exchange(c, ch, "["+strings.Join(notes, ",")+"]")
+	got = stats.Methods()
+	if len(got) != wschannel.MaxMethods+1 {
+		t.Errorf("Methods: got %d entries, want %d", len(got), wschannel.MaxMethods+1)
+	}
+	if n, want := got[wschannel.OtherMethods].Notifications, int64(len(want)); n != want {
+		t.Errorf("Methods %q: got %d notifications, want %d", wschannel.OtherMethods, n, want)
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		Channel: &wschannel.ChannelOptions{Batch: true, Capabilities: []string{"x-two", "x-three"}},
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	tests := []struct {
+		name string
+		opts *wschannel.ChannelOptions
+		want map[string]bool
+	}{
+		{"None", nil, map[string]bool{}},
+		{"Batch", &wschannel.ChannelOptions{Batch: true}, map[string]bool{"batch": true}},
+		{"Some", &wschannel.ChannelOptions{Batch: true, Capabilities: []string{"x-one", "x-two"}},
+			map[string]bool{"batch": true, "x-two": true}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{Channel: tc.opts})
+			if err != nil {
+				t.Fatalf("Dial: unexpected error: %v", err)
+			}
+			defer c.Close()
+			ch, err := lst.AcceptChannel(context.Background())
+			if err != nil {
+				t.Fatalf("Accept: unexpected error: %v", err)
+			}
+			defer ch.Close()
+
+			for _, side := range []*wschannel.Channel{c, ch} {
+				if got := side.Protocol(); got != wschannel.Protocol {
+					t.Errorf("Protocol: got %q, want %q", got, wschannel.Protocol)
+				}
+				if got := side.Capabilities(); !maps.Equal(got, tc.want) {
+					t.Errorf("Capabilities: got %v, want %v", got, tc.want)
+				}
+				if got, want := side.Batched(), tc.want["batch"]; got != want {
+					t.Errorf("Batched: got %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	srvPub, srvPriv, _ := box.GenerateKey(rand.Reader)
+	cliPub, cliPriv, _ := box.GenerateKey(rand.Reader)
+	expect := func(want *[32]byte) func(*http.Request, *[32]byte) error {
+		return func(_ *http.Request, key *[32]byte) error {
+			if *key != *want {
+				return errors.New("unknown key")
+			}
+			return nil
+		}
+	}
+
+	var buf bytes.Buffer
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		Channel: &wschannel.ChannelOptions{
+			Encryption: &wschannel.Encryption{PrivateKey: srvPriv, VerifyPeer: expect(cliPub)},
+		},
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	t.Run("OK", func(t *testing.T) {
+		c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{
+			Channel: &wschannel.ChannelOptions{
+				Text:       true,
+				Encryption: &wschannel.Encryption{PrivateKey: cliPriv, VerifyPeer: expect(srvPub)},
+				Dump:       &wschannel.FrameDump{W: &buf},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Dial: unexpected error: %v", err)
+		}
+		defer c.Close()
+		ch, err := lst.AcceptChannel(context.Background())
+		if err != nil {
+			t.Fatalf("Accept: unexpected error: %v", err)
+		}
+		defer ch.Close()
+
+		for _, msg := range []string{"hello", "", `{"secret":true}`} {
+			if err := c.Send([]byte(msg)); err != nil {
+				t.Fatalf("Send: unexpected error: %v", err)
+			}
+			if got, err := ch.Recv(); err != nil || string(got) != msg {
+				t.Errorf("Recv: got (%q, %v), want (%q, nil)", got, err, msg)
+			}
+		}
+		if err := ch.Send([]byte("reply")); err != nil {
+			t.Fatalf("Send: unexpected error: %v", err)
+		}
+		if got, err := c.Recv(); err != nil || string(got) != "reply" {
+			t.Errorf("Recv: got (%q, %v), want (reply, nil)", got, err)
+		}
+
+		// The dump shows the plaintext of the messages.
+		if !strings.Contains(buf.String(), `send text 5 "hello"`) {
+			t.Errorf("Dump does not show plaintext:\n%s", buf.String())
+		}
+	})
+
+	// A client without a key, or whose key is not accepted, is rejected.
+	for _, opts := range []*wschannel.ChannelOptions{
+		nil,
+		{Encryption: &wschannel.Encryption{}},
+	} {
+		c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{Channel: opts})
+		var rerr *wschannel.RejectedError
+		if err == nil {
+			c.Close()
+		}
+		if !errors.As(err, &rerr) || rerr.Code != http.StatusForbidden {
+			t.Errorf("Dial: got %v, want status %d", err, http.StatusForbidden)
+		}
+	}
+
+	t.Run("ServerKeyRejected", func(t *testing.T) {
+		c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{
+			Channel: &wschannel.ChannelOptions{
+				Encryption: &wschannel.Encryption{PrivateKey: cliPriv, VerifyPeer: expect(cliPub)},
+			},
+		})
+		if err == nil {
+			c.Close()
+		}
+		if !errors.Is(err, wschannel.ErrPeerKey) {
+			t.Errorf("Dial: got %v, want %v", err, wschannel.ErrPeerKey)
+		}
+	})
+}
+
+func TestMessageAuth(t *testing.T) {
+	sessionKey := func(req *http.Request) ([]byte, error) {
+		if s := req.Header.Get("X-Session"); s != "" {
+			return []byte("key-" + s), nil
+		}
+		return nil, errors.New("no session")
+	}
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		Channel: &wschannel.ChannelOptions{
+			MessageAuth: &wschannel.MessageAuth{SessionKey: sessionKey},
+		},
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	dial := func(t *testing.T, key string) (*wschannel.Channel, *wschannel.Channel) {
+		t.Helper()
+		c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{
+			Header: http.Header{"X-Session": {"s1"}},
+			Channel: &wschannel.ChannelOptions{
+				MessageAuth: &wschannel.MessageAuth{Key: []byte(key)},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Dial: unexpected error: %v", err)
+		}
+		ch, err := lst.AcceptChannel(context.Background())
+		if err != nil {
+			t.Fatalf("Accept: unexpected error: %v", err)
+		}
+		return c, ch
+	}
+
+	t.Run("OK", func(t *testing.T) {
+		c, ch := dial(t, "key-s1")
+		defer c.Close()
+		defer ch.Close()
+
+		for _, msg := range []string{"hello", "", "hello"} {
+			if err := c.Send([]byte(msg)); err != nil {
+				t.Fatalf("Send: unexpected error: %v", err)
+			}
+			if got, err := ch.Recv(); err != nil || string(got) != msg {
+				t.Errorf("Recv: got (%q, %v), want (%q, nil)", got, err, msg)
+			}
+		}
+		if err := ch.Send([]byte("reply")); err != nil {
+			t.Fatalf("Send: unexpected error: %v", err)
+		}
+		if got, err := c.Recv(); err != nil || string(got) != "reply" {
+			t.Errorf("Recv: got (%q, %v), want (reply, nil)", got, err)
+		}
+	})
+
+	t.Run("WrongKey", func(t *testing.T) {
+		c, ch := dial(t, "key-s2")
+		defer c.Close()
+		defer ch.Close()
+
+		if err := c.Send([]byte("tampered")); err != nil {
+			t.Fatalf("Send: unexpected error: %v", err)
+		}
+		if got, err := ch.Recv(); !errors.Is(err, wschannel.ErrBadMAC) {
+			t.Errorf("Recv: got (%q, %v), want %v", got, err, wschannel.ErrBadMAC)
+		}
+		_, err := c.Recv()
+		if got, want := websocket.CloseStatus(err), websocket.StatusPolicyViolation; got != want {
+			t.Errorf("Client close status: got %v, want %v", got, want)
+		}
+	})
+
+	// A client without a session is rejected.
+	c, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{
+		Channel: &wschannel.ChannelOptions{
+			MessageAuth: &wschannel.MessageAuth{Key: []byte("key-s1")},
+		},
+	})
+	var rerr *wschannel.RejectedError
+	if err == nil {
+		c.Close()
+	}
+	if !errors.As(err, &rerr) || rerr.Code != http.StatusForbidden {
+		t.Errorf("Dial: got %v, want status %d", err, http.StatusForbidden)
+	}
+}
+
+func TestFallbackOptions(t *testing.T) {
+	for _, copts := range []*wschannel.ChannelOptions{
+		{Encryption: &wschannel.Encryption{}},
+		{MessageAuth: &wschannel.MessageAuth{Key: []byte("key")}},
+	} {
+		lst := wschannel.NewListener(&wschannel.ListenOptions{Fallback: true, Channel: copts})
+		defer lst.Close()
+		s := httptest.NewServer(lst)
+		defer s.Close()
+
+		// The client rejects the combination before dialing.
+		_, err := wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{Fallback: true, Channel: copts})
+		if !errors.Is(err, wschannel.ErrFallbackOptions) {
+			t.Errorf("Dial: got %v, want %v", err, wschannel.ErrFallbackOptions)
+		}
+
+		// The listener rejects every request, and reports the error.
+		_, err = wschannel.Dial(fixURL(s.URL), &wschannel.DialOptions{Channel: copts})
+		var rerr *wschannel.RejectedError
+		if !errors.As(err, &rerr) || rerr.Code != http.StatusInternalServerError {
+			t.Errorf("Dial: got %v, want status %d", err, http.StatusInternalServerError)
+		}
+		if _, err := lst.AcceptChannel(context.Background()); !errors.Is(err, wschannel.ErrFallbackOptions) {
+			t.Errorf("Accept: got %v, want %v", err, wschannel.ErrFallbackOptions)
+		}
+		nl, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		if err := lst.ServeListener(nl); !errors.Is(err, wschannel.ErrFallbackOptions) {
+			t.Errorf("ServeListener: got %v, want %v", err, wschannel.ErrFallbackOptions)
+		}
+	}
+}
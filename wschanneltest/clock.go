@@ -0,0 +1,142 @@
+package wschanneltest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/creachadair/wschannel"
+)
+
+// A FakeClock is a wschannel.Clock whose time advances only when Advance is
+// called, for testing timer-driven behavior deterministically. A zero
+// FakeClock is not ready for use; call NewFakeClock to construct one.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer // active timers, in no particular order
+}
+
+// NewFakeClock constructs a FakeClock whose current time is now.
+func NewFakeClock(now time.Time) *FakeClock { return &FakeClock{now: now} }
+
+// Now implements part of the wschannel.Clock interface.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer implements part of the wschannel.Clock interface.
+func (c *FakeClock) NewTimer(d time.Duration) wschannel.Timer {
+	return c.schedule(d, make(chan time.Time, 1), nil)
+}
+
+// AfterFunc implements part of the wschannel.Clock interface. The function f
+// is called synchronously by the Advance call that triggers it.
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) wschannel.Timer {
+	return c.schedule(d, nil, f)
+}
+
+// Timers reports the number of active timers scheduled on c.
+func (c *FakeClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// Advance moves the time of c forward by d, firing the timers that come due
+// in order of their deadlines. The time of c when each timer fires is its
+// deadline. Timers scheduled by the callbacks of other timers also fire if
+// they come due before the end of the interval.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		t := c.next(end)
+		if t == nil {
+			break
+		}
+		c.now = t.when
+		if t.f == nil {
+			select {
+			case t.c <- t.when:
+			default:
+			}
+			continue
+		}
+		c.mu.Unlock()
+		t.f()
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// next removes and returns the earliest active timer due at or before end,
+// or returns nil if there are none. The caller must hold c.mu.
+func (c *FakeClock) next(end time.Time) *fakeTimer {
+	sort.SliceStable(c.timers, func(i, j int) bool {
+		return c.timers[i].when.Before(c.timers[j].when)
+	})
+	if len(c.timers) == 0 || c.timers[0].when.After(end) {
+		return nil
+	}
+	t := c.timers[0]
+	c.timers = c.timers[1:]
+	return t
+}
+
+func (c *FakeClock) schedule(d time.Duration, ch chan time.Time, f func()) *fakeTimer {
+	t := &fakeTimer{clock: c, c: ch, f: f}
+	t.Reset(d)
+	return t
+}
+
+// remove removes t from the active timers of c, and reports whether it was
+// present. The caller must hold c.mu.
+func (c *FakeClock) remove(t *fakeTimer) bool {
+	for i, u := range c.timers {
+		if u == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// A fakeTimer is a wschannel.Timer scheduled on a FakeClock.
+type fakeTimer struct {
+	clock *FakeClock
+	when  time.Time
+	c     chan time.Time // for NewTimer; nil for AfterFunc
+	f     func()         // for AfterFunc; nil for NewTimer
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.drain()
+	return t.clock.remove(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.drain()
+	active := t.clock.remove(t)
+	t.when = t.clock.now.Add(d)
+	t.clock.timers = append(t.clock.timers, t)
+	return active
+}
+
+// drain discards an undelivered time from the channel of t, as a time.Timer
+// does when it is stopped or reset.
+func (t *fakeTimer) drain() {
+	select {
+	case <-t.c:
+	default:
+	}
+}
@@ -0,0 +1,189 @@
+package wschanneltest
+
+import (
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/creachadair/jrpc2/channel"
+)
+
+// A Fault is a kind of misbehavior injected by a FaultChannel.
+type Fault string
+
+// The faults a FaultChannel can inject.
+const (
+	FaultDrop       Fault = "drop"       // the message is discarded
+	FaultDuplicate  Fault = "duplicate"  // the message is delivered twice
+	FaultDelay      Fault = "delay"      // the message is delayed
+	FaultTruncate   Fault = "truncate"   // a prefix of the message is delivered
+	FaultCorrupt    Fault = "corrupt"    // one bit of the message is flipped
+	FaultDisconnect Fault = "disconnect" // the channel is closed
+)
+
+// A FaultPolicy describes the faults injected by a FaultChannel. Each
+// probability is in the range 0 to 1, and is applied independently to each
+// message sent or received, in the order the fields are listed. A zero
+// FaultPolicy injects no faults.
+type FaultPolicy struct {
+	Disconnect float64 // close the channel instead of transferring the message
+	Drop       float64 // discard the message
+	Duplicate  float64 // deliver the message twice
+	Truncate   float64 // deliver a random prefix of the message
+	Corrupt    float64 // flip a random bit of the message
+	Delay      float64 // wait up to MaxDelay before transferring the message
+
+	// The longest delay injected by Delay. If zero, the default is 100ms.
+	MaxDelay time.Duration
+
+	// If positive, close the channel after this many messages have been
+	// transferred, in either direction.
+	DisconnectAfter int
+
+	// If set, the source of randomness. Use a fixed seed for reproducible
+	// faults. If nil, a randomly-seeded source is used.
+	Rand *rand.Rand
+
+	// If set, this function is called for each fault injected.
+	OnFault func(Fault)
+}
+
+// A FaultChannel wraps a channel.Channel to inject faults into the messages
+// it sends and receives according to a FaultPolicy, so that applications can
+// test their resilience to transport misbehavior.
+type FaultChannel struct {
+	ch     channel.Channel
+	policy FaultPolicy
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	count int    // messages transferred
+	dup   []byte // if not nil, a duplicate for the next Recv
+}
+
+// NewFaultChannel returns a channel that wraps ch and injects faults into its
+// messages according to policy. The FaultChannel takes ownership of ch.
+func NewFaultChannel(ch channel.Channel, policy FaultPolicy) *FaultChannel {
+	rng := policy.Rand
+	if rng == nil {
+		rng = rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = 100 * time.Millisecond
+	}
+	return &FaultChannel{ch: ch, policy: policy, rng: rng}
+}
+
+// Send implements the corresponding method of the Channel interface.
+func (f *FaultChannel) Send(data []byte) error {
+	data, faults, err := f.apply(data)
+	if err != nil {
+		return err
+	}
+	for _, fault := range faults {
+		switch fault {
+		case FaultDrop:
+			return nil
+		case FaultDuplicate:
+			if err := f.ch.Send(data); err != nil {
+				return err
+			}
+		}
+	}
+	return f.ch.Send(data)
+}
+
+// Recv implements the corresponding method of the Channel interface.
+func (f *FaultChannel) Recv() ([]byte, error) {
+	f.mu.Lock()
+	if dup := f.dup; dup != nil {
+		f.dup = nil
+		f.mu.Unlock()
+		return dup, nil
+	}
+	f.mu.Unlock()
+
+	for {
+		data, err := f.ch.Recv()
+		if err != nil {
+			return nil, err
+		}
+		data, faults, err := f.apply(data)
+		if err != nil {
+			return nil, err
+		}
+		dropped := false
+		for _, fault := range faults {
+			switch fault {
+			case FaultDrop:
+				dropped = true
+			case FaultDuplicate:
+				f.mu.Lock()
+				f.dup = data
+				f.mu.Unlock()
+			}
+		}
+		if !dropped {
+			return data, nil
+		}
+	}
+}
+
+// Close implements the corresponding method of the Channel interface.
+func (f *FaultChannel) Close() error { return f.ch.Close() }
+
+// apply chooses the faults to inject for a message, and applies those that
+// modify the message or the channel. It returns the message to transfer and
+// the faults chosen. If the channel was disconnected, apply reports
+// net.ErrClosed.
+func (f *FaultChannel) apply(data []byte) ([]byte, []Fault, error) {
+	f.mu.Lock()
+	p := &f.policy
+	f.count++
+	if f.roll(p.Disconnect) || (p.DisconnectAfter > 0 && f.count > p.DisconnectAfter) {
+		f.mu.Unlock()
+		f.report(FaultDisconnect)
+		f.ch.Close()
+		return nil, nil, net.ErrClosed
+	}
+
+	var faults []Fault
+	if f.roll(p.Drop) {
+		faults = append(faults, FaultDrop)
+	}
+	if f.roll(p.Duplicate) {
+		faults = append(faults, FaultDuplicate)
+	}
+	if f.roll(p.Truncate) && len(data) != 0 {
+		faults = append(faults, FaultTruncate)
+		data = data[:f.rng.IntN(len(data))]
+	}
+	if f.roll(p.Corrupt) && len(data) != 0 {
+		faults = append(faults, FaultCorrupt)
+		data = append([]byte(nil), data...)
+		data[f.rng.IntN(len(data))] ^= 1 << f.rng.IntN(8)
+	}
+	var delay time.Duration
+	if f.roll(p.Delay) {
+		faults = append(faults, FaultDelay)
+		delay = time.Duration(f.rng.Int64N(int64(p.MaxDelay)) + 1)
+	}
+	f.mu.Unlock()
+
+	for _, fault := range faults {
+		f.report(fault)
+	}
+	time.Sleep(delay)
+	return data, faults, nil
+}
+
+// roll reports whether an event with probability p occurs.
+// The caller must hold f.mu.
+func (f *FaultChannel) roll(p float64) bool { return p > 0 && f.rng.Float64() < p }
+
+func (f *FaultChannel) report(fault Fault) {
+	if f.policy.OnFault != nil {
+		f.policy.OnFault(fault)
+	}
+}
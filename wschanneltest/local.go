@@ -0,0 +1,39 @@
+package wschanneltest
+
+import "github.com/creachadair/jrpc2"
+
+// Local is a jrpc2 client and server connected by a Pipe, so that tests
+// exercise the wschannel code path without a network. It is analogous to the
+// Local type of the jrpc2 server package.
+type Local struct {
+	Server *jrpc2.Server
+	Client *jrpc2.Client
+}
+
+// Close shuts down the client and waits for the server to exit, returning the
+// result from the server's Wait method.
+func (l Local) Close() error {
+	l.Client.Close()
+	return l.Server.Wait()
+}
+
+// NewLocal constructs a *jrpc2.Server and a *jrpc2.Client connected to it via
+// a Pipe, using the specified assigner and options. If opts == nil, it
+// behaves as if the client and server options are also nil.
+func NewLocal(assigner jrpc2.Assigner, opts *LocalOptions) Local {
+	if opts == nil {
+		opts = new(LocalOptions)
+	}
+	c, s := Pipe()
+	return Local{
+		Server: jrpc2.NewServer(assigner, opts.Server).Start(s),
+		Client: jrpc2.NewClient(c, opts.Client),
+	}
+}
+
+// LocalOptions control the behaviour of the server and client constructed by
+// the NewLocal function.
+type LocalOptions struct {
+	Client *jrpc2.ClientOptions
+	Server *jrpc2.ServerOptions
+}
@@ -0,0 +1,175 @@
+package wschanneltest
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A Mock is a scripted implementation of the jrpc2 channel.Channel interface,
+// for testing code that uses a channel without a websocket at all.
+//
+// A test programs the mock with a script of steps: messages it expects to be
+// sent, and responses to return from Recv. Calls to Send must match the
+// expected messages in order. The responses are returned by Recv in order,
+// but each only once every Send expected before it in the script has been
+// made, so that a response can follow the request it answers. When the
+// responses are exhausted, Recv blocks until the mock is closed.
+//
+// When the test ends, the mock reports an error if any steps of its script
+// were not used. Unexpected sends are also reported as test errors.
+type Mock struct {
+	t    testing.TB
+	done chan struct{} // closed by Close
+
+	mu     sync.Mutex
+	cond   *sync.Cond // signaled when a step is used or the mock closes
+	steps  []*Step
+	si, ri int // the index of the next send and recv step, respectively
+	closed bool
+}
+
+// A Step is a single step in the script of a Mock.
+type Step struct {
+	send  bool
+	data  []byte
+	err   error
+	delay time.Duration
+}
+
+// Delay causes the call that uses s to wait for d before returning.
+// It returns s to permit chaining.
+func (s *Step) Delay(d time.Duration) *Step { s.delay = d; return s }
+
+// Fail causes the call that uses s to report err. It returns s to permit
+// chaining. For a response step, this is the same as RespondError.
+func (s *Step) Fail(err error) *Step { s.err = err; return s }
+
+// NewMock returns a new mock channel with an empty script. The script is
+// checked when t ends.
+func NewMock(t testing.TB) *Mock {
+	m := &Mock{t: t, done: make(chan struct{})}
+	m.cond = sync.NewCond(&m.mu)
+	t.Cleanup(m.check)
+	return m
+}
+
+// ExpectSend adds a step to the script, expecting a call to Send with the
+// given data. If data == nil, any message is accepted.
+func (m *Mock) ExpectSend(data []byte) *Step { return m.add(&Step{send: true, data: data}) }
+
+// Respond adds a step to the script, in which Recv returns data.
+func (m *Mock) Respond(data []byte) *Step { return m.add(&Step{data: data}) }
+
+// RespondError adds a step to the script, in which Recv reports err.
+func (m *Mock) RespondError(err error) *Step { return m.add(&Step{err: err}) }
+
+func (m *Mock) add(s *Step) *Step {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.steps = append(m.steps, s)
+	m.advance()
+	m.cond.Broadcast()
+	return s
+}
+
+// advance moves the step indices of m to the next step of their kind.
+// The caller must hold m.mu.
+func (m *Mock) advance() {
+	for m.si < len(m.steps) && !m.steps[m.si].send {
+		m.si++
+	}
+	for m.ri < len(m.steps) && m.steps[m.ri].send {
+		m.ri++
+	}
+}
+
+// Send implements the corresponding method of the Channel interface.
+func (m *Mock) Send(data []byte) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return net.ErrClosed
+	} else if m.si >= len(m.steps) {
+		m.mu.Unlock()
+		m.t.Errorf("Mock: unexpected Send(%q)", data)
+		return fmt.Errorf("unexpected send")
+	}
+	s := m.steps[m.si]
+	m.si++
+	m.advance()
+	m.cond.Broadcast()
+	m.mu.Unlock()
+
+	if s.data != nil && !bytes.Equal(data, s.data) {
+		m.t.Errorf("Mock: Send(%q), want %q", data, s.data)
+		return fmt.Errorf("unexpected send")
+	}
+	return m.wait(s)
+}
+
+// Recv implements the corresponding method of the Channel interface.
+func (m *Mock) Recv() ([]byte, error) {
+	m.mu.Lock()
+	for !m.closed && (m.ri >= len(m.steps) || m.si < m.ri) {
+		m.cond.Wait() // no response is ready
+	}
+	if m.closed {
+		m.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	s := m.steps[m.ri]
+	m.ri++
+	m.advance()
+	m.mu.Unlock()
+
+	if err := m.wait(s); err != nil {
+		return nil, err
+	}
+	return s.data, nil
+}
+
+// wait waits for the delay of s, if any, and returns its error.
+func (m *Mock) wait(s *Step) error {
+	if s.delay > 0 {
+		t := time.NewTimer(s.delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-m.done:
+			return net.ErrClosed
+		}
+	}
+	return s.err
+}
+
+// Close implements the corresponding method of the Channel interface.
+// Pending and subsequent calls to Send and Recv report net.ErrClosed.
+func (m *Mock) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		m.closed = true
+		close(m.done)
+		m.cond.Broadcast()
+	}
+	return nil
+}
+
+// check reports an error for any steps of the script that were not used.
+func (m *Mock) check() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int
+	for i, s := range m.steps {
+		if (s.send && i >= m.si) || (!s.send && i >= m.ri) {
+			n++
+		}
+	}
+	if n != 0 {
+		m.t.Errorf("Mock: %d of %d steps were not used", n, len(m.steps))
+	}
+}
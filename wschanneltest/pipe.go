@@ -0,0 +1,134 @@
+// Package wschanneltest provides support for testing code that uses the
+// wschannel package, without a network or an HTTP server.
+package wschanneltest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/coder/websocket"
+	"github.com/creachadair/wschannel"
+)
+
+// pipeBuffer is the number of messages in flight in each direction of a pipe
+// before a write blocks.
+const pipeBuffer = 16
+
+// Pipe returns a pair of channels connected to each other by an in-memory
+// transport. Each message sent on one channel is received as a single message
+// by the other. Closing either channel performs a close handshake: the peer
+// first receives any messages sent before the close, then Recv reports a
+// websocket.CloseError with the status given by the closing side.
+func Pipe() (client, server *wschannel.Channel) {
+	c, s := connPipe()
+	return wschannel.New(c), wschannel.New(s)
+}
+
+// A message is a websocket message in transit.
+type message struct {
+	typ  websocket.MessageType
+	data []byte
+}
+
+// pipeState is shared by both ends of a pipe.
+type pipeState struct {
+	once   sync.Once
+	closed chan struct{} // closed when either end is closed
+
+	// These are set before closed is closed.
+	code   websocket.StatusCode
+	reason string
+}
+
+// A pipeConn is one end of a pipe. It implements the wschannel.Conn
+// interface, and the optional Ping and SetReadLimit methods.
+type pipeConn struct {
+	p     *pipeState
+	in    <-chan message
+	out   chan<- message
+	limit int64 // if positive, the read limit
+}
+
+func connPipe() (*pipeConn, *pipeConn) {
+	p := &pipeState{closed: make(chan struct{})}
+	ab, ba := make(chan message, pipeBuffer), make(chan message, pipeBuffer)
+	return &pipeConn{p: p, in: ba, out: ab, limit: 32768},
+		&pipeConn{p: p, in: ab, out: ba, limit: 32768}
+}
+
+// Read implements part of the wschannel.Conn interface. Messages already sent
+// by the peer are delivered before a close.
+func (c *pipeConn) Read(ctx context.Context) (websocket.MessageType, []byte, error) {
+	select {
+	case m := <-c.in:
+		return c.check(m)
+	default:
+	}
+	select {
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	case m := <-c.in:
+		return c.check(m)
+	case <-c.p.closed:
+		select {
+		case m := <-c.in:
+			return c.check(m)
+		default:
+			return 0, nil, websocket.CloseError{Code: c.p.code, Reason: c.p.reason}
+		}
+	}
+}
+
+// check enforces the read limit of c for m, as the websocket library does.
+func (c *pipeConn) check(m message) (websocket.MessageType, []byte, error) {
+	if c.limit > 0 && int64(len(m.data)) > c.limit {
+		reason := fmt.Sprintf("read limited at %d bytes", c.limit)
+		c.Close(websocket.StatusMessageTooBig, reason)
+		return 0, nil, fmt.Errorf("failed to read: %s", reason)
+	}
+	return m.typ, m.data, nil
+}
+
+// Write implements part of the wschannel.Conn interface.
+func (c *pipeConn) Write(ctx context.Context, typ websocket.MessageType, data []byte) error {
+	select {
+	case <-c.p.closed:
+		return net.ErrClosed
+	default:
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.p.closed:
+		return net.ErrClosed
+	case c.out <- message{typ: typ, data: append([]byte(nil), data...)}:
+		return nil
+	}
+}
+
+// Close implements part of the wschannel.Conn interface. Only the first
+// close of either end has any effect.
+func (c *pipeConn) Close(code websocket.StatusCode, reason string) error {
+	c.p.once.Do(func() {
+		c.p.code, c.p.reason = code, reason
+		close(c.p.closed)
+	})
+	return nil
+}
+
+// Ping reports an error if the pipe is closed; otherwise the peer responds
+// immediately.
+func (c *pipeConn) Ping(ctx context.Context) error {
+	select {
+	case <-c.p.closed:
+		return net.ErrClosed
+	default:
+		return ctx.Err()
+	}
+}
+
+// SetReadLimit sets the maximum size of a message c will read. If n < 0,
+// there is no limit.
+func (c *pipeConn) SetReadLimit(n int64) { c.limit = n }
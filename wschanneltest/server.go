@@ -0,0 +1,23 @@
+package wschanneltest
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/creachadair/wschannel"
+)
+
+// NewTestServer starts an HTTP server for a new listener with the given
+// options, and returns the listener and the websocket URL ("ws://...") of
+// the server. The server and the listener are closed when the test ends.
+func NewTestServer(t testing.TB, opts *wschannel.ListenOptions) (*wschannel.Listener, string) {
+	t.Helper()
+	lst := wschannel.NewListener(opts)
+	s := httptest.NewServer(lst)
+	t.Cleanup(func() {
+		lst.Close()
+		s.Close()
+	})
+	return lst, "ws" + strings.TrimPrefix(s.URL, "http")
+}
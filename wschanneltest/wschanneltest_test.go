@@ -0,0 +1,286 @@
+//go:build !js
+
+package wschanneltest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/jrpc2/handler"
+	"github.com/creachadair/wschannel"
+	"github.com/creachadair/wschannel/wschanneltest"
+)
+
+func TestPipe(t *testing.T) {
+	c, s := wschanneltest.Pipe()
+
+	for _, msg := range []string{"one", "", "three"} {
+		if err := c.Send([]byte(msg)); err != nil {
+			t.Fatalf("Send %q: unexpected error: %v", msg, err)
+		}
+	}
+	for _, want := range []string{"one", "", "three"} {
+		if got, err := s.Recv(); err != nil || string(got) != want {
+			t.Errorf("Recv: got (%q, %v), want (%q, nil)", got, err, want)
+		}
+	}
+
+	// Messages sent before a close are delivered before it.
+	if err := s.Send([]byte("bye")); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+	s.Close()
+	if got, err := c.Recv(); err != nil || string(got) != "bye" {
+		t.Errorf("Recv: got (%q, %v), want (bye, nil)", got, err)
+	}
+	if _, err := c.Recv(); websocket.CloseStatus(err) != websocket.StatusNormalClosure {
+		t.Errorf("Recv after close: got %v, want status %v", err, websocket.StatusNormalClosure)
+	}
+	if err := c.Send([]byte("hello?")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Send after close: got %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestPipeJRPC2(t *testing.T) {
+	c, s := wschanneltest.Pipe()
+	srv := jrpc2.NewServer(handler.Map{
+		"Hello": handler.New(func(context.Context) string { return "world" }),
+	}, nil).Start(s)
+	defer srv.Stop()
+	cli := jrpc2.NewClient(c, nil)
+	defer cli.Close()
+
+	var got string
+	if err := cli.CallResult(context.Background(), "Hello", nil, &got); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	} else if got != "world" {
+		t.Errorf("Call result: got %q, want world", got)
+	}
+}
+
+func TestNewTestServer(t *testing.T) {
+	lst, url := wschanneltest.NewTestServer(t, nil)
+	if !strings.HasPrefix(url, "ws://") {
+		t.Errorf("URL: got %q, want ws://...", url)
+	}
+
+	c, err := wschannel.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+	s, err := lst.Accept(context.Background())
+	if err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+	defer s.Close()
+
+	if err := c.Send([]byte("hello")); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+	if got, err := s.Recv(); err != nil || string(got) != "hello" {
+		t.Errorf("Recv: got (%q, %v), want (hello, nil)", got, err)
+	}
+}
+
+func TestMock(t *testing.T) {
+	t.Run("Client", func(t *testing.T) {
+		m := wschanneltest.NewMock(t)
+		m.ExpectSend(nil)
+		m.Respond([]byte(`{"jsonrpc":"2.0","id":1,"result":"world"}`))
+
+		cli := jrpc2.NewClient(m, nil)
+		defer cli.Close()
+		var got string
+		if err := cli.CallResult(context.Background(), "Hello", nil, &got); err != nil {
+			t.Fatalf("Call failed: %v", err)
+		} else if got != "world" {
+			t.Errorf("Call result: got %q, want world", got)
+		}
+	})
+
+	t.Run("Script", func(t *testing.T) {
+		m := wschanneltest.NewMock(t)
+		m.ExpectSend([]byte("ping"))
+		m.Respond([]byte("pong")).Delay(10 * time.Millisecond)
+		m.RespondError(errors.New("boom"))
+
+		// The response is not available until the send preceding it.
+		recv := make(chan error, 1)
+		go func() {
+			got, err := m.Recv()
+			if err == nil && string(got) != "pong" {
+				err = fmt.Errorf("got %q, want pong", got)
+			}
+			recv <- err
+		}()
+		if err := m.Send([]byte("ping")); err != nil {
+			t.Errorf("Send: unexpected error: %v", err)
+		}
+		if err := <-recv; err != nil {
+			t.Errorf("Recv: %v", err)
+		}
+		if _, err := m.Recv(); err == nil || err.Error() != "boom" {
+			t.Errorf("Recv: got %v, want boom", err)
+		}
+
+		m.Close()
+		if err := m.Send([]byte("extra")); !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Send after close: got %v, want %v", err, net.ErrClosed)
+		}
+	})
+}
+
+func TestFaultChannel(t *testing.T) {
+	const msg = "a message of modest length"
+	seeded := func() *rand.Rand { return rand.New(rand.NewPCG(1, 2)) }
+
+	t.Run("Drop", func(t *testing.T) {
+		c, s := wschanneltest.Pipe()
+		f := wschanneltest.NewFaultChannel(c, wschanneltest.FaultPolicy{Drop: 1})
+		if err := f.Send([]byte(msg)); err != nil {
+			t.Fatalf("Send: unexpected error: %v", err)
+		}
+		f.Close()
+		if got, err := s.Recv(); err == nil {
+			t.Errorf("Recv: got %q, want error", got)
+		}
+	})
+
+	t.Run("Duplicate", func(t *testing.T) {
+		c, s := wschanneltest.Pipe()
+		defer s.Close()
+		f := wschanneltest.NewFaultChannel(s, wschanneltest.FaultPolicy{Duplicate: 1})
+		if err := c.Send([]byte(msg)); err != nil {
+			t.Fatalf("Send: unexpected error: %v", err)
+		}
+		for range 2 {
+			if got, err := f.Recv(); err != nil || string(got) != msg {
+				t.Errorf("Recv: got (%q, %v), want (%q, nil)", got, err, msg)
+			}
+		}
+	})
+
+	t.Run("TruncateCorrupt", func(t *testing.T) {
+		var faults []wschanneltest.Fault
+		c, s := wschanneltest.Pipe()
+		defer s.Close()
+		f := wschanneltest.NewFaultChannel(c, wschanneltest.FaultPolicy{
+			Truncate: 1,
+			Corrupt:  1,
+			Rand:     seeded(),
+			OnFault:  func(f wschanneltest.Fault) { faults = append(faults, f) },
+		})
+		if err := f.Send([]byte(msg)); err != nil {
+			t.Fatalf("Send: unexpected error: %v", err)
+		}
+		got, err := s.Recv()
+		if err != nil {
+			t.Fatalf("Recv: unexpected error: %v", err)
+		}
+		if len(got) >= len(msg) || string(got) == msg[:len(got)] {
+			t.Errorf("Recv: got %q, want a corrupted prefix of %q", got, msg)
+		}
+		want := []wschanneltest.Fault{wschanneltest.FaultTruncate, wschanneltest.FaultCorrupt}
+		if !slices.Equal(faults, want) {
+			t.Errorf("Faults: got %q, want %q", faults, want)
+		}
+	})
+
+	t.Run("DisconnectAfter", func(t *testing.T) {
+		c, s := wschanneltest.Pipe()
+		f := wschanneltest.NewFaultChannel(c, wschanneltest.FaultPolicy{DisconnectAfter: 2})
+		for i := range 3 {
+			err := f.Send([]byte(msg))
+			if i < 2 && err != nil {
+				t.Errorf("Send %d: unexpected error: %v", i+1, err)
+			} else if i == 2 && !errors.Is(err, net.ErrClosed) {
+				t.Errorf("Send %d: got %v, want %v", i+1, err, net.ErrClosed)
+			}
+		}
+		for range 2 {
+			if _, err := s.Recv(); err != nil {
+				t.Errorf("Recv: unexpected error: %v", err)
+			}
+		}
+		if _, err := s.Recv(); err == nil {
+			t.Error("Recv after disconnect: got nil error, want failure")
+		}
+	})
+}
+
+func TestFakeClock(t *testing.T) {
+	clk := wschanneltest.NewFakeClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	lst, url := wschanneltest.NewTestServer(t, &wschannel.ListenOptions{
+		IdleTimeout: time.Minute,
+		Channel:     &wschannel.ChannelOptions{Clock: clk},
+	})
+
+	c, err := wschannel.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+	s, err := lst.AcceptChannel(context.Background())
+	if err != nil {
+		t.Fatalf("AcceptChannel: unexpected error: %v", err)
+	}
+	defer s.Close()
+	if got := s.Info().Queued; !got.Equal(clk.Now()) {
+		t.Errorf("Queued: got %v, want %v", got, clk.Now())
+	}
+
+	isClosed := func() bool {
+		select {
+		case <-s.Done():
+			return true
+		default:
+			return false
+		}
+	}
+
+	// Activity halfway through the timeout postpones the reaper.
+	clk.Advance(30 * time.Second)
+	if err := c.Send([]byte("hello")); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+	if _, err := s.Recv(); err != nil {
+		t.Fatalf("Recv: unexpected error: %v", err)
+	}
+	clk.Advance(59 * time.Second)
+	if isClosed() {
+		t.Fatal("Channel closed before the idle timeout")
+	}
+	clk.Advance(time.Second)
+	if !isClosed() {
+		t.Fatal("Channel not closed after the idle timeout")
+	}
+	if got := lst.Metrics().Reaped; got != 1 {
+		t.Errorf("Reaped: got %d, want 1", got)
+	}
+}
+
+func TestNewLocal(t *testing.T) {
+	loc := wschanneltest.NewLocal(handler.Map{
+		"Hello": handler.New(func(context.Context) string { return "world" }),
+	}, nil)
+
+	var got string
+	if err := loc.Client.CallResult(context.Background(), "Hello", nil, &got); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	} else if got != "world" {
+		t.Errorf("Call result: got %q, want world", got)
+	}
+	if err := loc.Close(); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package wsjrpc
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/coder/websocket"
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/wschannel"
+)
+
+// A Bridge is an http.Handler that upgrades each request to a websocket and
+// serves JSON-RPC on it with a jrpc2 server, until the peer disconnects. The
+// server runs in the goroutine serving the request, so no Listener or Accept
+// loop is required. This is the websocket analogue of jhttp.Bridge.
+type Bridge struct {
+	assigner jrpc2.Assigner
+	opts     *BridgeOptions
+
+	ctx    context.Context // ends when the bridge is closed
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup // running servers; add only while holding mu
+}
+
+// NewBridge constructs a new Bridge that serves requests using assigner and
+// the given options.
+func NewBridge(assigner jrpc2.Assigner, opts *BridgeOptions) *Bridge {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Bridge{assigner: assigner, opts: opts, ctx: ctx, cancel: cancel}
+}
+
+// ServeHTTP implements the http.Handler interface. A request that cannot be
+// upgraded to a websocket is answered with an HTTP error.
+func (b *Bridge) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		http.Error(w, "bridge is closed", http.StatusServiceUnavailable)
+		return
+	}
+	b.wg.Add(1)
+	b.mu.Unlock()
+	defer b.wg.Done()
+
+	conn, err := websocket.Accept(w, req, b.opts.acceptOptions())
+	if err != nil {
+		return // Accept has already written a response
+	}
+	ch := wschannel.NewServerConn(conn, req, b.opts.channelOptions())
+	defer ch.Close()
+
+	srv := jrpc2.NewServer(b.assigner, b.opts.serverOptions()).Start(ch)
+	defer context.AfterFunc(b.ctx, srv.Stop)()
+	if hub := b.opts.hub(); hub != nil {
+		defer hub.add(ch, srv)()
+	}
+	srv.Wait()
+}
+
+// Close stops the servers running on the bridge, and waits for their
+// requests to return. After Close, requests to the bridge are answered with
+// 503 (Service Unavailable).
+func (b *Bridge) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.cancel()
+	b.wg.Wait()
+	return nil
+}
+
+// BridgeOptions are settings for a Bridge. A nil *BridgeOptions is ready for
+// use and provides default values as described.
+type BridgeOptions struct {
+	// Options for the server started on each connection.
+	Server *jrpc2.ServerOptions
+
+	// Options for the channel created for each connection.
+	Channel *wschannel.ChannelOptions
+
+	// Options for the websocket upgrade, for example to set the permitted
+	// origins or subprotocols.
+	Accept *websocket.AcceptOptions
+
+	// If set, each server is tracked by this hub while it runs.
+	Hub *Hub
+}
+
+func (o *BridgeOptions) serverOptions() *jrpc2.ServerOptions {
+	if o == nil {
+		return nil
+	}
+	return o.Server
+}
+
+func (o *BridgeOptions) channelOptions() *wschannel.ChannelOptions {
+	if o == nil {
+		return nil
+	}
+	return o.Channel
+}
+
+func (o *BridgeOptions) acceptOptions() *websocket.AcceptOptions {
+	if o == nil {
+		return nil
+	}
+	return o.Accept
+}
+
+func (o *BridgeOptions) hub() *Hub {
+	if o == nil {
+		return nil
+	}
+	return o.Hub
+}
@@ -0,0 +1,104 @@
+package wsjrpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/jrpc2/channel"
+	"github.com/creachadair/wschannel"
+)
+
+// NewClient dials a websocket channel to url with the given dial options, and
+// returns a jrpc2 client using the channel with the given client options.
+// Closing the client closes the channel.
+func NewClient(ctx context.Context, url string, dopts *wschannel.DialOptions, copts *jrpc2.ClientOptions) (*jrpc2.Client, error) {
+	ch, err := wschannel.DialContext(ctx, url, dopts)
+	if err != nil {
+		return nil, err
+	}
+	return jrpc2.NewClient(ch, copts), nil
+}
+
+// ErrClientClosed is reported by the methods of a RedialClient after it has
+// been closed.
+var ErrClientClosed = errors.New("client is closed")
+
+// A RedialClient is a jrpc2 client that dials a new websocket channel when
+// its connection fails. Calls in flight when the connection fails report an
+// error and are not retried; the next call redials.
+type RedialClient struct {
+	dial func() (channel.Channel, error)
+	opts *jrpc2.ClientOptions
+
+	mu     sync.Mutex
+	cli    *jrpc2.Client // the current client, or nil
+	closed bool
+}
+
+// NewRedialClient returns a client that dials url with the given options,
+// using wschannel.Redialer, and runs a jrpc2 client with the given client
+// options on each channel. The first channel is dialed on the first call.
+func NewRedialClient(url string, dopts *wschannel.DialOptions, copts *jrpc2.ClientOptions) *RedialClient {
+	return &RedialClient{dial: wschannel.Redialer(url, dopts), opts: copts}
+}
+
+// Client returns the current client of r, dialing a new channel if there is
+// no current client or it has stopped.
+func (r *RedialClient) Client() (*jrpc2.Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, ErrClientClosed
+	}
+	if r.cli == nil || r.cli.IsStopped() {
+		ch, err := r.dial()
+		if err != nil {
+			return nil, err
+		}
+		r.cli = jrpc2.NewClient(ch, r.opts)
+	}
+	return r.cli, nil
+}
+
+// Call issues a call to the specified method, as jrpc2.Client.Call.
+func (r *RedialClient) Call(ctx context.Context, method string, params any) (*jrpc2.Response, error) {
+	cli, err := r.Client()
+	if err != nil {
+		return nil, err
+	}
+	return cli.Call(ctx, method, params)
+}
+
+// CallResult issues a call to the specified method and decodes its result, as
+// jrpc2.Client.CallResult.
+func (r *RedialClient) CallResult(ctx context.Context, method string, params, result any) error {
+	cli, err := r.Client()
+	if err != nil {
+		return err
+	}
+	return cli.CallResult(ctx, method, params, result)
+}
+
+// Notify sends a notification for the specified method, as
+// jrpc2.Client.Notify.
+func (r *RedialClient) Notify(ctx context.Context, method string, params any) error {
+	cli, err := r.Client()
+	if err != nil {
+		return err
+	}
+	return cli.Notify(ctx, method, params)
+}
+
+// Close closes the current client of r, if any. After Close, the methods of
+// r report ErrClientClosed.
+func (r *RedialClient) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.cli != nil {
+		return r.cli.Close()
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package wsjrpc
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/creachadair/wschannel"
+)
+
+// Dual returns an http.Handler that routes websocket upgrade requests, and
+// the requests of fallback sessions (see wschannel.IsFallback), to ws, and all
+// other requests to post. Typically ws is a *wschannel.Listener or a
+// *Bridge, and post is a jhttp.Bridge for the same methods, so that clients
+// that cannot use websockets (for example, behind a proxy that does not
+// support them) can send JSON-RPC requests to the same URL as HTTP POST.
+func Dual(ws, post http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if IsUpgrade(req) || wschannel.IsFallback(req) {
+			ws.ServeHTTP(w, req)
+		} else {
+			post.ServeHTTP(w, req)
+		}
+	})
+}
+
+// IsUpgrade reports whether req is a request to upgrade to a websocket.
+func IsUpgrade(req *http.Request) bool {
+	return hasToken(req.Header, "Connection", "upgrade") && hasToken(req.Header, "Upgrade", "websocket")
+}
+
+// hasToken reports whether the comma-separated values of the header key in h
+// include token, ignoring case.
+func hasToken(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
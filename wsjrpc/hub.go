@@ -0,0 +1,107 @@
+package wsjrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/wschannel"
+)
+
+// A Hub tracks the jrpc2 servers running on websocket channels, so that a
+// program can push notifications and callbacks to their clients. To track
+// the servers started by Serve or a Bridge, set the Hub field of their
+// options. The servers must be started with ServerOptions.AllowPush set.
+// A zero Hub is ready for use, but must not be copied after first use.
+type Hub struct {
+	mu      sync.Mutex
+	servers map[*wschannel.Channel]*jrpc2.Server
+}
+
+// add registers srv as the server for ch, and returns a function that
+// removes it.
+func (h *Hub) add(ch *wschannel.Channel, srv *jrpc2.Server) func() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.servers == nil {
+		h.servers = make(map[*wschannel.Channel]*jrpc2.Server)
+	}
+	h.servers[ch] = srv
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.servers, ch)
+	}
+}
+
+// Len reports the number of servers tracked by h.
+func (h *Hub) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.servers)
+}
+
+// match returns the channels and servers tracked by h whose channels satisfy
+// match, or all of them if match == nil.
+func (h *Hub) match(match func(*wschannel.Channel) bool) (chs []*wschannel.Channel, srvs []*jrpc2.Server) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch, srv := range h.servers {
+		if match == nil || match(ch) {
+			chs = append(chs, ch)
+			srvs = append(srvs, srv)
+		}
+	}
+	return chs, srvs
+}
+
+// PushAll sends a notification for method with params to the clients of all
+// the servers tracked by h. See PushMatching.
+func (h *Hub) PushAll(ctx context.Context, method string, params any) error {
+	return h.PushMatching(ctx, nil, method, params)
+}
+
+// PushMatching sends a notification for method with params to the clients of
+// the servers tracked by h whose channels satisfy match. If match == nil, all
+// the clients are notified. Clients whose connections have closed are
+// skipped. Other errors are reported together, labeled by channel ID.
+func (h *Hub) PushMatching(ctx context.Context, match func(*wschannel.Channel) bool, method string, params any) error {
+	chs, srvs := h.match(match)
+	var errs []error
+	for i, srv := range srvs {
+		if err := srv.Notify(ctx, method, params); err != nil && !errors.Is(err, jrpc2.ErrConnClosed) {
+			errs = append(errs, fmt.Errorf("channel %s: %w", chs[i].ID(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// A CallResult is the outcome of a callback to one client by CallMatching.
+type CallResult struct {
+	Channel  *wschannel.Channel
+	Response *jrpc2.Response // the response, if Err == nil
+	Err      error
+}
+
+// CallMatching issues a callback for method with params to the clients of
+// the servers tracked by h whose channels satisfy match, or to all of them
+// if match == nil. The callbacks run concurrently, and CallMatching waits for
+// all of them to complete or for ctx to end. The results are in no
+// particular order.
+func (h *Hub) CallMatching(ctx context.Context, match func(*wschannel.Channel) bool, method string, params any) []CallResult {
+	chs, srvs := h.match(match)
+	out := make([]CallResult, len(srvs))
+	var wg sync.WaitGroup
+	for i, srv := range srvs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rsp, err := srv.Callback(ctx, method, params)
+			out[i] = CallResult{Channel: chs[i], Response: rsp, Err: err}
+		}()
+	}
+	wg.Wait()
+	return out
+}
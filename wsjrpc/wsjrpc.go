@@ -0,0 +1,73 @@
+// Package wsjrpc connects jrpc2 servers and clients to websocket channels.
+//
+// It is a separate package so that the wschannel package depends only on the
+// channel package of jrpc2, and not on the client and server.
+package wsjrpc
+
+import (
+	"context"
+
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/wschannel"
+)
+
+// ServeOptions are settings for Serve. A nil *ServeOptions is ready for use
+// and provides default values as described.
+type ServeOptions struct {
+	// Options for the server started on each channel.
+	Server *jrpc2.ServerOptions
+
+	// If set, this function is called with the status of the server for each
+	// channel after it exits, before the channel is closed.
+	OnExit func(*wschannel.Channel, jrpc2.ServerStatus)
+
+	// If set, each server is tracked by this hub while it runs.
+	Hub *Hub
+}
+
+func (o *ServeOptions) serverOptions() *jrpc2.ServerOptions {
+	if o == nil {
+		return nil
+	}
+	return o.Server
+}
+
+func (o *ServeOptions) hub() *Hub {
+	if o == nil {
+		return nil
+	}
+	return o.Hub
+}
+
+func (o *ServeOptions) onExit() func(*wschannel.Channel, jrpc2.ServerStatus) {
+	if o == nil {
+		return nil
+	}
+	return o.OnExit
+}
+
+// Serve accepts channels from lst until ctx ends or lst closes, and runs a
+// jrpc2 server on each channel using assigner and the server options from
+// opts. A server runs until its peer disconnects or the channel is closed,
+// after which its channel is closed. If ctx ends, the running servers are
+// stopped.
+//
+// Serve waits for all the servers it started to exit before returning. To
+// shut down gracefully, call lst.Shutdown, which stops new connections and
+// waits for the active servers to finish.
+//
+// Serve returns nil if the listener closed, or ctx.Err() if ctx ended.
+func Serve(ctx context.Context, lst *wschannel.Listener, assigner jrpc2.Assigner, opts *ServeOptions) error {
+	sopts, onExit, hub := opts.serverOptions(), opts.onExit(), opts.hub()
+	return lst.Serve(ctx, func(ch *wschannel.Channel) {
+		srv := jrpc2.NewServer(assigner, sopts).Start(ch)
+		defer context.AfterFunc(ctx, srv.Stop)()
+		if hub != nil {
+			defer hub.add(ch, srv)()
+		}
+		st := srv.WaitStatus()
+		if onExit != nil {
+			onExit(ch, st)
+		}
+	})
+}
@@ -0,0 +1,321 @@
+//go:build !js
+
+package wsjrpc_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creachadair/jrpc2"
+	"github.com/creachadair/jrpc2/handler"
+	"github.com/creachadair/jrpc2/jhttp"
+	"github.com/creachadair/wschannel"
+	"github.com/creachadair/wschannel/wsjrpc"
+)
+
+var testMethods = handler.Map{
+	"Hello": handler.New(func(context.Context) string { return "world" }),
+}
+
+// newServer starts an HTTP server for lst, and returns its websocket URL.
+func newServer(t *testing.T, lst *wschannel.Listener) string {
+	t.Helper()
+	s := httptest.NewServer(lst)
+	t.Cleanup(s.Close)
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+func TestServe(t *testing.T) {
+	lst := wschannel.NewListener(nil)
+	url := newServer(t, lst)
+
+	exited := make(chan jrpc2.ServerStatus, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- wsjrpc.Serve(context.Background(), lst, testMethods, &wsjrpc.ServeOptions{
+			OnExit: func(_ *wschannel.Channel, st jrpc2.ServerStatus) { exited <- st },
+		})
+	}()
+
+	ch, err := wschannel.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	cli := jrpc2.NewClient(ch, nil)
+	var got string
+	if err := cli.CallResult(context.Background(), "Hello", nil, &got); err != nil {
+		t.Fatalf("Call: unexpected error: %v", err)
+	} else if got != "world" {
+		t.Errorf("Call: got %q, want world", got)
+	}
+	cli.Close()
+
+	select {
+	case st := <-exited:
+		if !st.Closed {
+			t.Errorf("Server status: got %+v, want closed", st)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the server to exit")
+	}
+
+	lst.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve: unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for Serve to return")
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	lst := wschannel.NewListener(nil)
+	defer lst.Close()
+	url := newServer(t, lst)
+	go wsjrpc.Serve(context.Background(), lst, testMethods, nil)
+
+	cli, err := wsjrpc.NewClient(context.Background(), url, nil, nil)
+	if err != nil {
+		t.Fatalf("NewClient: unexpected error: %v", err)
+	}
+	defer cli.Close()
+	var got string
+	if err := cli.CallResult(context.Background(), "Hello", nil, &got); err != nil {
+		t.Fatalf("Call: unexpected error: %v", err)
+	} else if got != "world" {
+		t.Errorf("Call: got %q, want world", got)
+	}
+
+	bad := httptest.NewServer(http.NotFoundHandler())
+	defer bad.Close()
+	if _, err := wsjrpc.NewClient(context.Background(), "ws"+strings.TrimPrefix(bad.URL, "http"), nil, nil); err == nil {
+		t.Error("NewClient without a websocket server: got nil error, want error")
+	}
+}
+
+func TestRedialClient(t *testing.T) {
+	accepted := make(chan *wschannel.Channel, 2)
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		Channel: &wschannel.ChannelOptions{
+			OnEvent: func(e wschannel.Event) {
+				if e.Kind == wschannel.Accepted {
+					accepted <- e.Channel
+				}
+			},
+		},
+	})
+	defer lst.Close()
+	url := newServer(t, lst)
+	go wsjrpc.Serve(context.Background(), lst, testMethods, nil)
+
+	rc := wsjrpc.NewRedialClient(url, nil, nil)
+	call := func() {
+		t.Helper()
+		var got string
+		if err := rc.CallResult(context.Background(), "Hello", nil, &got); err != nil {
+			t.Fatalf("Call: unexpected error: %v", err)
+		} else if got != "world" {
+			t.Errorf("Call: got %q, want world", got)
+		}
+	}
+	call()
+	first, err := rc.Client()
+	if err != nil {
+		t.Fatalf("Client: unexpected error: %v", err)
+	}
+
+	// Drop the connection from the server side, and wait for the client to
+	// notice, then verify that the next call redials.
+	(<-accepted).Close()
+	for !first.IsStopped() {
+		time.Sleep(time.Millisecond)
+	}
+	call()
+	if next, _ := rc.Client(); next == first {
+		t.Error("Client was not replaced after the connection failed")
+	}
+
+	rc.Close()
+	if err := rc.Notify(context.Background(), "Hello", nil); err != wsjrpc.ErrClientClosed {
+		t.Errorf("Notify after Close: got %v, want %v", err, wsjrpc.ErrClientClosed)
+	}
+}
+
+func TestBridge(t *testing.T) {
+	b := wsjrpc.NewBridge(testMethods, nil)
+	s := httptest.NewServer(b)
+	defer s.Close()
+	url := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	cli, err := wsjrpc.NewClient(context.Background(), url, nil, nil)
+	if err != nil {
+		t.Fatalf("NewClient: unexpected error: %v", err)
+	}
+	var got string
+	if err := cli.CallResult(context.Background(), "Hello", nil, &got); err != nil {
+		t.Fatalf("Call: unexpected error: %v", err)
+	} else if got != "world" {
+		t.Errorf("Call: got %q, want world", got)
+	}
+
+	// Closing the bridge stops the server, which disconnects the client.
+	if err := b.Close(); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+	if err := cli.CallResult(context.Background(), "Hello", nil, &got); err == nil {
+		t.Error("Call after Close: got nil error, want error")
+	}
+	cli.Close()
+
+	rsp, err := http.Get(s.URL)
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Get after Close: got status %d, want %d", rsp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+func TestHub(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		CheckAccept: func(req *http.Request) (int, error) {
+			wschannel.SetLabel(req, "name", req.URL.Query().Get("name"))
+			return 0, nil
+		},
+	})
+	defer lst.Close()
+	url := newServer(t, lst)
+
+	var hub wsjrpc.Hub
+	go wsjrpc.Serve(context.Background(), lst, testMethods, &wsjrpc.ServeOptions{
+		Server: &jrpc2.ServerOptions{AllowPush: true},
+		Hub:    &hub,
+	})
+
+	notes := make(chan string, 4)
+	connect := func(name string) *jrpc2.Client {
+		t.Helper()
+		cli, err := wsjrpc.NewClient(context.Background(), url+"?name="+name, nil, &jrpc2.ClientOptions{
+			OnNotify: func(req *jrpc2.Request) { notes <- name + ":" + req.Method() },
+			OnCallback: func(ctx context.Context, req *jrpc2.Request) (any, error) {
+				return name, nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("NewClient: unexpected error: %v", err)
+		}
+		t.Cleanup(func() { cli.Close() })
+		return cli
+	}
+	connect("a")
+	connect("b")
+	for hub.Len() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	recvNotes := func(n int) []string {
+		t.Helper()
+		var got []string
+		for range n {
+			select {
+			case note := <-notes:
+				got = append(got, note)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for notifications; got %q", got)
+			}
+		}
+		slices.Sort(got)
+		return got
+	}
+	isA := func(ch *wschannel.Channel) bool { return ch.Info().Labels["name"] == "a" }
+
+	if err := hub.PushAll(context.Background(), "hello", nil); err != nil {
+		t.Fatalf("PushAll: unexpected error: %v", err)
+	}
+	if got, want := recvNotes(2), []string{"a:hello", "b:hello"}; !slices.Equal(got, want) {
+		t.Errorf("PushAll: got %q, want %q", got, want)
+	}
+	if err := hub.PushMatching(context.Background(), isA, "only", nil); err != nil {
+		t.Fatalf("PushMatching: unexpected error: %v", err)
+	}
+	if got, want := recvNotes(1), []string{"a:only"}; !slices.Equal(got, want) {
+		t.Errorf("PushMatching: got %q, want %q", got, want)
+	}
+
+	var names []string
+	for _, res := range hub.CallMatching(context.Background(), nil, "who", nil) {
+		var name string
+		if res.Err != nil {
+			t.Errorf("Callback to %s: unexpected error: %v", res.Channel.ID(), res.Err)
+		} else if err := res.Response.UnmarshalResult(&name); err != nil {
+			t.Errorf("Callback result: %v", err)
+		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	if want := []string{"a", "b"}; !slices.Equal(names, want) {
+		t.Errorf("CallMatching: got %q, want %q", names, want)
+	}
+}
+
+func TestDual(t *testing.T) {
+	ws := wsjrpc.NewBridge(testMethods, nil)
+	defer ws.Close()
+	post := jhttp.NewBridge(testMethods, nil)
+	defer post.Close()
+	s := httptest.NewServer(wsjrpc.Dual(ws, post))
+	defer s.Close()
+
+	wsc, err := wsjrpc.NewClient(context.Background(), "ws"+strings.TrimPrefix(s.URL, "http"), nil, nil)
+	if err != nil {
+		t.Fatalf("NewClient: unexpected error: %v", err)
+	}
+	defer wsc.Close()
+	httpc := jrpc2.NewClient(jhttp.NewChannel(s.URL, nil), nil)
+	defer httpc.Close()
+
+	for _, cli := range []*jrpc2.Client{wsc, httpc} {
+		var got string
+		if err := cli.CallResult(context.Background(), "Hello", nil, &got); err != nil {
+			t.Errorf("Call: unexpected error: %v", err)
+		} else if got != "world" {
+			t.Errorf("Call: got %q, want world", got)
+		}
+	}
+
+	t.Run("Fallback", func(t *testing.T) {
+		lst := wschannel.NewListener(&wschannel.ListenOptions{Fallback: true})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go wsjrpc.Serve(ctx, lst, testMethods, nil)
+		defer lst.Close()
+
+		// Simulate a proxy that does not forward websocket upgrades.
+		dual := wsjrpc.Dual(lst, post)
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req.Header.Del("Upgrade")
+			dual.ServeHTTP(w, req)
+		}))
+		defer s.Close()
+
+		cli, err := wsjrpc.NewClient(context.Background(), "ws"+strings.TrimPrefix(s.URL, "http"),
+			&wschannel.DialOptions{Fallback: true}, nil)
+		if err != nil {
+			t.Fatalf("NewClient: unexpected error: %v", err)
+		}
+		defer cli.Close()
+		var got string
+		if err := cli.CallResult(context.Background(), "Hello", nil, &got); err != nil {
+			t.Errorf("Call: unexpected error: %v", err)
+		} else if got != "world" {
+			t.Errorf("Call: got %q, want world", got)
+		}
+	})
+}
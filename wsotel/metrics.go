@@ -0,0 +1,83 @@
+package wsotel
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// meters are the metric instruments recorded by this package.
+//
+//   - wschannel.connections: instrumented channels currently open
+//   - wschannel.messages: messages sent and received
+//   - wschannel.message.bytes: payload bytes sent and received
+//   - wschannel.handshake.duration: time taken by the websocket handshake
+//   - wschannel.closes: channels closed, by close status
+//
+// Each is labeled with the role of the channel ("client" or "server");
+// message counters are also labeled by message.type, as for trace events.
+type meters struct {
+	conns     metric.Int64UpDownCounter
+	messages  metric.Int64Counter
+	bytes     metric.Int64Counter
+	handshake metric.Float64Histogram
+	closes    metric.Int64Counter
+}
+
+// newMeters constructs the instruments of this package from mp. Errors
+// creating an instrument are reported to the global OTel error handler; the
+// affected instrument records nothing.
+func newMeters(mp metric.MeterProvider) *meters {
+	m := mp.Meter(scope)
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	var ms meters
+	var err error
+	ms.conns, err = m.Int64UpDownCounter("wschannel.connections",
+		metric.WithDescription("Channels currently open."),
+		metric.WithUnit("{connection}"))
+	check(err)
+	ms.messages, err = m.Int64Counter("wschannel.messages",
+		metric.WithDescription("Messages sent and received."),
+		metric.WithUnit("{message}"))
+	check(err)
+	ms.bytes, err = m.Int64Counter("wschannel.message.bytes",
+		metric.WithDescription("Payload bytes sent and received."),
+		metric.WithUnit("By"))
+	check(err)
+	ms.handshake, err = m.Float64Histogram("wschannel.handshake.duration",
+		metric.WithDescription("Duration of the websocket handshake."),
+		metric.WithUnit("s"))
+	check(err)
+	ms.closes, err = m.Int64Counter("wschannel.closes",
+		metric.WithDescription("Channels closed, by close status."),
+		metric.WithUnit("{connection}"))
+	check(err)
+	for _, err := range errs {
+		otel.Handle(err)
+	}
+	return &ms
+}
+
+// The roles of a channel, for metric attributes.
+var (
+	roleClient = attrRole.String("client")
+	roleServer = attrRole.String("server")
+)
+
+// handshakeDone records the duration of a handshake that began at start,
+// with the given HTTP status code, if it is positive.
+func (m *meters) handshakeDone(ctx context.Context, role attribute.KeyValue, start time.Time, code int) {
+	attrs := []attribute.KeyValue{role}
+	if code > 0 {
+		attrs = append(attrs, attrStatusCode.Int(code))
+	}
+	m.handshake.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(attrs...))
+}
@@ -0,0 +1,359 @@
+// Package wsotel provides OpenTelemetry tracing for wschannel connections.
+//
+// On the client side, Dial records a span for the websocket handshake and
+// propagates its trace context to the server in the handshake headers. On the
+// server side, Handler records a span for each upgrade request, and Wrap
+// instruments an accepted channel with a span that continues the trace of
+// the client. Each instrumented channel has a span covering its lifetime,
+// with an event (or optionally a child span) for each message.
+//
+// The same functions also record metrics, if a meter provider is configured:
+// the number of open channels, message and byte counts, handshake durations,
+// and close statuses.
+//
+// It is a separate module so that the wschannel package does not depend on
+// the OpenTelemetry libraries.
+package wsotel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/creachadair/jrpc2/channel"
+	"github.com/creachadair/wschannel"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// scope is the instrumentation scope name reported for spans.
+const scope = "github.com/creachadair/wschannel/wsotel"
+
+// Attribute keys for the spans and events recorded by this package.
+var (
+	attrMessageType = attribute.Key("message.type")
+	attrMessageSize = attribute.Key("message.uncompressed_size")
+	attrCloseStatus = attribute.Key("websocket.close_status")
+	attrChannelID   = attribute.Key("websocket.channel_id")
+	attrStatusCode  = attribute.Key("http.response.status_code")
+	attrMethod      = attribute.Key("http.request.method")
+	attrURL         = attribute.Key("url.full")
+	attrPath        = attribute.Key("url.path")
+	attrRole        = attribute.Key("websocket.role")
+)
+
+// Options are settings for tracing. A nil *Options is ready for use and
+// provides default values as described.
+type Options struct {
+	// The provider of the tracer used to record spans. If nil, the global
+	// provider is used (see otel.GetTracerProvider).
+	TracerProvider trace.TracerProvider
+
+	// The propagator used to carry trace context in the handshake headers.
+	// If nil, the global propagator is used (see otel.GetTextMapPropagator).
+	Propagator propagation.TextMapPropagator
+
+	// If true, record a child span for each message sent or received, rather
+	// than an event on the span of the channel.
+	MessageSpans bool
+
+	// The provider of the meter used to record metrics. If nil, the global
+	// provider is used (see otel.GetMeterProvider), which records nothing
+	// unless the program installs one.
+	MeterProvider metric.MeterProvider
+}
+
+func (o *Options) tracer() trace.Tracer {
+	if o == nil || o.TracerProvider == nil {
+		return otel.GetTracerProvider().Tracer(scope)
+	}
+	return o.TracerProvider.Tracer(scope)
+}
+
+func (o *Options) propagator() propagation.TextMapPropagator {
+	if o == nil || o.Propagator == nil {
+		return otel.GetTextMapPropagator()
+	}
+	return o.Propagator
+}
+
+func (o *Options) messageSpans() bool { return o != nil && o.MessageSpans }
+
+func (o *Options) meters() *meters {
+	if o == nil || o.MeterProvider == nil {
+		return newMeters(otel.GetMeterProvider())
+	}
+	return newMeters(o.MeterProvider)
+}
+
+// Dial dials the specified websocket URL as wschannel.DialContext, and
+// returns an instrumented channel. The handshake is recorded as a client
+// span, a child of the span in ctx, whose trace context is sent to the
+// server in the handshake headers. The span of the channel is a child of the
+// handshake span.
+func Dial(ctx context.Context, url string, dopts *wschannel.DialOptions, opts *Options) (*Channel, error) {
+	start, m := time.Now(), opts.meters()
+	ctx, span := opts.tracer().Start(ctx, "wschannel.dial",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrURL.String(url)),
+	)
+	defer span.End()
+
+	var do wschannel.DialOptions
+	if dopts != nil {
+		do = *dopts
+	}
+	do.Header = do.Header.Clone()
+	if do.Header == nil {
+		do.Header = make(http.Header)
+	}
+	opts.propagator().Inject(ctx, propagation.HeaderCarrier(do.Header))
+
+	ch, err := wschannel.DialContext(ctx, url, &do)
+	if err != nil {
+		var rerr *wschannel.RejectedError
+		code := 0
+		if errors.As(err, &rerr) {
+			code = rerr.Code
+			span.SetAttributes(attrStatusCode.Int(code))
+		}
+		m.handshakeDone(ctx, roleClient, start, code)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(attrStatusCode.Int(http.StatusSwitchingProtocols))
+	m.handshakeDone(ctx, roleClient, start, http.StatusSwitchingProtocols)
+	return wrap(ctx, ch, opts, m), nil
+}
+
+// Handler returns an http.Handler that records a server span for each
+// request served by h, typically a *wschannel.Listener. The span continues
+// the trace context propagated in the request headers, and is available from
+// the request context, for example to the CheckAccept hook of a listener.
+//
+// A Listener serves each request until its channel closes, so the span and
+// the handshake duration cover the life of the connection. To record only
+// the upgrade, set the Detach option of the listener.
+func Handler(h http.Handler, opts *Options) http.Handler {
+	tracer, prop, m := opts.tracer(), opts.propagator(), opts.meters()
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		ctx := prop.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := tracer.Start(ctx, "wschannel.upgrade",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attrMethod.String(req.Method),
+				attrPath.String(req.URL.Path),
+			),
+		)
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, req.WithContext(ctx))
+		code := sw.status()
+		span.SetAttributes(attrStatusCode.Int(code))
+		m.handshakeDone(ctx, roleServer, start, code)
+		if code >= 400 {
+			span.SetStatus(codes.Error, http.StatusText(code))
+		}
+	})
+}
+
+// Channel is an instrumented wschannel.Channel. It records a span from the
+// time it is created until it is closed, either by Close or by the peer.
+type Channel struct {
+	*wschannel.Channel
+
+	ctx      context.Context // carries the span of the channel
+	span     trace.Span
+	tracer   trace.Tracer
+	msgSpans bool
+	meters   *meters
+	role     metric.MeasurementOption // the role of the channel
+	once     sync.Once                // guards ending span
+}
+
+// Wrap returns an instrumented channel for ch, whose span is a child of the
+// span in ctx. If ctx has no span and ch was served by a Listener, the span
+// instead continues the trace context propagated in the handshake headers.
+// The Channel takes ownership of ch.
+func Wrap(ctx context.Context, ch *wschannel.Channel, opts *Options) *Channel {
+	return wrap(ctx, ch, opts, opts.meters())
+}
+
+func wrap(ctx context.Context, ch *wschannel.Channel, opts *Options, m *meters) *Channel {
+	kind, role := trace.SpanKindClient, roleClient
+	if info := ch.Info(); info != nil {
+		kind, role = trace.SpanKindServer, roleServer
+		if !trace.SpanContextFromContext(ctx).IsValid() {
+			ctx = opts.propagator().Extract(ctx, propagation.HeaderCarrier(info.Header))
+		}
+	}
+	tracer := opts.tracer()
+	ctx, span := tracer.Start(ctx, "wschannel.channel",
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(attrChannelID.String(ch.ID())),
+	)
+	c := &Channel{
+		Channel:  ch,
+		ctx:      ctx,
+		span:     span,
+		tracer:   tracer,
+		msgSpans: opts.messageSpans(),
+		meters:   m,
+		role:     metric.WithAttributes(role),
+	}
+	m.conns.Add(ctx, 1, c.role)
+	return c
+}
+
+// Context returns a context that carries the span of c, for use as the
+// parent of spans for the work done on the channel.
+func (c *Channel) Context() context.Context { return c.ctx }
+
+// Send implements the corresponding method of the Channel interface.
+func (c *Channel) Send(data []byte) error {
+	span := c.message("SENT", len(data))
+	err := c.Channel.Send(data)
+	if err == nil {
+		c.count("SENT", len(data))
+	}
+	c.finish(span, err)
+	return err
+}
+
+// Recv implements the corresponding method of the Channel interface.
+func (c *Channel) Recv() ([]byte, error) {
+	data, err := c.Channel.Recv()
+	if err == nil {
+		c.count("RECEIVED", len(data))
+		c.finish(c.message("RECEIVED", len(data)), nil)
+	} else {
+		c.finish(nil, err)
+	}
+	return data, err
+}
+
+// Close implements the corresponding method of the Channel interface.
+func (c *Channel) Close() error {
+	err := c.Channel.Close()
+	c.end(nil)
+	return err
+}
+
+// message records a message of the given type and size, returning a span
+// for it if c records messages as spans.
+func (c *Channel) message(typ string, size int) trace.Span {
+	attrs := trace.WithAttributes(attrMessageType.String(typ), attrMessageSize.Int(size))
+	if !c.msgSpans {
+		c.span.AddEvent("message", attrs)
+		return nil
+	}
+	name := "wschannel.send"
+	if typ == "RECEIVED" {
+		name = "wschannel.recv"
+	}
+	_, span := c.tracer.Start(c.ctx, name, attrs)
+	return span
+}
+
+// count records a message of the given type and size in the metrics of c.
+func (c *Channel) count(typ string, size int) {
+	attrs := metric.WithAttributes(attrMessageType.String(typ))
+	c.meters.messages.Add(c.ctx, 1, c.role, attrs)
+	c.meters.bytes.Add(c.ctx, int64(size), c.role, attrs)
+}
+
+// finish ends span, if it is not nil, and records err, if it is not nil.
+// An error reporting that the channel closed ends the span of c.
+func (c *Channel) finish(span trace.Span, err error) {
+	if err != nil {
+		if channel.IsErrClosing(err) {
+			c.end(err)
+		} else {
+			c.span.RecordError(err)
+			if span != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+		}
+	}
+	if span != nil {
+		span.End()
+	}
+}
+
+// end ends the span of c, once, recording the close status if err carries
+// one, or a normal closure if err == nil. An abnormal closure is recorded as
+// an error.
+func (c *Channel) end(err error) {
+	c.once.Do(func() {
+		c.meters.conns.Add(c.ctx, -1, c.role)
+		code := websocket.StatusNormalClosure
+		if err != nil {
+			code = websocket.CloseStatus(err)
+		}
+		if code < 0 {
+			c.meters.closes.Add(c.ctx, 1, c.role)
+		} else {
+			c.span.SetAttributes(attrCloseStatus.Int(int(code)))
+			c.meters.closes.Add(c.ctx, 1, c.role, metric.WithAttributes(attrCloseStatus.Int(int(code))))
+			if err != nil && code != websocket.StatusNormalClosure && code != websocket.StatusGoingAway {
+				c.span.SetStatus(codes.Error, err.Error())
+			}
+		}
+		c.span.End()
+	})
+}
+
+// statusWriter is an http.ResponseWriter that records the status code of the
+// response written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Hijack supports the websocket upgrade, which does not write a status
+// through the ResponseWriter.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.code == 0 {
+		w.code = http.StatusSwitchingProtocols
+	}
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// Unwrap supports http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// status returns the status code of the response, or 200 (OK) if none has
+// been written, as the HTTP server would report.
+func (w *statusWriter) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
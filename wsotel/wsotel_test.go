@@ -0,0 +1,185 @@
+package wsotel_test
+
+import (
+	"context"
+	"maps"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/creachadair/wschannel"
+	"github.com/creachadair/wschannel/wsotel"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	opts := &wsotel.Options{
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)),
+		Propagator:     propagation.TraceContext{},
+	}
+
+	lst := wschannel.NewListener(&wschannel.ListenOptions{Detach: true})
+	defer lst.Close()
+	s := httptest.NewServer(wsotel.Handler(lst, opts))
+	defer s.Close()
+	url := "ws:" + strings.TrimPrefix(s.URL, "http:")
+
+	ctx := context.Background()
+	cli, err := wsotel.Dial(ctx, url, nil, opts)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	ch, err := lst.AcceptChannel(ctx)
+	if err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+	srv := wsotel.Wrap(ctx, ch, opts)
+
+	if err := cli.Send([]byte("hello")); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+	if msg, err := srv.Recv(); err != nil || string(msg) != "hello" {
+		t.Fatalf("Recv: got (%q, %v), want hello", msg, err)
+	}
+	cli.Close()
+	if _, err := srv.Recv(); err == nil {
+		t.Fatal("Recv: got nil error after close")
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range rec.Ended() {
+		key := span.Name() + "/" + span.SpanKind().String()
+		spans[key] = span
+	}
+	dial := spans["wschannel.dial/client"]
+	upgrade := spans["wschannel.upgrade/server"]
+	client := spans["wschannel.channel/client"]
+	server := spans["wschannel.channel/server"]
+	if dial == nil || upgrade == nil || client == nil || server == nil {
+		t.Fatalf("Missing spans: got %v", spans)
+	}
+
+	// The server spans continue the trace of the dial.
+	id := dial.SpanContext().SpanID()
+	for _, span := range []sdktrace.ReadOnlySpan{upgrade, client, server} {
+		if got := span.Parent().SpanID(); got != id {
+			t.Errorf("Span %q: got parent %v, want %v", span.Name(), got, id)
+		}
+	}
+
+	checkEvent := func(span sdktrace.ReadOnlySpan, typ string) {
+		t.Helper()
+		for _, evt := range span.Events() {
+			var gotType string
+			var gotSize int64
+			for _, kv := range evt.Attributes {
+				switch kv.Key {
+				case "message.type":
+					gotType = kv.Value.AsString()
+				case "message.uncompressed_size":
+					gotSize = kv.Value.AsInt64()
+				}
+			}
+			if evt.Name == "message" && gotType == typ && gotSize == 5 {
+				return
+			}
+		}
+		t.Errorf("Span %q: missing %s event: %v", span.Name(), typ, span.Events())
+	}
+	checkEvent(client, "SENT")
+	checkEvent(server, "RECEIVED")
+
+	var status int64 = -1
+	for _, kv := range server.Attributes() {
+		if kv.Key == "websocket.close_status" {
+			status = kv.Value.AsInt64()
+		}
+	}
+	if status != 1000 {
+		t.Errorf("Server close status: got %d, want 1000", status)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	rd := sdkmetric.NewManualReader()
+	opts := &wsotel.Options{
+		MeterProvider: sdkmetric.NewMeterProvider(sdkmetric.WithReader(rd)),
+	}
+
+	lst := wschannel.NewListener(&wschannel.ListenOptions{Detach: true})
+	defer lst.Close()
+	s := httptest.NewServer(wsotel.Handler(lst, opts))
+	defer s.Close()
+	url := "ws:" + strings.TrimPrefix(s.URL, "http:")
+
+	ctx := context.Background()
+	cli, err := wsotel.Dial(ctx, url, nil, opts)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	ch, err := lst.AcceptChannel(ctx)
+	if err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+	srv := wsotel.Wrap(ctx, ch, opts)
+	if err := cli.Send([]byte("hello")); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+	if _, err := srv.Recv(); err != nil {
+		t.Fatalf("Recv: unexpected error: %v", err)
+	}
+
+	// collect returns the sums (or, for a histogram, the counts) of the named
+	// metric, keyed by role.
+	collect := func(name string) map[string]int64 {
+		t.Helper()
+		var rm metricdata.ResourceMetrics
+		if err := rd.Collect(ctx, &rm); err != nil {
+			t.Fatalf("Collect: %v", err)
+		}
+		out := make(map[string]int64)
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				if m.Name != name {
+					continue
+				}
+				switch d := m.Data.(type) {
+				case metricdata.Sum[int64]:
+					for _, dp := range d.DataPoints {
+						role, _ := dp.Attributes.Value("websocket.role")
+						out[role.AsString()] += dp.Value
+					}
+				case metricdata.Histogram[float64]:
+					for _, dp := range d.DataPoints {
+						role, _ := dp.Attributes.Value("websocket.role")
+						out[role.AsString()] += int64(dp.Count)
+					}
+				}
+			}
+		}
+		return out
+	}
+	check := func(name string, want map[string]int64) {
+		t.Helper()
+		if got := collect(name); !maps.Equal(got, want) {
+			t.Errorf("Metric %q: got %v, want %v", name, got, want)
+		}
+	}
+
+	check("wschannel.connections", map[string]int64{"client": 1, "server": 1})
+	check("wschannel.messages", map[string]int64{"client": 1, "server": 1})
+	check("wschannel.message.bytes", map[string]int64{"client": 5, "server": 5})
+	check("wschannel.handshake.duration", map[string]int64{"client": 1, "server": 1})
+
+	cli.Close()
+	if _, err := srv.Recv(); err == nil {
+		t.Fatal("Recv: got nil error after close")
+	}
+	check("wschannel.connections", map[string]int64{"client": 0, "server": 0})
+	check("wschannel.closes", map[string]int64{"client": 1, "server": 1})
+}
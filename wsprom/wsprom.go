@@ -0,0 +1,200 @@
+// Package wsprom provides a Prometheus collector for the metrics of a
+// wschannel.Listener.
+//
+// It is a separate module so that the wschannel package does not depend on
+// the Prometheus client library.
+package wsprom
+
+import (
+	"github.com/creachadair/wschannel"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Options are settings for a Collector. A nil *Options is ready for use and
+// provides default values as described.
+type Options struct {
+	// The namespace (prefix) of the metric names. If empty, the default is
+	// "wschannel".
+	Namespace string
+
+	// Labels attached to every metric, for example to distinguish multiple
+	// listeners in the same process.
+	ConstLabels prometheus.Labels
+
+	// If true, report message and byte counters for each live channel,
+	// labeled by its ID. This adds a set of series for every connection, so
+	// enable it only where the number of connections is modest.
+	PerChannel bool
+
+	// The names of channel labels (see wschannel.SetLabel) to add to the
+	// per-channel metrics. A channel without one of these labels reports it
+	// as empty. This has no effect unless PerChannel is true.
+	ChannelLabels []string
+}
+
+func (o *Options) namespace() string {
+	if o == nil || o.Namespace == "" {
+		return "wschannel"
+	}
+	return o.Namespace
+}
+
+func (o *Options) constLabels() prometheus.Labels {
+	if o == nil {
+		return nil
+	}
+	return o.ConstLabels
+}
+
+func (o *Options) perChannel() bool { return o != nil && o.PerChannel }
+
+func (o *Options) channelLabels() []string {
+	if o == nil {
+		return nil
+	}
+	return o.ChannelLabels
+}
+
+// A Collector implements the prometheus.Collector interface to report the
+// metrics of a listener. It reports:
+//
+//   - upgraded_total: connections upgraded to websockets
+//   - accepted_total: channels returned by Accept
+//   - rejected_total: requests rejected, labeled by reason
+//   - discarded_total: channels closed before or after acceptance by the
+//     listener's policies, labeled by reason
+//   - pending: channels admitted but not yet accepted
+//   - active: live channels, including those that are pending
+//   - handshake_duration_seconds, send_duration_seconds, and
+//     recv_duration_seconds: histograms of operation latency (see
+//     wschannel.LatencyStats)
+//
+// If per-channel metrics are enabled, it also reports
+// channel_messages_sent_total, channel_messages_received_total,
+// channel_bytes_sent_total, and channel_bytes_received_total for each live
+// channel, labeled by "id" and the configured channel labels.
+type Collector struct {
+	lst    *wschannel.Listener
+	labels []string // channel labels, if per-channel metrics are enabled
+
+	upgraded, accepted, rejected, discarded, pending, active *prometheus.Desc
+	handshake, send, recv                                    *prometheus.Desc
+
+	msgSent, msgRcvd, bytesSent, bytesRcvd *prometheus.Desc // nil unless per-channel
+}
+
+// NewCollector constructs a Collector for the metrics of lst. Register it
+// with a prometheus.Registerer to export them.
+func NewCollector(lst *wschannel.Listener, opts *Options) *Collector {
+	ns, cl := opts.namespace(), opts.constLabels()
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(ns, "", name), help, labels, cl)
+	}
+	c := &Collector{
+		lst:       lst,
+		upgraded:  desc("upgraded_total", "Connections upgraded to websockets."),
+		accepted:  desc("accepted_total", "Channels returned by Accept."),
+		rejected:  desc("rejected_total", "Requests rejected by the listener.", "reason"),
+		discarded: desc("discarded_total", "Channels closed by listener policy.", "reason"),
+		pending:   desc("pending", "Channels admitted but not yet accepted."),
+		active:    desc("active", "Live channels, including pending channels."),
+		handshake: desc("handshake_duration_seconds", "Duration of websocket handshakes."),
+		send:      desc("send_duration_seconds", "Duration of calls to Send."),
+		recv:      desc("recv_duration_seconds", "Duration of calls to Recv, including waiting for a message."),
+	}
+	if opts.perChannel() {
+		c.labels = opts.channelLabels()
+		labels := append([]string{"id"}, c.labels...)
+		c.msgSent = desc("channel_messages_sent_total", "Messages sent on a channel.", labels...)
+		c.msgRcvd = desc("channel_messages_received_total", "Messages received on a channel.", labels...)
+		c.bytesSent = desc("channel_bytes_sent_total", "Payload bytes sent on a channel.", labels...)
+		c.bytesRcvd = desc("channel_bytes_received_total", "Payload bytes received on a channel.", labels...)
+	}
+	return c
+}
+
+// Describe implements part of the prometheus.Collector interface.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.upgraded
+	ch <- c.accepted
+	ch <- c.rejected
+	ch <- c.discarded
+	ch <- c.pending
+	ch <- c.active
+	ch <- c.handshake
+	ch <- c.send
+	ch <- c.recv
+	if c.msgSent != nil {
+		ch <- c.msgSent
+		ch <- c.msgRcvd
+		ch <- c.bytesSent
+		ch <- c.bytesRcvd
+	}
+}
+
+// Collect implements part of the prometheus.Collector interface.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	m := c.lst.Metrics()
+	counter := func(d *prometheus.Desc, v int64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(v), labels...)
+	}
+	gauge := func(d *prometheus.Desc, v int) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, float64(v))
+	}
+
+	counter(c.upgraded, m.Upgraded)
+	counter(c.accepted, m.Accepted)
+	for reason, v := range map[string]int64{
+		"check":          m.Rejected,
+		"denied":         m.Denied,
+		"queue_full":     m.QueueFull,
+		"ip_limited":     m.IPLimited,
+		"active_limited": m.ActiveLimited,
+		"paused":         m.Paused,
+		"upgrade_failed": m.UpgradeFailed,
+		"auth_failed":    m.AuthFailed,
+	} {
+		counter(c.rejected, v, reason)
+	}
+	for reason, v := range map[string]int64{
+		"filtered": m.Filtered,
+		"expired":  m.Expired,
+		"reaped":   m.Reaped,
+	} {
+		counter(c.discarded, v, reason)
+	}
+	gauge(c.pending, c.lst.Pending())
+	gauge(c.active, c.lst.Active())
+
+	lat := c.lst.Latency()
+	histogram(ch, c.handshake, lat.Handshake)
+	histogram(ch, c.send, lat.Send)
+	histogram(ch, c.recv, lat.Recv)
+
+	if c.msgSent == nil {
+		return
+	}
+	for _, wc := range c.lst.Channels() {
+		info := wc.Info()
+		labels := []string{info.ID}
+		for _, name := range c.labels {
+			labels = append(labels, info.Labels[name])
+		}
+		st := wc.Stats()
+		counter(c.msgSent, st.MessagesSent, labels...)
+		counter(c.msgRcvd, st.MessagesReceived, labels...)
+		counter(c.bytesSent, st.BytesSent, labels...)
+		counter(c.bytesRcvd, st.BytesReceived, labels...)
+	}
+}
+
+// histogram reports h as a Prometheus histogram in seconds.
+func histogram(ch chan<- prometheus.Metric, d *prometheus.Desc, h wschannel.Histogram) {
+	buckets := make(map[float64]uint64, len(h.Bounds))
+	var n uint64
+	for i, b := range h.Bounds {
+		n += uint64(h.Counts[i])
+		buckets[b.Seconds()] = n
+	}
+	ch <- prometheus.MustNewConstHistogram(d, uint64(h.Count), h.Sum.Seconds(), buckets)
+}
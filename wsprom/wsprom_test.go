@@ -0,0 +1,89 @@
+package wsprom_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/creachadair/wschannel"
+	"github.com/creachadair/wschannel/wsprom"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ prometheus.Collector = (*wsprom.Collector)(nil)
+
+func TestCollector(t *testing.T) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		CheckAccept: func(req *http.Request) (int, error) {
+			wschannel.SetLabel(req, "tenant", req.Header.Get("X-Tenant"))
+			return 0, nil
+		},
+	})
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+	url := "ws:" + strings.TrimPrefix(s.URL, "http:")
+
+	c, err := wschannel.Dial(url, &wschannel.DialOptions{
+		Header: http.Header{"X-Tenant": {"acme"}},
+	})
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer c.Close()
+	ch, err := lst.AcceptChannel(context.Background())
+	if err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+	defer ch.Close()
+	if err := c.Send([]byte("hello")); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+	if _, err := ch.Recv(); err != nil {
+		t.Fatalf("Recv: unexpected error: %v", err)
+	}
+
+	col := wsprom.NewCollector(lst, &wsprom.Options{
+		ConstLabels:   prometheus.Labels{"listener": "test"},
+		PerChannel:    true,
+		ChannelLabels: []string{"tenant"},
+	})
+	want := `
+# HELP wschannel_accepted_total Channels returned by Accept.
+# TYPE wschannel_accepted_total counter
+wschannel_accepted_total{listener="test"} 1
+# HELP wschannel_active Live channels, including pending channels.
+# TYPE wschannel_active gauge
+wschannel_active{listener="test"} 1
+# HELP wschannel_channel_bytes_received_total Payload bytes received on a channel.
+# TYPE wschannel_channel_bytes_received_total counter
+wschannel_channel_bytes_received_total{id="` + ch.ID() + `",listener="test",tenant="acme"} 5
+# HELP wschannel_rejected_total Requests rejected by the listener.
+# TYPE wschannel_rejected_total counter
+wschannel_rejected_total{listener="test",reason="active_limited"} 0
+wschannel_rejected_total{listener="test",reason="auth_failed"} 0
+wschannel_rejected_total{listener="test",reason="check"} 0
+wschannel_rejected_total{listener="test",reason="denied"} 0
+wschannel_rejected_total{listener="test",reason="ip_limited"} 0
+wschannel_rejected_total{listener="test",reason="paused"} 0
+wschannel_rejected_total{listener="test",reason="queue_full"} 0
+wschannel_rejected_total{listener="test",reason="upgrade_failed"} 0
+`
+	if err := testutil.CollectAndCompare(col, strings.NewReader(want),
+		"wschannel_accepted_total", "wschannel_active",
+		"wschannel_channel_bytes_received_total", "wschannel_rejected_total",
+	); err != nil {
+		t.Error(err)
+	}
+	if n := testutil.CollectAndCount(col, "wschannel_handshake_duration_seconds"); n != 1 {
+		t.Errorf("Handshake histograms: got %d, want 1", n)
+	}
+	if probs, err := testutil.CollectAndLint(col); err != nil {
+		t.Errorf("Lint: %v", err)
+	} else if len(probs) != 0 {
+		t.Errorf("Lint: %v", probs)
+	}
+}
@@ -0,0 +1,307 @@
+// Package wtchannel implements the jrpc2 Channel interface over a WebTransport
+// session, using the github.com/quic-go/webtransport-go package.
+//
+// It is a sibling of the wschannel package, with the same Dial and Listener
+// shape, so that a service can offer WebTransport alongside websockets and
+// migrate clients incrementally, without changes to its jrpc2 handlers.
+//
+// Each channel uses a single bidirectional stream of its session, opened by
+// the client. Messages on the stream are framed with a varint length prefix.
+// WebTransport channels are not wire-compatible with websocket peers.
+//
+// This package is a separate module, since its dependencies require a newer
+// version of Go than wschannel does.
+package wtchannel
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/creachadair/jrpc2/channel"
+	"github.com/quic-go/webtransport-go"
+)
+
+// ErrListenerClosed is the error reported for a closed listener.
+var ErrListenerClosed = errors.New("listener is closed")
+
+// MaxMessageSize is the largest message, in bytes, that a Channel will
+// receive. A longer message causes Recv to report an error.
+const MaxMessageSize = 1 << 24
+
+// streamHeader is sent by the client when it opens the stream for a channel.
+// A QUIC stream is not visible to the peer until data are sent on it, so this
+// lets the server accept the stream before the first message, and guards
+// against stray streams that do not speak this protocol.
+var streamHeader = []byte("jrpc2/wt\x00")
+
+// Channel implements the jrpc2 Channel interface over a stream of a
+// WebTransport session.
+type Channel struct {
+	sess *webtransport.Session
+	str  *webtransport.Stream
+	rd   *bufio.Reader
+	wmu  sync.Mutex    // serializes writes to str
+	done chan struct{} // closed by Close
+	once sync.Once     // guards closing done
+}
+
+// New wraps a stream of the given session to implement the Channel interface.
+// The channel takes ownership of both; closing the channel ends the session.
+// New does not exchange the stream header; use Dial and Listener for that.
+func New(sess *webtransport.Session, str *webtransport.Stream) *Channel {
+	return &Channel{
+		sess: sess,
+		str:  str,
+		rd:   bufio.NewReader(str),
+		done: make(chan struct{}),
+	}
+}
+
+// Send implements the corresponding method of the Channel interface.
+func (c *Channel) Send(data []byte) error {
+	buf := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(data)), uint64(len(data)))
+	buf = append(buf, data...)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.str.Write(buf)
+	return c.filterErr(err)
+}
+
+// Recv implements the corresponding method of the Channel interface.
+func (c *Channel) Recv() ([]byte, error) {
+	n, err := binary.ReadUvarint(c.rd)
+	if err != nil {
+		return nil, c.filterErr(err)
+	} else if n > MaxMessageSize {
+		return nil, fmt.Errorf("message length %d exceeds limit %d", n, MaxMessageSize)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(c.rd, data); err != nil {
+		return nil, c.filterErr(err)
+	}
+	return data, nil
+}
+
+// Close shuts down the stream and its session. Only the first call has any
+// effect.
+func (c *Channel) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.done)
+		c.str.Close()
+		err = c.sess.CloseWithError(0, "")
+	})
+	return err
+}
+
+// Done returns a channel that is closed when c is closed.
+func (c *Channel) Done() <-chan struct{} { return c.done }
+
+// Session returns the WebTransport session underlying c.
+func (c *Channel) Session() *webtransport.Session { return c.sess }
+
+// filterErr maps errors reporting the end of the stream or session to
+// net.ErrClosed, as the wschannel package does.
+func (c *Channel) filterErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	var serr *webtransport.SessionError
+	if errors.Is(err, io.EOF) || errors.As(err, &serr) || c.sess.Context().Err() != nil {
+		return net.ErrClosed
+	}
+	return err
+}
+
+// DialOptions are settings for a client channel. A nil *DialOptions is ready
+// for use and provides default values as described.
+type DialOptions struct {
+	// The transport used to establish the session. If nil, a transport with
+	// default settings is used.
+	Transport *webtransport.Transport
+
+	// Additional headers to send with the session request.
+	Header http.Header
+}
+
+func (o *DialOptions) transport() *webtransport.Transport {
+	if o == nil || o.Transport == nil {
+		return new(webtransport.Transport)
+	}
+	return o.Transport
+}
+
+func (o *DialOptions) header() http.Header {
+	if o == nil {
+		return nil
+	}
+	return o.Header
+}
+
+// Dial dials the specified WebTransport URL ("https://...") and returns a
+// channel for the session.
+func Dial(url string, opts *DialOptions) (*Channel, error) {
+	return DialContext(context.Background(), url, opts)
+}
+
+// DialContext dials the specified WebTransport URL ("https://...") and
+// returns a channel for the session. The dial is governed by ctx, but ctx
+// does not affect the channel once it is established.
+func DialContext(ctx context.Context, url string, opts *DialOptions) (*Channel, error) {
+	rsp, sess, err := opts.transport().Dial(ctx, url, opts.header())
+	if err != nil {
+		if rsp != nil && (rsp.StatusCode < 200 || rsp.StatusCode > 299) {
+			return nil, fmt.Errorf("dial: %s: %w", rsp.Status, err)
+		}
+		return nil, err
+	}
+	str, err := sess.OpenStreamSync(ctx)
+	if err == nil {
+		_, err = str.Write(streamHeader)
+	}
+	if err != nil {
+		sess.CloseWithError(0, "")
+		return nil, err
+	}
+	return New(sess, str), nil
+}
+
+// ListenOptions are settings for a listener. A nil *ListenOptions is ready
+// for use and provides default values as described.
+type ListenOptions struct {
+	// The maximum number of channels that may be pending acceptance. Further
+	// requests are rejected with status 503 until the queue drains.
+	// If MaxPending ≤ 0, the default is 1.
+	MaxPending int
+}
+
+func (o *ListenOptions) maxPending() int {
+	if o == nil || o.MaxPending <= 0 {
+		return 1
+	}
+	return o.MaxPending
+}
+
+// A Listener implements the http.Handler interface to bridge WebTransport
+// session requests to channels. Each session served to the listener is made
+// available to the Accept method.
+//
+// The listener must be served by the HTTP/3 server of srv, which must be
+// configured for WebTransport (see webtransport.ConfigureHTTP3Server).
+type Listener struct {
+	srv     *webtransport.Server
+	pending chan *Channel // admitted but not yet accepted
+	quit    chan struct{} // closed when lst closes
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewListener constructs a new listener that upgrades requests using srv.
+// Use opts == nil for default settings (see ListenOptions).
+func NewListener(srv *webtransport.Server, opts *ListenOptions) *Listener {
+	return &Listener{
+		srv:     srv,
+		pending: make(chan *Channel, opts.maxPending()),
+		quit:    make(chan struct{}),
+	}
+}
+
+// ServeHTTP implements the http.Handler interface. It upgrades the request to
+// a WebTransport session, waits for the client to open the stream for the
+// channel, and enqueues the channel on the listener.
+func (lst *Listener) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if lst.isClosed() {
+		http.Error(w, "listener is closed", http.StatusServiceUnavailable)
+		return
+	} else if len(lst.pending) == cap(lst.pending) {
+		http.Error(w, "connection queue is full", http.StatusServiceUnavailable)
+		return
+	}
+	sess, err := lst.srv.Upgrade(w, req)
+	if err != nil {
+		return // Upgrade already sent an error response
+	}
+	str, err := acceptStream(sess)
+	if err != nil {
+		sess.CloseWithError(0, "")
+		return
+	}
+
+	// The queue may have filled, or the listener closed, during the upgrade.
+	ch := New(sess, str)
+	lst.mu.Lock()
+	defer lst.mu.Unlock()
+	if lst.closed {
+		ch.Close()
+		return
+	}
+	select {
+	case lst.pending <- ch:
+	default:
+		ch.Close()
+	}
+}
+
+// acceptStream waits for the client to open the stream for a channel on
+// sess, and checks its header.
+func acceptStream(sess *webtransport.Session) (*webtransport.Stream, error) {
+	str, err := sess.AcceptStream(sess.Context())
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, len(streamHeader))
+	if _, err := io.ReadFull(str, hdr); err != nil {
+		return nil, err
+	} else if string(hdr) != string(streamHeader) {
+		return nil, errors.New("invalid stream header")
+	}
+	return str, nil
+}
+
+// Accept blocks until a channel is available or ctx ends. Accept returns
+// ErrListenerClosed if the listener has closed.
+func (lst *Listener) Accept(ctx context.Context) (channel.Channel, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-lst.quit:
+		return nil, ErrListenerClosed
+	case ch := <-lst.pending:
+		return ch, nil
+	}
+}
+
+// Close closes the listener, discarding any pending channels. Channels
+// already accepted are not affected.
+func (lst *Listener) Close() error {
+	lst.mu.Lock()
+	defer lst.mu.Unlock()
+	if lst.closed {
+		return nil
+	}
+	lst.closed = true
+	close(lst.quit)
+	for {
+		select {
+		case ch := <-lst.pending:
+			ch.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (lst *Listener) isClosed() bool {
+	lst.mu.Lock()
+	defer lst.mu.Unlock()
+	return lst.closed
+}
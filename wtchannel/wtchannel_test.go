@@ -0,0 +1,174 @@
+package wtchannel_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/creachadair/jrpc2/channel"
+	"github.com/creachadair/wschannel/wtchannel"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+var _ channel.Channel = (*wtchannel.Channel)(nil)
+
+// selfSigned returns a TLS certificate for localhost, and a pool that trusts it.
+func selfSigned(t testing.TB) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// startServer serves lst at /rpc on a local WebTransport server, and returns
+// the URL and client options to reach it.
+func startServer(t testing.TB, opts *wtchannel.ListenOptions) (*wtchannel.Listener, string, *wtchannel.DialOptions) {
+	t.Helper()
+	cert, pool := selfSigned(t)
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	h3 := &http3.Server{
+		Handler:   mux,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+	}
+	webtransport.ConfigureHTTP3Server(h3)
+	srv := &webtransport.Server{H3: h3}
+	lst := wtchannel.NewListener(srv, opts)
+	mux.Handle("/rpc", lst)
+
+	go srv.Serve(udp)
+	t.Cleanup(func() {
+		lst.Close()
+		srv.Close()
+		udp.Close()
+	})
+	return lst, "https://" + udp.LocalAddr().String() + "/rpc", &wtchannel.DialOptions{
+		Transport: &webtransport.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+}
+
+func TestClientServer(t *testing.T) {
+	lst, url, dopts := startServer(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	go func() {
+		ch, err := lst.Accept(ctx)
+		if err != nil {
+			t.Errorf("Accept: unexpected error: %v", err)
+			return
+		}
+		defer ch.Close()
+		for {
+			msg, err := ch.Recv()
+			if err != nil {
+				return
+			}
+			ch.Send(append([]byte("echo: "), msg...))
+		}
+	}()
+
+	c, err := wtchannel.DialContext(ctx, url, dopts)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	for _, msg := range []string{"hello", "", "world"} {
+		if err := c.Send([]byte(msg)); err != nil {
+			t.Fatalf("Send %q: unexpected error: %v", msg, err)
+		}
+		if got, err := c.Recv(); err != nil || string(got) != "echo: "+msg {
+			t.Errorf("Recv: got %q, %v; want %q", got, err, "echo: "+msg)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+	if _, err := c.Recv(); !channel.IsErrClosing(err) {
+		t.Errorf("Recv after close: got %v, want a closing error", err)
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	lst, _, _ := startServer(t, nil)
+	lst.Close()
+	if ch, err := lst.Accept(context.Background()); !errors.Is(err, wtchannel.ErrListenerClosed) {
+		t.Errorf("Accept: got (%v, %v), want %v", ch, err, wtchannel.ErrListenerClosed)
+	}
+}
+
+func BenchmarkRoundTrip(b *testing.B) {
+	for _, size := range []int{64, 1 << 10, 16 << 10, 256 << 10, 4 << 20} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			lst, url, dopts := startServer(b, nil)
+			ctx := context.Background()
+			go func() {
+				ch, err := lst.Accept(ctx)
+				if err != nil {
+					return
+				}
+				defer ch.Close()
+				for {
+					msg, err := ch.Recv()
+					if err != nil || ch.Send(msg) != nil {
+						return
+					}
+				}
+			}()
+			c, err := wtchannel.DialContext(ctx, url, dopts)
+			if err != nil {
+				b.Fatalf("Dial: %v", err)
+			}
+			defer c.Close()
+			msg := make([]byte, size)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(2 * size))
+			b.ResetTimer()
+			for range b.N {
+				if err := c.Send(msg); err != nil {
+					b.Fatalf("Send: %v", err)
+				}
+				if _, err := c.Recv(); err != nil {
+					b.Fatalf("Recv: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+module github.com/creachadair/wschannel/xnetws
+
+go 1.25.0
+
+replace github.com/creachadair/wschannel => ../
+
+require (
+	github.com/creachadair/jrpc2 v1.3.0
+	github.com/creachadair/wschannel v0.0.0
+	golang.org/x/net v0.41.0
+)
+
+require (
+	github.com/coder/websocket v1.8.12 // indirect
+	golang.org/x/crypto v0.40.0 // indirect
+	golang.org/x/sys v0.34.0 // indirect
+)
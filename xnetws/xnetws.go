@@ -0,0 +1,126 @@
+// Package xnetws implements the jrpc2 Channel interface over a websocket
+// provided by the golang.org/x/net/websocket package.
+//
+// This is an alternative to the wschannel package for environments that
+// permit only golang.org/x/net/websocket. The channels it produces are
+// compatible with wschannel peers: each message is sent as a single binary
+// websocket message, and either binary or text messages are received.
+// Features of wschannel that depend on its websocket library, such as
+// listener admission control and keepalive pings, are not available.
+package xnetws
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// Channel implements the jrpc2 Channel interface over a websocket connection
+// from the golang.org/x/net/websocket package.
+type Channel struct {
+	c    *websocket.Conn
+	done chan struct{} // closed by Close
+	once sync.Once     // guards closing done
+}
+
+// New wraps the given websocket connection to implement the Channel
+// interface. The channel takes ownership of conn.
+func New(conn *websocket.Conn) *Channel {
+	return &Channel{c: conn, done: make(chan struct{})}
+}
+
+// Send implements the corresponding method of the Channel interface.
+// The data are transmitted as a single binary websocket message.
+func (c *Channel) Send(data []byte) error {
+	return filterErr(websocket.Message.Send(c.c, data))
+}
+
+// Recv implements the corresponding method of the Channel interface.
+// The message type is not checked; either a binary or text message is
+// accepted.
+func (c *Channel) Recv() ([]byte, error) {
+	var data []byte
+	if err := websocket.Message.Receive(c.c, &data); err != nil {
+		return nil, filterErr(err)
+	}
+	return data, nil
+}
+
+// Close shuts down the websocket. Only the first call has any effect.
+func (c *Channel) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.done)
+		err = c.c.Close()
+	})
+	return err
+}
+
+// Done returns a channel that is closed when c is closed.
+func (c *Channel) Done() <-chan struct{} { return c.done }
+
+// filterErr maps errors reporting the end of the connection to net.ErrClosed,
+// as the wschannel package does.
+func filterErr(err error) error {
+	if errors.Is(err, io.EOF) {
+		return net.ErrClosed
+	}
+	return err
+}
+
+// Dial dials the specified websocket URL ("ws://...."), sending the given
+// origin URL in the handshake, and returns a channel for the connection.
+// If origin == "", the URL of the server is used with its scheme replaced by
+// "http" or "https".
+func Dial(url, origin string) (*Channel, error) {
+	if origin == "" {
+		if rest, ok := strings.CutPrefix(url, "ws:"); ok {
+			origin = "http:" + rest
+		} else if rest, ok := strings.CutPrefix(url, "wss:"); ok {
+			origin = "https:" + rest
+		}
+	}
+	conn, err := websocket.Dial(url, "", origin)
+	if err != nil {
+		return nil, err
+	}
+	return New(conn), nil
+}
+
+// Handler returns an http.Handler that accepts websocket connections and
+// calls serve with a channel for each connection. The channel is closed when
+// serve returns.
+//
+// As with a wschannel.Listener, the handler admits only requests with no
+// Origin header or whose origin host matches the host of the request. For
+// other policies, use a websocket.Server with a custom Handshake and wrap its
+// connections with New.
+func Handler(serve func(*Channel)) http.Handler {
+	return websocket.Server{
+		Handshake: sameOrigin,
+		Handler: func(conn *websocket.Conn) {
+			ch := New(conn)
+			defer ch.Close()
+			serve(ch)
+		},
+	}
+}
+
+// sameOrigin is a websocket handshake function that rejects cross-origin
+// requests.
+func sameOrigin(cfg *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(cfg, req)
+	if err != nil {
+		return err
+	} else if origin != nil && !strings.EqualFold(origin.Host, req.Host) {
+		return fmt.Errorf("origin %q is not allowed", origin.Host)
+	}
+	cfg.Origin = origin
+	return nil
+}
@@ -0,0 +1,137 @@
+//go:build !js
+
+package xnetws_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/creachadair/jrpc2/channel"
+	"github.com/creachadair/wschannel"
+	"github.com/creachadair/wschannel/xnetws"
+)
+
+var _ channel.Channel = (*xnetws.Channel)(nil)
+
+func wsURL(url string) string { return "ws:" + strings.TrimPrefix(url, "http:") }
+
+func TestHandler(t *testing.T) {
+	s := httptest.NewServer(xnetws.Handler(func(ch *xnetws.Channel) {
+		for {
+			msg, err := ch.Recv()
+			if err != nil {
+				return
+			}
+			ch.Send(append([]byte("echo: "), msg...))
+		}
+	}))
+	defer s.Close()
+
+	// Both an xnetws client and a wschannel client can talk to the handler.
+	x, err := xnetws.Dial(wsURL(s.URL), "")
+	if err != nil {
+		t.Fatalf("xnetws.Dial: unexpected error: %v", err)
+	}
+	defer x.Close()
+	w, err := wschannel.Dial(wsURL(s.URL), nil)
+	if err != nil {
+		t.Fatalf("wschannel.Dial: unexpected error: %v", err)
+	}
+	defer w.Close()
+
+	for _, c := range []channel.Channel{x, w} {
+		if err := c.Send([]byte("hello")); err != nil {
+			t.Fatalf("Send: unexpected error: %v", err)
+		}
+		if got, err := c.Recv(); err != nil || string(got) != "echo: hello" {
+			t.Errorf("Recv: got %q, %v; want %q", got, err, "echo: hello")
+		}
+	}
+
+	// Cross-origin requests are rejected.
+	if c, err := xnetws.Dial(wsURL(s.URL), "http://evil.example.com"); err == nil {
+		c.Close()
+		t.Error("Dial with foreign origin: got nil error, want failure")
+	}
+}
+
+func TestListener(t *testing.T) {
+	lst := wschannel.NewListener(nil)
+	defer lst.Close()
+	s := httptest.NewServer(lst)
+	defer s.Close()
+
+	c, err := xnetws.Dial(wsURL(s.URL), "")
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	ch, err := lst.Accept(context.Background())
+	if err != nil {
+		t.Fatalf("Accept: unexpected error: %v", err)
+	}
+	defer ch.Close()
+
+	if err := c.Send([]byte("ping")); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+	if got, err := ch.Recv(); err != nil || string(got) != "ping" {
+		t.Errorf("Server Recv: got %q, %v; want ping", got, err)
+	}
+	if err := ch.Send([]byte("pong")); err != nil {
+		t.Fatalf("Server Send: unexpected error: %v", err)
+	}
+	if got, err := c.Recv(); err != nil || string(got) != "pong" {
+		t.Errorf("Recv: got %q, %v; want pong", got, err)
+	}
+
+	c.Close()
+	select {
+	case <-c.Done():
+	default:
+		t.Error("Done channel is not closed after Close")
+	}
+	if _, err := c.Recv(); err == nil {
+		t.Error("Recv after Close: got nil error, want failure")
+	}
+}
+
+// BenchmarkRoundTrip measures the latency of sending a message from an xnetws
+// client to a wschannel.Listener and receiving its echo, for comparison with
+// the benchmarks of the wschannel package.
+func BenchmarkRoundTrip(b *testing.B) {
+	lst := wschannel.NewListener(&wschannel.ListenOptions{
+		Channel: &wschannel.ChannelOptions{ReadLimit: -1},
+	})
+	s := httptest.NewServer(lst)
+	defer func() { lst.Close(); s.Close() }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lst.Serve(ctx, func(ch *wschannel.Channel) {
+		for {
+			msg, err := ch.Recv()
+			if err != nil || ch.Send(msg) != nil {
+				return
+			}
+		}
+	})
+
+	c, err := xnetws.Dial(wsURL(s.URL), "")
+	if err != nil {
+		b.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	msg := []byte(strings.Repeat("x", 1<<10))
+
+	b.ReportAllocs()
+	b.SetBytes(int64(2 * len(msg)))
+	for b.Loop() {
+		if err := c.Send(msg); err != nil {
+			b.Fatalf("Send: %v", err)
+		}
+		if _, err := c.Recv(); err != nil {
+			b.Fatalf("Recv: %v", err)
+		}
+	}
+}